@@ -0,0 +1,366 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"grooper/app"
+	"grooper/app/constants"
+	"grooper/app/models"
+	ops "grooper/app/operations"
+	"grooper/app/utils"
+	"html/template"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/revel/modules/jobs/app/jobs"
+	"github.com/revel/revel"
+)
+
+const (
+	PROVISIONING_STATUS_PENDING     = "PENDING"
+	PROVISIONING_STATUS_PROVISIONED = "PROVISIONED"
+	PROVISIONING_STATUS_INVITED     = "INVITED"
+	PROVISIONING_STATUS_FAILED      = "FAILED"
+	PROVISIONING_STATUS_MANUAL      = "MANUAL"
+)
+
+// AccountProvisioner creates or invites the account of a user on a provider
+// once their REQUEST_TO_CREATE_ACCOUNT has been accepted.
+type AccountProvisioner interface {
+	Provision(account ProvisioningAccount) (ProvisioningResult, error)
+}
+
+// ProvisioningAccount is the user to create the account for, with the tokens
+// of the company integration and where the company wants its accounts.
+type ProvisioningAccount struct {
+	CompanyID       string
+	UserID          string
+	Email           string
+	FirstName       string
+	LastName        string
+	IntegrationID   string
+	IntegrationSlug string
+	Credentials     IntegrationCredentials
+	Settings        ProvisioningSettings
+}
+
+// ProvisioningResult is what the provider answered. Login and
+// InitialPassword are set when the user signs in with an address and a
+// password of the provider's; the password is mailed to the user and never
+// stored.
+type ProvisioningResult struct {
+	AccountID       string
+	Login           string
+	InitialPassword string
+	Invited         bool
+}
+
+// AccountProvisioning is the provisioning state of one requester, kept on the
+// request under the requester's user ID.
+type AccountProvisioning struct {
+	Status          string `json:"Status,omitempty"`
+	IntegrationSlug string `json:"IntegrationSlug,omitempty"`
+	AccountID       string `json:"AccountID,omitempty"`
+	Error           string `json:"Error,omitempty"`
+	UpdatedAt       string `json:"UpdatedAt,omitempty"`
+}
+
+var accountProvisioners = map[string]AccountProvisioner{}
+
+/*
+****************
+RegisterAccountProvisioner()
+- Registers the account provisioner of an integration slug. Called from
+init() of the file implementing the provisioner.
+****************
+*/
+func RegisterAccountProvisioner(integrationSlug string, provisioner AccountProvisioner) {
+	accountProvisioners[integrationSlug] = provisioner
+}
+
+/*
+****************
+GetAccountProvisioner()
+- Returns the provisioner registered for the slug. Accounts on other
+providers are still created by an admin.
+****************
+*/
+func GetAccountProvisioner(integrationSlug string) (AccountProvisioner, bool) {
+	provisioner, ok := accountProvisioners[integrationSlug]
+	return provisioner, ok
+}
+
+/*
+****************
+provisionAccount()
+- Queues the provisioner of the requested integration for the requester.
+The request shows the account as pending until AccountProvisioningJob has
+run; accounts on providers without a provisioner are left to an admin.
+****************
+*/
+func provisionAccount(request Request, integration models.NotificationIntegration, subject RequestSubject) error {
+	userID := subject.User.UserID
+	if _, ok := GetAccountProvisioner(integration.IntegrationSlug); !ok {
+		return UpdateRequestProvisioning(request, userID, AccountProvisioning{
+			Status:          PROVISIONING_STATUS_MANUAL,
+			IntegrationSlug: integration.IntegrationSlug,
+		})
+	}
+
+	err := UpdateRequestProvisioning(request, userID, AccountProvisioning{
+		Status:          PROVISIONING_STATUS_PENDING,
+		IntegrationSlug: integration.IntegrationSlug,
+	})
+	if err != nil {
+		return err
+	}
+
+	email := subject.User.Email
+	if email == "" {
+		email = subject.RequesterInfo.Email
+	}
+	jobs.Now(AccountProvisioningJob{
+		Request:     request,
+		Integration: integration,
+		UserID:      userID,
+		Email:       email,
+		FirstName:   subject.RequesterInfo.FirstName,
+		LastName:    subject.RequesterInfo.LastName,
+	})
+	return nil
+}
+
+// AccountProvisioningJob creates or invites the account of one requester,
+// tracks the outcome on the request and tells the requester about it. It
+// runs out of the decision, so a slow provider never holds up the approver.
+type AccountProvisioningJob struct {
+	Request     Request
+	Integration models.NotificationIntegration
+	UserID      string
+	Email       string
+	FirstName   string
+	LastName    string
+}
+
+func (j AccountProvisioningJob) Run() {
+	integration := j.Integration
+	provisioner, ok := GetAccountProvisioner(integration.IntegrationSlug)
+	if !ok {
+		return
+	}
+
+	credentials, _ := companyIntegrationCredentials(j.Request.CompanyID, models.Integration{IntegrationID: integration.IntegrationID})
+	settings, _, err := GetProvisioningSettings(j.Request.CompanyID, integration.IntegrationSlug)
+	if err != nil {
+		revel.AppLog.Error("AccountProvisioningJob: unable to retrieve provisioning settings of "+j.Request.CompanyID, err)
+	}
+
+	var result ProvisioningResult
+	provisionErr := err
+	if provisionErr == nil {
+		result, provisionErr = provisioner.Provision(ProvisioningAccount{
+			CompanyID:       j.Request.CompanyID,
+			UserID:          j.UserID,
+			Email:           j.Email,
+			FirstName:       j.FirstName,
+			LastName:        j.LastName,
+			IntegrationID:   integration.IntegrationID,
+			IntegrationSlug: integration.IntegrationSlug,
+			Credentials:     credentials,
+			Settings:        settings,
+		})
+	}
+	if provisionErr == nil && result.InitialPassword != "" {
+		if err := sendAccountCredentials(j, result); err != nil {
+			provisionErr = errors.New("the account " + result.Login + " was created but its password could not be sent: " + err.Error())
+		}
+	}
+
+	provisioning := AccountProvisioning{
+		Status:          PROVISIONING_STATUS_PROVISIONED,
+		IntegrationSlug: integration.IntegrationSlug,
+		AccountID:       result.AccountID,
+	}
+	if provisionErr != nil {
+		provisioning.Status = PROVISIONING_STATUS_FAILED
+		provisioning.Error = provisionErr.Error()
+	} else if result.Invited {
+		provisioning.Status = PROVISIONING_STATUS_INVITED
+	}
+	if err := UpdateRequestProvisioning(j.Request, j.UserID, provisioning); err != nil {
+		revel.AppLog.Error("AccountProvisioningJob: unable to store the provisioning of request "+j.Request.RequestID, err)
+	}
+
+	if err := notifyProvisioningOutcome(jobController(j.Request.CompanyID), j.Request, j.UserID, integration, provisioning); err != nil {
+		revel.AppLog.Error("AccountProvisioningJob: unable to notify "+j.UserID, err)
+	}
+}
+
+// accountCredentials is what accountCredentialsTemplate renders, in the
+// requester's locale.
+type accountCredentials struct {
+	Greeting string
+	Created  string
+	SignIn   string
+}
+
+var accountCredentialsTemplate = template.Must(template.New("account_credentials").Parse(`<p>{{.Greeting}}</p>
+<p>{{.Created}}</p>
+<p>{{.SignIn}}</p>
+`))
+
+// sendAccountCredentials mails the sign in of a new account to the address
+// the requester uses with us, since they cannot read the new mailbox yet.
+func sendAccountCredentials(j AccountProvisioningJob, result ProvisioningResult) error {
+	locale := userMessageLocale(j.UserID)
+	name := strings.TrimSpace(j.FirstName + " " + j.LastName)
+	return sendTemplateEmail(j.Email, renderRequestMessage(locale, MESSAGE_ACCOUNT_CREDENTIALS, []string{j.Integration.IntegrationName}), accountCredentialsTemplate, accountCredentials{
+		Greeting: renderRequestMessage(locale, MESSAGE_ACCOUNT_CREDENTIALS_GREETING, []string{name}),
+		Created:  renderRequestMessage(locale, MESSAGE_ACCOUNT_CREDENTIALS_CREATED, []string{j.Integration.IntegrationName}),
+		SignIn:   renderRequestMessage(locale, MESSAGE_ACCOUNT_CREDENTIALS_SIGN_IN, []string{result.Login, result.InitialPassword}),
+	})
+}
+
+/*
+****************
+UpdateRequestProvisioning()
+- Stores the provisioning state of a requester on the request
+****************
+*/
+func UpdateRequestProvisioning(request Request, userID string, provisioning AccountProvisioning) error {
+	provisioning.UpdatedAt = utils.GetCurrentTimestamp()
+	av, err := dynamodbattribute.MarshalMap(provisioning)
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	key := map[string]*dynamodb.AttributeValue{
+		"PK": {
+			S: aws.String(request.PK),
+		},
+		"SK": {
+			S: aws.String(request.SK),
+		},
+	}
+
+	// the map has to exist before one of its keys can be set
+	_, err = app.SVC.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:        aws.String(app.TABLE_NAME),
+		Key:              key,
+		UpdateExpression: aws.String("SET Provisioning = if_not_exists(Provisioning, :empty)"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":empty": {
+				M: map[string]*dynamodb.AttributeValue{},
+			},
+		},
+	})
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	_, err = app.SVC.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName:        aws.String(app.TABLE_NAME),
+		Key:              key,
+		UpdateExpression: aws.String("SET Provisioning.#u = :p, UpdatedAt = :ua"),
+		ExpressionAttributeNames: map[string]*string{
+			"#u": aws.String(userID),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":p": {
+				M: av,
+			},
+			":ua": {
+				S: aws.String(provisioning.UpdatedAt),
+			},
+		},
+	})
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	return nil
+}
+
+/*
+****************
+notifyProvisioningOutcome()
+- Tells the requester whether their account got created
+****************
+*/
+func notifyProvisioningOutcome(c *revel.Controller, request Request, userID string, integration models.NotificationIntegration, provisioning AccountProvisioning) error {
+	content := models.NotificationContentType{
+		RequesterUserID: userID,
+		ActiveCompany:   request.CompanyID,
+		Integration:     integration,
+	}
+	var message NotificationTemplate
+	switch provisioning.Status {
+	case PROVISIONING_STATUS_PROVISIONED:
+		content.IsAccepted = NOTIFICATION_REQUEST_ACCEPTED
+		message = NewNotificationTemplate(MESSAGE_ACCOUNT_PROVISIONED, integration.IntegrationName)
+	case PROVISIONING_STATUS_INVITED:
+		content.IsAccepted = NOTIFICATION_REQUEST_ACCEPTED
+		message = NewNotificationTemplate(MESSAGE_ACCOUNT_INVITED, integration.IntegrationName)
+	default:
+		content.IsAccepted = PROVISIONING_STATUS_FAILED
+		message = NewNotificationTemplate(MESSAGE_ACCOUNT_FAILED, integration.IntegrationName)
+	}
+	content.Message = message.Render(userMessageLocale(userID))
+
+	createdNotification, err := ops.CreateNotification(ops.CreateNotificationInput{
+		UserID:              userID,
+		NotificationType:    constants.REQUEST_STATUS_UPDATE,
+		NotificationContent: content,
+		Global:              false,
+	}, c)
+	if err != nil {
+		return errors.New("Unable to create notification for " + userID)
+	}
+	return SetNotificationTemplate(createdNotification, &message)
+}
+
+// sendProvisioningRequest sends a JSON request to a provider API and decodes
+// the JSON answer into out, when given.
+func sendProvisioningRequest(client *http.Client, method, url, authorization string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+
+	if client == nil {
+		client = &http.Client{Timeout: HTTP_PROVIDER_TIMEOUT}
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.New("provider answered with status " + strconv.Itoa(res.StatusCode))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
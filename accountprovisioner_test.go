@@ -0,0 +1,227 @@
+package controllers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestGooglePrimaryEmail(t *testing.T) {
+	tests := []struct {
+		name    string
+		account ProvisioningAccount
+		want    string
+		wantErr bool
+	}{
+		{
+			name:    "already on the domain",
+			account: ProvisioningAccount{Email: "Jane.Doe@Example.com", FirstName: "Jane", LastName: "Doe"},
+			want:    "jane.doe@example.com",
+		},
+		{
+			name:    "external address",
+			account: ProvisioningAccount{Email: "jane@gmail.com", FirstName: "Jane", LastName: "Doe"},
+			want:    "jane.doe@example.com",
+		},
+		{
+			name:    "name needs cleaning",
+			account: ProvisioningAccount{Email: "jane@gmail.com", FirstName: "Jane Anne", LastName: "O'Neil"},
+			want:    "janeanne.oneil@example.com",
+		},
+		{
+			name:    "no name",
+			account: ProvisioningAccount{Email: "j.doe+work@gmail.com"},
+			want:    "j.doework@example.com",
+		},
+		{
+			name:    "nothing usable",
+			account: ProvisioningAccount{Email: "@gmail.com"},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := googlePrimaryEmail(test.account, "example.com")
+			if (err != nil) != test.wantErr {
+				t.Fatalf("err = %v; wantErr %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("googlePrimaryEmail() = %q; want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestGoogleCloudAccountProvisioner(t *testing.T) {
+	var body googleDirectoryUser
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/admin/directory/v1/users" {
+			t.Errorf("request = %s %s", r.Method, r.URL.Path)
+		}
+		if got := r.Header.Get("Authorization"); got != "Bearer token" {
+			t.Errorf("Authorization = %q", got)
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("body: %v", err)
+		}
+		w.Write([]byte(`{"id":"g1"}`))
+	}))
+	defer server.Close()
+
+	result, err := GoogleCloudAccountProvisioner{DirectoryURL: server.URL}.Provision(ProvisioningAccount{
+		Email:       "jane@gmail.com",
+		FirstName:   "Jane",
+		LastName:    "Doe",
+		Credentials: IntegrationCredentials{AccessToken: "token"},
+		Settings:    ProvisioningSettings{Domain: "example.com"},
+	})
+	if err != nil {
+		t.Fatalf("Provision() err = %v", err)
+	}
+	if body.PrimaryEmail != "jane.doe@example.com" || body.RecoveryEmail != "jane@gmail.com" || !body.ChangePasswordAtNextLogin {
+		t.Errorf("body = %+v", body)
+	}
+	if result.AccountID != "g1" || result.Login != "jane.doe@example.com" {
+		t.Errorf("result = %+v", result)
+	}
+	if result.InitialPassword == "" || result.InitialPassword != body.Password {
+		t.Errorf("InitialPassword = %q; want the password sent to Google", result.InitialPassword)
+	}
+
+	_, err = GoogleCloudAccountProvisioner{DirectoryURL: server.URL}.Provision(ProvisioningAccount{
+		Email:       "jane@gmail.com",
+		Credentials: IntegrationCredentials{AccessToken: "token"},
+	})
+	if err == nil {
+		t.Errorf("Provision() without a domain err = nil")
+	}
+}
+
+func TestBitbucketAccountProvisioner(t *testing.T) {
+	tests := []struct {
+		name     string
+		settings ProvisioningSettings
+		status   int
+		wantRole string
+		wantErr  bool
+	}{
+		{
+			name:     "invited with the default role",
+			settings: ProvisioningSettings{OrganizationID: "org 1", Workspace: "acme"},
+			status:   http.StatusOK,
+			wantRole: BITBUCKET_DEFAULT_ROLE,
+		},
+		{
+			name:     "invited with the company role",
+			settings: ProvisioningSettings{OrganizationID: "org 1", Workspace: "acme", Role: "atlassian/admin"},
+			status:   http.StatusOK,
+			wantRole: "atlassian/admin",
+		},
+		{
+			name:     "refused",
+			settings: ProvisioningSettings{OrganizationID: "org 1", Workspace: "acme"},
+			status:   http.StatusForbidden,
+			wantRole: BITBUCKET_DEFAULT_ROLE,
+			wantErr:  true,
+		},
+		{
+			name:     "not set up",
+			settings: ProvisioningSettings{Workspace: "acme"},
+			wantErr:  true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			called := false
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				if r.Method != http.MethodPost || r.URL.EscapedPath() != "/admin/v2/orgs/org%201/users/invite" {
+					t.Errorf("request = %s %s", r.Method, r.URL.EscapedPath())
+				}
+				var body atlassianInvite
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					t.Errorf("body: %v", err)
+				}
+				want := atlassianInvite{
+					Emails:           []string{"jane@example.com"},
+					Resources:        []atlassianInviteResource{{ARI: "ari:cloud:bitbucket::workspace/acme", Role: test.wantRole}},
+					SendNotification: true,
+				}
+				if !reflect.DeepEqual(body, want) {
+					t.Errorf("body = %+v; want %+v", body, want)
+				}
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+
+			result, err := BitbucketAccountProvisioner{APIURL: server.URL}.Provision(ProvisioningAccount{
+				Email:       "jane@example.com",
+				Credentials: IntegrationCredentials{AccessToken: "token"},
+				Settings:    test.settings,
+			})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("err = %v; wantErr %v", err, test.wantErr)
+			}
+			if called != (test.status != 0) {
+				t.Errorf("called = %v", called)
+			}
+			if !test.wantErr && !result.Invited {
+				t.Errorf("Invited = false")
+			}
+		})
+	}
+}
+
+func TestJiraAccountProvisioner(t *testing.T) {
+	tests := []struct {
+		name         string
+		products     []string
+		wantProducts []string
+	}{
+		{
+			name:         "default product",
+			wantProducts: []string{JIRA_DEFAULT_PRODUCT},
+		},
+		{
+			name:         "company products",
+			products:     []string{"jira-software", "jira-servicedesk"},
+			wantProducts: []string{"jira-software", "jira-servicedesk"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != http.MethodPost || r.URL.Path != "/rest/api/3/user" {
+					t.Errorf("request = %s %s", r.Method, r.URL.Path)
+				}
+				var body jiraCreateUser
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					t.Errorf("body: %v", err)
+				}
+				if body.EmailAddress != "jane@example.com" || !reflect.DeepEqual(body.Products, test.wantProducts) {
+					t.Errorf("body = %+v", body)
+				}
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte(`{"accountId":"a1"}`))
+			}))
+			defer server.Close()
+
+			result, err := JiraAccountProvisioner{}.Provision(ProvisioningAccount{
+				Email:       "jane@example.com",
+				Credentials: IntegrationCredentials{AccessToken: "token"},
+				Settings:    ProvisioningSettings{SiteURL: server.URL, Products: test.products},
+			})
+			if err != nil {
+				t.Fatalf("Provision() err = %v", err)
+			}
+			if result.AccountID != "a1" {
+				t.Errorf("AccountID = %q", result.AccountID)
+			}
+		})
+	}
+}
@@ -0,0 +1,75 @@
+package controllers
+
+import (
+	"grooper/app/constants"
+	"grooper/app/models"
+)
+
+func init() {
+	RegisterRequestHandler(constants.REQUEST_TO_CREATE_ACCOUNT, AccountRequestHandler{})
+	RegisterRequestPermissions(constants.REQUEST_TO_CREATE_ACCOUNT, RequestPermissions{
+		Accept: PERMISSION_CREATE_ACCOUNT,
+		Reject: PERMISSION_CREATE_ACCOUNT,
+		View:   PERMISSION_CREATE_ACCOUNT,
+	})
+}
+
+// AccountRequestHandler handles requests to get an account on an integrated
+// provider.
+type AccountRequestHandler struct{}
+
+func (h AccountRequestHandler) Validate(ctx *RequestContext) error {
+	if ctx.Integration.IntegrationSlug == "" && ctx.Integration.IntegrationID == "" {
+		return NewRequestError(400, "Unable to retrieve original notification")
+	}
+	return nil
+}
+
+func (h AccountRequestHandler) Authorize(ctx *RequestContext, accept bool) error {
+	return nil
+}
+
+func (h AccountRequestHandler) Accept(ctx *RequestContext, subject RequestSubject, content *models.NotificationContentType) error {
+	// the account is created by a job once the decision is committed, the
+	// requester is told the outcome separately
+	request := *ctx.Request
+	integration := ctx.Integration
+	ctx.AfterCommit(func() error {
+		return provisionAccount(request, integration, subject)
+	})
+
+	content.Integration = ctx.Integration
+	ctx.AdminMessage(content, NewNotificationTemplate(requestMessageKey(h.messageKind(ctx.Integration), "admin", true), requesterName(subject.RequesterInfo)))
+	return nil
+}
+
+func (h AccountRequestHandler) Reject(ctx *RequestContext, subject RequestSubject, content *models.NotificationContentType) error {
+	content.Integration = ctx.Integration
+	ctx.AdminMessage(content, NewNotificationTemplate(requestMessageKey(h.messageKind(ctx.Integration), "admin", false), requesterName(subject.RequesterInfo)))
+	return nil
+}
+
+func (h AccountRequestHandler) Describe(ctx *RequestContext, content *models.NotificationContentType, accepted bool) error {
+	content.Integration = models.NotificationIntegration{
+		IntegrationID:   ctx.Integration.IntegrationID,
+		IntegrationSlug: ctx.Integration.IntegrationSlug,
+		IntegrationName: ctx.Integration.IntegrationName,
+	}
+	ctx.RequesterMessage(content, NewNotificationTemplate(requestMessageKey(h.messageKind(ctx.Integration), "requester", accepted)))
+	return nil
+}
+
+// messageKind picks the messages of the provider, the generic ones are used
+// for the others.
+func (h AccountRequestHandler) messageKind(integration models.NotificationIntegration) string {
+	switch integration.IntegrationSlug {
+	case constants.INTEG_SLUG_GOOGLE_CLOUD:
+		return "account.google_cloud"
+	case constants.INTEG_SLUG_BITBUCKET:
+		return "account.bitbucket"
+	case constants.INTEG_SLUG_JIRA:
+		return "account.jira"
+	default:
+		return "account"
+	}
+}
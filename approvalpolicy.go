@@ -0,0 +1,576 @@
+package controllers
+
+import (
+	"errors"
+	"grooper/app"
+	"grooper/app/constants"
+	"grooper/app/models"
+	ops "grooper/app/operations"
+	"grooper/app/utils"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const (
+	PREFIX_APPROVAL_POLICY       = "APPROVAL_POLICY#"
+	PREFIX_APPROVAL              = "APPROVAL#"
+	ENTITY_TYPE_APPROVAL_POLICY  = "APPROVAL_POLICY"
+	ENTITY_TYPE_REQUEST_APPROVAL = "REQUEST_APPROVAL"
+	APPROVAL_POLICY_SCOPE_TYPE   = "REQUEST_TYPE"
+	APPROVAL_POLICY_SCOPE_ROLE   = "ROLE"
+	// APPROVAL_POLICY_SCOPE_ELEVATION applies to elevations to a role, on
+	// top of the policy of the role
+	APPROVAL_POLICY_SCOPE_ELEVATION = "ELEVATION"
+)
+
+// ApprovalPolicy decides how many approvals a request needs before it is
+// accepted. Every rule must be satisfied, each by different approvers. A
+// policy without rules is satisfied by the first authorized approver, which
+// is how requests behave when the company has not configured anything.
+type ApprovalPolicy struct {
+	PK          string         `json:"PK,omitempty"`
+	SK          string         `json:"SK,omitempty"`
+	CompanyID   string         `json:"CompanyID,omitempty"`
+	PolicyScope string         `json:"PolicyScope,omitempty"`
+	Target      string         `json:"Target,omitempty"`
+	Rules       []ApprovalRule `json:"Rules,omitempty"`
+	// EscalationRoleID is the role stale requests are escalated to. Holders
+	// of it may decide an escalated request on their own.
+	EscalationRoleID string `json:"EscalationRoleID,omitempty"`
+	CreatedBy        string `json:"CreatedBy,omitempty"`
+	CreatedAt        string `json:"CreatedAt,omitempty"`
+	UpdatedAt        string `json:"UpdatedAt,omitempty"`
+	Type             string `json:"Type,omitempty"`
+}
+
+// ApprovalRule requires Count approvals from holders of RoleID.
+type ApprovalRule struct {
+	RoleID string `json:"RoleID,omitempty"`
+	Count  int    `json:"Count,omitempty"`
+}
+
+// RequestApproval records one approver's approval of a request.
+type RequestApproval struct {
+	PK         string `json:"PK,omitempty"`
+	SK         string `json:"SK,omitempty"`
+	RequestID  string `json:"RequestID,omitempty"`
+	CompanyID  string `json:"CompanyID,omitempty"`
+	ApproverID string `json:"ApproverID,omitempty"`
+	CreatedAt  string `json:"CreatedAt,omitempty"`
+	Type       string `json:"Type,omitempty"`
+}
+
+// QuorumStatus is returned to the approver while a request still waits for
+// more approvals.
+type QuorumStatus struct {
+	Satisfied bool     `json:"satisfied"`
+	Approvals int      `json:"approvals"`
+	Required  int      `json:"required"`
+	Approvers []string `json:"approvers,omitempty"`
+}
+
+func approvalPolicySK(scope, target string) string {
+	return utils.AppendPrefix(utils.AppendPrefix(PREFIX_APPROVAL_POLICY, scope), target)
+}
+
+/*
+****************
+GetApprovalPolicy()
+- Returns the policy configured for a request type or a role. The returned
+bool is false if none is configured.
+****************
+*/
+func GetApprovalPolicy(companyID, scope, target string) (ApprovalPolicy, bool, error) {
+	var policy ApprovalPolicy
+
+	res, err := app.SVC.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
+			},
+			"SK": {
+				S: aws.String(approvalPolicySK(scope, target)),
+			},
+		},
+	})
+	if err != nil {
+		return policy, false, errors.New(constants.HTTP_STATUS_500)
+	}
+
+	if res.Item == nil {
+		return policy, false, nil
+	}
+
+	err = dynamodbattribute.UnmarshalMap(res.Item, &policy)
+	if err != nil {
+		return policy, false, errors.New(constants.HTTP_STATUS_400)
+	}
+
+	return policy, true, nil
+}
+
+/*
+****************
+GetCompanyApprovalPolicies()
+- Returns every approval policy of the company
+****************
+*/
+func GetCompanyApprovalPolicies(companyID string) ([]ApprovalPolicy, error) {
+	policies := []ApprovalPolicy{}
+
+	params := &dynamodb.QueryInput{
+		TableName: aws.String(app.TABLE_NAME),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"PK": {
+				ComparisonOperator: aws.String(constants.CONDITION_EQUAL),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
+					},
+				},
+			},
+			"SK": {
+				ComparisonOperator: aws.String(constants.CONDITION_BEGINS_WITH),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(PREFIX_APPROVAL_POLICY),
+					},
+				},
+			},
+		},
+	}
+
+	res, err := app.SVC.Query(params)
+	if err != nil {
+		return policies, errors.New(constants.HTTP_STATUS_500)
+	}
+
+	err = dynamodbattribute.UnmarshalListOfMaps(res.Items, &policies)
+	if err != nil {
+		return policies, errors.New(constants.HTTP_STATUS_400)
+	}
+
+	return policies, nil
+}
+
+/*
+****************
+SaveApprovalPolicy()
+- Creates or replaces the policy of a request type or a role
+****************
+*/
+func SaveApprovalPolicy(policy ApprovalPolicy) error {
+	policy.PK = utils.AppendPrefix(constants.PREFIX_COMPANY, policy.CompanyID)
+	policy.SK = approvalPolicySK(policy.PolicyScope, policy.Target)
+	policy.Type = ENTITY_TYPE_APPROVAL_POLICY
+
+	av, err := dynamodbattribute.MarshalMap(policy)
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	_, err = app.SVC.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(app.TABLE_NAME),
+	})
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	return nil
+}
+
+/*
+****************
+DeleteApprovalPolicy()
+- Removes the policy of a request type or a role
+****************
+*/
+func DeleteApprovalPolicy(companyID, scope, target string) error {
+	_, err := app.SVC.DeleteItem(&dynamodb.DeleteItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
+			},
+			"SK": {
+				S: aws.String(approvalPolicySK(scope, target)),
+			},
+		},
+		TableName: aws.String(app.TABLE_NAME),
+	})
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	return nil
+}
+
+/*
+****************
+GetRequestApprovalPolicy()
+- Resolves the policy that applies to a request. The request type policy is
+combined with the policy of every requested role, keeping the highest count
+asked for each approver role.
+****************
+*/
+func GetRequestApprovalPolicy(request Request) (ApprovalPolicy, error) {
+	policy := ApprovalPolicy{
+		CompanyID:   request.CompanyID,
+		PolicyScope: APPROVAL_POLICY_SCOPE_TYPE,
+		Target:      request.RequestType,
+	}
+
+	typePolicy, found, err := GetApprovalPolicy(request.CompanyID, APPROVAL_POLICY_SCOPE_TYPE, request.RequestType)
+	if err != nil {
+		return policy, err
+	}
+	if found {
+		policy.Rules = mergeApprovalRules(policy.Rules, typePolicy.Rules)
+		policy.EscalationRoleID = typePolicy.EscalationRoleID
+	}
+
+	scopes := []string{APPROVAL_POLICY_SCOPE_ROLE}
+	if request.ElevationSeconds != 0 {
+		scopes = append(scopes, APPROVAL_POLICY_SCOPE_ELEVATION)
+	}
+	for _, roleID := range request.RolesRequested {
+		for _, scope := range scopes {
+			rolePolicy, found, err := GetApprovalPolicy(request.CompanyID, scope, roleID)
+			if err != nil {
+				return policy, err
+			}
+			if found {
+				policy.Rules = mergeApprovalRules(policy.Rules, rolePolicy.Rules)
+				if policy.EscalationRoleID == "" {
+					policy.EscalationRoleID = rolePolicy.EscalationRoleID
+				}
+			}
+		}
+	}
+
+	return policy, nil
+}
+
+func mergeApprovalRules(rules []ApprovalRule, more []ApprovalRule) []ApprovalRule {
+	for _, rule := range more {
+		merged := false
+		for i := range rules {
+			if rules[i].RoleID == rule.RoleID {
+				if rule.Count > rules[i].Count {
+					rules[i].Count = rule.Count
+				}
+				merged = true
+				break
+			}
+		}
+		if !merged {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+/*
+****************
+GetPolicyApprovers()
+- Returns every user who can approve under the policy, one entry per user.
+A policy without rules falls back to the company admins.
+****************
+*/
+func GetPolicyApprovers(companyID string, policy ApprovalPolicy) ([]models.CompanyUser, error) {
+	var approvers []models.CompanyUser
+
+	roleIDs := []string{constants.ROLE_ID_COMPANY_ADMIN}
+	if len(policy.Rules) != 0 {
+		roleIDs = nil
+		for _, rule := range policy.Rules {
+			roleIDs = append(roleIDs, rule.RoleID)
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, roleID := range roleIDs {
+		holders, err := ops.GetCompanyAdminsByRoleID(companyID, roleID)
+		if err != nil {
+			return approvers, errors.New(constants.HTTP_STATUS_500)
+		}
+		for _, holder := range holders {
+			if !seen[holder.UserID] {
+				seen[holder.UserID] = true
+				approvers = append(approvers, holder)
+			}
+		}
+	}
+
+	return approvers, nil
+}
+
+/*
+****************
+GetRequestApprovals()
+- Returns the approvals recorded on a request
+****************
+*/
+func GetRequestApprovals(requestID string) ([]RequestApproval, error) {
+	approvals := []RequestApproval{}
+
+	params := &dynamodb.QueryInput{
+		TableName: aws.String(app.TABLE_NAME),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"PK": {
+				ComparisonOperator: aws.String(constants.CONDITION_EQUAL),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(utils.AppendPrefix(PREFIX_REQUEST, requestID)),
+					},
+				},
+			},
+			"SK": {
+				ComparisonOperator: aws.String(constants.CONDITION_BEGINS_WITH),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(PREFIX_APPROVAL),
+					},
+				},
+			},
+		},
+	}
+
+	res, err := app.SVC.Query(params)
+	if err != nil {
+		return approvals, errors.New(constants.HTTP_STATUS_500)
+	}
+
+	err = dynamodbattribute.UnmarshalListOfMaps(res.Items, &approvals)
+	if err != nil {
+		return approvals, errors.New(constants.HTTP_STATUS_400)
+	}
+
+	return approvals, nil
+}
+
+/*
+****************
+ClearRequestApprovals()
+- Removes the approvals recorded on a request, used when the request changes
+under its approvers. When before is set, only the approvals recorded up to
+that time are removed.
+****************
+*/
+func ClearRequestApprovals(requestID, before string) error {
+	approvals, err := GetRequestApprovals(requestID)
+	if err != nil {
+		return err
+	}
+
+	writer := NewBatchWriter()
+	for _, approval := range approvals {
+		if before == "" || approval.CreatedAt <= before {
+			writer.Delete(approval.PK, approval.SK)
+		}
+	}
+	if _, err := writer.Flush(); err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	return nil
+}
+
+/*
+****************
+RemoveRequestApproval()
+- Removes the approval of one approver, used when the acceptance it
+completed could not be applied so the approver can try again
+****************
+*/
+func RemoveRequestApproval(requestID, approverID string) error {
+	_, err := app.SVC.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(utils.AppendPrefix(PREFIX_REQUEST, requestID)),
+			},
+			"SK": {
+				S: aws.String(utils.AppendPrefix(PREFIX_APPROVAL, approverID)),
+			},
+		},
+	})
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+	return nil
+}
+
+/*
+****************
+RecordRequestApproval()
+- Records the approver's approval of the request and reports whether the
+request's policy is now satisfied
+****************
+*/
+func RecordRequestApproval(ctx *RequestContext) (QuorumStatus, error) {
+	var quorum QuorumStatus
+
+	policy, err := GetRequestApprovalPolicy(*ctx.Request)
+	if err != nil {
+		return quorum, NewRequestError(500, "Unable to retrieve approval policy")
+	}
+
+	eligible, err := approvalEligibility(ctx.CompanyID, policy)
+	if err != nil {
+		return quorum, NewRequestError(500, "Unable to retrieve approvers")
+	}
+	escalated, err := isEscalationApprover(*ctx.Request, policy, ctx.ApproverID)
+	if err != nil {
+		return quorum, NewRequestError(500, "Unable to retrieve approvers")
+	}
+	if len(policy.Rules) != 0 && !escalated && !isEligibleApprover(eligible, ctx.ApproverID) {
+		return quorum, NewRequestError(403, "You are not an approver of this request")
+	}
+
+	approval := RequestApproval{
+		PK:         utils.AppendPrefix(PREFIX_REQUEST, ctx.Request.RequestID),
+		SK:         utils.AppendPrefix(PREFIX_APPROVAL, ctx.ApproverID),
+		RequestID:  ctx.Request.RequestID,
+		CompanyID:  ctx.CompanyID,
+		ApproverID: ctx.ApproverID,
+		CreatedAt:  utils.GetCurrentTimestamp(),
+		Type:       ENTITY_TYPE_REQUEST_APPROVAL,
+	}
+	av, err := dynamodbattribute.MarshalMap(approval)
+	if err != nil {
+		return quorum, NewRequestError(500, "Error at marshalmap")
+	}
+	_, err = app.SVC.PutItem(&dynamodb.PutItemInput{
+		Item:                av,
+		TableName:           aws.String(app.TABLE_NAME),
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return quorum, NewRequestError(409, "You have already approved this request")
+		}
+		return quorum, NewRequestError(500, "Unable to record approval")
+	}
+
+	// approvals are read back after writing ours so two approvers finishing
+	// at the same time both see the quorum; the status change decides who
+	// applies it
+	approvals, err := GetRequestApprovals(ctx.Request.RequestID)
+	if err != nil {
+		return quorum, NewRequestError(500, "Unable to retrieve approvals")
+	}
+
+	var approverIDs []string
+	for _, recorded := range approvals {
+		approverIDs = append(approverIDs, recorded.ApproverID)
+	}
+
+	quorum.Approvals = len(approverIDs)
+	quorum.Approvers = approverIDs
+	quorum.Required, quorum.Satisfied = evaluateApprovalPolicy(policy, eligible, approverIDs)
+	if escalated {
+		quorum.Satisfied = true
+	}
+	return quorum, nil
+}
+
+// isEscalationApprover reports whether the user belongs to the tier an
+// escalated request was handed to.
+func isEscalationApprover(request Request, policy ApprovalPolicy, userID string) (bool, error) {
+	if request.Stage != REQUEST_STAGE_ESCALATED {
+		return false, nil
+	}
+	holders, err := ops.GetCompanyAdminsByRoleID(request.CompanyID, escalationRoleID(policy))
+	if err != nil {
+		return false, err
+	}
+	for _, holder := range holders {
+		if holder.UserID == userID {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// approvalEligibility lists, for each rule of the policy, who may approve
+// under it.
+func approvalEligibility(companyID string, policy ApprovalPolicy) ([]map[string]bool, error) {
+	var eligible []map[string]bool
+	for _, rule := range policy.Rules {
+		holders, err := ops.GetCompanyAdminsByRoleID(companyID, rule.RoleID)
+		if err != nil {
+			return eligible, err
+		}
+		users := map[string]bool{}
+		for _, holder := range holders {
+			users[holder.UserID] = true
+		}
+		eligible = append(eligible, users)
+	}
+	return eligible, nil
+}
+
+func isEligibleApprover(eligible []map[string]bool, userID string) bool {
+	for _, users := range eligible {
+		if users[userID] {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+****************
+evaluateApprovalPolicy()
+- Returns the number of approvals the policy requires and whether the given
+approvers satisfy it. Every approver fills at most one required slot, so
+"group admin AND company admin" needs two different people.
+****************
+*/
+func evaluateApprovalPolicy(policy ApprovalPolicy, eligible []map[string]bool, approverIDs []string) (int, bool) {
+	if len(policy.Rules) == 0 {
+		return 1, len(approverIDs) >= 1
+	}
+
+	// one slot per approval required, labelled with the rule it belongs to
+	var slots []int
+	for i, rule := range policy.Rules {
+		for n := 0; n < rule.Count; n++ {
+			slots = append(slots, i)
+		}
+	}
+
+	// bipartite matching of approvers onto slots
+	slotOwner := make([]int, len(slots))
+	for i := range slotOwner {
+		slotOwner[i] = -1
+	}
+	var assign func(approver int, visited []bool) bool
+	assign = func(approver int, visited []bool) bool {
+		for s, rule := range slots {
+			if visited[s] || !eligible[rule][approverIDs[approver]] {
+				continue
+			}
+			visited[s] = true
+			if slotOwner[s] == -1 || assign(slotOwner[s], visited) {
+				slotOwner[s] = approver
+				return true
+			}
+		}
+		return false
+	}
+
+	matched := 0
+	for approver := range approverIDs {
+		if assign(approver, make([]bool, len(slots))) {
+			matched++
+		}
+	}
+
+	return len(slots), matched == len(slots)
+}
@@ -0,0 +1,157 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func eligibleUsers(userIDs ...string) map[string]bool {
+	users := map[string]bool{}
+	for _, userID := range userIDs {
+		users[userID] = true
+	}
+	return users
+}
+
+func TestEvaluateApprovalPolicy(t *testing.T) {
+	tests := []struct {
+		name      string
+		rules     []ApprovalRule
+		eligible  []map[string]bool
+		approvers []string
+		required  int
+		satisfied bool
+	}{
+		{
+			name:      "no rules needs one approval",
+			required:  1,
+			approvers: []string{"u1"},
+			satisfied: true,
+		},
+		{
+			name:      "no rules and no approval",
+			required:  1,
+			satisfied: false,
+		},
+		{
+			name:      "count of one rule",
+			rules:     []ApprovalRule{{RoleID: "admin", Count: 2}},
+			eligible:  []map[string]bool{eligibleUsers("u1", "u2", "u3")},
+			approvers: []string{"u1", "u3"},
+			required:  2,
+			satisfied: true,
+		},
+		{
+			name:      "count of one rule not reached",
+			rules:     []ApprovalRule{{RoleID: "admin", Count: 2}},
+			eligible:  []map[string]bool{eligibleUsers("u1", "u2")},
+			approvers: []string{"u1"},
+			required:  2,
+			satisfied: false,
+		},
+		{
+			name:      "approver outside every rule does not count",
+			rules:     []ApprovalRule{{RoleID: "admin", Count: 1}},
+			eligible:  []map[string]bool{eligibleUsers("u1")},
+			approvers: []string{"u9"},
+			required:  1,
+			satisfied: false,
+		},
+		{
+			name: "one approver cannot fill two rules",
+			rules: []ApprovalRule{
+				{RoleID: "group_admin", Count: 1},
+				{RoleID: "company_admin", Count: 1},
+			},
+			eligible: []map[string]bool{
+				eligibleUsers("u1"),
+				eligibleUsers("u1"),
+			},
+			approvers: []string{"u1"},
+			required:  2,
+			satisfied: false,
+		},
+		{
+			name: "matching reassigns an approver to free a slot",
+			rules: []ApprovalRule{
+				{RoleID: "group_admin", Count: 1},
+				{RoleID: "company_admin", Count: 1},
+			},
+			eligible: []map[string]bool{
+				eligibleUsers("u1", "u2"),
+				eligibleUsers("u1"),
+			},
+			// u1 first takes the group admin slot, then has to move so u2
+			// can take it
+			approvers: []string{"u1", "u2"},
+			required:  2,
+			satisfied: true,
+		},
+		{
+			name: "two rules each filled",
+			rules: []ApprovalRule{
+				{RoleID: "group_admin", Count: 1},
+				{RoleID: "company_admin", Count: 2},
+			},
+			eligible: []map[string]bool{
+				eligibleUsers("u1"),
+				eligibleUsers("u2", "u3"),
+			},
+			approvers: []string{"u3", "u1", "u2"},
+			required:  3,
+			satisfied: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			policy := ApprovalPolicy{Rules: test.rules}
+			required, satisfied := evaluateApprovalPolicy(policy, test.eligible, test.approvers)
+			if required != test.required || satisfied != test.satisfied {
+				t.Errorf("evaluateApprovalPolicy() = %d, %t; want %d, %t", required, satisfied, test.required, test.satisfied)
+			}
+		})
+	}
+}
+
+func TestMergeApprovalRules(t *testing.T) {
+	tests := []struct {
+		name  string
+		rules []ApprovalRule
+		more  []ApprovalRule
+		want  []ApprovalRule
+	}{
+		{
+			name: "into no rules",
+			more: []ApprovalRule{{RoleID: "admin", Count: 1}},
+			want: []ApprovalRule{{RoleID: "admin", Count: 1}},
+		},
+		{
+			name:  "keeps the highest count of a role",
+			rules: []ApprovalRule{{RoleID: "admin", Count: 1}},
+			more:  []ApprovalRule{{RoleID: "admin", Count: 3}},
+			want:  []ApprovalRule{{RoleID: "admin", Count: 3}},
+		},
+		{
+			name:  "does not lower a count",
+			rules: []ApprovalRule{{RoleID: "admin", Count: 3}},
+			more:  []ApprovalRule{{RoleID: "admin", Count: 2}},
+			want:  []ApprovalRule{{RoleID: "admin", Count: 3}},
+		},
+		{
+			name:  "adds other roles",
+			rules: []ApprovalRule{{RoleID: "admin", Count: 1}},
+			more:  []ApprovalRule{{RoleID: "security", Count: 2}},
+			want:  []ApprovalRule{{RoleID: "admin", Count: 1}, {RoleID: "security", Count: 2}},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := mergeApprovalRules(test.rules, test.more)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("mergeApprovalRules() = %v; want %v", got, test.want)
+			}
+		})
+	}
+}
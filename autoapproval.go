@@ -0,0 +1,689 @@
+package controllers
+
+import (
+	"errors"
+	"grooper/app"
+	"grooper/app/constants"
+	"grooper/app/models"
+	ops "grooper/app/operations"
+	"grooper/app/utils"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/revel/revel"
+)
+
+const (
+	PREFIX_AUTO_APPROVAL_RULE      = "AUTO_APPROVAL_RULE#"
+	ENTITY_TYPE_AUTO_APPROVAL_RULE = "AUTO_APPROVAL_RULE"
+	AUTO_APPROVAL_TIME_LAYOUT      = "15:04"
+)
+
+// AutoApprovalRule accepts matching requests as soon as they are created.
+// Every condition that is set must hold; an empty list or time matches
+// anything, but for Targets, which must name everything the rule covers. A
+// rule is written by a company admin and stands in for their approval, so
+// it also bypasses the approval policy of the request.
+type AutoApprovalRule struct {
+	PK          string `json:"PK,omitempty"`
+	SK          string `json:"SK,omitempty"`
+	RuleID      string `json:"RuleID,omitempty"`
+	CompanyID   string `json:"CompanyID,omitempty"`
+	Name        string `json:"Name,omitempty"`
+	RequestType string `json:"RequestType,omitempty"`
+	// Targets are the role, group or integration IDs the rule covers.
+	// Everything a request asks for must be listed.
+	Targets []string `json:"Targets,omitempty"`
+	// EmailDomains matches the domain of the requester's company email.
+	EmailDomains []string `json:"EmailDomains,omitempty"`
+	// RequesterRoleIDs matches requesters holding any of the roles.
+	RequesterRoleIDs []string `json:"RequesterRoleIDs,omitempty"`
+	// RequesterGroupIDs matches requesters already member of any of the
+	// groups, e.g. the group of their department.
+	RequesterGroupIDs []string `json:"RequesterGroupIDs,omitempty"`
+	// Weekdays, StartTime and EndTime ("15:04") restrict when the rule
+	// applies, in TimeZone (UTC when empty).
+	Weekdays  []string `json:"Weekdays,omitempty"`
+	StartTime string   `json:"StartTime,omitempty"`
+	EndTime   string   `json:"EndTime,omitempty"`
+	TimeZone  string   `json:"TimeZone,omitempty"`
+	// MaxElevation (e.g. 1h) restricts the rule to elevations of at most
+	// that long. Elevations to high-risk roles only match rules setting it.
+	MaxElevation string `json:"MaxElevation,omitempty"`
+	Enabled      bool   `json:"Enabled"`
+	CreatedBy    string `json:"CreatedBy,omitempty"`
+	CreatedAt    string `json:"CreatedAt,omitempty"`
+	UpdatedAt    string `json:"UpdatedAt,omitempty"`
+	Type         string `json:"Type,omitempty"`
+}
+
+// AutoApprovalRuleParams is the body of SaveAutoApprovalRule.
+type AutoApprovalRuleParams struct {
+	RuleID            string   `json:"rule_id,omitempty"`
+	Name              string   `json:"name,omitempty"`
+	RequestType       string   `json:"request_type,omitempty"`
+	Targets           []string `json:"targets,omitempty"`
+	EmailDomains      []string `json:"email_domains,omitempty"`
+	RequesterRoleIDs  []string `json:"requester_role_ids,omitempty"`
+	RequesterGroupIDs []string `json:"requester_group_ids,omitempty"`
+	Weekdays          []string `json:"weekdays,omitempty"`
+	StartTime         string   `json:"start_time,omitempty"`
+	EndTime           string   `json:"end_time,omitempty"`
+	TimeZone          string   `json:"time_zone,omitempty"`
+	MaxElevation      string   `json:"max_elevation,omitempty"`
+	Enabled           bool     `json:"enabled"`
+}
+
+/*
+****************
+GetCompanyAutoApprovalRules()
+- Returns every auto-approval rule of the company
+****************
+*/
+func GetCompanyAutoApprovalRules(companyID string) ([]AutoApprovalRule, error) {
+	rules := []AutoApprovalRule{}
+
+	params := &dynamodb.QueryInput{
+		TableName: aws.String(app.TABLE_NAME),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"PK": {
+				ComparisonOperator: aws.String(constants.CONDITION_EQUAL),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
+					},
+				},
+			},
+			"SK": {
+				ComparisonOperator: aws.String(constants.CONDITION_BEGINS_WITH),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(PREFIX_AUTO_APPROVAL_RULE),
+					},
+				},
+			},
+		},
+	}
+
+	res, err := app.SVC.Query(params)
+	if err != nil {
+		return rules, errors.New(constants.HTTP_STATUS_500)
+	}
+
+	err = dynamodbattribute.UnmarshalListOfMaps(res.Items, &rules)
+	if err != nil {
+		return rules, errors.New(constants.HTTP_STATUS_400)
+	}
+
+	return rules, nil
+}
+
+/*
+****************
+GetAutoApprovalRule()
+- Returns an auto-approval rule of the company. The returned bool is false
+if there is none with the ID.
+****************
+*/
+func GetAutoApprovalRule(companyID, ruleID string) (AutoApprovalRule, bool, error) {
+	var rule AutoApprovalRule
+
+	res, err := app.SVC.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
+			},
+			"SK": {
+				S: aws.String(utils.AppendPrefix(PREFIX_AUTO_APPROVAL_RULE, ruleID)),
+			},
+		},
+	})
+	if err != nil {
+		return rule, false, errors.New(constants.HTTP_STATUS_500)
+	}
+	if res.Item == nil {
+		return rule, false, nil
+	}
+
+	if err := dynamodbattribute.UnmarshalMap(res.Item, &rule); err != nil {
+		return rule, false, errors.New(constants.HTTP_STATUS_400)
+	}
+
+	return rule, true, nil
+}
+
+/*
+****************
+SaveAutoApprovalRule()
+- Creates or replaces an auto-approval rule
+****************
+*/
+func SaveAutoApprovalRule(rule AutoApprovalRule) error {
+	rule.PK = utils.AppendPrefix(constants.PREFIX_COMPANY, rule.CompanyID)
+	rule.SK = utils.AppendPrefix(PREFIX_AUTO_APPROVAL_RULE, rule.RuleID)
+	rule.Type = ENTITY_TYPE_AUTO_APPROVAL_RULE
+
+	av, err := dynamodbattribute.MarshalMap(rule)
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	_, err = app.SVC.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(app.TABLE_NAME),
+	})
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	return nil
+}
+
+/*
+****************
+DeleteAutoApprovalRule()
+- Removes an auto-approval rule
+****************
+*/
+func DeleteAutoApprovalRule(companyID, ruleID string) error {
+	_, err := app.SVC.DeleteItem(&dynamodb.DeleteItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
+			},
+			"SK": {
+				S: aws.String(utils.AppendPrefix(PREFIX_AUTO_APPROVAL_RULE, ruleID)),
+			},
+		},
+		TableName: aws.String(app.TABLE_NAME),
+	})
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	return nil
+}
+
+/*
+****************
+MatchAutoApprovalRule()
+- Returns the first enabled rule of the company matching a new request. The
+returned bool is false if none matches.
+****************
+*/
+func MatchAutoApprovalRule(request Request, requester models.CompanyUser, now time.Time) (AutoApprovalRule, bool, error) {
+	rules, err := GetCompanyAutoApprovalRules(request.CompanyID)
+	if err != nil {
+		return AutoApprovalRule{}, false, err
+	}
+
+	highRisk, err := isHighRiskElevation(request)
+	if err != nil {
+		return AutoApprovalRule{}, false, err
+	}
+
+	for _, rule := range rules {
+		if !rule.Enabled || rule.RequestType != request.RequestType {
+			continue
+		}
+		if !autoApprovalTargetsMatch(rule, request) || !autoApprovalTimeMatches(rule, now) || !autoApprovalElevationMatches(rule, request, highRisk) {
+			continue
+		}
+		matched, err := autoApprovalRequesterMatches(rule, request.CompanyID, requester)
+		if err != nil {
+			return AutoApprovalRule{}, false, err
+		}
+		if matched {
+			return rule, true, nil
+		}
+	}
+
+	return AutoApprovalRule{}, false, nil
+}
+
+// autoApprovalTargetsMatch requires the rule to name everything the request
+// asks for. A rule without targets matches nothing, so no rule can cover a
+// sensitive target by omission.
+func autoApprovalTargetsMatch(rule AutoApprovalRule, request Request) bool {
+	targets := requestTargets(request)
+	if len(rule.Targets) == 0 || len(targets) == 0 {
+		return false
+	}
+	for _, target := range targets {
+		if !utils.StringInSlice(target, rule.Targets) {
+			return false
+		}
+	}
+	return true
+}
+
+// requestTargets lists what the request asks for: its group, its roles or
+// its integrations.
+func requestTargets(request Request) []string {
+	switch {
+	case request.GroupID != "":
+		return []string{request.GroupID}
+	case len(request.RolesRequested) != 0:
+		return request.RolesRequested
+	case len(request.RequestedIntegrations) != 0:
+		return request.RequestedIntegrations
+	case request.Integration.IntegrationID != "":
+		return []string{request.Integration.IntegrationID}
+	}
+	return nil
+}
+
+// isHighRiskElevation reports whether the request elevates to the company
+// admin role or to a role the company requires more approvals to elevate to.
+func isHighRiskElevation(request Request) (bool, error) {
+	if request.ElevationSeconds == 0 {
+		return false, nil
+	}
+	for _, roleID := range request.RolesRequested {
+		if roleID == constants.ROLE_ID_COMPANY_ADMIN {
+			return true, nil
+		}
+		_, found, err := GetApprovalPolicy(request.CompanyID, APPROVAL_POLICY_SCOPE_ELEVATION, roleID)
+		if err != nil {
+			return false, err
+		}
+		if found {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// autoApprovalElevationMatches checks the length of an elevation against
+// the rule's limit. Rules without a limit match any request but a high-risk
+// elevation, which needs a rule opting in with a limit.
+func autoApprovalElevationMatches(rule AutoApprovalRule, request Request, highRisk bool) bool {
+	if rule.MaxElevation == "" {
+		return !highRisk
+	}
+	limit, err := time.ParseDuration(rule.MaxElevation)
+	if err != nil || request.ElevationSeconds == 0 {
+		return false
+	}
+	return time.Duration(request.ElevationSeconds)*time.Second <= limit
+}
+
+// autoApprovalTimeMatches checks the weekday and the time window, which may
+// run past midnight.
+func autoApprovalTimeMatches(rule AutoApprovalRule, now time.Time) bool {
+	location := time.UTC
+	if rule.TimeZone != "" {
+		loaded, err := time.LoadLocation(rule.TimeZone)
+		if err != nil {
+			return false
+		}
+		location = loaded
+	}
+	now = now.In(location)
+
+	if len(rule.Weekdays) != 0 {
+		today := strings.ToUpper(now.Weekday().String()[:3])
+		matched := false
+		for _, weekday := range rule.Weekdays {
+			if strings.ToUpper(weekday) == today {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if rule.StartTime == "" || rule.EndTime == "" {
+		return true
+	}
+	start, err := time.Parse(AUTO_APPROVAL_TIME_LAYOUT, rule.StartTime)
+	if err != nil {
+		return false
+	}
+	end, err := time.Parse(AUTO_APPROVAL_TIME_LAYOUT, rule.EndTime)
+	if err != nil {
+		return false
+	}
+	minute := now.Hour()*60 + now.Minute()
+	from := start.Hour()*60 + start.Minute()
+	to := end.Hour()*60 + end.Minute()
+	if from <= to {
+		return minute >= from && minute < to
+	}
+	return minute >= from || minute < to
+}
+
+func autoApprovalRequesterMatches(rule AutoApprovalRule, companyID string, requester models.CompanyUser) (bool, error) {
+	if len(rule.EmailDomains) != 0 {
+		at := strings.LastIndex(requester.Email, "@")
+		if at < 0 {
+			return false, nil
+		}
+		domain := strings.ToLower(requester.Email[at+1:])
+		matched := false
+		for _, allowed := range rule.EmailDomains {
+			if strings.ToLower(strings.TrimPrefix(allowed, "@")) == domain {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+
+	if len(rule.RequesterRoleIDs) != 0 {
+		matched := false
+		for _, roleID := range rule.RequesterRoleIDs {
+			holders, err := ops.GetCompanyAdminsByRoleID(companyID, roleID)
+			if err != nil {
+				return false, errors.New(constants.HTTP_STATUS_500)
+			}
+			for _, holder := range holders {
+				if holder.UserID == requester.UserID {
+					matched = true
+					break
+				}
+			}
+			if matched {
+				break
+			}
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+
+	if len(rule.RequesterGroupIDs) != 0 {
+		matched := false
+		for _, groupID := range rule.RequesterGroupIDs {
+			member, err := isActiveGroupMember(groupID, requester.UserID)
+			if err != nil {
+				return false, err
+			}
+			if member {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// isActiveGroupMember looks up the membership item written by the group join
+// handler.
+func isActiveGroupMember(groupID, userID string) (bool, error) {
+	res, err := app.SVC.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(utils.AppendPrefix(constants.PREFIX_GROUP, groupID)),
+			},
+			"SK": {
+				S: aws.String(utils.AppendPrefix(constants.PREFIX_USER, userID)),
+			},
+		},
+	})
+	if err != nil {
+		return false, errors.New(constants.HTTP_STATUS_500)
+	}
+	if res.Item == nil {
+		return false, nil
+	}
+
+	var member models.GroupMember
+	if err := dynamodbattribute.UnmarshalMap(res.Item, &member); err != nil {
+		return false, errors.New(constants.HTTP_STATUS_400)
+	}
+	return member.Status == constants.ITEM_STATUS_ACTIVE, nil
+}
+
+/*
+****************
+AutoApproveRequest()
+- Accepts a stored request on behalf of the rule that matched it, through
+the same path as an approver's accept. The request must have been created
+with AutoApprovalRuleID set.
+****************
+*/
+func AutoApproveRequest(request *Request, rule AutoApprovalRule) requestDecisionResult {
+	decision := RequestDecision{
+		RequestType: request.RequestType,
+		UserIDs:     []string{request.RequesterUserID},
+	}
+
+	ctx, err := NewRequestContext(jobController(request.CompanyID), request, decision)
+	if err != nil {
+		return requestErrorResult(err)
+	}
+	ctx.AutoApprovalRuleID = rule.RuleID
+
+	// the rule stands in for the approver, so only the request is checked
+	handler, ok := GetRequestHandler(ctx.RequestType)
+	if !ok {
+		return requestErrorResult(NewRequestError(400, "Unsupported request type: "+ctx.RequestType))
+	}
+	if err := handler.Validate(ctx); err != nil {
+		return requestErrorResult(err)
+	}
+
+	result := commitRequestAcceptance(ctx, handler, decision)
+	if data, ok := result.Body.(map[string]interface{}); ok {
+		data["action"] = "AutoApprove"
+		data["rule"] = rule
+	}
+	return result
+}
+
+/*
+****************
+SaveAutoApprovalRule()
+- Creates or replaces an auto-approval rule of the company
+Body:
+rule_id - optional, replaces the rule when set
+request_type - required
+targets[] - required (the roles, groups or integrations covered)
+email_domains[], requester_role_ids[], requester_group_ids[] - optional
+weekdays[] (MON..SUN), start_time, end_time (HH:MM), time_zone - optional
+max_elevation - optional (e.g. 1h), only elevations up to that long
+enabled - required
+****************
+*/
+func (c RequestController) SaveAutoApprovalRule() revel.Result {
+	companyID := c.ViewArgs["companyID"].(string)
+	userID := c.ViewArgs["userID"].(string)
+	data := make(map[string]interface{})
+
+	isAdmin, err := isCompanyAdmin(companyID, userID)
+	if err != nil || !isAdmin {
+		c.Response.Status = 401
+		data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_401)
+		return c.RenderJSON(data)
+	}
+
+	var input AutoApprovalRuleParams
+	c.Params.BindJSON(&input)
+
+	if errs := validateAutoApprovalRule(companyID, input); len(errs) != 0 {
+		c.Response.Status = 422
+		data["errors"] = errs
+		data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_422)
+		return c.RenderJSON(data)
+	}
+
+	currentTime := utils.GetCurrentTimestamp()
+	rule := AutoApprovalRule{
+		RuleID:            input.RuleID,
+		CompanyID:         companyID,
+		Name:              input.Name,
+		RequestType:       input.RequestType,
+		Targets:           input.Targets,
+		EmailDomains:      input.EmailDomains,
+		RequesterRoleIDs:  input.RequesterRoleIDs,
+		RequesterGroupIDs: input.RequesterGroupIDs,
+		Weekdays:          input.Weekdays,
+		StartTime:         input.StartTime,
+		EndTime:           input.EndTime,
+		TimeZone:          input.TimeZone,
+		MaxElevation:      input.MaxElevation,
+		Enabled:           input.Enabled,
+		CreatedBy:         userID,
+		CreatedAt:         currentTime,
+		UpdatedAt:         currentTime,
+	}
+	if rule.RuleID == "" {
+		rule.RuleID = utils.GenerateTimestampWithUID()
+	} else {
+		// a replaced rule keeps who created it and when
+		existing, found, err := GetAutoApprovalRule(companyID, rule.RuleID)
+		if err != nil {
+			data["status"] = utils.GetHTTPStatus(err.Error())
+			return c.RenderJSON(data)
+		}
+		if !found {
+			c.Response.Status = 404
+			return c.RenderJSON(models.ErrorResponse{
+				Code:           "404",
+				HTTPStatusCode: 404,
+				Message:        "Auto-approval rule not found: " + rule.RuleID,
+			})
+		}
+		rule.CreatedBy = existing.CreatedBy
+		rule.CreatedAt = existing.CreatedAt
+	}
+
+	if err := SaveAutoApprovalRule(rule); err != nil {
+		data["status"] = utils.GetHTTPStatus(err.Error())
+		return c.RenderJSON(data)
+	}
+
+	data["rule"] = rule
+	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+	return c.RenderJSON(data)
+}
+
+// validateAutoApprovalRule returns what is wrong with the rule, empty when it
+// can be saved.
+func validateAutoApprovalRule(companyID string, input AutoApprovalRuleParams) []string {
+	var errs []string
+
+	if _, ok := GetRequestHandler(input.RequestType); !ok {
+		errs = append(errs, "Unsupported request type: "+input.RequestType)
+	}
+	if len(input.Targets) == 0 {
+		errs = append(errs, "Missing required parameter - targets")
+	}
+	if input.RequestType == constants.REQUEST_COMPANY_ROLE_UPDATE {
+		for _, roleID := range input.Targets {
+			if _, opsErr := ops.GetRoleByID(roleID, companyID); opsErr != nil {
+				errs = append(errs, "Role not found: "+roleID)
+			}
+		}
+	}
+	for _, roleID := range input.RequesterRoleIDs {
+		if _, opsErr := ops.GetRoleByID(roleID, companyID); opsErr != nil {
+			errs = append(errs, "Role not found: "+roleID)
+		}
+	}
+	for _, weekday := range input.Weekdays {
+		if !utils.StringInSlice(strings.ToUpper(weekday), []string{"MON", "TUE", "WED", "THU", "FRI", "SAT", "SUN"}) {
+			errs = append(errs, "Unknown weekday: "+weekday)
+		}
+	}
+	if (input.StartTime == "") != (input.EndTime == "") {
+		errs = append(errs, "start_time and end_time must be set together")
+	}
+	for _, value := range []string{input.StartTime, input.EndTime} {
+		if value == "" {
+			continue
+		}
+		if _, err := time.Parse(AUTO_APPROVAL_TIME_LAYOUT, value); err != nil {
+			errs = append(errs, "Times must be HH:MM: "+value)
+		}
+	}
+	if input.TimeZone != "" {
+		if _, err := time.LoadLocation(input.TimeZone); err != nil {
+			errs = append(errs, "Unknown time zone: "+input.TimeZone)
+		}
+	}
+	if input.MaxElevation != "" {
+		if input.RequestType != constants.REQUEST_COMPANY_ROLE_UPDATE {
+			errs = append(errs, "max_elevation only applies to role requests")
+		}
+		if limit, err := time.ParseDuration(input.MaxElevation); err != nil || limit <= 0 {
+			errs = append(errs, "max_elevation must be a duration such as 1h: "+input.MaxElevation)
+		}
+	}
+
+	return errs
+}
+
+/*
+****************
+GetAutoApprovalRules()
+- Returns every auto-approval rule of the company
+****************
+*/
+func (c RequestController) GetAutoApprovalRules() revel.Result {
+	companyID := c.ViewArgs["companyID"].(string)
+	data := make(map[string]interface{})
+
+	rules, err := GetCompanyAutoApprovalRules(companyID)
+	if err != nil {
+		data["status"] = utils.GetHTTPStatus(err.Error())
+		return c.RenderJSON(data)
+	}
+
+	data["rules"] = rules
+	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+	return c.RenderJSON(data)
+}
+
+/*
+****************
+DeleteAutoApprovalRule()
+- Removes an auto-approval rule
+Params:
+rule_id - required
+****************
+*/
+func (c RequestController) DeleteAutoApprovalRule() revel.Result {
+	companyID := c.ViewArgs["companyID"].(string)
+	userID := c.ViewArgs["userID"].(string)
+	ruleID := c.Params.Get("rule_id")
+	data := make(map[string]interface{})
+
+	isAdmin, err := isCompanyAdmin(companyID, userID)
+	if err != nil || !isAdmin {
+		c.Response.Status = 401
+		data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_401)
+		return c.RenderJSON(data)
+	}
+
+	if ruleID == "" {
+		c.Response.Status = 400
+		return c.RenderJSON(models.ErrorResponse{
+			HTTPStatusCode: 400,
+			Message:        "Missing required parameter - rule_id",
+			Status:         utils.GetHTTPStatus(constants.HTTP_STATUS_400),
+		})
+	}
+
+	if err := DeleteAutoApprovalRule(companyID, ruleID); err != nil {
+		data["status"] = utils.GetHTTPStatus(err.Error())
+		return c.RenderJSON(data)
+	}
+
+	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+	return c.RenderJSON(data)
+}
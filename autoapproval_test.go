@@ -0,0 +1,114 @@
+package controllers
+
+import (
+	"grooper/app/models"
+	"testing"
+)
+
+func TestAutoApprovalElevationMatches(t *testing.T) {
+	tests := []struct {
+		name     string
+		rule     AutoApprovalRule
+		request  Request
+		highRisk bool
+		want     bool
+	}{
+		{
+			name:    "rule without a limit and a regular request",
+			request: Request{},
+			want:    true,
+		},
+		{
+			name:    "rule without a limit and an elevation",
+			request: Request{ElevationSeconds: 3600},
+			want:    true,
+		},
+		{
+			name:     "rule without a limit and a high-risk elevation",
+			request:  Request{ElevationSeconds: 3600},
+			highRisk: true,
+			want:     false,
+		},
+		{
+			name:     "high-risk elevation within an explicit limit",
+			rule:     AutoApprovalRule{MaxElevation: "1h"},
+			request:  Request{ElevationSeconds: 3600},
+			highRisk: true,
+			want:     true,
+		},
+		{
+			name:    "elevation longer than the limit",
+			rule:    AutoApprovalRule{MaxElevation: "1h"},
+			request: Request{ElevationSeconds: 3601},
+			want:    false,
+		},
+		{
+			name:    "limit and a regular request",
+			rule:    AutoApprovalRule{MaxElevation: "1h"},
+			request: Request{},
+			want:    false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := autoApprovalElevationMatches(test.rule, test.request, test.highRisk)
+			if got != test.want {
+				t.Errorf("autoApprovalElevationMatches() = %t; want %t", got, test.want)
+			}
+		})
+	}
+}
+
+func TestAutoApprovalTargetsMatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    AutoApprovalRule
+		request Request
+		want    bool
+	}{
+		{
+			name:    "rule without targets",
+			request: Request{RolesRequested: []string{"r1"}},
+			want:    false,
+		},
+		{
+			name:    "every role listed",
+			rule:    AutoApprovalRule{Targets: []string{"r1", "r2", "r3"}},
+			request: Request{RolesRequested: []string{"r1", "r2"}},
+			want:    true,
+		},
+		{
+			name:    "one role not listed",
+			rule:    AutoApprovalRule{Targets: []string{"r1"}},
+			request: Request{RolesRequested: []string{"r1", "r2"}},
+			want:    false,
+		},
+		{
+			name:    "group listed",
+			rule:    AutoApprovalRule{Targets: []string{"g1"}},
+			request: Request{GroupID: "g1"},
+			want:    true,
+		},
+		{
+			name:    "integration listed",
+			rule:    AutoApprovalRule{Targets: []string{"i1"}},
+			request: Request{Integration: models.NotificationIntegration{IntegrationID: "i1"}},
+			want:    true,
+		},
+		{
+			name:    "request without targets",
+			rule:    AutoApprovalRule{Targets: []string{"r1"}},
+			request: Request{},
+			want:    false,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := autoApprovalTargetsMatch(test.rule, test.request); got != test.want {
+				t.Errorf("autoApprovalTargetsMatch() = %v; want %v", got, test.want)
+			}
+		})
+	}
+}
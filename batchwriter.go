@@ -0,0 +1,228 @@
+package controllers
+
+import (
+	"errors"
+	"grooper/app"
+	"grooper/app/constants"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const (
+	BATCH_WRITE_LIMIT        = 25
+	BATCH_WRITE_MAX_ATTEMPTS = 5
+	BATCH_WRITE_BASE_DELAY   = 50 * time.Millisecond
+	BATCH_WRITE_MAX_DELAY    = 2 * time.Second
+	BATCH_WRITE_ACTION_PUT   = "PUT"
+	BATCH_WRITE_ACTION_DEL   = "DELETE"
+)
+
+var ErrBatchWriteIncomplete = errors.New("some items of the batch could not be written")
+
+// BatchWriter collects independent puts and deletes and writes them with
+// BatchWriteItem, BATCH_WRITE_LIMIT at a time. Unlike RequestTransaction the
+// writes are not atomic, each item that could not be written is reported.
+type BatchWriter struct {
+	requests []*dynamodb.WriteRequest
+	index    map[string]int
+	client   batchWriteClient
+	sleep    func(time.Duration)
+}
+
+// batchWriteClient is the part of the DynamoDB client the writer uses.
+type batchWriteClient interface {
+	BatchWriteItem(*dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error)
+}
+
+// BatchWriteFailure is an item the writer gave up on.
+type BatchWriteFailure struct {
+	PK     string `json:"pk"`
+	SK     string `json:"sk"`
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+}
+
+// BatchWriteResult is the outcome of BatchWriter.Flush.
+type BatchWriteResult struct {
+	Written  int                 `json:"written"`
+	Failures []BatchWriteFailure `json:"failures"`
+}
+
+// Failed reports whether the item with the key was not written.
+func (r BatchWriteResult) Failed(pk, sk string) bool {
+	for _, failure := range r.Failures {
+		if failure.PK == pk && failure.SK == sk {
+			return true
+		}
+	}
+	return false
+}
+
+// NewBatchWriter returns an empty writer.
+func NewBatchWriter() *BatchWriter {
+	return &BatchWriter{index: map[string]int{}, client: app.SVC, sleep: time.Sleep}
+}
+
+/*
+****************
+Put()
+- Adds an item to be written
+****************
+*/
+func (w *BatchWriter) Put(item map[string]*dynamodb.AttributeValue) {
+	w.add(&dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{
+		Item: item,
+	}})
+}
+
+/*
+****************
+PutModel()
+- Marshals a model and adds it to be written
+****************
+*/
+func (w *BatchWriter) PutModel(model interface{}) error {
+	av, err := dynamodbattribute.MarshalMap(model)
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+	w.Put(av)
+	return nil
+}
+
+/*
+****************
+Delete()
+- Adds an item to be deleted
+****************
+*/
+func (w *BatchWriter) Delete(pk, sk string) {
+	w.add(&dynamodb.WriteRequest{DeleteRequest: &dynamodb.DeleteRequest{
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(pk),
+			},
+			"SK": {
+				S: aws.String(sk),
+			},
+		},
+	}})
+}
+
+// Len returns the number of items collected so far.
+func (w *BatchWriter) Len() int {
+	return len(w.requests)
+}
+
+// add keeps one write per key, BatchWriteItem rejects a batch that touches
+// the same item twice. The last write to a key wins.
+func (w *BatchWriter) add(request *dynamodb.WriteRequest) {
+	pk, sk := writeRequestKey(request)
+	if i, ok := w.index[pk+"|"+sk]; ok {
+		w.requests[i] = request
+		return
+	}
+	w.index[pk+"|"+sk] = len(w.requests)
+	w.requests = append(w.requests, request)
+}
+
+/*
+****************
+Flush()
+- Writes the collected items in batches of BATCH_WRITE_LIMIT. Unprocessed
+items are retried with an exponential backoff, up to BATCH_WRITE_MAX_ATTEMPTS
+times. The writer is empty afterwards. ErrBatchWriteIncomplete is returned
+along with the failures when any item could not be written.
+****************
+*/
+func (w *BatchWriter) Flush() (BatchWriteResult, error) {
+	result := BatchWriteResult{Failures: []BatchWriteFailure{}}
+	requests := w.requests
+	w.requests = nil
+	w.index = map[string]int{}
+
+	for start := 0; start < len(requests); start += BATCH_WRITE_LIMIT {
+		end := start + BATCH_WRITE_LIMIT
+		if end > len(requests) {
+			end = len(requests)
+		}
+		chunk := requests[start:end]
+		failures := w.writeBatch(chunk)
+		result.Written += len(chunk) - len(failures)
+		result.Failures = append(result.Failures, failures...)
+	}
+
+	if len(result.Failures) > 0 {
+		return result, ErrBatchWriteIncomplete
+	}
+	return result, nil
+}
+
+// writeBatch writes one batch, retrying what DynamoDB leaves unprocessed, and
+// returns the items that could not be written.
+func (w *BatchWriter) writeBatch(batch []*dynamodb.WriteRequest) []BatchWriteFailure {
+	pending := batch
+	var reason string
+	delay := BATCH_WRITE_BASE_DELAY
+
+	for attempt := 1; len(pending) > 0 && attempt <= BATCH_WRITE_MAX_ATTEMPTS; attempt++ {
+		if attempt > 1 {
+			w.sleep(delay)
+			delay *= 2
+			if delay > BATCH_WRITE_MAX_DELAY {
+				delay = BATCH_WRITE_MAX_DELAY
+			}
+		}
+
+		res, err := w.client.BatchWriteItem(&dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]*dynamodb.WriteRequest{
+				app.TABLE_NAME: pending,
+			},
+		})
+		if err != nil {
+			// throttling and validation errors fail the whole call, the
+			// batch is tried again as it was
+			reason = err.Error()
+			continue
+		}
+		reason = "unprocessed after retries"
+		pending = res.UnprocessedItems[app.TABLE_NAME]
+	}
+
+	failures := []BatchWriteFailure{}
+	for _, request := range pending {
+		pk, sk := writeRequestKey(request)
+		action := BATCH_WRITE_ACTION_PUT
+		if request.DeleteRequest != nil {
+			action = BATCH_WRITE_ACTION_DEL
+		}
+		failures = append(failures, BatchWriteFailure{
+			PK:     pk,
+			SK:     sk,
+			Action: action,
+			Reason: reason,
+		})
+	}
+	return failures
+}
+
+// writeRequestKey returns the PK and SK a write request touches.
+func writeRequestKey(request *dynamodb.WriteRequest) (string, string) {
+	var key map[string]*dynamodb.AttributeValue
+	if request.PutRequest != nil {
+		key = request.PutRequest.Item
+	} else if request.DeleteRequest != nil {
+		key = request.DeleteRequest.Key
+	}
+	var pk, sk string
+	if key["PK"] != nil {
+		pk = aws.StringValue(key["PK"].S)
+	}
+	if key["SK"] != nil {
+		sk = aws.StringValue(key["SK"].S)
+	}
+	return pk, sk
+}
@@ -0,0 +1,193 @@
+package controllers
+
+import (
+	"errors"
+	"grooper/app"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// fakeBatchWriteClient records the keys of each call. A key in unprocessed
+// comes back unprocessed that many times, -1 for always. A non-nil err fails
+// every call.
+type fakeBatchWriteClient struct {
+	unprocessed map[string]int
+	err         error
+	calls       [][]string
+	written     map[string]*dynamodb.WriteRequest
+}
+
+func (f *fakeBatchWriteClient) BatchWriteItem(input *dynamodb.BatchWriteItemInput) (*dynamodb.BatchWriteItemOutput, error) {
+	var keys []string
+	var left []*dynamodb.WriteRequest
+	for _, request := range input.RequestItems[app.TABLE_NAME] {
+		pk, sk := writeRequestKey(request)
+		keys = append(keys, pk+"|"+sk)
+		if f.err != nil {
+			continue
+		}
+		if n := f.unprocessed[pk+"|"+sk]; n != 0 {
+			if n > 0 {
+				f.unprocessed[pk+"|"+sk] = n - 1
+			}
+			left = append(left, request)
+			continue
+		}
+		f.written[pk+"|"+sk] = request
+	}
+	f.calls = append(f.calls, keys)
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &dynamodb.BatchWriteItemOutput{
+		UnprocessedItems: map[string][]*dynamodb.WriteRequest{app.TABLE_NAME: left},
+	}, nil
+}
+
+func batchWriteItem(pk, sk, value string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"PK":    {S: aws.String(pk)},
+		"SK":    {S: aws.String(sk)},
+		"Value": {S: aws.String(value)},
+	}
+}
+
+func TestBatchWriterFlush(t *testing.T) {
+	putMany := func(n int) func(w *BatchWriter) {
+		return func(w *BatchWriter) {
+			for i := 0; i < n; i++ {
+				w.Put(batchWriteItem("P", strconv.Itoa(i), ""))
+			}
+		}
+	}
+
+	tests := []struct {
+		name        string
+		fill        func(w *BatchWriter)
+		unprocessed map[string]int
+		err         error
+		wantCalls   []int
+		wantWritten int
+		wantFailed  []string
+		wantReason  string
+		wantSleeps  int
+	}{
+		{
+			name:        "chunks at the batch limit",
+			fill:        putMany(60),
+			wantCalls:   []int{25, 25, 10},
+			wantWritten: 60,
+		},
+		{
+			name: "keeps the last write to a key",
+			fill: func(w *BatchWriter) {
+				w.Put(batchWriteItem("P", "a", "first"))
+				w.Delete("P", "b")
+				w.Put(batchWriteItem("P", "a", "second"))
+				w.Put(batchWriteItem("P", "b", "put"))
+			},
+			wantCalls:   []int{2},
+			wantWritten: 2,
+		},
+		{
+			name:        "retries unprocessed items",
+			fill:        putMany(5),
+			unprocessed: map[string]int{"P|1": 1, "P|3": 2},
+			wantCalls:   []int{5, 2, 1},
+			wantWritten: 5,
+			wantSleeps:  2,
+		},
+		{
+			name:        "gives up after the last attempt",
+			fill:        putMany(3),
+			unprocessed: map[string]int{"P|2": -1},
+			wantCalls:   []int{3, 1, 1, 1, 1},
+			wantWritten: 2,
+			wantFailed:  []string{"P|2"},
+			wantReason:  "unprocessed after retries",
+			wantSleeps:  BATCH_WRITE_MAX_ATTEMPTS - 1,
+		},
+		{
+			name:       "fails the batch the client rejects",
+			fill:       putMany(2),
+			err:        errors.New("throttled"),
+			wantCalls:  []int{2, 2, 2, 2, 2},
+			wantFailed: []string{"P|0", "P|1"},
+			wantReason: "throttled",
+			wantSleeps: BATCH_WRITE_MAX_ATTEMPTS - 1,
+		},
+		{
+			name: "writes nothing when empty",
+			fill: func(w *BatchWriter) {},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &fakeBatchWriteClient{unprocessed: tt.unprocessed, err: tt.err, written: map[string]*dynamodb.WriteRequest{}}
+			sleeps := 0
+			w := NewBatchWriter()
+			w.client = client
+			w.sleep = func(time.Duration) { sleeps++ }
+			tt.fill(w)
+
+			result, err := w.Flush()
+
+			if len(client.calls) != len(tt.wantCalls) {
+				t.Fatalf("got %d calls, want %d", len(client.calls), len(tt.wantCalls))
+			}
+			for i, keys := range client.calls {
+				if len(keys) != tt.wantCalls[i] {
+					t.Errorf("call %d wrote %d items, want %d", i, len(keys), tt.wantCalls[i])
+				}
+			}
+			if result.Written != tt.wantWritten {
+				t.Errorf("Written = %d, want %d", result.Written, tt.wantWritten)
+			}
+			if len(result.Failures) != len(tt.wantFailed) {
+				t.Fatalf("got %d failures, want %d", len(result.Failures), len(tt.wantFailed))
+			}
+			for i, failure := range result.Failures {
+				if failure.PK+"|"+failure.SK != tt.wantFailed[i] || failure.Reason != tt.wantReason {
+					t.Errorf("failure %d = %+v, want %s (%s)", i, failure, tt.wantFailed[i], tt.wantReason)
+				}
+			}
+			if (err == ErrBatchWriteIncomplete) != (len(tt.wantFailed) != 0) || (err != nil && err != ErrBatchWriteIncomplete) {
+				t.Errorf("err = %v with %d failures", err, len(result.Failures))
+			}
+			if sleeps != tt.wantSleeps {
+				t.Errorf("slept %d times, want %d", sleeps, tt.wantSleeps)
+			}
+			if w.Len() != 0 {
+				t.Errorf("writer still holds %d items", w.Len())
+			}
+		})
+	}
+}
+
+func TestBatchWriterLastWriteWins(t *testing.T) {
+	client := &fakeBatchWriteClient{written: map[string]*dynamodb.WriteRequest{}}
+	w := NewBatchWriter()
+	w.client = client
+	w.sleep = func(time.Duration) {}
+	w.Put(batchWriteItem("P", "a", "first"))
+	w.Delete("P", "b")
+	w.Put(batchWriteItem("P", "a", "second"))
+	w.Put(batchWriteItem("P", "b", "put"))
+
+	if _, err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	a := client.written["P|a"]
+	if a == nil || a.PutRequest == nil || aws.StringValue(a.PutRequest.Item["Value"].S) != "second" {
+		t.Errorf("P|a was not written with its last put")
+	}
+	b := client.written["P|b"]
+	if b == nil || b.PutRequest == nil {
+		t.Errorf("the put of P|b did not replace its delete")
+	}
+}
@@ -0,0 +1,72 @@
+package controllers
+
+import (
+	"errors"
+	"grooper/app/constants"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	ATLASSIAN_ADMIN_API_URL = "https://api.atlassian.com"
+	BITBUCKET_DEFAULT_ROLE  = "atlassian/user"
+)
+
+func init() {
+	RegisterAccountProvisioner(constants.INTEG_SLUG_BITBUCKET, BitbucketAccountProvisioner{})
+}
+
+// BitbucketAccountProvisioner invites the user through the Atlassian
+// organization of the company's provisioning settings, to its Bitbucket
+// workspace with the settings' role. The account exists once the user
+// accepts the invitation email.
+type BitbucketAccountProvisioner struct {
+	APIURL string
+	Client *http.Client
+}
+
+// atlassianInvite is the body of POST /admin/v2/orgs/{orgId}/users/invite.
+type atlassianInvite struct {
+	Emails           []string                  `json:"emails"`
+	Resources        []atlassianInviteResource `json:"resources"`
+	SendNotification bool                      `json:"sendNotification"`
+}
+
+type atlassianInviteResource struct {
+	ARI  string `json:"ari"`
+	Role string `json:"role"`
+}
+
+func (p BitbucketAccountProvisioner) Provision(account ProvisioningAccount) (ProvisioningResult, error) {
+	settings := account.Settings
+	if settings.OrganizationID == "" || settings.Workspace == "" {
+		return ProvisioningResult{}, errors.New("Bitbucket workspace is not set up")
+	}
+	if account.Credentials.AccessToken == "" {
+		return ProvisioningResult{}, errors.New("Bitbucket token not found")
+	}
+	role := settings.Role
+	if role == "" {
+		role = BITBUCKET_DEFAULT_ROLE
+	}
+	apiURL := p.APIURL
+	if apiURL == "" {
+		apiURL = ATLASSIAN_ADMIN_API_URL
+	}
+
+	inviteURL := strings.TrimRight(apiURL, "/") + "/admin/v2/orgs/" + url.PathEscape(settings.OrganizationID) + "/users/invite"
+	err := sendProvisioningRequest(p.Client, http.MethodPost, inviteURL, "Bearer "+account.Credentials.AccessToken, atlassianInvite{
+		Emails: []string{account.Email},
+		Resources: []atlassianInviteResource{{
+			ARI:  "ari:cloud:bitbucket::workspace/" + settings.Workspace,
+			Role: role,
+		}},
+		SendNotification: true,
+	}, nil)
+	if err != nil {
+		return ProvisioningResult{}, err
+	}
+
+	return ProvisioningResult{Invited: true}, nil
+}
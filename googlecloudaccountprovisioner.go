@@ -0,0 +1,117 @@
+package controllers
+
+import (
+	"errors"
+	"grooper/app/constants"
+	"net/http"
+	"strings"
+)
+
+const (
+	GOOGLE_DIRECTORY_URL         = "https://admin.googleapis.com"
+	GOOGLE_INITIAL_PASSWORD_SIZE = 24
+)
+
+func init() {
+	RegisterAccountProvisioner(constants.INTEG_SLUG_GOOGLE_CLOUD, GoogleCloudAccountProvisioner{})
+}
+
+// GoogleCloudAccountProvisioner creates the user in the company's Google
+// Workspace directory, under the domain of its provisioning settings. The
+// user signs in with the returned login and temporary password and sets
+// their own password on first sign in.
+type GoogleCloudAccountProvisioner struct {
+	DirectoryURL string
+	Client       *http.Client
+}
+
+// googleDirectoryUser is the body of POST /admin/directory/v1/users.
+type googleDirectoryUser struct {
+	PrimaryEmail string `json:"primaryEmail"`
+	Name         struct {
+		GivenName  string `json:"givenName"`
+		FamilyName string `json:"familyName"`
+	} `json:"name"`
+	Password                  string `json:"password"`
+	ChangePasswordAtNextLogin bool   `json:"changePasswordAtNextLogin"`
+	RecoveryEmail             string `json:"recoveryEmail,omitempty"`
+}
+
+func (p GoogleCloudAccountProvisioner) Provision(account ProvisioningAccount) (ProvisioningResult, error) {
+	if account.Settings.Domain == "" {
+		return ProvisioningResult{}, errors.New("Google Workspace domain is not set up")
+	}
+	if account.Credentials.AccessToken == "" {
+		return ProvisioningResult{}, errors.New("Google Cloud token not found")
+	}
+	primaryEmail, err := googlePrimaryEmail(account, account.Settings.Domain)
+	if err != nil {
+		return ProvisioningResult{}, err
+	}
+	directoryURL := p.DirectoryURL
+	if directoryURL == "" {
+		directoryURL = GOOGLE_DIRECTORY_URL
+	}
+
+	password, err := randomToken(GOOGLE_INITIAL_PASSWORD_SIZE)
+	if err != nil {
+		return ProvisioningResult{}, err
+	}
+	user := googleDirectoryUser{
+		PrimaryEmail:              primaryEmail,
+		Password:                  password,
+		ChangePasswordAtNextLogin: true,
+	}
+	user.Name.GivenName = account.FirstName
+	user.Name.FamilyName = account.LastName
+	if !strings.EqualFold(account.Email, primaryEmail) {
+		user.RecoveryEmail = account.Email
+	}
+
+	var created struct {
+		ID string `json:"id"`
+	}
+	err = sendProvisioningRequest(p.Client, http.MethodPost, strings.TrimRight(directoryURL, "/")+"/admin/directory/v1/users", "Bearer "+account.Credentials.AccessToken, user, &created)
+	if err != nil {
+		return ProvisioningResult{}, err
+	}
+
+	return ProvisioningResult{
+		AccountID:       created.ID,
+		Login:           primaryEmail,
+		InitialPassword: user.Password,
+	}, nil
+}
+
+// googlePrimaryEmail returns the address of the user in the domain. Users
+// already on the domain keep their address, others get firstname.lastname,
+// or the local part of their address when they have no name.
+func googlePrimaryEmail(account ProvisioningAccount, domain string) (string, error) {
+	domain = strings.ToLower(domain)
+	email := strings.ToLower(account.Email)
+	if strings.HasSuffix(email, "@"+domain) {
+		return email, nil
+	}
+
+	local := googleLocalPart(account.FirstName + "." + account.LastName)
+	if local == "" {
+		local = googleLocalPart(strings.SplitN(email, "@", 2)[0])
+	}
+	if local == "" {
+		return "", errors.New("no address can be made for the user in " + domain)
+	}
+
+	return local + "@" + domain, nil
+}
+
+// googleLocalPart keeps the characters Google accepts in an address and
+// drops the dots left at either end.
+func googleLocalPart(name string) string {
+	var local strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '.' || r == '-' || r == '_' {
+			local.WriteRune(r)
+		}
+	}
+	return strings.Trim(local.String(), ".")
+}
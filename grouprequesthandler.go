@@ -0,0 +1,207 @@
+package controllers
+
+import (
+	"grooper/app/constants"
+	"grooper/app/mail"
+	"grooper/app/models"
+	"grooper/app/utils"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/revel/modules/jobs/app/jobs"
+	"github.com/revel/revel"
+	"github.com/revel/revel/cache"
+)
+
+func init() {
+	RegisterRequestHandler(constants.REQUEST_TO_JOIN_GROUP, GroupJoinRequestHandler{})
+	RegisterRequestPermissions(constants.REQUEST_TO_JOIN_GROUP, RequestPermissions{
+		Accept: constants.ADD_GROUP_MEMBER,
+		Reject: constants.ADD_GROUP_MEMBER,
+		View:   constants.ADD_GROUP_MEMBER,
+	})
+}
+
+// GroupJoinRequestHandler adds the requester to a group.
+type GroupJoinRequestHandler struct{}
+
+func (h GroupJoinRequestHandler) Validate(ctx *RequestContext) error {
+	if ctx.GroupID == "" {
+		return NewRequestError(400, "Missing required parameter - group_id")
+	}
+	return nil
+}
+
+func (h GroupJoinRequestHandler) Authorize(ctx *RequestContext, accept bool) error {
+	return nil
+}
+
+func (h GroupJoinRequestHandler) Accept(ctx *RequestContext, subject RequestSubject, content *models.NotificationContentType) error {
+	group, err := GetGroupByID(ctx.GroupID)
+	if err != nil {
+		return NewRequestError(404, "Group not exists.")
+	}
+
+	member := models.GroupMember{
+		PK:         utils.AppendPrefix(constants.PREFIX_GROUP, ctx.GroupID),
+		SK:         utils.AppendPrefix(constants.PREFIX_USER, subject.User.UserID),
+		CompanyID:  ctx.CompanyID,
+		GroupID:    ctx.GroupID,
+		MemberID:   subject.User.UserID,
+		Status:     constants.ITEM_STATUS_ACTIVE,
+		MemberType: ctx.MemberType,
+		MemberRole: constants.MEMBER_TYPE_USER,
+		CreatedAt:  utils.GetCurrentTimestamp(),
+		UpdatedAt:  utils.GetCurrentTimestamp(),
+		Type:       constants.ENTITY_TYPE_GROUP_MEMBER,
+	}
+	ctx.Transaction.Put(map[string]*dynamodb.AttributeValue{
+		"PK": &dynamodb.AttributeValue{
+			S: aws.String(member.PK),
+		},
+		"SK": &dynamodb.AttributeValue{
+			S: aws.String(member.SK),
+		},
+		"CompanyID": &dynamodb.AttributeValue{
+			S: aws.String(member.CompanyID),
+		},
+		"GroupID": &dynamodb.AttributeValue{
+			S: aws.String(member.GroupID),
+		},
+		"MemberID": &dynamodb.AttributeValue{
+			S: aws.String(member.MemberID),
+		},
+		"Status": &dynamodb.AttributeValue{
+			S: aws.String(member.Status),
+		},
+		"MemberType": &dynamodb.AttributeValue{
+			S: aws.String(member.MemberType),
+		},
+		"MemberRole": &dynamodb.AttributeValue{
+			S: aws.String(member.MemberRole),
+		},
+		"CreatedAt": &dynamodb.AttributeValue{
+			S: aws.String(member.CreatedAt),
+		},
+		"UpdatedAt": &dynamodb.AttributeValue{
+			S: aws.String(member.UpdatedAt),
+		},
+		"Type": &dynamodb.AttributeValue{
+			S: aws.String(member.Type),
+		},
+	})
+
+	ctx.AfterCommit(func() error {
+		go cache.Set("member_"+member.MemberID, member, 30*time.Minute)
+		jobs.Now(mail.SendEmail{
+			Subject: "You have been added to a group",
+			Recipients: []mail.Recipient{
+				{
+					Name:       subject.User.FirstName + " " + subject.User.LastName,
+					Email:      subject.User.Email,
+					GroupName:  group.GroupName,
+					ActionType: "added",
+				},
+			},
+			Template: "notify_group_member.html",
+		})
+		return nil
+	})
+
+	ctx.AdminMessage(content, NewNotificationTemplate(requestMessageKey("group", "admin", true), requesterName(subject.RequesterInfo), group.GroupName))
+	content.GroupID = ctx.GroupID
+	return nil
+}
+
+func (h GroupJoinRequestHandler) Reject(ctx *RequestContext, subject RequestSubject, content *models.NotificationContentType) error {
+	group, err := GetGroupByID(ctx.GroupID)
+	if err != nil {
+		return NewRequestError(404, "Group not exists.")
+	}
+
+	ctx.AdminMessage(content, NewNotificationTemplate(requestMessageKey("group", "admin", false), requesterName(subject.RequesterInfo), group.GroupName))
+	content.GroupID = ctx.GroupID
+	return nil
+}
+
+func (h GroupJoinRequestHandler) Describe(ctx *RequestContext, content *models.NotificationContentType, accepted bool) error {
+	group, err := GetGroupByID(ctx.GroupID)
+	if err != nil {
+		return NewRequestError(404, "Group not exists.")
+	}
+
+	ctx.RequesterMessage(content, NewNotificationTemplate(requestMessageKey("group", "requester", accepted), group.GroupName))
+	return nil
+}
+
+/*
+****************
+RequestGroupJoin()
+- Files the caller's request to join a group. It goes through FileRequest
+like role requests, so auto-approval rules, Slack messages and email links
+apply to it.
+Body:
+group_id - required
+****************
+*/
+func (c RequestController) RequestGroupJoin() revel.Result {
+	companyID := c.ViewArgs["companyID"].(string)
+	userID := c.ViewArgs["userID"].(string)
+
+	var groupID string
+	c.Params.Bind(&groupID, "group_id")
+	if groupID == "" {
+		return renderRequestError(c.Controller, NewRequestError(400, "Missing required parameter - group_id"))
+	}
+
+	group, err := GetGroupByID(groupID)
+	if err != nil || group.CompanyID != companyID {
+		return renderRequestError(c.Controller, NewRequestError(404, "Group not exists."))
+	}
+	member, err := isActiveGroupMember(groupID, userID)
+	if err != nil {
+		return renderRequestError(c.Controller, NewRequestError(500, "Unable to retrieve group member"))
+	}
+	if member {
+		return renderRequestError(c.Controller, NewRequestError(409, "You are already a member of "+group.GroupName))
+	}
+
+	pendingRequests, err := GetPendingRequestsOfUser(companyID, userID, constants.REQUEST_TO_JOIN_GROUP)
+	if err != nil {
+		return renderRequestError(c.Controller, NewRequestError(500, "Error retrieving pending requests"))
+	}
+	for _, pending := range pendingRequests {
+		if pending.GroupID == groupID {
+			c.Response.Status = 497
+			return c.RenderJSON(models.ErrorResponse{
+				Code:    "497",
+				Message: "Request already submitted.",
+				Status:  utils.GetHTTPStatus(constants.HTTP_STATUS_497),
+			})
+		}
+	}
+
+	requester, err := GetCompanyUser(companyID, userID)
+	if err != nil {
+		return renderRequestError(c.Controller, NewRequestError(400, "Unable to retrieve Company user"))
+	}
+
+	request := NewRequest(companyID, constants.REQUEST_TO_JOIN_GROUP, userID, userID)
+	request.GroupID = groupID
+	template := NewNotificationTemplate(MESSAGE_GROUP_REQUESTED, requesterName(requester), group.GroupName)
+
+	filed, err := FileRequest(c.Controller, request, requester, template)
+	if err != nil {
+		revel.AppLog.Error("RequestGroupJoin:", err)
+		return renderRequestError(c.Controller, NewRequestError(500, "Error storing pending request"))
+	}
+
+	data := make(map[string]interface{})
+	data["request"] = filed.Request
+	if filed.AutoApproval != nil {
+		data["auto_approval"] = filed.AutoApproval.Body
+	}
+	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+	return c.RenderJSON(data)
+}
@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"grooper/app/models"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/revel/revel"
+)
+
+const HTTP_PROVIDER_TIMEOUT = 10 * time.Second
+
+// the slugs listed in integration.http_providers are revoked through
+// HTTPIntegrationProvider, each at integration.revoke_url.<slug>. Pointing
+// one at a local server exercises the disconnect flow without the real
+// provider.
+func init() {
+	revel.OnAppStart(func() {
+		for _, slug := range strings.Split(revel.Config.StringDefault("integration.http_providers", ""), ",") {
+			slug = strings.TrimSpace(slug)
+			if slug == "" {
+				continue
+			}
+			RegisterIntegrationProvider(slug, HTTPIntegrationProvider{
+				RevokeURL: revel.Config.StringDefault("integration.revoke_url."+slug, ""),
+			})
+		}
+	})
+}
+
+// HTTPIntegrationProvider revokes an integration by posting to an endpoint
+// with the company's access token.
+type HTTPIntegrationProvider struct {
+	RevokeURL string
+	Client    *http.Client
+}
+
+// httpRevokeBody is posted to the revoke endpoint.
+type httpRevokeBody struct {
+	CompanyID       string `json:"company_id"`
+	IntegrationID   string `json:"integration_id"`
+	IntegrationSlug string `json:"integration_slug"`
+}
+
+func (p HTTPIntegrationProvider) Credentials(companyID string, integration models.Integration) (IntegrationCredentials, error) {
+	credentials, _ := companyIntegrationCredentials(companyID, integration)
+	return credentials, nil
+}
+
+func (p HTTPIntegrationProvider) Revoke(companyID string, integration models.Integration, credentials IntegrationCredentials) error {
+	if p.RevokeURL == "" {
+		return nil
+	}
+
+	body, err := json.Marshal(httpRevokeBody{
+		CompanyID:       companyID,
+		IntegrationID:   integration.IntegrationID,
+		IntegrationSlug: integration.IntegrationSlug,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, p.RevokeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if credentials.AccessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+credentials.AccessToken)
+	}
+
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: HTTP_PROVIDER_TIMEOUT}
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return errors.New("revoke of " + integration.IntegrationSlug + " failed with status " + strconv.Itoa(res.StatusCode))
+	}
+	return nil
+}
+
+func (p HTTPIntegrationProvider) LocalState(companyID string, integration models.Integration, connectedGroups []models.Integration) ([]DisconnectItem, error) {
+	return nil, nil
+}
+
+func (p HTTPIntegrationProvider) CleanupLocalState(companyID string, integration models.Integration, connectedGroups []models.Integration) error {
+	return nil
+}
+
+func (p HTTPIntegrationProvider) ReauthorizesOnRestore() bool {
+	return p.RevokeURL != ""
+}
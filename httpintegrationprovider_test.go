@@ -0,0 +1,104 @@
+package controllers
+
+import (
+	"encoding/json"
+	"grooper/app/models"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPIntegrationProviderRevoke(t *testing.T) {
+	integration := models.Integration{IntegrationID: "i1", IntegrationSlug: "slack"}
+
+	tests := []struct {
+		name        string
+		status      int
+		credentials IntegrationCredentials
+		noURL       bool
+		wantCalled  bool
+		wantAuth    string
+		wantErr     bool
+	}{
+		{
+			name:        "revoked",
+			status:      http.StatusOK,
+			credentials: IntegrationCredentials{AccessToken: "token"},
+			wantCalled:  true,
+			wantAuth:    "Bearer token",
+		},
+		{
+			name:       "revoked without a token",
+			status:     http.StatusNoContent,
+			wantCalled: true,
+		},
+		{
+			name:        "refused",
+			status:      http.StatusUnauthorized,
+			credentials: IntegrationCredentials{AccessToken: "token"},
+			wantCalled:  true,
+			wantAuth:    "Bearer token",
+			wantErr:     true,
+		},
+		{
+			name:        "provider down",
+			status:      http.StatusBadGateway,
+			credentials: IntegrationCredentials{AccessToken: "token"},
+			wantCalled:  true,
+			wantAuth:    "Bearer token",
+			wantErr:     true,
+		},
+		{
+			name:        "no revoke url",
+			credentials: IntegrationCredentials{AccessToken: "token"},
+			noURL:       true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			called := false
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				called = true
+				if r.Method != http.MethodPost {
+					t.Errorf("method = %s; want POST", r.Method)
+				}
+				if got := r.Header.Get("Authorization"); got != test.wantAuth {
+					t.Errorf("Authorization = %q; want %q", got, test.wantAuth)
+				}
+				var body httpRevokeBody
+				if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+					t.Errorf("body: %v", err)
+				}
+				want := httpRevokeBody{CompanyID: "c1", IntegrationID: "i1", IntegrationSlug: "slack"}
+				if body != want {
+					t.Errorf("body = %+v; want %+v", body, want)
+				}
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+
+			provider := HTTPIntegrationProvider{RevokeURL: server.URL, Client: server.Client()}
+			if test.noURL {
+				provider.RevokeURL = ""
+			}
+			err := provider.Revoke("c1", integration, test.credentials)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Revoke() error = %v; want error %t", err, test.wantErr)
+			}
+			if called != test.wantCalled {
+				t.Errorf("endpoint called = %t; want %t", called, test.wantCalled)
+			}
+		})
+	}
+}
+
+func TestHTTPIntegrationProviderUnreachable(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	server.Close()
+
+	provider := HTTPIntegrationProvider{RevokeURL: server.URL}
+	if err := provider.Revoke("c1", models.Integration{IntegrationSlug: "slack"}, IntegrationCredentials{}); err == nil {
+		t.Error("Revoke() of an unreachable endpoint returned no error")
+	}
+}
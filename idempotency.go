@@ -0,0 +1,352 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"grooper/app"
+	"grooper/app/constants"
+	"grooper/app/utils"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/revel/revel"
+)
+
+const (
+	IDEMPOTENCY_KEY_HEADER         = "Idempotency-Key"
+	IDEMPOTENCY_MAX_KEY_LENGTH     = 255
+	IDEMPOTENCY_DEFAULT_WINDOW     = "24h"
+	PREFIX_IDEMPOTENCY             = "IDEMPOTENCY#"
+	ENTITY_TYPE_IDEMPOTENCY_RESULT = "IDEMPOTENCY_RESULT"
+	IDEMPOTENCY_ACTION_ACCEPT      = "ACCEPT_REQUEST"
+	IDEMPOTENCY_ACTION_REJECT      = "REJECT_REQUEST"
+	IDEMPOTENCY_STATUS_IN_FLIGHT   = "IN_FLIGHT"
+	IDEMPOTENCY_STATUS_DONE        = "DONE"
+	// IDEMPOTENCY_IN_FLIGHT_LEASE is how long a call holds its key before a
+	// retry may take it over, in case the call died before finishing
+	IDEMPOTENCY_IN_FLIGHT_LEASE = 2 * time.Minute
+)
+
+var ErrIdempotencyKeyTaken = errors.New("idempotency key is held by another call")
+
+// IdempotencyResult is the stored response of the first call made with an
+// Idempotency-Key. The key belongs to the user who made the call and to its
+// payload. While the call runs the item only marks the key as in flight.
+// ExpiresAt is the table's TTL attribute.
+type IdempotencyResult struct {
+	PK             string `json:"PK,omitempty"`
+	SK             string `json:"SK,omitempty"`
+	CompanyID      string `json:"CompanyID,omitempty"`
+	IdempotencyKey string `json:"IdempotencyKey,omitempty"`
+	Action         string `json:"Action,omitempty"`
+	UserID         string `json:"UserID,omitempty"`
+	PayloadHash    string `json:"PayloadHash,omitempty"`
+	Status         string `json:"Status,omitempty"`
+	StatusCode     int    `json:"StatusCode,omitempty"`
+	Response       string `json:"Response,omitempty"`
+	CreatedAt      string `json:"CreatedAt,omitempty"`
+	ExpiresAt      int64  `json:"ExpiresAt,omitempty"`
+	Type           string `json:"Type,omitempty"`
+}
+
+// idempotentCall is a call holding its Idempotency-Key. The zero value is a
+// call made without a key, for which Complete and Release do nothing.
+type idempotentCall struct {
+	CompanyID   string
+	Action      string
+	UserID      string
+	Key         string
+	PayloadHash string
+	CreatedAt   string
+}
+
+/*
+****************
+idempotencyWindow()
+- How long a stored result is replayed, from request.idempotency.window
+****************
+*/
+func idempotencyWindow() time.Duration {
+	window, err := time.ParseDuration(revel.Config.StringDefault("request.idempotency.window", IDEMPOTENCY_DEFAULT_WINDOW))
+	if err != nil || window <= 0 {
+		window, _ = time.ParseDuration(IDEMPOTENCY_DEFAULT_WINDOW)
+	}
+	return window
+}
+
+// idempotencyKeyAttributes scopes the key to the user, so two users can
+// never replay each other's results.
+func idempotencyKeyAttributes(companyID, action, userID, key string) map[string]*dynamodb.AttributeValue {
+	return map[string]*dynamodb.AttributeValue{
+		"PK": {
+			S: aws.String(utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
+		},
+		"SK": {
+			S: aws.String(utils.AppendPrefix(utils.AppendPrefix(utils.AppendPrefix(PREFIX_IDEMPOTENCY, action), userID), key)),
+		},
+	}
+}
+
+// idempotencyPayloadHash fingerprints what a call asked for, so a key
+// reused with another payload is refused rather than replayed.
+func idempotencyPayloadHash(payload interface{}) (string, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(body)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+/*
+****************
+GetIdempotentResult()
+- Returns the stored result or in-flight marker for the key if it is still
+inside its window
+****************
+*/
+func GetIdempotentResult(companyID, action, userID, key string) (IdempotencyResult, bool, error) {
+	var result IdempotencyResult
+
+	res, err := app.SVC.GetItem(&dynamodb.GetItemInput{
+		TableName:      aws.String(app.TABLE_NAME),
+		Key:            idempotencyKeyAttributes(companyID, action, userID, key),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return result, false, errors.New(constants.HTTP_STATUS_500)
+	}
+
+	if res.Item == nil {
+		return result, false, nil
+	}
+
+	err = dynamodbattribute.UnmarshalMap(res.Item, &result)
+	if err != nil {
+		return result, false, errors.New(constants.HTTP_STATUS_400)
+	}
+
+	// TTL deletion can lag behind, so expiry is checked here as well
+	if result.ExpiresAt <= time.Now().Unix() {
+		return result, false, nil
+	}
+
+	return result, true, nil
+}
+
+/*
+****************
+claimIdempotencyKey()
+- Marks the key as in flight for the call. Fails with
+ErrIdempotencyKeyTaken while another call holds the key or its result is
+still stored.
+****************
+*/
+func claimIdempotencyKey(call idempotentCall) error {
+	now := time.Now()
+	keyAttributes := idempotencyKeyAttributes(call.CompanyID, call.Action, call.UserID, call.Key)
+	marker := IdempotencyResult{
+		PK:             *keyAttributes["PK"].S,
+		SK:             *keyAttributes["SK"].S,
+		CompanyID:      call.CompanyID,
+		IdempotencyKey: call.Key,
+		Action:         call.Action,
+		UserID:         call.UserID,
+		PayloadHash:    call.PayloadHash,
+		Status:         IDEMPOTENCY_STATUS_IN_FLIGHT,
+		CreatedAt:      call.CreatedAt,
+		ExpiresAt:      now.Add(IDEMPOTENCY_IN_FLIGHT_LEASE).Unix(),
+		Type:           ENTITY_TYPE_IDEMPOTENCY_RESULT,
+	}
+
+	av, err := dynamodbattribute.MarshalMap(marker)
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	_, err = app.SVC.PutItem(&dynamodb.PutItemInput{
+		Item:                av,
+		TableName:           aws.String(app.TABLE_NAME),
+		ConditionExpression: aws.String("attribute_not_exists(PK) OR ExpiresAt <= :now"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":now": {
+				N: aws.String(strconv.FormatInt(now.Unix(), 10)),
+			},
+		},
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return ErrIdempotencyKeyTaken
+		}
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	return nil
+}
+
+/*
+****************
+Complete()
+- Stores the response of the call in place of its in-flight marker, to be
+replayed for the rest of the window
+****************
+*/
+func (call idempotentCall) Complete(statusCode int, response interface{}) error {
+	if call.Key == "" {
+		return nil
+	}
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	_, err = app.SVC.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(app.TABLE_NAME),
+		Key:       idempotencyKeyAttributes(call.CompanyID, call.Action, call.UserID, call.Key),
+		ExpressionAttributeNames: map[string]*string{
+			"#s": aws.String("Status"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":inFlight": {
+				S: aws.String(IDEMPOTENCY_STATUS_IN_FLIGHT),
+			},
+			":ca": {
+				S: aws.String(call.CreatedAt),
+			},
+			":done": {
+				S: aws.String(IDEMPOTENCY_STATUS_DONE),
+			},
+			":sc": {
+				N: aws.String(strconv.Itoa(statusCode)),
+			},
+			":r": {
+				S: aws.String(string(body)),
+			},
+			":e": {
+				N: aws.String(strconv.FormatInt(time.Now().Add(idempotencyWindow()).Unix(), 10)),
+			},
+		},
+		ConditionExpression: aws.String("#s = :inFlight AND CreatedAt = :ca"),
+		UpdateExpression:    aws.String("SET #s = :done, StatusCode = :sc, Response = :r, ExpiresAt = :e"),
+	})
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	return nil
+}
+
+/*
+****************
+Release()
+- Removes the in-flight marker of a call that failed, so a retry with the
+same key runs again
+****************
+*/
+func (call idempotentCall) Release() error {
+	if call.Key == "" {
+		return nil
+	}
+
+	_, err := app.SVC.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(app.TABLE_NAME),
+		Key:       idempotencyKeyAttributes(call.CompanyID, call.Action, call.UserID, call.Key),
+		ExpressionAttributeNames: map[string]*string{
+			"#s": aws.String("Status"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":inFlight": {
+				S: aws.String(IDEMPOTENCY_STATUS_IN_FLIGHT),
+			},
+			":ca": {
+				S: aws.String(call.CreatedAt),
+			},
+		},
+		ConditionExpression: aws.String("#s = :inFlight AND CreatedAt = :ca"),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return nil
+		}
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	return nil
+}
+
+/*
+****************
+beginIdempotentCall()
+- Takes the Idempotency-Key of the call for the user and payload. The call
+runs when the key is new; otherwise the stored result is replayed, a key
+still in flight answers 409 and a key used with another payload 422. The
+returned call must be completed or released once the action is done.
+****************
+*/
+func beginIdempotentCall(c *revel.Controller, companyID, action string, payload interface{}) (idempotentCall, revel.Result) {
+	key := c.Request.Header.Get(IDEMPOTENCY_KEY_HEADER)
+	if key == "" {
+		return idempotentCall{}, nil
+	}
+
+	if len(key) > IDEMPOTENCY_MAX_KEY_LENGTH {
+		c.Response.Status = 422
+		return idempotentCall{}, c.RenderJSON(map[string]interface{}{
+			"error":  "Idempotency-Key must not be longer than " + strconv.Itoa(IDEMPOTENCY_MAX_KEY_LENGTH) + " characters",
+			"status": utils.GetHTTPStatus(constants.HTTP_STATUS_422),
+		})
+	}
+
+	payloadHash, err := idempotencyPayloadHash(payload)
+	if err != nil {
+		return idempotentCall{}, renderRequestError(c, NewRequestError(500, "Unable to read the call"))
+	}
+	call := idempotentCall{
+		CompanyID:   companyID,
+		Action:      action,
+		UserID:      c.ViewArgs["userID"].(string),
+		Key:         key,
+		PayloadHash: payloadHash,
+		CreatedAt:   utils.GetCurrentTimestamp(),
+	}
+
+	// the stored item can expire between the claim and the read, so the
+	// claim is tried once more
+	for attempt := 0; attempt < 2; attempt++ {
+		err := claimIdempotencyKey(call)
+		if err == nil {
+			return call, nil
+		}
+		if err != ErrIdempotencyKeyTaken {
+			return idempotentCall{}, renderRequestError(c, NewRequestError(500, "Unable to check the Idempotency-Key"))
+		}
+
+		stored, found, err := GetIdempotentResult(companyID, action, call.UserID, key)
+		if err != nil {
+			return idempotentCall{}, renderRequestError(c, NewRequestError(500, "Unable to check the Idempotency-Key"))
+		}
+		if !found {
+			continue
+		}
+		if stored.PayloadHash != payloadHash {
+			return idempotentCall{}, renderRequestError(c, NewRequestError(422, "Idempotency-Key was already used with another payload"))
+		}
+		if stored.Status == IDEMPOTENCY_STATUS_IN_FLIGHT {
+			c.Response.Out.Header().Set("Retry-After", strconv.Itoa(int(time.Until(time.Unix(stored.ExpiresAt, 0))/time.Second)+1))
+			return idempotentCall{}, renderRequestError(c, NewRequestError(409, "A call with this Idempotency-Key is still in progress"))
+		}
+
+		c.Response.Out.Header().Set("Idempotent-Replayed", "true")
+		c.Response.Status = stored.StatusCode
+		return idempotentCall{}, c.RenderJSON(json.RawMessage(stored.Response))
+	}
+
+	return idempotentCall{}, renderRequestError(c, NewRequestError(409, "A call with this Idempotency-Key is still in progress"))
+}
@@ -0,0 +1,28 @@
+package controllers
+
+import "testing"
+
+func TestIdempotencyPayloadHash(t *testing.T) {
+	hash := func(payload interface{}) string {
+		h, err := idempotencyPayloadHash(payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return h
+	}
+
+	decision := RequestDecision{NotificationID: "n1", RequestType: "ROLE", UserIDs: []string{"u1"}}
+	same := RequestDecision{NotificationID: "n1", RequestType: "ROLE", UserIDs: []string{"u1"}}
+	otherUser := RequestDecision{NotificationID: "n1", RequestType: "ROLE", UserIDs: []string{"u2"}}
+	otherReason := RequestDecision{NotificationID: "n1", RequestType: "ROLE", UserIDs: []string{"u1"}, Reason: "no"}
+
+	if hash(decision) != hash(same) {
+		t.Error("the same payload hashed differently")
+	}
+	if hash(decision) == hash(otherUser) {
+		t.Error("payloads for other users hashed the same")
+	}
+	if hash(decision) == hash(otherReason) {
+		t.Error("payloads with other reasons hashed the same")
+	}
+}
@@ -0,0 +1,680 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"grooper/app"
+	"grooper/app/constants"
+	"grooper/app/models"
+	ops "grooper/app/operations"
+	"grooper/app/utils"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/revel/revel"
+)
+
+const (
+	PREFIX_INTEGRATION_ARCHIVE        = "INTEGRATION_ARCHIVE#"
+	PREFIX_ARCHIVED_ITEM              = "ARCHIVED_ITEM#"
+	ENTITY_TYPE_INTEGRATION_ARCHIVE   = "INTEGRATION_ARCHIVE"
+	ENTITY_TYPE_ARCHIVED_ITEM         = "ARCHIVED_ITEM"
+	ARCHIVE_STATUS_ARCHIVED           = "ARCHIVED"
+	ARCHIVE_STATUS_RESTORING          = "RESTORING"
+	ARCHIVE_STATUS_RESTORED           = "RESTORED"
+	DEFAULT_INTEGRATION_ARCHIVE_TTL   = "720h"
+	INTEGRATION_ARCHIVE_RETENTION_KEY = "integration.archive.retention"
+	// a restore interrupted half way can be taken over after this long
+	INTEGRATION_ARCHIVE_RESTORE_LEASE = 5 * time.Minute
+)
+
+var ErrArchiveUnavailable = errors.New("integration archive is restored or expired")
+var ErrIntegrationReconnected = errors.New("integration is connected again")
+
+// IntegrationArchive is the record of a disconnected integration. The items
+// the disconnect deleted are kept under the archive until ExpiresAt, which is
+// the table's TTL attribute, and can be put back with
+// RestoreIntegrationArchive.
+type IntegrationArchive struct {
+	PK              string `json:"PK,omitempty"`
+	SK              string `json:"SK,omitempty"`
+	ArchiveID       string `json:"ArchiveID,omitempty"`
+	CompanyID       string `json:"CompanyID,omitempty"`
+	IntegrationID   string `json:"IntegrationID,omitempty"`
+	IntegrationSlug string `json:"IntegrationSlug,omitempty"`
+	IntegrationName string `json:"IntegrationName,omitempty"`
+	RequestID       string `json:"RequestID,omitempty"`
+	ArchivedBy      string `json:"ArchivedBy,omitempty"`
+	RestoredBy      string `json:"RestoredBy,omitempty"`
+	Status          string `json:"Status,omitempty"`
+	ItemCount       int    `json:"ItemCount,omitempty"`
+	ExpiresAt       int64  `json:"ExpiresAt,omitempty"`
+	CreatedAt       string `json:"CreatedAt,omitempty"`
+	RestoredAt      string `json:"RestoredAt,omitempty"`
+	// RestoringUntil is the end of the lease of a restore in progress
+	RestoringUntil int64  `json:"RestoringUntil,omitempty"`
+	Type           string `json:"Type,omitempty"`
+}
+
+// archivedItem is one item deleted by the disconnect, as it was stored.
+type archivedItem struct {
+	Kind string
+	Item map[string]*dynamodb.AttributeValue
+}
+
+// integrationArchiveRetention is how long a disconnect can be restored.
+func integrationArchiveRetention() time.Duration {
+	retention, err := time.ParseDuration(revel.Config.StringDefault(INTEGRATION_ARCHIVE_RETENTION_KEY, DEFAULT_INTEGRATION_ARCHIVE_TTL))
+	if err != nil || retention <= 0 {
+		retention, _ = time.ParseDuration(DEFAULT_INTEGRATION_ARCHIVE_TTL)
+	}
+	return retention
+}
+
+/*
+****************
+NewIntegrationArchive()
+- Builds the archive record of an integration disconnected by a request
+****************
+*/
+func NewIntegrationArchive(ctx *RequestContext, integration models.Integration, itemCount int) IntegrationArchive {
+	archiveID := utils.GenerateTimestampWithUID()
+	return IntegrationArchive{
+		PK:              utils.AppendPrefix(constants.PREFIX_COMPANY, ctx.CompanyID),
+		SK:              utils.AppendPrefix(PREFIX_INTEGRATION_ARCHIVE, archiveID),
+		ArchiveID:       archiveID,
+		CompanyID:       ctx.CompanyID,
+		IntegrationID:   integration.IntegrationID,
+		IntegrationSlug: integration.IntegrationSlug,
+		IntegrationName: integration.IntegrationName,
+		RequestID:       ctx.Request.RequestID,
+		ArchivedBy:      ctx.ApproverID,
+		Status:          ARCHIVE_STATUS_ARCHIVED,
+		ItemCount:       itemCount,
+		ExpiresAt:       time.Now().Add(integrationArchiveRetention()).Unix(),
+		CreatedAt:       utils.GetCurrentTimestamp(),
+		Type:            ENTITY_TYPE_INTEGRATION_ARCHIVE,
+	}
+}
+
+/*
+****************
+snapshotDisconnectPlan()
+- Reads every item of the plan as it is stored, so it can be archived before
+the disconnect deletes it. Items that are already gone are skipped.
+****************
+*/
+func snapshotDisconnectPlan(plan DisconnectPlan) ([]archivedItem, error) {
+	var items []archivedItem
+	for _, planItem := range plan.Items {
+		res, err := app.SVC.GetItem(&dynamodb.GetItemInput{
+			TableName: aws.String(app.TABLE_NAME),
+			Key: map[string]*dynamodb.AttributeValue{
+				"PK": {
+					S: aws.String(planItem.PK),
+				},
+				"SK": {
+					S: aws.String(planItem.SK),
+				},
+			},
+		})
+		if err != nil {
+			return items, errors.New(constants.HTTP_STATUS_500)
+		}
+		if res.Item == nil {
+			continue
+		}
+		items = append(items, archivedItem{Kind: planItem.Kind, Item: res.Item})
+	}
+	return items, nil
+}
+
+/*
+****************
+writeArchivedItems()
+- Stores the snapshot under the archive, with the archive's expiry
+****************
+*/
+func writeArchivedItems(archive IntegrationArchive, items []archivedItem) error {
+	expiresAt := strconv.FormatInt(archive.ExpiresAt, 10)
+
+	writer := NewBatchWriter()
+	for i, item := range items {
+		writer.Put(map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(utils.AppendPrefix(PREFIX_INTEGRATION_ARCHIVE, archive.ArchiveID)),
+			},
+			"SK": {
+				// zero padded so the items come back in the order they were archived
+				S: aws.String(utils.AppendPrefix(PREFIX_ARCHIVED_ITEM, fmt.Sprintf("%05d", i))),
+			},
+			"Kind": {
+				S: aws.String(item.Kind),
+			},
+			"Item": {
+				M: item.Item,
+			},
+			"ExpiresAt": {
+				N: aws.String(expiresAt),
+			},
+			"Type": {
+				S: aws.String(ENTITY_TYPE_ARCHIVED_ITEM),
+			},
+		})
+	}
+
+	_, err := writer.Flush()
+	return err
+}
+
+/*
+****************
+GetIntegrationArchiveByID()
+- Returns the archive with the given ID under the company
+****************
+*/
+func GetIntegrationArchiveByID(companyID, archiveID string) (IntegrationArchive, error) {
+	var archive IntegrationArchive
+
+	res, err := app.SVC.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
+			},
+			"SK": {
+				S: aws.String(utils.AppendPrefix(PREFIX_INTEGRATION_ARCHIVE, archiveID)),
+			},
+		},
+	})
+	if err != nil {
+		return archive, errors.New(constants.HTTP_STATUS_500)
+	}
+
+	if res.Item == nil {
+		return archive, errors.New(constants.HTTP_STATUS_404)
+	}
+
+	err = dynamodbattribute.UnmarshalMap(res.Item, &archive)
+	if err != nil {
+		return archive, errors.New(constants.HTTP_STATUS_400)
+	}
+
+	return archive, nil
+}
+
+/*
+****************
+GetCompanyIntegrationArchives()
+- Returns the archives of the company that have not expired yet
+****************
+*/
+func GetCompanyIntegrationArchives(companyID string) ([]IntegrationArchive, error) {
+	archives := []IntegrationArchive{}
+
+	params := &dynamodb.QueryInput{
+		TableName: aws.String(app.TABLE_NAME),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"PK": {
+				ComparisonOperator: aws.String(constants.CONDITION_EQUAL),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
+					},
+				},
+			},
+			"SK": {
+				ComparisonOperator: aws.String(constants.CONDITION_BEGINS_WITH),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(PREFIX_INTEGRATION_ARCHIVE),
+					},
+				},
+			},
+		},
+	}
+
+	var items []map[string]*dynamodb.AttributeValue
+	err := app.SVC.QueryPages(params, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		items = append(items, page.Items...)
+		return true
+	})
+	if err != nil {
+		return archives, errors.New(constants.HTTP_STATUS_500)
+	}
+
+	var all []IntegrationArchive
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &all)
+	if err != nil {
+		return archives, errors.New(constants.HTTP_STATUS_400)
+	}
+
+	// the TTL sweep can lag behind the expiry
+	now := time.Now().Unix()
+	for _, archive := range all {
+		if archive.ExpiresAt > now {
+			archives = append(archives, archive)
+		}
+	}
+
+	return archives, nil
+}
+
+// getArchivedItems returns the snapshot stored under the archive.
+func getArchivedItems(archiveID string) ([]archivedItem, error) {
+	params := &dynamodb.QueryInput{
+		TableName: aws.String(app.TABLE_NAME),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"PK": {
+				ComparisonOperator: aws.String(constants.CONDITION_EQUAL),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(utils.AppendPrefix(PREFIX_INTEGRATION_ARCHIVE, archiveID)),
+					},
+				},
+			},
+		},
+	}
+
+	var items []archivedItem
+	err := app.SVC.QueryPages(params, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, row := range page.Items {
+			if row["Item"] == nil || row["Item"].M == nil {
+				continue
+			}
+			item := archivedItem{Item: row["Item"].M}
+			if row["Kind"] != nil && row["Kind"].S != nil {
+				item.Kind = *row["Kind"].S
+			}
+			items = append(items, item)
+		}
+		return true
+	})
+	if err != nil {
+		return items, errors.New(constants.HTTP_STATUS_500)
+	}
+	return items, nil
+}
+
+/*
+****************
+claimIntegrationArchive()
+- Starts the restore of an archive, only if it is still archived and has not
+expired. Two restores of the same archive cannot both go through; one left
+half way can be taken over once its lease has run out.
+****************
+*/
+func claimIntegrationArchive(archive *IntegrationArchive) error {
+	now := time.Now()
+	until := now.Add(INTEGRATION_ARCHIVE_RESTORE_LEASE).Unix()
+	_, err := app.SVC.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(archive.PK),
+			},
+			"SK": {
+				S: aws.String(archive.SK),
+			},
+		},
+		UpdateExpression:    aws.String("SET #s = :restoring, RestoringUntil = :until"),
+		ConditionExpression: aws.String("(#s = :archived OR (#s = :restoring AND RestoringUntil < :now)) AND ExpiresAt > :now"),
+		ExpressionAttributeNames: map[string]*string{
+			"#s": aws.String("Status"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":restoring": {
+				S: aws.String(ARCHIVE_STATUS_RESTORING),
+			},
+			":archived": {
+				S: aws.String(ARCHIVE_STATUS_ARCHIVED),
+			},
+			":until": {
+				N: aws.String(strconv.FormatInt(until, 10)),
+			},
+			":now": {
+				N: aws.String(strconv.FormatInt(now.Unix(), 10)),
+			},
+		},
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return ErrArchiveUnavailable
+		}
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	archive.Status = ARCHIVE_STATUS_RESTORING
+	archive.RestoringUntil = until
+	return nil
+}
+
+// releaseIntegrationArchive gives back an archive whose restore failed, so
+// it can be restored again.
+func releaseIntegrationArchive(archive *IntegrationArchive) error {
+	return finishIntegrationArchiveRestore(archive, ARCHIVE_STATUS_ARCHIVED, "")
+}
+
+/*
+****************
+markIntegrationArchiveRestored()
+- Marks the archive restored once its items have all been put back
+****************
+*/
+func markIntegrationArchiveRestored(archive *IntegrationArchive, userID string) error {
+	return finishIntegrationArchiveRestore(archive, ARCHIVE_STATUS_RESTORED, userID)
+}
+
+// finishIntegrationArchiveRestore ends the restore claimed by
+// claimIntegrationArchive in the given status.
+func finishIntegrationArchiveRestore(archive *IntegrationArchive, status, userID string) error {
+	currentTime := utils.GetCurrentTimestamp()
+	update := "SET #s = :to REMOVE RestoringUntil"
+	values := map[string]*dynamodb.AttributeValue{
+		":to": {
+			S: aws.String(status),
+		},
+		":restoring": {
+			S: aws.String(ARCHIVE_STATUS_RESTORING),
+		},
+		":until": {
+			N: aws.String(strconv.FormatInt(archive.RestoringUntil, 10)),
+		},
+	}
+	if userID != "" {
+		update = "SET #s = :to, RestoredBy = :by, RestoredAt = :at REMOVE RestoringUntil"
+		values[":by"] = &dynamodb.AttributeValue{
+			S: aws.String(userID),
+		}
+		values[":at"] = &dynamodb.AttributeValue{
+			S: aws.String(currentTime),
+		}
+	}
+
+	_, err := app.SVC.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(archive.PK),
+			},
+			"SK": {
+				S: aws.String(archive.SK),
+			},
+		},
+		UpdateExpression: aws.String(update),
+		// only the restore holding the lease may end it
+		ConditionExpression: aws.String("#s = :restoring AND RestoringUntil = :until"),
+		ExpressionAttributeNames: map[string]*string{
+			"#s": aws.String("Status"),
+		},
+		ExpressionAttributeValues: values,
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return ErrArchiveUnavailable
+		}
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	archive.Status = status
+	archive.RestoringUntil = 0
+	if userID != "" {
+		archive.RestoredBy = userID
+		archive.RestoredAt = currentTime
+	}
+	return nil
+}
+
+// isCompanyIntegrationConnected reports whether the company integration row
+// exists.
+func isCompanyIntegrationConnected(companyID, integrationID string) (bool, error) {
+	res, err := app.SVC.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
+			},
+			"SK": {
+				S: aws.String(utils.AppendPrefix(constants.PREFIX_INTEGRATION, integrationID)),
+			},
+		},
+	})
+	if err != nil {
+		return false, errors.New(constants.HTTP_STATUS_500)
+	}
+	return res.Item != nil, nil
+}
+
+// putCompanyIntegration puts back the company integration row, only if the
+// integration has not been connected again since it was checked.
+func putCompanyIntegration(item map[string]*dynamodb.AttributeValue) error {
+	_, err := app.SVC.PutItem(&dynamodb.PutItemInput{
+		Item:                item,
+		TableName:           aws.String(app.TABLE_NAME),
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return ErrIntegrationReconnected
+		}
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+	return nil
+}
+
+// deleteCompanyIntegration takes back the company integration row put by a
+// restore that could not be finished.
+func deleteCompanyIntegration(item map[string]*dynamodb.AttributeValue) error {
+	_, err := app.SVC.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": item["PK"],
+			"SK": item["SK"],
+		},
+	})
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+	return nil
+}
+
+/*
+****************
+GetIntegrationArchives()
+- Returns the disconnects of the company that can still be restored
+****************
+*/
+func (c IntegrationConnectionController) GetIntegrationArchives() revel.Result {
+	companyID := c.ViewArgs["companyID"].(string)
+	data := make(map[string]interface{})
+
+	archives, err := GetCompanyIntegrationArchives(companyID)
+	if err != nil {
+		data["status"] = utils.GetHTTPStatus(err.Error())
+		return c.RenderJSON(data)
+	}
+
+	data["archives"] = archives
+	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+	return c.RenderJSON(data)
+}
+
+/*
+****************
+RestoreIntegrationArchive()
+- Puts back the items deleted by a disconnect, within the retention window.
+Providers whose tokens were revoked are not given their old company
+integration record back, a connection is started instead and the admin
+authorizes the provider again.
+Params:
+archive_id - required
+****************
+*/
+func (c IntegrationConnectionController) RestoreIntegrationArchive() revel.Result {
+	companyID := c.ViewArgs["companyID"].(string)
+	userID := c.ViewArgs["userID"].(string)
+	archiveID := c.Params.Get("archive_id")
+	data := make(map[string]interface{})
+
+	isAdmin, err := isCompanyAdmin(companyID, userID)
+	if err != nil || !isAdmin {
+		c.Response.Status = 403
+		return c.RenderJSON(models.ErrorResponse{
+			Code:           "403",
+			HTTPStatusCode: 403,
+			Message:        "Only company admins can restore integrations",
+		})
+	}
+
+	if archiveID == "" {
+		c.Response.Status = 400
+		return c.RenderJSON(models.ErrorResponse{
+			Code:           "400",
+			HTTPStatusCode: 400,
+			Message:        "Missing required parameter - archive_id",
+		})
+	}
+
+	archive, err := GetIntegrationArchiveByID(companyID, archiveID)
+	if err != nil {
+		c.Response.Status = 404
+		return c.RenderJSON(models.ErrorResponse{
+			Code:    "404",
+			Message: "Unable to retrieve integration archive",
+		})
+	}
+	if archive.Status == ARCHIVE_STATUS_RESTORED || archive.ExpiresAt <= time.Now().Unix() {
+		return renderArchiveUnavailable(c.Controller)
+	}
+
+	connected, err := isCompanyIntegrationConnected(companyID, archive.IntegrationID)
+	if err != nil {
+		data["status"] = utils.GetHTTPStatus(err.Error())
+		return c.RenderJSON(data)
+	}
+	if connected {
+		return renderIntegrationReconnected(c.Controller, archive)
+	}
+
+	items, err := getArchivedItems(archive.ArchiveID)
+	if err != nil {
+		data["status"] = utils.GetHTTPStatus(err.Error())
+		return c.RenderJSON(data)
+	}
+
+	if err := claimIntegrationArchive(&archive); err != nil {
+		if err == ErrArchiveUnavailable {
+			return renderArchiveUnavailable(c.Controller)
+		}
+		data["status"] = utils.GetHTTPStatus(err.Error())
+		return c.RenderJSON(data)
+	}
+
+	reauthorize := GetIntegrationProvider(archive.IntegrationSlug).ReauthorizesOnRestore()
+
+	// the company integration row goes back first and only if the
+	// integration was not connected again after the check above
+	var companyIntegration map[string]*dynamodb.AttributeValue
+	writer := NewBatchWriter()
+	for _, item := range items {
+		if item.Kind == DISCONNECT_ITEM_COMPANY_INTEGRATION {
+			if !reauthorize {
+				companyIntegration = item.Item
+			}
+			continue
+		}
+		writer.Put(item.Item)
+	}
+	if companyIntegration != nil {
+		if err := putCompanyIntegration(companyIntegration); err != nil {
+			if err := releaseIntegrationArchive(&archive); err != nil {
+				revel.AppLog.Error("RestoreIntegrationArchive: unable to release archive "+archive.ArchiveID, err)
+			}
+			if err == ErrIntegrationReconnected {
+				return renderIntegrationReconnected(c.Controller, archive)
+			}
+			data["status"] = utils.GetHTTPStatus(err.Error())
+			return c.RenderJSON(data)
+		}
+	}
+	if result, err := writer.Flush(); err != nil {
+		// the items put back are put again by the next attempt, which
+		// puts the company integration row back again as well
+		if companyIntegration != nil {
+			if err := deleteCompanyIntegration(companyIntegration); err != nil {
+				revel.AppLog.Error("RestoreIntegrationArchive: unable to remove company integration of archive "+archive.ArchiveID, err)
+			}
+		}
+		if err := releaseIntegrationArchive(&archive); err != nil {
+			revel.AppLog.Error("RestoreIntegrationArchive: unable to release archive "+archive.ArchiveID, err)
+		}
+		c.Response.Status = 500
+		data["failures"] = result.Failures
+		data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_500)
+		return c.RenderJSON(data)
+	}
+	if err := markIntegrationArchiveRestored(&archive, userID); err != nil {
+		if err == ErrArchiveUnavailable {
+			return renderArchiveUnavailable(c.Controller)
+		}
+		data["status"] = utils.GetHTTPStatus(err.Error())
+		return c.RenderJSON(data)
+	}
+
+	if reauthorize {
+		integration, err := ops.GetIntegrationByID(archive.IntegrationID)
+		if err != nil {
+			c.Response.Status = 404
+			return c.RenderJSON(models.ErrorResponse{
+				Code:    "404",
+				Message: "Unable to retrieve Integrations",
+			})
+		}
+		connection, err := NewIntegrationConnection(companyID, archive.RequestID, userID, userID, integration)
+		if err != nil {
+			data["status"] = utils.GetHTTPStatus(err.Error())
+			return c.RenderJSON(data)
+		}
+		av, err := dynamodbattribute.MarshalMap(connection)
+		if err != nil {
+			data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_500)
+			return c.RenderJSON(data)
+		}
+		_, err = app.SVC.PutItem(&dynamodb.PutItemInput{
+			Item:      av,
+			TableName: aws.String(app.TABLE_NAME),
+		})
+		if err != nil {
+			data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_500)
+			return c.RenderJSON(data)
+		}
+		// the admin continues with the provider authorization
+		data["connection"] = connection
+	}
+
+	data["archive"] = archive
+	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+	return c.RenderJSON(data)
+}
+
+func renderIntegrationReconnected(c *revel.Controller, archive IntegrationArchive) revel.Result {
+	c.Response.Status = 409
+	return c.RenderJSON(models.ErrorResponse{
+		Code:           "409",
+		HTTPStatusCode: 409,
+		Message:        archive.IntegrationName + " is connected again, the archive cannot be restored",
+	})
+}
+
+func renderArchiveUnavailable(c *revel.Controller) revel.Result {
+	c.Response.Status = 410
+	return c.RenderJSON(models.ErrorResponse{
+		Code:           "410",
+		HTTPStatusCode: 410,
+		Message:        "Integration archive has already been restored or has expired",
+	})
+}
@@ -0,0 +1,581 @@
+package controllers
+
+import (
+	"encoding/json"
+	"errors"
+	"grooper/app"
+	"grooper/app/constants"
+	"grooper/app/models"
+	ops "grooper/app/operations"
+	"grooper/app/utils"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/revel/revel"
+)
+
+const (
+	PREFIX_INTEGRATION_CONNECTION       = "INTEGRATION_CONNECTION#"
+	ENTITY_TYPE_INTEGRATION_CONNECTION  = "INTEGRATION_CONNECTION"
+	CONNECTION_STATUS_AWAITING_AUTH     = "AWAITING_AUTHORIZATION"
+	CONNECTION_STATUS_CONNECTING        = "CONNECTING"
+	CONNECTION_STATUS_CONNECTED         = "CONNECTED"
+	CONNECTION_STATUS_FAILED            = "FAILED"
+	CONNECTION_AUTHORIZATION_STATE_SIZE = 32
+)
+
+var ErrConnectionStateChanged = errors.New("integration connection is no longer in the expected state")
+
+// connectionTransitions lists the states a connection may move to from each
+// state.
+var connectionTransitions = map[string][]string{
+	CONNECTION_STATUS_AWAITING_AUTH: {
+		CONNECTION_STATUS_CONNECTING,
+		CONNECTION_STATUS_FAILED,
+	},
+	CONNECTION_STATUS_CONNECTING: {
+		CONNECTION_STATUS_CONNECTED,
+		CONNECTION_STATUS_FAILED,
+	},
+}
+
+// IntegrationConnection tracks the connection of an integration started by
+// an accepted connect request, from the provider authorization to the company
+// integration record being created.
+type IntegrationConnection struct {
+	PK                 string `json:"PK,omitempty"`
+	SK                 string `json:"SK,omitempty"`
+	ConnectionID       string `json:"ConnectionID,omitempty"`
+	CompanyID          string `json:"CompanyID,omitempty"`
+	IntegrationID      string `json:"IntegrationID,omitempty"`
+	IntegrationSlug    string `json:"IntegrationSlug,omitempty"`
+	IntegrationName    string `json:"IntegrationName,omitempty"`
+	RequestID          string `json:"RequestID,omitempty"`
+	RequesterUserID    string `json:"RequesterUserID,omitempty"`
+	ApproverID         string `json:"ApproverID,omitempty"`
+	Status             string `json:"Status,omitempty"`
+	AuthorizationState string `json:"AuthorizationState,omitempty"`
+	AuthorizationURL   string `json:"AuthorizationURL,omitempty"`
+	FailureReason      string `json:"FailureReason,omitempty"`
+	CreatedAt          string `json:"CreatedAt,omitempty"`
+	UpdatedAt          string `json:"UpdatedAt,omitempty"`
+	Type               string `json:"Type,omitempty"`
+}
+
+/*
+****************
+NewIntegrationConnection()
+- Builds a connection waiting for the approver to authorize the provider
+****************
+*/
+func NewIntegrationConnection(companyID, requestID, requesterUserID, approverID string, integration models.Integration) (IntegrationConnection, error) {
+	state, err := randomToken(CONNECTION_AUTHORIZATION_STATE_SIZE)
+	if err != nil {
+		return IntegrationConnection{}, errors.New(constants.HTTP_STATUS_500)
+	}
+	connectionID := utils.GenerateTimestampWithUID()
+	currentTime := utils.GetCurrentTimestamp()
+	connection := IntegrationConnection{
+		PK:                 utils.AppendPrefix(constants.PREFIX_COMPANY, companyID),
+		SK:                 utils.AppendPrefix(PREFIX_INTEGRATION_CONNECTION, connectionID),
+		ConnectionID:       connectionID,
+		CompanyID:          companyID,
+		IntegrationID:      integration.IntegrationID,
+		IntegrationSlug:    integration.IntegrationSlug,
+		IntegrationName:    integration.IntegrationName,
+		RequestID:          requestID,
+		RequesterUserID:    requesterUserID,
+		ApproverID:         approverID,
+		Status:             CONNECTION_STATUS_AWAITING_AUTH,
+		AuthorizationState: state,
+		CreatedAt:          currentTime,
+		UpdatedAt:          currentTime,
+		Type:               ENTITY_TYPE_INTEGRATION_CONNECTION,
+	}
+	connection.AuthorizationURL = connectionAuthorizationURL(connection)
+	return connection, nil
+}
+
+// connectionAuthorizationURL is where the approver authorizes the provider.
+// The state lets the callback be matched to the connection. Providers
+// without a configured URL are authorized from the integrations page.
+func connectionAuthorizationURL(connection IntegrationConnection) string {
+	authorizeURL := revel.Config.StringDefault("integration.authorize_url."+connection.IntegrationSlug, "")
+	if authorizeURL == "" {
+		return ""
+	}
+	parsed, err := url.Parse(authorizeURL)
+	if err != nil {
+		return ""
+	}
+	query := parsed.Query()
+	query.Set("state", connection.AuthorizationState)
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
+
+/*
+****************
+GetIntegrationConnectionByID()
+- Returns the connection with the given ID under the company
+****************
+*/
+func GetIntegrationConnectionByID(companyID, connectionID string) (IntegrationConnection, error) {
+	var connection IntegrationConnection
+
+	res, err := app.SVC.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
+			},
+			"SK": {
+				S: aws.String(utils.AppendPrefix(PREFIX_INTEGRATION_CONNECTION, connectionID)),
+			},
+		},
+	})
+	if err != nil {
+		return connection, errors.New(constants.HTTP_STATUS_500)
+	}
+
+	if res.Item == nil {
+		return connection, errors.New(constants.HTTP_STATUS_404)
+	}
+
+	err = dynamodbattribute.UnmarshalMap(res.Item, &connection)
+	if err != nil {
+		return connection, errors.New(constants.HTTP_STATUS_400)
+	}
+
+	return connection, nil
+}
+
+/*
+****************
+GetCompanyIntegrationConnections()
+- Returns the connections of the company, optionally only those in a state
+****************
+*/
+func GetCompanyIntegrationConnections(companyID, status string) ([]IntegrationConnection, error) {
+	connections := []IntegrationConnection{}
+
+	params := &dynamodb.QueryInput{
+		TableName: aws.String(app.TABLE_NAME),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"PK": {
+				ComparisonOperator: aws.String(constants.CONDITION_EQUAL),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
+					},
+				},
+			},
+			"SK": {
+				ComparisonOperator: aws.String(constants.CONDITION_BEGINS_WITH),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(PREFIX_INTEGRATION_CONNECTION),
+					},
+				},
+			},
+		},
+	}
+	if status != "" {
+		params.QueryFilter = map[string]*dynamodb.Condition{
+			"Status": {
+				ComparisonOperator: aws.String(constants.CONDITION_EQUAL),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(status),
+					},
+				},
+			},
+		}
+	}
+
+	var items []map[string]*dynamodb.AttributeValue
+	err := app.SVC.QueryPages(params, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		items = append(items, page.Items...)
+		return true
+	})
+	if err != nil {
+		return connections, errors.New(constants.HTTP_STATUS_500)
+	}
+
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &connections)
+	if err != nil {
+		return connections, errors.New(constants.HTTP_STATUS_400)
+	}
+
+	return connections, nil
+}
+
+/*
+****************
+TransitionIntegrationConnection()
+- Moves the connection to a new state, only if it is still in the state it
+was read in
+****************
+*/
+func TransitionIntegrationConnection(connection *IntegrationConnection, status, failureReason string) error {
+	allowed := false
+	for _, next := range connectionTransitions[connection.Status] {
+		if next == status {
+			allowed = true
+		}
+	}
+	if !allowed {
+		return ErrConnectionStateChanged
+	}
+
+	currentTime := utils.GetCurrentTimestamp()
+	values := map[string]*dynamodb.AttributeValue{
+		":from": {
+			S: aws.String(connection.Status),
+		},
+		":to": {
+			S: aws.String(status),
+		},
+		":ua": {
+			S: aws.String(currentTime),
+		},
+	}
+	update := "SET #s = :to, UpdatedAt = :ua"
+	if failureReason != "" {
+		values[":fr"] = &dynamodb.AttributeValue{
+			S: aws.String(failureReason),
+		}
+		update += ", FailureReason = :fr"
+	}
+
+	_, err := app.SVC.UpdateItem(&dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: values,
+		ExpressionAttributeNames: map[string]*string{
+			"#s": aws.String("Status"),
+		},
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(connection.PK),
+			},
+			"SK": {
+				S: aws.String(connection.SK),
+			},
+		},
+		ConditionExpression: aws.String("#s = :from"),
+		UpdateExpression:    aws.String(update),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return ErrConnectionStateChanged
+		}
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	connection.Status = status
+	connection.UpdatedAt = currentTime
+	if failureReason != "" {
+		connection.FailureReason = failureReason
+	}
+	return nil
+}
+
+/*
+****************
+createCompanyIntegration()
+- Stores the company integration record of a connection. Fails if the
+integration is already connected.
+****************
+*/
+func createCompanyIntegration(connection IntegrationConnection, token models.IntegrationToken) error {
+	currentTime := utils.GetCurrentTimestamp()
+	companyIntegration := models.CompanyIntegration{
+		PK:               utils.AppendPrefix(constants.PREFIX_COMPANY, connection.CompanyID),
+		SK:               utils.AppendPrefix(constants.PREFIX_INTEGRATION, connection.IntegrationID),
+		CompanyID:        connection.CompanyID,
+		IntegrationID:    connection.IntegrationID,
+		IntegrationName:  connection.IntegrationName,
+		IntegrationSlug:  connection.IntegrationSlug,
+		IntegrationToken: &token,
+		CreatedAt:        currentTime,
+		UpdatedAt:        currentTime,
+		Type:             constants.ENTITY_TYPE_COMPANY_INTEGRATION,
+	}
+
+	av, err := dynamodbattribute.MarshalMap(companyIntegration)
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	_, err = app.SVC.PutItem(&dynamodb.PutItemInput{
+		Item:                av,
+		TableName:           aws.String(app.TABLE_NAME),
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return errors.New("integration is already connected")
+		}
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	return nil
+}
+
+/*
+****************
+exchangeAuthorizationCode()
+- Trades the code the provider sent the approver back with for the tokens
+of the integration. The exchange is made from here with the client secret,
+so no token handed in by a client is ever stored.
+****************
+*/
+func exchangeAuthorizationCode(connection IntegrationConnection, code string) (models.IntegrationToken, error) {
+	var token models.IntegrationToken
+
+	slug := connection.IntegrationSlug
+	tokenURL := revel.Config.StringDefault("integration.token_url."+slug, "")
+	clientID := revel.Config.StringDefault("integration.client_id."+slug, "")
+	clientSecret := revel.Config.StringDefault("integration.client_secret."+slug, "")
+	if tokenURL == "" || clientID == "" || clientSecret == "" {
+		return token, errors.New("the authorization of " + connection.IntegrationName + " is not configured")
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("client_id", clientID)
+	form.Set("client_secret", clientSecret)
+	if redirectURL := revel.Config.StringDefault("integration.redirect_url."+slug, ""); redirectURL != "" {
+		form.Set("redirect_uri", redirectURL)
+	}
+
+	client := &http.Client{Timeout: HTTP_PROVIDER_TIMEOUT}
+	res, err := client.PostForm(tokenURL, form)
+	if err != nil {
+		return token, errors.New("unable to reach " + connection.IntegrationName)
+	}
+	defer res.Body.Close()
+
+	var body struct {
+		AccessToken  string `json:"access_token"`
+		RefreshToken string `json:"refresh_token"`
+		Error        string `json:"error"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil || res.StatusCode != http.StatusOK {
+		return token, errors.New(connection.IntegrationName + " answered with status " + strconv.Itoa(res.StatusCode))
+	}
+	// some providers answer 200 with an error
+	if body.Error != "" || body.AccessToken == "" {
+		return token, errors.New(connection.IntegrationName + " refused the authorization: " + body.Error)
+	}
+
+	token.AccessToken = body.AccessToken
+	token.RefreshToken = body.RefreshToken
+	return token, nil
+}
+
+/*
+****************
+notifyConnectionOutcome()
+- Tells the requester whether the integration they asked for got connected
+****************
+*/
+func notifyConnectionOutcome(c *revel.Controller, connection IntegrationConnection) error {
+	content := models.NotificationContentType{
+		RequesterUserID:       connection.RequesterUserID,
+		ActiveCompany:         connection.CompanyID,
+		RequestedIntegrations: []string{connection.IntegrationID},
+		Integration: models.NotificationIntegration{
+			IntegrationID:   connection.IntegrationID,
+			IntegrationSlug: connection.IntegrationSlug,
+			IntegrationName: connection.IntegrationName,
+		},
+	}
+	template := NewNotificationTemplate(MESSAGE_CONNECTION_FAILED, connection.IntegrationName)
+	content.IsAccepted = CONNECTION_STATUS_FAILED
+	if connection.Status == CONNECTION_STATUS_CONNECTED {
+		template = NewNotificationTemplate(MESSAGE_CONNECTION_CONNECTED, connection.IntegrationName)
+		content.IsAccepted = NOTIFICATION_REQUEST_ACCEPTED
+	}
+	content.Message = template.Render(userMessageLocale(connection.RequesterUserID))
+
+	createdNotification, err := ops.CreateNotification(ops.CreateNotificationInput{
+		UserID:              connection.RequesterUserID,
+		NotificationType:    constants.REQUEST_STATUS_UPDATE,
+		NotificationContent: content,
+		Global:              false,
+	}, c)
+	if err != nil {
+		return errors.New("Unable to create notification for " + connection.RequesterUserID)
+	}
+	return SetNotificationTemplate(createdNotification, &template)
+}
+
+type IntegrationConnectionController struct {
+	*revel.Controller
+}
+
+/*
+****************
+GetIntegrationConnections()
+- Returns the integration connections of the company to its admins, without
+what completes them
+Params:
+status - optional
+****************
+*/
+func (c IntegrationConnectionController) GetIntegrationConnections() revel.Result {
+	companyID := c.ViewArgs["companyID"].(string)
+	userID := c.ViewArgs["userID"].(string)
+	status := c.Params.Get("status")
+	data := make(map[string]interface{})
+
+	isAdmin, err := isCompanyAdmin(companyID, userID)
+	if err != nil || !isAdmin {
+		c.Response.Status = 403
+		return c.RenderJSON(models.ErrorResponse{
+			Code:           "403",
+			HTTPStatusCode: 403,
+			Message:        "Only company admins can view integration connections",
+		})
+	}
+
+	connections, err := GetCompanyIntegrationConnections(companyID, status)
+	if err != nil {
+		data["status"] = utils.GetHTTPStatus(err.Error())
+		return c.RenderJSON(data)
+	}
+
+	// the authorization is for the approver only, it completes the connection
+	for i := range connections {
+		connections[i].AuthorizationState = ""
+		connections[i].AuthorizationURL = ""
+	}
+	data["connections"] = connections
+	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+	return c.RenderJSON(data)
+}
+
+// CompleteConnectionParams is the body of CompleteIntegrationConnection.
+type CompleteConnectionParams struct {
+	ConnectionID string `json:"connection_id,omitempty"`
+	State        string `json:"state,omitempty"`
+	Code         string `json:"code,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+/*
+****************
+CompleteIntegrationConnection()
+- Finishes a connection once the approver has been through the provider
+authorization. The code the provider sent back is exchanged for the tokens,
+the company integration record is created and the requester is told the
+outcome. An error from the provider fails the connection.
+Body:
+connection_id - required
+state - required
+code - required unless error is set
+error - optional
+****************
+*/
+func (c IntegrationConnectionController) CompleteIntegrationConnection() revel.Result {
+	companyID := c.ViewArgs["companyID"].(string)
+	userID := c.ViewArgs["userID"].(string)
+	data := make(map[string]interface{})
+
+	var input CompleteConnectionParams
+	c.Params.BindJSON(&input)
+
+	if utils.FindEmptyStringElement([]string{input.ConnectionID, input.State}) {
+		c.Response.Status = 400
+		return c.RenderJSON(models.ErrorResponse{
+			Code:           "400",
+			HTTPStatusCode: 400,
+			Message:        "Missing required parameter - connection_id, state",
+		})
+	}
+
+	connection, err := GetIntegrationConnectionByID(companyID, input.ConnectionID)
+	if err != nil {
+		c.Response.Status = 404
+		return c.RenderJSON(models.ErrorResponse{
+			Code:    "404",
+			Message: "Unable to retrieve integration connection",
+		})
+	}
+	if connection.ApproverID != userID || connection.AuthorizationState != input.State {
+		c.Response.Status = 403
+		return c.RenderJSON(models.ErrorResponse{
+			Code:           "403",
+			HTTPStatusCode: 403,
+			Message:        "Authorization does not match the integration connection",
+		})
+	}
+
+	if input.Error != "" {
+		if err := TransitionIntegrationConnection(&connection, CONNECTION_STATUS_FAILED, input.Error); err != nil {
+			return renderConnectionTransitionError(c.Controller, connection, err)
+		}
+		notifyConnectionOutcome(c.Controller, connection)
+		data["connection"] = connection
+		data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+		return c.RenderJSON(data)
+	}
+	if input.Code == "" {
+		c.Response.Status = 400
+		return c.RenderJSON(models.ErrorResponse{
+			Code:           "400",
+			HTTPStatusCode: 400,
+			Message:        "Missing required parameter - code",
+		})
+	}
+
+	if err := TransitionIntegrationConnection(&connection, CONNECTION_STATUS_CONNECTING, ""); err != nil {
+		return renderConnectionTransitionError(c.Controller, connection, err)
+	}
+
+	token, err := exchangeAuthorizationCode(connection, input.Code)
+	if err == nil {
+		err = createCompanyIntegration(connection, token)
+	}
+	if err != nil {
+		err = TransitionIntegrationConnection(&connection, CONNECTION_STATUS_FAILED, err.Error())
+	} else {
+		err = TransitionIntegrationConnection(&connection, CONNECTION_STATUS_CONNECTED, "")
+	}
+	if err != nil {
+		return renderConnectionTransitionError(c.Controller, connection, err)
+	}
+	if err := notifyConnectionOutcome(c.Controller, connection); err != nil {
+		data["notifications"] = "error while notifying the requester"
+	}
+
+	data["connection"] = connection
+	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+	return c.RenderJSON(data)
+}
+
+// renderConnectionTransitionError answers 409 when the connection was moved
+// by someone else and 500 when the transition could not be stored.
+func renderConnectionTransitionError(c *revel.Controller, connection IntegrationConnection, err error) revel.Result {
+	if err != ErrConnectionStateChanged {
+		c.Response.Status = 500
+		return c.RenderJSON(models.ErrorResponse{
+			Code:           "500",
+			HTTPStatusCode: 500,
+			Message:        "Unable to update the integration connection",
+		})
+	}
+	c.Response.Status = 409
+	return c.RenderJSON(models.ErrorResponse{
+		Code:           "409",
+		HTTPStatusCode: 409,
+		Message:        "Integration connection is already " + connection.Status,
+	})
+}
@@ -0,0 +1,188 @@
+package controllers
+
+import (
+	"grooper/app/constants"
+	"grooper/app/models"
+	ops "grooper/app/operations"
+	"grooper/app/utils"
+
+	"github.com/revel/revel"
+)
+
+const (
+	DISCONNECT_ITEM_COMPANY_INTEGRATION = "COMPANY_INTEGRATION"
+	DISCONNECT_ITEM_GROUP_INTEGRATION   = "GROUP_INTEGRATION"
+	DISCONNECT_ITEM_GROUP_SUB           = "GROUP_SUB_INTEGRATION"
+	DISCONNECT_ITEM_OAUTH               = "OAUTH"
+)
+
+// DisconnectItem is one item a disconnect deletes.
+type DisconnectItem struct {
+	PK      string `json:"pk"`
+	SK      string `json:"sk"`
+	Kind    string `json:"kind"`
+	GroupID string `json:"group_id,omitempty"`
+	ItemID  string `json:"item_id,omitempty"`
+}
+
+// DisconnectPlan lists everything disconnecting an integration deletes.
+type DisconnectPlan struct {
+	IntegrationID     string           `json:"integration_id"`
+	IntegrationName   string           `json:"integration_name"`
+	IntegrationSlug   string           `json:"integration_slug"`
+	GroupIDs          []string         `json:"group_ids"`
+	SubIntegrationIDs []string         `json:"sub_integration_ids"`
+	Items             []DisconnectItem `json:"items"`
+}
+
+/*
+****************
+getConnectedGroups()
+- Returns the group connections of the integration and of its sub
+integrations. The cascade is skipped when the sub integrations cannot be
+read.
+****************
+*/
+func getConnectedGroups(companyID string, integration models.Integration) ([]models.Integration, []models.Integration, bool) {
+	subIntegrations, err := GetSubIntegrations(integration.IntegrationID)
+	if err != nil {
+		return nil, nil, false
+	}
+
+	var connectedGroups []models.Integration
+	for _, sub := range subIntegrations {
+		cg := GetGroupsIntegrationConnection(sub.IntegrationID, companyID)
+		connectedGroups = append(connectedGroups, cg...)
+	}
+	emptyCg := GetGroupsIntegrationEmptySubConnection(integration.IntegrationID, companyID)
+	connectedGroups = append(connectedGroups, emptyCg...)
+
+	return connectedGroups, subIntegrations, true
+}
+
+/*
+****************
+BuildDisconnectPlan()
+- Lists what disconnecting the integration would delete, without deleting
+anything. It follows the same lookups as cleanupDisconnectedIntegration.
+****************
+*/
+func BuildDisconnectPlan(companyID string, integration models.Integration) (DisconnectPlan, error) {
+	plan := DisconnectPlan{
+		IntegrationID:     integration.IntegrationID,
+		IntegrationName:   integration.IntegrationName,
+		IntegrationSlug:   integration.IntegrationSlug,
+		GroupIDs:          []string{},
+		SubIntegrationIDs: []string{},
+		Items: []DisconnectItem{
+			{
+				PK:     utils.AppendPrefix(constants.PREFIX_COMPANY, companyID),
+				SK:     utils.AppendPrefix(constants.PREFIX_INTEGRATION, integration.IntegrationID),
+				Kind:   DISCONNECT_ITEM_COMPANY_INTEGRATION,
+				ItemID: integration.IntegrationID,
+			},
+		},
+	}
+
+	connectedGroups, subIntegrations, ok := getConnectedGroups(companyID, integration)
+	if !ok || len(connectedGroups) == 0 {
+		return plan, nil
+	}
+
+	for _, sub := range subIntegrations {
+		plan.SubIntegrationIDs = append(plan.SubIntegrationIDs, sub.IntegrationID)
+	}
+
+	providerItems, err := GetIntegrationProvider(integration.IntegrationSlug).LocalState(companyID, integration, connectedGroups)
+	if err != nil {
+		return plan, err
+	}
+	plan.Items = append(plan.Items, providerItems...)
+
+	seen := map[string]bool{}
+	add := func(item DisconnectItem) {
+		if !seen[item.PK+item.SK] {
+			seen[item.PK+item.SK] = true
+			plan.Items = append(plan.Items, item)
+		}
+	}
+	for _, g := range connectedGroups {
+		if !utils.StringInSlice(g.GroupID, plan.GroupIDs) {
+			plan.GroupIDs = append(plan.GroupIDs, g.GroupID)
+		}
+		add(DisconnectItem{
+			PK:      utils.AppendPrefix(constants.PREFIX_GROUP, g.GroupID),
+			SK:      utils.AppendPrefix(constants.PREFIX_INTEGRATION, integration.IntegrationID),
+			Kind:    DISCONNECT_ITEM_GROUP_INTEGRATION,
+			GroupID: g.GroupID,
+			ItemID:  integration.IntegrationID,
+		})
+		add(DisconnectItem{
+			PK:      g.PK,
+			SK:      g.SK,
+			Kind:    DISCONNECT_ITEM_GROUP_SUB,
+			GroupID: g.GroupID,
+			ItemID:  g.IntegrationID,
+		})
+	}
+
+	return plan, nil
+}
+
+/*
+****************
+PreviewDisconnect()
+- Returns what accepting a disconnect request would delete, for each
+integration of the request. Nothing is written.
+Params:
+notification_id - required
+integration_id - optional, defaults to the integrations of the request
+****************
+*/
+func (c RequestController) PreviewDisconnect() revel.Result {
+	var notificationID string
+	var integrationIDs []string
+	companyID := c.ViewArgs["companyID"].(string)
+	c.Params.Bind(&notificationID, "notification_id")
+	c.Params.Bind(&integrationIDs, "integration_id")
+	data := make(map[string]interface{})
+
+	// a preview changes nothing, not even the migration of a legacy request
+	request, err := PeekRequestByNotificationID(notificationID, companyID)
+	if err != nil {
+		c.Response.Status = 404
+		return c.RenderJSON(models.ErrorResponse{
+			Code:    "404",
+			Message: "Unable to retrieve request",
+		})
+	}
+	if request.RequestType != constants.REQUEST_DISCONNECT_INTEGRATION {
+		return renderRequestError(c.Controller, NewRequestError(422, "Only disconnect requests can be previewed"))
+	}
+	if len(integrationIDs) == 0 {
+		integrationIDs = request.RequestedIntegrations
+	}
+	for _, integrationID := range integrationIDs {
+		if !utils.StringInSlice(integrationID, request.RequestedIntegrations) {
+			return renderRequestError(c.Controller, NewRequestError(422, "integration_id does not match the integrations of the request"))
+		}
+	}
+
+	plans := []DisconnectPlan{}
+	for _, integrationID := range integrationIDs {
+		integration, err := ops.GetIntegrationByID(integrationID)
+		if err != nil {
+			return renderRequestError(c.Controller, NewRequestError(404, "Unable to retrieve Integrations"))
+		}
+		plan, err := BuildDisconnectPlan(companyID, integration)
+		if err != nil {
+			return renderRequestError(c.Controller, NewRequestError(500, "Unable to list the items of "+integration.IntegrationName))
+		}
+		plans = append(plans, plan)
+	}
+
+	data["request"] = request
+	data["plans"] = plans
+	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+	return c.RenderJSON(data)
+}
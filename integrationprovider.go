@@ -0,0 +1,97 @@
+package controllers
+
+import (
+	"grooper/app/models"
+	ops "grooper/app/operations"
+)
+
+// IntegrationProvider implements what differs between providers when an
+// integration is disconnected. The group connection cascade is common to all
+// of them and is done by cleanupDisconnectedIntegration.
+type IntegrationProvider interface {
+	// Credentials returns what Revoke needs. It is called before the company
+	// integration row holding the tokens is deleted, and failing it stops
+	// the disconnect.
+	Credentials(companyID string, integration models.Integration) (IntegrationCredentials, error)
+	// Revoke uninstalls the app or revokes the tokens on the remote side.
+	Revoke(companyID string, integration models.Integration, credentials IntegrationCredentials) error
+	// LocalState lists the provider specific items CleanupLocalState
+	// removes, so a disconnect can be previewed.
+	LocalState(companyID string, integration models.Integration, connectedGroups []models.Integration) ([]DisconnectItem, error)
+	// CleanupLocalState removes the provider specific items left behind by
+	// the integration.
+	CleanupLocalState(companyID string, integration models.Integration, connectedGroups []models.Integration) error
+	// ReauthorizesOnRestore is true when Revoke makes the stored tokens
+	// useless, so restoring an archived disconnect needs a new authorization.
+	ReauthorizesOnRestore() bool
+}
+
+// IntegrationCredentials are the tokens of a company integration.
+type IntegrationCredentials struct {
+	AccessToken  string
+	RefreshToken string
+}
+
+var integrationProviders = map[string]IntegrationProvider{}
+
+/*
+****************
+RegisterIntegrationProvider()
+- Registers the provider of an integration slug. Called from init() of the
+file implementing the provider.
+****************
+*/
+func RegisterIntegrationProvider(integrationSlug string, provider IntegrationProvider) {
+	integrationProviders[integrationSlug] = provider
+}
+
+/*
+****************
+GetIntegrationProvider()
+- Returns the provider registered for the slug. Slugs without one only get
+their local rows deleted.
+****************
+*/
+func GetIntegrationProvider(integrationSlug string) IntegrationProvider {
+	if provider, ok := integrationProviders[integrationSlug]; ok {
+		return provider
+	}
+	return LocalIntegrationProvider{}
+}
+
+// LocalIntegrationProvider is used for providers with nothing to revoke
+// remotely.
+type LocalIntegrationProvider struct{}
+
+func (p LocalIntegrationProvider) Credentials(companyID string, integration models.Integration) (IntegrationCredentials, error) {
+	return IntegrationCredentials{}, nil
+}
+
+func (p LocalIntegrationProvider) Revoke(companyID string, integration models.Integration, credentials IntegrationCredentials) error {
+	return nil
+}
+
+func (p LocalIntegrationProvider) LocalState(companyID string, integration models.Integration, connectedGroups []models.Integration) ([]DisconnectItem, error) {
+	return nil, nil
+}
+
+func (p LocalIntegrationProvider) CleanupLocalState(companyID string, integration models.Integration, connectedGroups []models.Integration) error {
+	return nil
+}
+
+func (p LocalIntegrationProvider) ReauthorizesOnRestore() bool {
+	return false
+}
+
+// companyIntegrationCredentials reads the tokens stored on the company
+// integration row.
+func companyIntegrationCredentials(companyID string, integration models.Integration) (IntegrationCredentials, bool) {
+	integrationInfo, err := ops.GetCompanyIntegration(companyID, integration.IntegrationID)
+	if err != nil || integrationInfo.IntegrationToken == nil || integrationInfo.IntegrationToken.AccessToken == "" {
+		return IntegrationCredentials{}, false
+	}
+	return IntegrationCredentials{
+		AccessToken:  integrationInfo.IntegrationToken.AccessToken,
+		RefreshToken: integrationInfo.IntegrationToken.RefreshToken,
+	}, true
+}
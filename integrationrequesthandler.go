@@ -0,0 +1,278 @@
+package controllers
+
+import (
+	"errors"
+	"grooper/app"
+	"grooper/app/constants"
+	"grooper/app/models"
+	ops "grooper/app/operations"
+	"grooper/app/utils"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func init() {
+	RegisterRequestHandler(constants.REQUEST_CONNECT_INTEGRATION, IntegrationRequestHandler{Connect: true})
+	RegisterRequestHandler(constants.REQUEST_DISCONNECT_INTEGRATION, IntegrationRequestHandler{Connect: false})
+	RegisterRequestPermissions(constants.REQUEST_CONNECT_INTEGRATION, RequestPermissions{
+		Accept: PERMISSION_CONNECT_INTEGRATION,
+		Reject: PERMISSION_CONNECT_INTEGRATION,
+		View:   PERMISSION_CONNECT_INTEGRATION,
+	})
+	RegisterRequestPermissions(constants.REQUEST_DISCONNECT_INTEGRATION, RequestPermissions{
+		Accept: constants.DISCONNECT_INTEGRATION,
+		Reject: constants.DISCONNECT_INTEGRATION,
+		View:   constants.DISCONNECT_INTEGRATION,
+	})
+}
+
+// IntegrationRequestHandler handles requests to connect or disconnect company
+// integrations.
+type IntegrationRequestHandler struct {
+	Connect bool
+}
+
+func (h IntegrationRequestHandler) Validate(ctx *RequestContext) error {
+	if len(ctx.IntegrationIDs) == 0 {
+		return NewRequestError(400, "Missing required parameter - integration_id")
+	}
+	return nil
+}
+
+func (h IntegrationRequestHandler) Authorize(ctx *RequestContext, accept bool) error {
+	return nil
+}
+
+func (h IntegrationRequestHandler) Accept(ctx *RequestContext, subject RequestSubject, content *models.NotificationContentType) error {
+	integrationNames, err := h.integrationNames(ctx)
+	if err != nil {
+		return err
+	}
+
+	if h.Connect && ctx.Once("connect") {
+		var connections []IntegrationConnection
+		for _, integrationID := range ctx.IntegrationIDs {
+			connection, err := h.connect(ctx, integrationID, subject)
+			if err != nil {
+				return err
+			}
+			connections = append(connections, connection)
+		}
+		// the approver continues with the provider authorization
+		ctx.Respond("connections", connections)
+	}
+
+	if !h.Connect && ctx.Once("disconnect") {
+		var archives []IntegrationArchive
+		for _, integrationID := range ctx.IntegrationIDs {
+			archive, err := h.disconnect(ctx, integrationID)
+			if err != nil {
+				return err
+			}
+			archives = append(archives, archive)
+		}
+		// the disconnects can be restored from these until they expire
+		ctx.Respond("archives", archives)
+	}
+
+	ctx.AdminMessage(content, newListTemplate(requestMessageKey(h.action(), "admin", true), integrationNames, requesterName(subject.RequesterInfo)))
+	content.RequestedIntegrations = ctx.IntegrationIDs
+	return nil
+}
+
+// connect starts the tracked connection of the integration. It is written
+// with the request decision and waits for the approver to authorize the
+// provider.
+func (h IntegrationRequestHandler) connect(ctx *RequestContext, integrationID string, subject RequestSubject) (IntegrationConnection, error) {
+	res, getErr := app.SVC.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(utils.AppendPrefix(constants.PREFIX_COMPANY, ctx.CompanyID)),
+			},
+			"SK": {
+				S: aws.String(utils.AppendPrefix(constants.PREFIX_INTEGRATION, integrationID)),
+			},
+		},
+	})
+	if getErr != nil {
+		return IntegrationConnection{}, NewRequestError(500, "Unable to retrieve company integration")
+	}
+	if res.Item != nil {
+		return IntegrationConnection{}, NewRequestError(409, "Integration is already connected")
+	}
+
+	integration, operationErr := ops.GetIntegrationByID(integrationID)
+	if operationErr != nil {
+		return IntegrationConnection{}, NewRequestError(404, "Unable to retrieve Integrations")
+	}
+
+	connection, err := NewIntegrationConnection(ctx.CompanyID, ctx.Request.RequestID, subject.User.UserID, ctx.ApproverID, integration)
+	if err != nil {
+		return connection, NewRequestError(500, "Unable to create integration connection")
+	}
+	if err := ctx.Transaction.PutModel(connection); err != nil {
+		return connection, NewRequestError(500, "Error at marshalmap")
+	}
+	return connection, nil
+}
+
+// disconnect deletes the company integration row inside the transaction and
+// queues the remote uninstall and the group connection cleanup. Everything it
+// deletes is archived first.
+func (h IntegrationRequestHandler) disconnect(ctx *RequestContext, integrationID string) (IntegrationArchive, error) {
+	res, getErr := app.SVC.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(utils.AppendPrefix(constants.PREFIX_COMPANY, ctx.CompanyID)),
+			},
+			"SK": {
+				S: aws.String(utils.AppendPrefix(constants.PREFIX_INTEGRATION, integrationID)),
+			},
+		},
+	})
+	if getErr != nil {
+		return IntegrationArchive{}, NewRequestError(500, "Unable to retrieve company integration")
+	}
+
+	if res.Item == nil {
+		return IntegrationArchive{}, NewRequestError(404, "Integration is not connected")
+	}
+	integrationConnected, operationErr := ops.GetIntegrationByID(integrationID)
+	if operationErr != nil {
+		return IntegrationArchive{}, NewRequestError(404, "Unable to retrieve Integrations")
+	}
+
+	// the credentials have to be read now, the company integration row
+	// holding them is deleted by the transaction
+	credentials, err := GetIntegrationProvider(integrationConnected.IntegrationSlug).Credentials(ctx.CompanyID, integrationConnected)
+	if err != nil {
+		return IntegrationArchive{}, err
+	}
+	disconnect := integrationDisconnect{
+		Integration: integrationConnected,
+		Credentials: credentials,
+	}
+
+	plan, err := BuildDisconnectPlan(ctx.CompanyID, integrationConnected)
+	if err != nil {
+		return IntegrationArchive{}, NewRequestError(500, "Unable to list the items of "+integrationConnected.IntegrationName)
+	}
+	snapshot, err := snapshotDisconnectPlan(plan)
+	if err != nil {
+		return IntegrationArchive{}, NewRequestError(500, "Unable to archive "+integrationConnected.IntegrationName)
+	}
+	archive := NewIntegrationArchive(ctx, integrationConnected, len(snapshot))
+	if err := ctx.Transaction.PutModel(archive); err != nil {
+		return archive, NewRequestError(500, "Error at marshalmap")
+	}
+
+	ctx.Transaction.Delete(
+		utils.AppendPrefix(constants.PREFIX_COMPANY, ctx.CompanyID),
+		utils.AppendPrefix(constants.PREFIX_INTEGRATION, integrationConnected.IntegrationID),
+	)
+	// the snapshot is written before the cleanup deletes the group items;
+	// without it they could not be restored, so they are left in place
+	ctx.AfterCommit(func() error {
+		if err := writeArchivedItems(archive, snapshot); err != nil {
+			return err
+		}
+		return cleanupDisconnectedIntegration(ctx.CompanyID, disconnect)
+	})
+	return archive, nil
+}
+
+func (h IntegrationRequestHandler) Reject(ctx *RequestContext, subject RequestSubject, content *models.NotificationContentType) error {
+	integrationNames, err := h.integrationNames(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctx.AdminMessage(content, newListTemplate(requestMessageKey(h.action(), "admin", false), integrationNames, requesterName(subject.RequesterInfo)))
+	content.RequestedIntegrations = ctx.IntegrationIDs
+	return nil
+}
+
+func (h IntegrationRequestHandler) Describe(ctx *RequestContext, content *models.NotificationContentType, accepted bool) error {
+	integrationNames, err := h.integrationNames(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctx.RequesterMessage(content, newListTemplate(requestMessageKey(h.action(), "requester", accepted), integrationNames))
+	return nil
+}
+
+func (h IntegrationRequestHandler) action() string {
+	if h.Connect {
+		return "connect"
+	}
+	return "disconnect"
+}
+
+func (h IntegrationRequestHandler) integrationNames(ctx *RequestContext) ([]string, error) {
+	var integrationNames []string
+	for _, integrationID := range ctx.IntegrationIDs {
+		integInfo, err := ops.GetIntegrationByID(integrationID)
+		if err != nil {
+			return integrationNames, NewRequestError(400, "Unable to retrieve Integrations")
+		}
+		integrationNames = append(integrationNames, integInfo.IntegrationName)
+	}
+	return integrationNames, nil
+}
+
+// integrationDisconnect holds what is needed to clean up an integration once
+// its company integration row has been deleted.
+type integrationDisconnect struct {
+	Integration models.Integration
+	Credentials IntegrationCredentials
+}
+
+/*
+****************
+cleanupDisconnectedIntegration()
+- Revokes the integration through its provider and removes every group and
+sub integration connection of a disconnected integration. The local cleanup
+runs even when the revoke fails; the revoke error is returned once it is done.
+****************
+*/
+func cleanupDisconnectedIntegration(companyID string, disconnect integrationDisconnect) error {
+	integrationConnected := disconnect.Integration
+	provider := GetIntegrationProvider(integrationConnected.IntegrationSlug)
+
+	// the company integration row is already gone, so a failed revoke must
+	// not leave the groups pointing at it
+	revokeErr := provider.Revoke(companyID, integrationConnected, disconnect.Credentials)
+	if revokeErr != nil {
+		revokeErr = errors.New("revoke of " + integrationConnected.IntegrationName + " failed: " + revokeErr.Error())
+	}
+
+	connectedGroups, _, ok := getConnectedGroups(companyID, integrationConnected)
+	if ok {
+		if len(connectedGroups) != 0 {
+			if err := provider.CleanupLocalState(companyID, integrationConnected, connectedGroups); err != nil {
+				return err
+			}
+
+			// remove group and integration connection, and group and sub
+			// integration connection
+			writer := NewBatchWriter()
+			for _, g := range connectedGroups {
+				writer.Delete(
+					utils.AppendPrefix(constants.PREFIX_GROUP, g.GroupID),
+					utils.AppendPrefix(constants.PREFIX_INTEGRATION, integrationConnected.IntegrationID),
+				)
+				writer.Delete(g.PK, g.SK)
+			}
+
+			if _, err := writer.Flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	return revokeErr
+}
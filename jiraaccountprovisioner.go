@@ -0,0 +1,54 @@
+package controllers
+
+import (
+	"errors"
+	"grooper/app/constants"
+	"net/http"
+	"strings"
+)
+
+func init() {
+	RegisterAccountProvisioner(constants.INTEG_SLUG_JIRA, JiraAccountProvisioner{})
+}
+
+// JiraAccountProvisioner creates the account on the Jira Cloud site of the
+// company's provisioning settings, with access to the settings' products.
+type JiraAccountProvisioner struct {
+	Client *http.Client
+}
+
+// jiraCreateUser is the body of POST /rest/api/3/user.
+type jiraCreateUser struct {
+	EmailAddress string   `json:"emailAddress"`
+	DisplayName  string   `json:"displayName,omitempty"`
+	Products     []string `json:"products"`
+}
+
+func (p JiraAccountProvisioner) Provision(account ProvisioningAccount) (ProvisioningResult, error) {
+	siteURL := account.Settings.SiteURL
+	if siteURL == "" {
+		return ProvisioningResult{}, errors.New("Jira site is not set up")
+	}
+	if account.Credentials.AccessToken == "" {
+		return ProvisioningResult{}, errors.New("Jira token not found")
+	}
+
+	products := account.Settings.Products
+	if len(products) == 0 {
+		products = []string{JIRA_DEFAULT_PRODUCT}
+	}
+
+	var created struct {
+		AccountID string `json:"accountId"`
+	}
+	err := sendProvisioningRequest(p.Client, http.MethodPost, strings.TrimRight(siteURL, "/")+"/rest/api/3/user", "Bearer "+account.Credentials.AccessToken, jiraCreateUser{
+		EmailAddress: account.Email,
+		DisplayName:  strings.TrimSpace(account.FirstName + " " + account.LastName),
+		Products:     products,
+	}, &created)
+	if err != nil {
+		return ProvisioningResult{}, err
+	}
+
+	return ProvisioningResult{AccountID: created.AccountID}, nil
+}
@@ -387,8 +387,16 @@ func (c NotificationController) GetAllNotifications() revel.Result {
 }
 
 func PaginateUserNotifications(currentUser, companyID, exclusiveStartKey string, pageLimit int64, all bool, sortOutput bool) ([]models.Notification, models.Notification, error) {
+	notifications, lastEvaluatedKey, _, err := paginateUserNotifications(currentUser, companyID, exclusiveStartKey, pageLimit, all, sortOutput)
+	return notifications, lastEvaluatedKey, err
+}
+
+// paginateUserNotifications also returns the message templates stored on the
+// notifications, keyed by notification ID.
+func paginateUserNotifications(currentUser, companyID, exclusiveStartKey string, pageLimit int64, all bool, sortOutput bool) ([]models.Notification, models.Notification, map[string]NotificationTemplate, error) {
 	notifications := []models.Notification{}
 	lastEvaluatedKey := models.Notification{}
+	templates := map[string]NotificationTemplate{}
 
 	params := &dynamodb.QueryInput{
 		TableName: aws.String(app.TABLE_NAME),
@@ -425,24 +433,25 @@ func PaginateUserNotifications(currentUser, companyID, exclusiveStartKey string,
 	result, err := ops.HandleQueryWithLimit(params, int(pageLimit), all)
 	if err != nil {
 		e := errors.New(constants.HTTP_STATUS_500)
-		return notifications, lastEvaluatedKey, e
+		return notifications, lastEvaluatedKey, templates, e
 	}
 
 	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &notifications)
 	if err != nil {
 		e := errors.New(constants.HTTP_STATUS_400)
-		return notifications, lastEvaluatedKey, e
+		return notifications, lastEvaluatedKey, templates, e
 	}
+	templates = notificationTemplates(result.Items)
 
 	key := result.LastEvaluatedKey
 
 	err = dynamodbattribute.UnmarshalMap(key, &lastEvaluatedKey)
 	if err != nil {
 		e := errors.New(constants.HTTP_STATUS_400)
-		return notifications, lastEvaluatedKey, e
+		return notifications, lastEvaluatedKey, templates, e
 	}
 
-	return notifications, lastEvaluatedKey, nil
+	return notifications, lastEvaluatedKey, templates, nil
 }
 
 // @Summary Get User Notifications
@@ -476,7 +485,7 @@ func (c NotificationController) GetUserNotifications() revel.Result {
 		}
 	}
 
-	notifications, lastEvaluatedKey, err := PaginateUserNotifications(currentUser, companyID, paramLastEvaluatedKey, pageLimit, all, sortOutput)
+	notifications, lastEvaluatedKey, templates, err := paginateUserNotifications(currentUser, companyID, paramLastEvaluatedKey, pageLimit, all, sortOutput)
 	if err != nil {
 		result["status"] = utils.GetHTTPStatus(err.Error())
 		return c.RenderJSON(result)
@@ -493,6 +502,7 @@ func (c NotificationController) GetUserNotifications() revel.Result {
 
 	result["unread"] = unread
 	result["notifications"] = notifications
+	result["templates"] = templates
 	result["lastEvaluatedKey"] = lastEvaluatedKey
 	result["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
 	return c.RenderJSON(result)
@@ -0,0 +1,130 @@
+package controllers
+
+import (
+	"errors"
+	"grooper/app/constants"
+	"grooper/app/models"
+	ops "grooper/app/operations"
+	"grooper/app/utils"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/revel/revel"
+)
+
+// the revocation endpoint and the client of the identity domain are read
+// once the configuration is loaded
+func init() {
+	revel.OnAppStart(func() {
+		slug := constants.INTEG_SLUG_ORACLE
+		RegisterIntegrationProvider(slug, OracleIntegrationProvider{
+			RevokeURL:    revel.Config.StringDefault("integration.revoke_url."+slug, ""),
+			ClientID:     revel.Config.StringDefault("integration.client_id."+slug, ""),
+			ClientSecret: revel.Config.StringDefault("integration.client_secret."+slug, ""),
+		})
+	})
+}
+
+// OracleIntegrationProvider revokes the company's tokens at the identity
+// domain and removes the OAuth items of the Autonomous DBs connected to the
+// company's groups.
+type OracleIntegrationProvider struct {
+	RevokeURL    string
+	ClientID     string
+	ClientSecret string
+	Client       *http.Client
+}
+
+func (p OracleIntegrationProvider) Credentials(companyID string, integration models.Integration) (IntegrationCredentials, error) {
+	credentials, _ := companyIntegrationCredentials(companyID, integration)
+	return credentials, nil
+}
+
+// Revoke posts each token to the OAuth revocation endpoint (RFC 7009).
+// Revoking the refresh token also ends the access tokens issued from it, the
+// access token is revoked on its own for grants without one.
+func (p OracleIntegrationProvider) Revoke(companyID string, integration models.Integration, credentials IntegrationCredentials) error {
+	if credentials.AccessToken == "" && credentials.RefreshToken == "" {
+		return nil
+	}
+	if p.RevokeURL == "" || p.ClientID == "" || p.ClientSecret == "" {
+		return errors.New("the revocation of " + integration.IntegrationSlug + " is not configured")
+	}
+
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Timeout: HTTP_PROVIDER_TIMEOUT}
+	}
+	tokens := []struct{ token, hint string }{
+		{credentials.RefreshToken, "refresh_token"},
+		{credentials.AccessToken, "access_token"},
+	}
+	for _, t := range tokens {
+		if t.token == "" {
+			continue
+		}
+		form := url.Values{}
+		form.Set("token", t.token)
+		form.Set("token_type_hint", t.hint)
+
+		req, err := http.NewRequest(http.MethodPost, p.RevokeURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.SetBasicAuth(p.ClientID, p.ClientSecret)
+
+		res, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return errors.New("revoke of " + integration.IntegrationSlug + " " + t.hint + " failed with status " + strconv.Itoa(res.StatusCode))
+		}
+	}
+	return nil
+}
+
+// LocalState lists the OAuth items of the Autonomous DBs connected to each
+// group.
+func (p OracleIntegrationProvider) LocalState(companyID string, integration models.Integration, connectedGroups []models.Integration) ([]DisconnectItem, error) {
+	var items []DisconnectItem
+	for _, g := range connectedGroups {
+		connectedDBs, err := ops.GetConnectedItemBySlug(g.GroupID, constants.INTEG_SLUG_ORACLE_AUTONOMOUS_DB)
+		if err != nil {
+			return items, err
+		}
+		for _, dbID := range connectedDBs {
+			items = append(items, DisconnectItem{
+				PK:      utils.AppendPrefix(constants.PREFIX_COMPANY, companyID),
+				SK:      utils.AppendPrefix(constants.PREFIX_OAUTH, dbID),
+				GroupID: g.GroupID,
+				ItemID:  dbID,
+				Kind:    DISCONNECT_ITEM_OAUTH,
+			})
+		}
+	}
+	return items, nil
+}
+
+func (p OracleIntegrationProvider) CleanupLocalState(companyID string, integration models.Integration, connectedGroups []models.Integration) error {
+	// Remove Connected Oracle Autonomous DB - OAuth
+	items, err := p.LocalState(companyID, integration, connectedGroups)
+	if err != nil {
+		return err
+	}
+
+	writer := NewBatchWriter()
+	for _, item := range items {
+		writer.Delete(item.PK, item.SK)
+	}
+	_, err = writer.Flush()
+	return err
+}
+
+func (p OracleIntegrationProvider) ReauthorizesOnRestore() bool {
+	return p.RevokeURL != ""
+}
@@ -0,0 +1,89 @@
+package controllers
+
+import (
+	"grooper/app/models"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOracleIntegrationProviderRevoke(t *testing.T) {
+	integration := models.Integration{IntegrationID: "i1", IntegrationSlug: "oracle"}
+
+	tests := []struct {
+		name        string
+		status      int
+		credentials IntegrationCredentials
+		noConfig    bool
+		wantTokens  []string
+		wantErr     bool
+	}{
+		{
+			name:        "both tokens revoked",
+			status:      http.StatusOK,
+			credentials: IntegrationCredentials{AccessToken: "access", RefreshToken: "refresh"},
+			wantTokens:  []string{"refresh_token:refresh", "access_token:access"},
+		},
+		{
+			name:        "access token only",
+			status:      http.StatusOK,
+			credentials: IntegrationCredentials{AccessToken: "access"},
+			wantTokens:  []string{"access_token:access"},
+		},
+		{
+			name:        "refused",
+			status:      http.StatusBadRequest,
+			credentials: IntegrationCredentials{AccessToken: "access", RefreshToken: "refresh"},
+			wantTokens:  []string{"refresh_token:refresh"},
+			wantErr:     true,
+		},
+		{
+			name: "nothing stored",
+		},
+		{
+			name:        "not configured",
+			credentials: IntegrationCredentials{AccessToken: "access"},
+			noConfig:    true,
+			wantErr:     true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var tokens []string
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if user, secret, ok := r.BasicAuth(); !ok || user != "client" || secret != "secret" {
+					t.Errorf("client authentication = %q, %q", user, secret)
+				}
+				if err := r.ParseForm(); err != nil {
+					t.Errorf("form: %v", err)
+				}
+				tokens = append(tokens, r.PostForm.Get("token_type_hint")+":"+r.PostForm.Get("token"))
+				w.WriteHeader(test.status)
+			}))
+			defer server.Close()
+
+			provider := OracleIntegrationProvider{
+				RevokeURL:    server.URL,
+				ClientID:     "client",
+				ClientSecret: "secret",
+				Client:       server.Client(),
+			}
+			if test.noConfig {
+				provider.ClientSecret = ""
+			}
+			err := provider.Revoke("c1", integration, test.credentials)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Revoke() error = %v; want error %t", err, test.wantErr)
+			}
+			if len(tokens) != len(test.wantTokens) {
+				t.Fatalf("revoked %v; want %v", tokens, test.wantTokens)
+			}
+			for i := range tokens {
+				if tokens[i] != test.wantTokens[i] {
+					t.Errorf("revoked %v; want %v", tokens, test.wantTokens)
+				}
+			}
+		})
+	}
+}
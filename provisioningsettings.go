@@ -0,0 +1,248 @@
+package controllers
+
+import (
+	"errors"
+	"grooper/app"
+	"grooper/app/constants"
+	"grooper/app/models"
+	"grooper/app/utils"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/revel/revel"
+)
+
+const (
+	PREFIX_PROVISIONING_SETTINGS      = "PROVISIONING_SETTINGS#"
+	ENTITY_TYPE_PROVISIONING_SETTINGS = "PROVISIONING_SETTINGS"
+	JIRA_DEFAULT_PRODUCT              = "jira-software"
+)
+
+// ProvisioningSettings tell the provisioner of an integration where the
+// company's accounts are created. Each company has its own, one item per
+// integration slug.
+type ProvisioningSettings struct {
+	PK              string `json:"PK,omitempty"`
+	SK              string `json:"SK,omitempty"`
+	CompanyID       string `json:"CompanyID,omitempty"`
+	IntegrationSlug string `json:"IntegrationSlug,omitempty"`
+	// Domain is the Google Workspace domain the accounts are created in
+	Domain string `json:"Domain,omitempty"`
+	// OrganizationID and Workspace are the Atlassian organization and the
+	// Bitbucket workspace users are invited to, with Role
+	OrganizationID string `json:"OrganizationID,omitempty"`
+	Workspace      string `json:"Workspace,omitempty"`
+	Role           string `json:"Role,omitempty"`
+	// SiteURL and Products are the Jira Cloud site and the products users
+	// get access to
+	SiteURL   string   `json:"SiteURL,omitempty"`
+	Products  []string `json:"Products,omitempty"`
+	UpdatedBy string   `json:"UpdatedBy,omitempty"`
+	UpdatedAt string   `json:"UpdatedAt,omitempty"`
+	Type      string   `json:"Type,omitempty"`
+}
+
+// ProvisioningSettingsParams is the body of SaveProvisioningSettings.
+type ProvisioningSettingsParams struct {
+	IntegrationSlug string   `json:"integration_slug,omitempty"`
+	Domain          string   `json:"domain,omitempty"`
+	OrganizationID  string   `json:"organization_id,omitempty"`
+	Workspace       string   `json:"workspace,omitempty"`
+	Role            string   `json:"role,omitempty"`
+	SiteURL         string   `json:"site_url,omitempty"`
+	Products        []string `json:"products,omitempty"`
+}
+
+/*
+****************
+GetProvisioningSettings()
+- Returns the provisioning settings of the company for the integration. The
+returned bool is false if the company has not set any.
+****************
+*/
+func GetProvisioningSettings(companyID, integrationSlug string) (ProvisioningSettings, bool, error) {
+	var settings ProvisioningSettings
+
+	res, err := app.SVC.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
+			},
+			"SK": {
+				S: aws.String(utils.AppendPrefix(PREFIX_PROVISIONING_SETTINGS, integrationSlug)),
+			},
+		},
+	})
+	if err != nil {
+		return settings, false, errors.New(constants.HTTP_STATUS_500)
+	}
+	if len(res.Item) == 0 {
+		return settings, false, nil
+	}
+
+	err = dynamodbattribute.UnmarshalMap(res.Item, &settings)
+	if err != nil {
+		return settings, false, errors.New(constants.HTTP_STATUS_400)
+	}
+
+	return settings, true, nil
+}
+
+/*
+****************
+SaveProvisioningSettings()
+- Creates or replaces the provisioning settings of the company for the
+integration
+****************
+*/
+func SaveProvisioningSettings(settings ProvisioningSettings) error {
+	settings.PK = utils.AppendPrefix(constants.PREFIX_COMPANY, settings.CompanyID)
+	settings.SK = utils.AppendPrefix(PREFIX_PROVISIONING_SETTINGS, settings.IntegrationSlug)
+	settings.Type = ENTITY_TYPE_PROVISIONING_SETTINGS
+
+	av, err := dynamodbattribute.MarshalMap(settings)
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	_, err = app.SVC.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(app.TABLE_NAME),
+	})
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	return nil
+}
+
+// validateProvisioningSettings returns what is wrong with the settings,
+// empty when they can be saved.
+func validateProvisioningSettings(input ProvisioningSettingsParams) []string {
+	var errs []string
+
+	switch input.IntegrationSlug {
+	case constants.INTEG_SLUG_GOOGLE_CLOUD:
+		if input.Domain == "" || strings.ContainsAny(input.Domain, "@/ ") {
+			errs = append(errs, "domain must be the Google Workspace domain, such as example.com")
+		}
+	case constants.INTEG_SLUG_BITBUCKET:
+		if input.OrganizationID == "" {
+			errs = append(errs, "Missing required parameter - organization_id")
+		}
+		if input.Workspace == "" {
+			errs = append(errs, "Missing required parameter - workspace")
+		}
+	case constants.INTEG_SLUG_JIRA:
+		site, err := url.Parse(input.SiteURL)
+		if err != nil || site.Scheme != "https" || site.Host == "" {
+			errs = append(errs, "site_url must be the https address of the Jira site")
+		}
+	default:
+		errs = append(errs, "Accounts are not provisioned on "+input.IntegrationSlug)
+	}
+
+	return errs
+}
+
+/*
+****************
+SaveProvisioningSettings()
+- Sets where the accounts of the company are created on an integration
+Body:
+integration_slug - required
+domain - required for Google Cloud
+organization_id, workspace - required for Bitbucket
+role - optional for Bitbucket
+site_url - required for Jira
+products[] - optional for Jira
+****************
+*/
+func (c RequestController) SaveProvisioningSettings() revel.Result {
+	companyID := c.ViewArgs["companyID"].(string)
+	userID := c.ViewArgs["userID"].(string)
+	data := make(map[string]interface{})
+
+	isAdmin, err := isCompanyAdmin(companyID, userID)
+	if err != nil || !isAdmin {
+		c.Response.Status = 401
+		data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_401)
+		return c.RenderJSON(data)
+	}
+
+	var input ProvisioningSettingsParams
+	c.Params.BindJSON(&input)
+
+	if errs := validateProvisioningSettings(input); len(errs) != 0 {
+		c.Response.Status = 422
+		data["errors"] = errs
+		data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_422)
+		return c.RenderJSON(data)
+	}
+
+	settings := ProvisioningSettings{
+		CompanyID:       companyID,
+		IntegrationSlug: input.IntegrationSlug,
+		Domain:          strings.ToLower(input.Domain),
+		OrganizationID:  input.OrganizationID,
+		Workspace:       input.Workspace,
+		Role:            input.Role,
+		SiteURL:         strings.TrimRight(input.SiteURL, "/"),
+		Products:        input.Products,
+		UpdatedBy:       userID,
+		UpdatedAt:       utils.GetCurrentTimestamp(),
+	}
+	if err := SaveProvisioningSettings(settings); err != nil {
+		data["status"] = utils.GetHTTPStatus(err.Error())
+		return c.RenderJSON(data)
+	}
+
+	data["settings"] = settings
+	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+	return c.RenderJSON(data)
+}
+
+/*
+****************
+GetProvisioningSettings()
+- Returns where the accounts of the company are created on an integration
+Params:
+integration_slug - required
+****************
+*/
+func (c RequestController) GetProvisioningSettings() revel.Result {
+	companyID := c.ViewArgs["companyID"].(string)
+	data := make(map[string]interface{})
+
+	integrationSlug := c.Params.Get("integration_slug")
+	if integrationSlug == "" {
+		c.Response.Status = 400
+		return c.RenderJSON(models.ErrorResponse{
+			Code:           "400",
+			HTTPStatusCode: 400,
+			Message:        "Missing required parameter - integration_slug",
+		})
+	}
+
+	settings, found, err := GetProvisioningSettings(companyID, integrationSlug)
+	if err != nil {
+		data["status"] = utils.GetHTTPStatus(err.Error())
+		return c.RenderJSON(data)
+	}
+	if !found {
+		c.Response.Status = 404
+		return c.RenderJSON(models.ErrorResponse{
+			Code:           "404",
+			HTTPStatusCode: 404,
+			Message:        "Accounts on " + integrationSlug + " are not set up",
+		})
+	}
+
+	data["settings"] = settings
+	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+	return c.RenderJSON(data)
+}
@@ -0,0 +1,55 @@
+package controllers
+
+import (
+	"grooper/app/constants"
+	"testing"
+)
+
+func TestValidateProvisioningSettings(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    ProvisioningSettingsParams
+		wantErrs int
+	}{
+		{
+			name:  "google",
+			input: ProvisioningSettingsParams{IntegrationSlug: constants.INTEG_SLUG_GOOGLE_CLOUD, Domain: "example.com"},
+		},
+		{
+			name:     "google address instead of domain",
+			input:    ProvisioningSettingsParams{IntegrationSlug: constants.INTEG_SLUG_GOOGLE_CLOUD, Domain: "admin@example.com"},
+			wantErrs: 1,
+		},
+		{
+			name:  "bitbucket",
+			input: ProvisioningSettingsParams{IntegrationSlug: constants.INTEG_SLUG_BITBUCKET, OrganizationID: "org", Workspace: "acme"},
+		},
+		{
+			name:     "bitbucket without organization or workspace",
+			input:    ProvisioningSettingsParams{IntegrationSlug: constants.INTEG_SLUG_BITBUCKET},
+			wantErrs: 2,
+		},
+		{
+			name:  "jira",
+			input: ProvisioningSettingsParams{IntegrationSlug: constants.INTEG_SLUG_JIRA, SiteURL: "https://acme.atlassian.net"},
+		},
+		{
+			name:     "jira over http",
+			input:    ProvisioningSettingsParams{IntegrationSlug: constants.INTEG_SLUG_JIRA, SiteURL: "http://acme.atlassian.net"},
+			wantErrs: 1,
+		},
+		{
+			name:     "not provisioned",
+			input:    ProvisioningSettingsParams{IntegrationSlug: "slack"},
+			wantErrs: 1,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if errs := validateProvisioningSettings(test.input); len(errs) != test.wantErrs {
+				t.Errorf("validateProvisioningSettings() = %v; want %d errors", errs, test.wantErrs)
+			}
+		})
+	}
+}
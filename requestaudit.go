@@ -0,0 +1,157 @@
+package controllers
+
+import (
+	"grooper/app/models"
+	"grooper/app/utils"
+	"strings"
+)
+
+const (
+	LOG_ACTION_ACCEPT_REQUEST  = "LOG_ACTION_ACCEPT_REQUEST"
+	LOG_ACTION_APPROVE_REQUEST = "LOG_ACTION_APPROVE_REQUEST"
+	LOG_ACTION_REJECT_REQUEST  = "LOG_ACTION_REJECT_REQUEST"
+	LOG_ACTION_REQUEST_FAILED  = "LOG_ACTION_REQUEST_FAILED"
+	// LOG_ACTION_AUTO_APPROVE_REQUEST is logged instead of an accept when an
+	// auto-approval rule accepted the request
+	LOG_ACTION_AUTO_APPROVE_REQUEST = "LOG_ACTION_AUTO_APPROVE_REQUEST"
+
+	PREFIX_REQUEST_AUDIT      = "AUDIT#"
+	ENTITY_TYPE_REQUEST_AUDIT = "REQUEST_AUDIT"
+)
+
+// RequestAuditEntry is the audit trail of a request, stored under the
+// request next to its comments. The company logs have no room for the
+// request or the reason, this is where they are joined back to the request.
+type RequestAuditEntry struct {
+	PK        string `json:"PK,omitempty"`
+	SK        string `json:"SK,omitempty"`
+	AuditID   string `json:"AuditID,omitempty"`
+	RequestID string `json:"RequestID,omitempty"`
+	CompanyID string `json:"CompanyID,omitempty"`
+	LogAction string `json:"LogAction,omitempty"`
+	LogType   string `json:"LogType,omitempty"`
+	// UserID performed the action: the approver, or the auto-approval rule
+	UserID string `json:"UserID,omitempty"`
+	// SubjectUserID is the requester the outcome is for
+	SubjectUserID string   `json:"SubjectUserID,omitempty"`
+	ItemIDs       []string `json:"ItemIDs,omitempty"`
+	Reason        string   `json:"Reason,omitempty"`
+	CreatedAt     string   `json:"CreatedAt,omitempty"`
+	Type          string   `json:"Type,omitempty"`
+}
+
+// requestAudit collects the logs of a decision, one per requester and
+// affected item. As in CreateGroupLog the item goes in the Role slot of the
+// log info, LogType is the request type and tells what the item is. Each
+// requester also gets one entry in the audit trail of the request.
+type requestAudit struct {
+	ctx     *RequestContext
+	logs    []*models.Logs
+	entries []RequestAuditEntry
+}
+
+func newRequestAudit(ctx *RequestContext) *requestAudit {
+	return &requestAudit{ctx: ctx}
+}
+
+/*
+****************
+record()
+- Adds the logs of one requester with the outcome of the decision for them
+****************
+*/
+func (a *requestAudit) record(logAction, userID string, requester models.CompanyUser) {
+	user := &models.LogModuleParams{
+		ID:   userID,
+		Name: strings.TrimSpace(requester.FirstName + " " + requester.LastName),
+	}
+
+	// auto-approvals are performed by the rule, not by an admin
+	performedBy := a.ctx.ApproverID
+	if a.ctx.AutoApprovalRuleID != "" {
+		performedBy = utils.AppendPrefix(PREFIX_AUTO_APPROVAL_RULE, a.ctx.AutoApprovalRuleID)
+	}
+
+	items := requestLogItems(a.ctx)
+	var itemIDs []string
+	for _, item := range items {
+		itemIDs = append(itemIDs, item.ID)
+	}
+	if len(items) == 0 {
+		items = []*models.LogModuleParams{nil}
+	}
+	for _, item := range items {
+		a.logs = append(a.logs, &models.Logs{
+			CompanyID: a.ctx.CompanyID,
+			UserID:    performedBy,
+			LogAction: logAction,
+			LogType:   a.ctx.RequestType,
+			LogInfo: &models.LogInformation{
+				Role:        item,
+				User:        user,
+				PerformedBy: performedBy,
+			},
+		})
+	}
+
+	if a.ctx.Request == nil {
+		return
+	}
+	auditID := utils.GenerateTimestampWithUID()
+	a.entries = append(a.entries, RequestAuditEntry{
+		PK:            utils.AppendPrefix(PREFIX_REQUEST, a.ctx.Request.RequestID),
+		SK:            utils.AppendPrefix(PREFIX_REQUEST_AUDIT, auditID+"#"+userID),
+		AuditID:       auditID,
+		RequestID:     a.ctx.Request.RequestID,
+		CompanyID:     a.ctx.CompanyID,
+		LogAction:     logAction,
+		LogType:       a.ctx.RequestType,
+		UserID:        performedBy,
+		SubjectUserID: userID,
+		ItemIDs:       itemIDs,
+		Reason:        a.ctx.Reason,
+		CreatedAt:     utils.GetCurrentTimestamp(),
+		Type:          ENTITY_TYPE_REQUEST_AUDIT,
+	})
+}
+
+// write stores the collected logs and the entries of the request's trail.
+func (a *requestAudit) write() error {
+	if len(a.logs) == 0 {
+		return nil
+	}
+	if _, err := CreateBatchLog(a.logs); err != nil {
+		return err
+	}
+
+	writer := NewBatchWriter()
+	for _, entry := range a.entries {
+		if err := writer.PutModel(entry); err != nil {
+			return err
+		}
+	}
+	_, err := writer.Flush()
+	return err
+}
+
+// requestLogItems returns the items a decision affects: the roles, the
+// integrations, the group or the provider of an account request.
+func requestLogItems(ctx *RequestContext) []*models.LogModuleParams {
+	var items []*models.LogModuleParams
+	for _, roleID := range ctx.RoleIDs {
+		items = append(items, &models.LogModuleParams{ID: roleID})
+	}
+	for _, integrationID := range ctx.IntegrationIDs {
+		items = append(items, &models.LogModuleParams{ID: integrationID})
+	}
+	if ctx.GroupID != "" {
+		items = append(items, &models.LogModuleParams{ID: ctx.GroupID})
+	}
+	if len(items) == 0 && ctx.Integration.IntegrationID != "" {
+		items = append(items, &models.LogModuleParams{
+			ID:   ctx.Integration.IntegrationID,
+			Name: ctx.Integration.IntegrationName,
+		})
+	}
+	return items
+}
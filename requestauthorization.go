@@ -0,0 +1,178 @@
+package controllers
+
+import (
+	"grooper/app/constants"
+	"time"
+
+	"github.com/revel/revel"
+)
+
+const (
+	REQUEST_ACTION_ACCEPT = "accept"
+	REQUEST_ACTION_REJECT = "reject"
+	REQUEST_ACTION_VIEW   = "view"
+)
+
+// Permissions of the request types that had none of their own
+const (
+	PERMISSION_ASSIGN_ROLE         = "ASSIGN_ROLE"
+	PERMISSION_CONNECT_INTEGRATION = "CONNECT_INTEGRATION"
+	PERMISSION_CREATE_ACCOUNT      = "CREATE_ACCOUNT"
+)
+
+// RequestPermissions are the permissions an approver needs for each action
+// on a request type. An empty permission leaves the action open to every
+// member of the company.
+type RequestPermissions struct {
+	Accept string
+	Reject string
+	View   string
+}
+
+func (p RequestPermissions) forAction(action string) string {
+	switch action {
+	case REQUEST_ACTION_ACCEPT:
+		return p.Accept
+	case REQUEST_ACTION_REJECT:
+		return p.Reject
+	case REQUEST_ACTION_VIEW:
+		return p.View
+	}
+	return ""
+}
+
+var requestPermissions = map[string]RequestPermissions{}
+
+// requestControllerActions are the RequestController actions guarded by the
+// interceptor and the request action each one performs. The other actions
+// check their own caller: requesters act on their own requests and the
+// approval policies are for company admins.
+var requestControllerActions = map[string]string{
+	"AcceptRequest":     REQUEST_ACTION_ACCEPT,
+	"RejectRequest":     REQUEST_ACTION_REJECT,
+	"GetRequests":       REQUEST_ACTION_VIEW,
+	"PreviewDisconnect": REQUEST_ACTION_VIEW,
+}
+
+func init() {
+	revel.InterceptMethod(RequestController.authorizeRequestAction, revel.BEFORE)
+}
+
+/*
+****************
+RegisterRequestPermissions()
+- Declares the permissions of a request type. Called from init() of the file
+implementing its handler, next to RegisterRequestHandler.
+****************
+*/
+func RegisterRequestPermissions(requestType string, permissions RequestPermissions) {
+	requestPermissions[requestType] = permissions
+}
+
+/*
+****************
+AuthorizeRequestAction()
+- Checks that the user holds the permission the request type declares for
+the action. Company admins hold every request permission. The error is a
+403 naming the missing permission.
+****************
+*/
+func AuthorizeRequestAction(companyID, userID, requestType, action string) error {
+	permissions, ok := requestPermissions[requestType]
+	if !ok {
+		return NewRequestError(400, "Unsupported request type: "+requestType)
+	}
+	permission := permissions.forAction(action)
+	if permission == "" {
+		return nil
+	}
+	if hasActivePermission(permission, userID, companyID) {
+		return nil
+	}
+	if isAdmin, err := isCompanyAdmin(companyID, userID); err == nil && isAdmin {
+		return nil
+	}
+	return NewRequestError(403, "Missing permission "+permission+" to "+action+" "+requestType+" requests")
+}
+
+// isCompanyAdmin reports whether the user is an admin of this company.
+// ops.CheckUserRole would also accept an admin of any other company, and an
+// admin grant that has ended but is not revoked yet.
+func isCompanyAdmin(companyID, userID string) (bool, error) {
+	grant := newUserRoleGrant(userID, constants.ROLE_ID_COMPANY_ADMIN, companyID, 0)
+	current, err := getUserRoleGrant(grant.PK, grant.SK)
+	if err == ErrRoleGrantChanged {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return current.Active(time.Now()), nil
+}
+
+// viewableRequestTypes returns the request types the user may view.
+func viewableRequestTypes(companyID, userID string) []string {
+	var requestTypes []string
+	for requestType := range requestPermissions {
+		if AuthorizeRequestAction(companyID, userID, requestType, REQUEST_ACTION_VIEW) == nil {
+			requestTypes = append(requestTypes, requestType)
+		}
+	}
+	return requestTypes
+}
+
+/*
+****************
+authorizeRequestAction()
+- Interceptor of RequestController. Resolves the request type of the call
+from the stored request, without writing anything, and rejects the call
+with a 403 when the user lacks the permission of the action. Calls without
+a resolvable request are left to the action, which answers them with its
+own 400 or 404. Decisions are checked again in prepareRequestDecision,
+which also covers the batch, Slack and email paths.
+****************
+*/
+func (c RequestController) authorizeRequestAction() revel.Result {
+	action, ok := requestControllerActions[c.MethodName]
+	if !ok {
+		return nil
+	}
+	companyID, _ := c.ViewArgs["companyID"].(string)
+	userID, _ := c.ViewArgs["userID"].(string)
+	if companyID == "" || userID == "" {
+		return nil
+	}
+
+	var requestTypes []string
+	switch c.MethodName {
+	case "GetRequests":
+		// without a type filter the inbox is narrowed to the viewable types
+		c.Params.Bind(&requestTypes, "request_type")
+	case "PreviewDisconnect":
+		requestTypes = []string{constants.REQUEST_DISCONNECT_INTEGRATION}
+	default:
+		// the permission is the one of the stored type, whatever the call says
+		decision := bindRequestDecision(c.Controller)
+		if decision.NotificationID == "" {
+			return nil
+		}
+		request, err := PeekRequestByNotificationID(decision.NotificationID, companyID)
+		if err != nil {
+			return nil
+		}
+		if decision.RequestType != "" && decision.RequestType != request.RequestType {
+			return renderRequestError(c.Controller, NewRequestError(422, "requestType does not match the request"))
+		}
+		requestTypes = []string{request.RequestType}
+	}
+
+	for _, requestType := range requestTypes {
+		if _, ok := requestPermissions[requestType]; !ok {
+			continue
+		}
+		if err := AuthorizeRequestAction(companyID, userID, requestType, action); err != nil {
+			return renderRequestError(c.Controller, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,452 @@
+package controllers
+
+import (
+	"errors"
+	"grooper/app"
+	"grooper/app/constants"
+	"grooper/app/models"
+	ops "grooper/app/operations"
+	"grooper/app/utils"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/revel/revel"
+)
+
+const (
+	PREFIX_REQUEST_COMMENT       = "COMMENT#"
+	ENTITY_TYPE_REQUEST_COMMENT  = "REQUEST_COMMENT"
+	NOTIFICATION_REQUEST_COMMENT = "REQUEST_COMMENT"
+	REQUEST_MAX_COMMENT_LENGTH   = 1000
+	REQUEST_PARTY_REQUESTER      = "REQUESTER"
+	REQUEST_PARTY_APPROVER       = "APPROVER"
+)
+
+// RequestComment is one message of the discussion between the approvers and
+// the requester of a request.
+type RequestComment struct {
+	PK         string `json:"PK,omitempty"`
+	SK         string `json:"SK,omitempty"`
+	CommentID  string `json:"CommentID,omitempty"`
+	RequestID  string `json:"RequestID,omitempty"`
+	CompanyID  string `json:"CompanyID,omitempty"`
+	AuthorID   string `json:"AuthorID,omitempty"`
+	AuthorRole string `json:"AuthorRole,omitempty"`
+	Body       string `json:"Body,omitempty"`
+	CreatedAt  string `json:"CreatedAt,omitempty"`
+	Type       string `json:"Type,omitempty"`
+}
+
+/*
+****************
+AddRequestComment()
+- Stores a comment on the request
+****************
+*/
+func AddRequestComment(request Request, authorID, authorRole, body string) (RequestComment, error) {
+	commentID := utils.GenerateTimestampWithUID()
+	comment := RequestComment{
+		PK:         utils.AppendPrefix(PREFIX_REQUEST, request.RequestID),
+		SK:         utils.AppendPrefix(PREFIX_REQUEST_COMMENT, commentID),
+		CommentID:  commentID,
+		RequestID:  request.RequestID,
+		CompanyID:  request.CompanyID,
+		AuthorID:   authorID,
+		AuthorRole: authorRole,
+		Body:       body,
+		CreatedAt:  utils.GetCurrentTimestamp(),
+		Type:       ENTITY_TYPE_REQUEST_COMMENT,
+	}
+
+	av, err := dynamodbattribute.MarshalMap(comment)
+	if err != nil {
+		return comment, errors.New(constants.HTTP_STATUS_500)
+	}
+
+	_, err = app.SVC.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(app.TABLE_NAME),
+	})
+	if err != nil {
+		return comment, errors.New(constants.HTTP_STATUS_500)
+	}
+
+	return comment, nil
+}
+
+/*
+****************
+DeleteRequestComment()
+- Removes a comment from the request
+****************
+*/
+func DeleteRequestComment(comment RequestComment) error {
+	_, err := app.SVC.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(comment.PK),
+			},
+			"SK": {
+				S: aws.String(comment.SK),
+			},
+		},
+	})
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+	return nil
+}
+
+/*
+****************
+GetRequestComments()
+- Returns the comments of a request, oldest first
+****************
+*/
+func GetRequestComments(requestID string) ([]RequestComment, error) {
+	comments := []RequestComment{}
+
+	params := &dynamodb.QueryInput{
+		TableName: aws.String(app.TABLE_NAME),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"PK": {
+				ComparisonOperator: aws.String(constants.CONDITION_EQUAL),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(utils.AppendPrefix(PREFIX_REQUEST, requestID)),
+					},
+				},
+			},
+			"SK": {
+				ComparisonOperator: aws.String(constants.CONDITION_BEGINS_WITH),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(PREFIX_REQUEST_COMMENT),
+					},
+				},
+			},
+		},
+		ScanIndexForward: aws.Bool(true),
+	}
+
+	var items []map[string]*dynamodb.AttributeValue
+	err := app.SVC.QueryPages(params, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		items = append(items, page.Items...)
+		return true
+	})
+	if err != nil {
+		return comments, errors.New(constants.HTTP_STATUS_500)
+	}
+
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &comments)
+	if err != nil {
+		return comments, errors.New(constants.HTTP_STATUS_400)
+	}
+
+	return comments, nil
+}
+
+/*
+****************
+getRequestApproverIDs()
+- Returns the users who were sent the request, one entry per user
+****************
+*/
+func getRequestApproverIDs(request Request) ([]string, error) {
+	var approverIDs []string
+
+	notifications, err := GetRequestNotifications(request.RequestID)
+	if err != nil {
+		return approverIDs, err
+	}
+
+	seen := map[string]bool{}
+	for _, notification := range notifications {
+		if !seen[notification.UserID] {
+			seen[notification.UserID] = true
+			approverIDs = append(approverIDs, notification.UserID)
+		}
+	}
+
+	return approverIDs, nil
+}
+
+// requestParty returns which side of the request the user is on, or an empty
+// string if the user takes no part in it.
+func requestParty(request Request, userID string) (string, error) {
+	if request.RequesterUserID == userID || request.RequestedBy == userID {
+		return REQUEST_PARTY_REQUESTER, nil
+	}
+
+	approverIDs, err := getRequestApproverIDs(request)
+	if err != nil {
+		return "", err
+	}
+	if utils.StringInSlice(userID, approverIDs) {
+		return REQUEST_PARTY_APPROVER, nil
+	}
+
+	return "", nil
+}
+
+/*
+****************
+notifyRequestComment()
+- Sends the comment to the other side of the request: the approvers when
+the requester wrote it, the requester otherwise
+****************
+*/
+func notifyRequestComment(c *revel.Controller, request Request, comment RequestComment) error {
+	author, err := GetCompanyUser(request.CompanyID, comment.AuthorID)
+	if err != nil {
+		return err
+	}
+
+	recipients := []string{request.RequesterUserID}
+	if comment.AuthorRole == REQUEST_PARTY_REQUESTER {
+		recipients, err = getRequestApproverIDs(request)
+		if err != nil {
+			return err
+		}
+	}
+
+	template := NewNotificationTemplate(MESSAGE_REQUEST_COMMENT, requesterName(author), comment.Body)
+	for _, recipientID := range recipients {
+		createdNotification, err := ops.CreateNotification(ops.CreateNotificationInput{
+			UserID:           recipientID,
+			NotificationType: NOTIFICATION_REQUEST_COMMENT,
+			NotificationContent: models.NotificationContentType{
+				RequesterUserID: request.RequesterUserID,
+				ActiveCompany:   request.CompanyID,
+				IsAccepted:      requestNotificationStatus[request.Status],
+				Message:         template.Render(userMessageLocale(recipientID)),
+			},
+			Global: false,
+		}, c)
+		if err != nil {
+			return errors.New("Unable to create notification for " + recipientID)
+		}
+		if err := SetNotificationTemplate(createdNotification, &template); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// validateRequestComment trims the comment and checks its length.
+func validateRequestComment(body string) (string, error) {
+	body = strings.TrimSpace(body)
+	if body == "" {
+		return body, NewRequestError(400, "Missing required parameter - comment")
+	}
+	if len(body) > REQUEST_MAX_COMMENT_LENGTH {
+		return body, NewRequestError(422, "Comment must be at most "+strconv.Itoa(REQUEST_MAX_COMMENT_LENGTH)+" characters")
+	}
+	return body, nil
+}
+
+/*
+****************
+RequestMoreInfo()
+- Puts a pending request on hold until the requester answers the approver's
+question. The question is the first comment of the thread.
+Params:
+notification_id - required
+comment - required
+****************
+*/
+func (c RequestController) RequestMoreInfo() revel.Result {
+	var notificationID string
+	var body string
+	companyID := c.ViewArgs["companyID"].(string)
+	userID := c.ViewArgs["userID"].(string)
+	c.Params.Bind(&notificationID, "notification_id")
+	c.Params.Bind(&body, "comment")
+	data := make(map[string]interface{})
+
+	body, err := validateRequestComment(body)
+	if err != nil {
+		return renderRequestError(c.Controller, err)
+	}
+
+	request, err := GetRequestByNotificationID(notificationID, companyID)
+	if err != nil {
+		c.Response.Status = 404
+		return c.RenderJSON(models.ErrorResponse{
+			Code:    "404",
+			Message: "Unable to retrieve request",
+		})
+	}
+	if request.Status != REQUEST_STATUS_PENDING {
+		return renderRequestNotPending(c.Controller, request)
+	}
+
+	party, err := requestParty(request, userID)
+	if err != nil {
+		return renderRequestError(c.Controller, NewRequestError(500, "Unable to retrieve approvers"))
+	}
+	if party != REQUEST_PARTY_APPROVER {
+		return renderRequestError(c.Controller, NewRequestError(403, "You are not an approver of this request"))
+	}
+
+	// the question is stored before the hold, a request must never wait on
+	// the requester without telling them what for
+	comment, err := AddRequestComment(request, userID, party, body)
+	if err != nil {
+		data["status"] = utils.GetHTTPStatus(err.Error())
+		return c.RenderJSON(data)
+	}
+
+	if err := TransitionRequest(&request, REQUEST_STATUS_NEEDS_INFO, userID, ""); err != nil {
+		if err := DeleteRequestComment(comment); err != nil {
+			revel.AppLog.Error("RequestMoreInfo: unable to remove the question on request "+request.RequestID, err)
+		}
+		return renderRequestNotPending(c.Controller, request)
+	}
+
+	template := NewNotificationTemplate(MESSAGE_REQUEST_INFO, body)
+	createdNotification, err := ops.CreateNotification(ops.CreateNotificationInput{
+		UserID:           request.RequesterUserID,
+		NotificationType: constants.REQUEST_STATUS_UPDATE,
+		NotificationContent: models.NotificationContentType{
+			RequesterUserID: request.RequesterUserID,
+			ActiveCompany:   companyID,
+			IsAccepted:      requestNotificationStatus[REQUEST_STATUS_NEEDS_INFO],
+			Message:         template.Render(userMessageLocale(request.RequesterUserID)),
+		},
+		Global: false,
+	}, c.Controller)
+	if err != nil || SetNotificationTemplate(createdNotification, &template) != nil {
+		data["notifications"] = "error while notifying the requester"
+	}
+
+	if err := SyncRequestNotifications(request); err != nil {
+		data["notifications"] = "error while updating request notifications"
+	}
+
+	data["request"] = request
+	data["comment"] = comment
+	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+	return c.RenderJSON(data)
+}
+
+// RequestCommentParams is the body of CommentOnRequest.
+type RequestCommentParams struct {
+	RequestID string `json:"request_id,omitempty"`
+	Comment   string `json:"comment,omitempty"`
+}
+
+/*
+****************
+CommentOnRequest()
+- Adds a comment to the request's thread and notifies the other side. A
+reply from the requester puts a request waiting on them back in review.
+Body:
+request_id - required
+comment - required
+****************
+*/
+func (c RequestController) CommentOnRequest() revel.Result {
+	companyID := c.ViewArgs["companyID"].(string)
+	userID := c.ViewArgs["userID"].(string)
+	data := make(map[string]interface{})
+
+	var input RequestCommentParams
+	c.Params.BindJSON(&input)
+
+	body, err := validateRequestComment(input.Comment)
+	if err != nil {
+		return renderRequestError(c.Controller, err)
+	}
+
+	request, err := GetRequestByID(companyID, input.RequestID)
+	if err != nil {
+		c.Response.Status = 404
+		return c.RenderJSON(models.ErrorResponse{
+			Code:    "404",
+			Message: "Unable to retrieve request",
+		})
+	}
+	if !IsRequestOpen(request.Status) {
+		return renderRequestNotPending(c.Controller, request)
+	}
+
+	party, err := requestParty(request, userID)
+	if err != nil {
+		return renderRequestError(c.Controller, NewRequestError(500, "Unable to retrieve approvers"))
+	}
+	if party == "" {
+		return renderRequestError(c.Controller, NewRequestError(403, "You take no part in this request"))
+	}
+
+	comment, err := AddRequestComment(request, userID, party, body)
+	if err != nil {
+		data["status"] = utils.GetHTTPStatus(err.Error())
+		return c.RenderJSON(data)
+	}
+
+	if party == REQUEST_PARTY_REQUESTER && request.Status == REQUEST_STATUS_NEEDS_INFO {
+		if err := TransitionRequest(&request, REQUEST_STATUS_PENDING, userID, ""); err == nil {
+			if err := SyncRequestNotifications(request); err != nil {
+				data["notifications"] = "error while updating request notifications"
+			}
+		}
+	}
+
+	if err := notifyRequestComment(c.Controller, request, comment); err != nil {
+		data["notifications"] = "error while sending the comment"
+	}
+
+	data["request"] = request
+	data["comment"] = comment
+	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+	return c.RenderJSON(data)
+}
+
+/*
+****************
+GetRequestThread()
+- Returns the comments of a request to its requester and approvers
+Params:
+request_id - required
+****************
+*/
+func (c RequestController) GetRequestThread() revel.Result {
+	companyID := c.ViewArgs["companyID"].(string)
+	userID := c.ViewArgs["userID"].(string)
+	requestID := c.Params.Get("request_id")
+	data := make(map[string]interface{})
+
+	request, err := GetRequestByID(companyID, requestID)
+	if err != nil {
+		c.Response.Status = 404
+		return c.RenderJSON(models.ErrorResponse{
+			Code:    "404",
+			Message: "Unable to retrieve request",
+		})
+	}
+
+	party, err := requestParty(request, userID)
+	if err != nil {
+		return renderRequestError(c.Controller, NewRequestError(500, "Unable to retrieve approvers"))
+	}
+	if party == "" {
+		return renderRequestError(c.Controller, NewRequestError(403, "You take no part in this request"))
+	}
+
+	comments, err := GetRequestComments(request.RequestID)
+	if err != nil {
+		data["status"] = utils.GetHTTPStatus(err.Error())
+		return c.RenderJSON(data)
+	}
+
+	data["request"] = request
+	data["comments"] = comments
+	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+	return c.RenderJSON(data)
+}
@@ -4,8 +4,6 @@ import (
 	"errors"
 	"grooper/app"
 	"grooper/app/constants"
-	slackoperations "grooper/app/integrations/slack"
-	"grooper/app/mail"
 	"grooper/app/models"
 	ops "grooper/app/operations"
 	"grooper/app/utils"
@@ -15,9 +13,7 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
-	"github.com/revel/modules/jobs/app/jobs"
 	"github.com/revel/revel"
-	"github.com/revel/revel/cache"
 )
 
 type RequestController struct {
@@ -28,827 +24,541 @@ type RequestController struct {
 ****************
 AcceptRequest()
 - Accept request depending on type (group, role, integration).
+The work specific to each type is done by its RequestHandler. Every user is
+processed; the response lists the result of each and is a 207 when only
+some of them could be accepted.
 ****************
 */
 func (c RequestController) AcceptRequest() revel.Result {
-	var userIDs []string
-	var requestType string
-	var notificationID string
 	companyID := c.ViewArgs["companyID"].(string)
-	c.Params.Bind(&userIDs, "user_id")
-	c.Params.Bind(&notificationID, "notification_id")
-	c.Params.Bind(&requestType, "requestType")
-	data := make(map[string]interface{})
+	decision := bindRequestDecision(c.Controller)
+
+	call, replayed := beginIdempotentCall(c.Controller, companyID, IDEMPOTENCY_ACTION_ACCEPT, decision)
+	if replayed != nil {
+		return replayed
+	}
 
-	company, opsError := ops.GetCompanyByID(companyID)
-	_, _ = company, opsError
+	_, opsError := ops.GetCompanyByID(companyID)
 	if opsError != nil {
+		if err := call.Release(); err != nil {
+			revel.AppLog.Error("AcceptRequest: unable to release idempotency key", err)
+		}
 		return c.RenderJSON(opsError)
 	}
 
-	companyAdmins, err := ops.GetCompanyAdminsByRoleID(companyID, constants.ROLE_ID_COMPANY_ADMIN)
-	_, _ = companyAdmins, err
-	if err != nil {
-		c.Response.Status = 400
-		return c.RenderJSON(models.ErrorResponse{
-			Code:    "400",
-			Message: "Unable to retrieve Company Admins",
-		})
-	}
+	result := acceptRequestDecision(c.Controller, decision)
 
-	for _, userID := range userIDs {
-		user, opsErr := ops.GetUserByIDNew(userID)
-		_, _ = user, opsErr
-		if opsErr != nil {
-			return c.RenderJSON(opsErr)
+	// only a call that went through is replayed, a failed one may be retried
+	if result.StatusCode == 200 || result.StatusCode == 207 {
+		if err := call.Complete(result.StatusCode, result.Body); err != nil {
+			revel.AppLog.Error("AcceptRequest: unable to store idempotent result", err)
 		}
+	} else if err := call.Release(); err != nil {
+		revel.AppLog.Error("AcceptRequest: unable to release idempotency key", err)
+	}
 
-		requesterInfo, err := ops.GetCompanyMember(ops.GetCompanyMemberParams{
-			UserID:    userID,
-			CompanyID: companyID,
-		}, c.Controller)
-		if err != nil {
-			c.Response.Status = 400
-			return c.RenderJSON(models.ErrorResponse{
-				Code:    "400",
-				Message: "Unable to retrieve Company user",
-			})
+	c.Response.Status = result.StatusCode
+	return c.RenderJSON(result.Body)
+}
+
+/*
+****************
+RejectRequest()
+- Reject request depending on type (group, role, integration).
+The optional reason is passed on to the requester. Like AcceptRequest,
+every user is processed and reported on.
+****************
+*/
+
+func (c RequestController) RejectRequest() revel.Result {
+	companyID := c.ViewArgs["companyID"].(string)
+	decision := bindRequestDecision(c.Controller)
+
+	call, replayed := beginIdempotentCall(c.Controller, companyID, IDEMPOTENCY_ACTION_REJECT, decision)
+	if replayed != nil {
+		return replayed
+	}
+
+	_, opsError := ops.GetCompanyByID(companyID)
+	if opsError != nil {
+		if err := call.Release(); err != nil {
+			revel.AppLog.Error("RejectRequest: unable to release idempotency key", err)
 		}
-		_, _ = requesterInfo, err
-		notificationContent := models.NotificationContentType{
-			RequesterUserID: requesterInfo.UserID,
-			ActiveCompany:   companyID,
-			IsAccepted:      "ACCEPTED",
+		return c.RenderJSON(opsError)
+	}
+
+	result := rejectRequestDecision(c.Controller, decision)
+
+	// only a call that went through is replayed, a failed one may be retried
+	if result.StatusCode == 200 || result.StatusCode == 207 {
+		if err := call.Complete(result.StatusCode, result.Body); err != nil {
+			revel.AppLog.Error("RejectRequest: unable to store idempotent result", err)
 		}
-		if groupID := c.Params.Get("group_id"); groupID != "" {
-			groupID := c.Params.Form.Get("group_id")
-			memberType := c.Params.Form.Get("member_type")
-			var memberRole, typeGroup, prefix string
-			memberRole = constants.MEMBER_TYPE_USER
-			typeGroup = constants.ENTITY_TYPE_GROUP_MEMBER
-			prefix = constants.PREFIX_USER
-			var recipients []mail.Recipient
-			var members []models.GroupMember
-			var inputRequest []*dynamodb.WriteRequest
-			var membersInput *dynamodb.BatchWriteItemInput
-			requestUserId := c.ViewArgs["userID"].(string)
-			checked := ops.CheckPermissions(constants.ADD_GROUP_MEMBER, requestUserId, companyID)
-			if !checked {
-				data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_401)
-				return c.RenderJSON(data)
-			}
-			group, err := GetGroupByID(groupID)
-			if err != nil {
-				data["error"] = "Group not exists."
-				data["status"] = utils.GetHTTPStatus(err.Error())
-				return c.RenderJSON(data)
-			}
-			members = append(members, models.GroupMember{
-				PK:         utils.AppendPrefix(constants.PREFIX_GROUP, groupID),
-				SK:         utils.AppendPrefix(prefix, userID),
-				CompanyID:  c.ViewArgs["companyID"].(string),
-				GroupID:    groupID,
-				MemberID:   userID,
-				Status:     constants.ITEM_STATUS_ACTIVE,
-				MemberType: memberType,
-				MemberRole: memberRole,
-				CreatedAt:  utils.GetCurrentTimestamp(),
-				UpdatedAt:  utils.GetCurrentTimestamp(),
-				Type:       typeGroup,
-			})
-			recipients = append(recipients, mail.Recipient{
-				Name:       user.FirstName + " " + user.LastName,
-				Email:      user.Email,
-				GroupName:  group.GroupName,
-				ActionType: "added",
-			})
-			for _, member := range members {
-				inputRequest = append(inputRequest, &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{
-					Item: map[string]*dynamodb.AttributeValue{
-						"PK": &dynamodb.AttributeValue{
-							S: aws.String(member.PK),
-						},
-						"SK": &dynamodb.AttributeValue{
-							S: aws.String(member.SK),
-						},
-						"CompanyID": &dynamodb.AttributeValue{
-							S: aws.String(member.CompanyID),
-						},
-						"GroupID": &dynamodb.AttributeValue{
-							S: aws.String(member.GroupID),
-						},
-						"MemberID": &dynamodb.AttributeValue{
-							S: aws.String(member.MemberID),
-						},
-						"Status": &dynamodb.AttributeValue{
-							S: aws.String(member.Status),
-						},
-						"MemberType": &dynamodb.AttributeValue{
-							S: aws.String(member.MemberType),
-						},
-						"MemberRole": &dynamodb.AttributeValue{
-							S: aws.String(member.MemberRole),
-						},
-						"CreatedAt": &dynamodb.AttributeValue{
-							S: aws.String(member.CreatedAt),
-						},
-						"UpdatedAt": &dynamodb.AttributeValue{
-							S: aws.String(member.UpdatedAt),
-						},
-						"Type": &dynamodb.AttributeValue{
-							S: aws.String(member.Type),
-						},
-					},
-				}})
-				go cache.Set("member_"+member.MemberID, member, 30*time.Minute)
-			}
-			jobs.Now(mail.SendEmail{
-				Subject:    "You have been added to a group",
-				Recipients: recipients,
-				Template:   "notify_group_member.html",
-			})
-			membersInput = &dynamodb.BatchWriteItemInput{
-				RequestItems: map[string][]*dynamodb.WriteRequest{
-					app.TABLE_NAME: inputRequest,
-				},
-			}
-			batchRes, err := app.SVC.BatchWriteItem(membersInput)
-			_ = batchRes
-
-			//ERROR AT INSERTING
-			if err != nil {
-				data["message"] = "Got error in put item (MEMBERS)"
-				data["error"] = err.Error()
-				data["status"] = utils.GetHTTPStatus(err.Error())
-				return c.RenderJSON(data)
-			}
-			notificationContent.Message = requesterInfo.FirstName + " " + requesterInfo.LastName + "'s request to join " + group.GroupName + " has been accepted."
-			notificationContent.GroupID = groupID
-			////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-		} else if roleIDs := c.Params.Values["role_id[]"]; len(roleIDs) > 0 {
-			c.Params.Bind(&roleIDs, "role_id")
-			var rolesRequested []string
-			for _, roleID := range roleIDs {
-
-				role, opsErr := ops.GetRoleByID(roleID, companyID)
-				_, _ = role, opsErr
-				if opsErr != nil {
-					return c.RenderJSON(opsErr)
-				}
-				rolesRequested = append(rolesRequested, role.RoleName)
-				item := models.UserRole{
-					PK:        utils.AppendPrefix(constants.PREFIX_USER, userID),
-					SK:        utils.AppendPrefix(utils.AppendPrefix(constants.PREFIX_ROLE, roleID), utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
-					UserID:    userID,
-					RoleID:    roleID,
-					CompanyID: companyID,
-					Type:      constants.ENTITY_TYPE_USER_ROLE,
-				}
-				av, err := dynamodbattribute.MarshalMap(item)
-				if err != nil {
-					data["error"] = "Error at marshalmap"
-					data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_500)
-					return c.RenderJSON(data)
-				}
-				input := &dynamodb.PutItemInput{
-					Item:      av,
-					TableName: aws.String(app.TABLE_NAME),
-				}
-				_, err = app.SVC.PutItem(input)
-				if err != nil {
-					data["error"] = "Cannot assign role due to server error"
-					data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_500)
-					return c.RenderJSON(data)
-				}
-				if len(rolesRequested) == 1 {
-					notificationContent.Message = requesterInfo.FirstName + " " + requesterInfo.LastName + "'s request to take on the role of " + rolesRequested[0] + " has been accepted."
-				} else {
-					notificationContent.Message = requesterInfo.FirstName + " " + requesterInfo.LastName + "'s request to take on the following roles: " + strings.Join(rolesRequested, ", ") + " has been accepted."
-				}
-				notificationContent.RolesRequested = roleIDs
-			}
-			/////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////////
-		} else if integrationIDs := c.Params.Values["integration_id[]"]; len(integrationIDs) > 0 {
-			c.Params.Bind(&integrationIDs, "integration_id")
-			requestUserId := c.ViewArgs["userID"].(string)
-			//authToken := c.Params.Form.Get("authToken")
-			var requestAction string
-			if requestType == constants.REQUEST_CONNECT_INTEGRATION {
-				requestAction = "connect"
-			} else {
-				requestAction = "disconnect"
-			}
-			var integrationsRequested []string
-			for _, integ := range integrationIDs {
-				integInfo, err := ops.GetIntegrationByID(integ)
-				if err != nil {
-					c.Response.Status = 400
-					return c.RenderJSON(models.ErrorResponse{
-						Code:    "400",
-						Message: "Unable to retrieve Integrations",
-					})
-				}
-				integrationsRequested = append(integrationsRequested, integInfo.IntegrationName)
-				if requestType == constants.REQUEST_CONNECT_INTEGRATION {
-
-				} else {
-					checked := ops.CheckPermissions(constants.DISCONNECT_INTEGRATION, requestUserId, companyID)
-					if !checked {
-						data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_401)
-						return c.RenderJSON(data)
-					}
-					res, getErr := app.SVC.GetItem(&dynamodb.GetItemInput{
-						TableName: aws.String(app.TABLE_NAME),
-						Key: map[string]*dynamodb.AttributeValue{
-							"PK": {
-								S: aws.String(utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
-							},
-							"SK": {
-								S: aws.String(utils.AppendPrefix(constants.PREFIX_INTEGRATION, integInfo.IntegrationID)),
-							},
-						},
-					})
-					if getErr != nil {
-						data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_500)
-						return c.RenderJSON(data)
-					}
-
-					if res.Item == nil {
-						data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_404)
-						return c.RenderJSON(data)
-					}
-					integrationConnected, operationErr := ops.GetIntegrationByID(integInfo.IntegrationID)
-					if operationErr != nil {
-						data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_404)
-						return c.RenderJSON(c.Result)
-					}
-					integrationSlug := integrationConnected.IntegrationSlug
-					if integrationConnected.IntegrationSlug == constants.INTEG_SLUG_SLACK {
-						integrationInfo, opssError := ops.GetCompanyIntegration(companyID, integrationConnected.IntegrationID)
-						if opssError != nil || integrationInfo.IntegrationToken == nil || integrationInfo.IntegrationToken.AccessToken == "" {
-							c.Response.Status = 401
-							return c.RenderJSON(models.ErrorResponse{
-								HTTPStatusCode: 401,
-								Message:        "GetSlackToken Error: Slack token not found",
-								Status:         utils.GetHTTPStatus(constants.HTTP_STATUS_401),
-							})
-						}
-
-						_, slackErr := slackoperations.UninstallAppFromSlackWorkspace("Bearer " + integrationInfo.IntegrationToken.AccessToken)
-						if slackErr != nil {
-							data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_500)
-							return c.RenderJSON(c.Result)
-						}
-					}
-					input := &dynamodb.DeleteItemInput{
-						Key: map[string]*dynamodb.AttributeValue{
-							"PK": {
-								S: aws.String(utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
-							},
-							"SK": {
-								S: aws.String(utils.AppendPrefix(constants.PREFIX_INTEGRATION, integrationConnected.IntegrationID)),
-							},
-						},
-						TableName: aws.String(app.TABLE_NAME),
-					}
-					_, err = app.SVC.DeleteItem(input)
-					if err != nil {
-						data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_500)
-						return c.RenderJSON(data)
-					}
-					subIntegrations, err := GetSubIntegrations(integrationConnected.IntegrationID)
-					if err == nil {
-						var connectedGroups []models.Integration
-						for _, sub := range subIntegrations {
-							cg := GetGroupsIntegrationConnection(sub.IntegrationID, companyID)
-							connectedGroups = append(connectedGroups, cg...)
-						}
-						emptyCg := GetGroupsIntegrationEmptySubConnection(integrationConnected.IntegrationID, companyID)
-						connectedGroups = append(connectedGroups, emptyCg...)
-
-						if len(connectedGroups) != 0 {
-							batchLimit := 25
-							var batches [][]*dynamodb.WriteRequest
-							var currentBatch []*dynamodb.WriteRequest
-
-							if integrationSlug == constants.INTEG_SLUG_ORACLE {
-
-								// Remove Connected Oracle Autonomous DB - OAuth
-								for i, g := range connectedGroups {
-
-									connectedDBs, err := ops.GetConnectedItemBySlug(g.GroupID, constants.INTEG_SLUG_ORACLE_AUTONOMOUS_DB)
-									if err != nil {
-										data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_400)
-										return c.RenderJSON(err.Error())
-									}
-
-									for _, dbID := range connectedDBs {
-										currentBatch = append(currentBatch, &dynamodb.WriteRequest{DeleteRequest: &dynamodb.DeleteRequest{
-											Key: map[string]*dynamodb.AttributeValue{
-												"PK": {
-													S: aws.String(utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
-												},
-												"SK": {
-													S: aws.String(utils.AppendPrefix(constants.PREFIX_OAUTH, dbID)),
-												},
-											},
-										}})
-										if i%batchLimit == 0 {
-											batches = append(batches, currentBatch)
-											currentBatch = nil
-										}
-									}
-
-									if len(currentBatch) > 0 && len(currentBatch) != batchLimit {
-										batches = append(batches, currentBatch)
-									}
-
-									_, err = ops.BatchWriteItemHandler(batches)
-									if err != nil {
-										data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_400)
-										return c.RenderJSON(err.Error())
-									}
-
-								}
-							}
-
-							// remove group and integration connection
-							for i, g := range connectedGroups {
-								currentBatch = append(currentBatch, &dynamodb.WriteRequest{DeleteRequest: &dynamodb.DeleteRequest{
-									Key: map[string]*dynamodb.AttributeValue{
-										"PK": {
-											S: aws.String(utils.AppendPrefix(constants.PREFIX_GROUP, g.GroupID)),
-										},
-										"SK": {
-											S: aws.String(utils.AppendPrefix(constants.PREFIX_INTEGRATION, integrationConnected.IntegrationID)),
-										},
-									},
-								}})
-								if i%batchLimit == 0 {
-									batches = append(batches, currentBatch)
-									currentBatch = nil
-								}
-							}
-
-							if len(currentBatch) > 0 && len(currentBatch) != batchLimit {
-								batches = append(batches, currentBatch)
-							}
-
-							_, err = ops.BatchWriteItemHandler(batches)
-							if err != nil {
-								data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_400)
-								return c.RenderJSON(err.Error())
-							}
-
-							// remove group and sub integration connection
-							for i, g := range connectedGroups {
-								currentBatch = append(currentBatch, &dynamodb.WriteRequest{DeleteRequest: &dynamodb.DeleteRequest{
-									Key: map[string]*dynamodb.AttributeValue{
-										"PK": {
-											S: aws.String(g.PK),
-										},
-										"SK": {
-											S: aws.String(g.SK),
-										},
-									},
-								}})
-								if i%batchLimit == 0 {
-									batches = append(batches, currentBatch)
-									currentBatch = nil
-								}
-							}
-
-							if len(currentBatch) > 0 && len(currentBatch) != batchLimit {
-								batches = append(batches, currentBatch)
-							}
-
-							_, err := ops.BatchWriteItemHandler(batches)
-							if err != nil {
-								data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_400)
-								return c.RenderJSON(err.Error())
-							}
-
-						}
-					}
-				}
-				if len(integrationsRequested) == 1 {
-					if requestType == constants.REQUEST_CONNECT_INTEGRATION {
-						notificationContent.Message = requesterInfo.FirstName + " " + requesterInfo.LastName + "'s request to " + requestAction + " " + integrationsRequested[0] + " has been checked and is in progress for connection."
-					} else {
-						notificationContent.Message = requesterInfo.FirstName + " " + requesterInfo.LastName + "'s request to " + requestAction + " " + integrationsRequested[0] + " has been accepted."
-					}
-				} else {
-					if requestType == constants.REQUEST_CONNECT_INTEGRATION {
-						notificationContent.Message = requesterInfo.FirstName + " " + requesterInfo.LastName + "'s request to " + requestAction + " the following integrations: " + strings.Join(integrationsRequested, ", ") + " has been checked and is in progress for connection."
-					} else {
-						notificationContent.Message = requesterInfo.FirstName + " " + requesterInfo.LastName + "'s request to " + requestAction + " the following integrations: " + strings.Join(integrationsRequested, ", ") + " has been accepted."
-					}
-
-				}
-				notificationContent.RequestedIntegrations = integrationIDs
-			}
-		} else if requestType == "REQUEST_TO_CREATE_ACCOUNT" {
-			originalNotification, opsErr := ops.GetNotificationByID(notificationID)
-			if opsErr != nil {
-				c.Response.Status = 400
-				return c.RenderJSON(models.ErrorResponse{
-					Code:    "400",
-					Message: "Unable to retrieve original notification",
-				})
-			}
-
-			notificationContent.Integration = originalNotification.NotificationContent.Integration
-			integration := notificationContent.Integration
-
-			switch integration.IntegrationSlug {
-			case constants.INTEG_SLUG_GOOGLE_CLOUD:
-				notificationContent.Message = requesterInfo.FirstName + " " + requesterInfo.LastName + "'s request to create an account on Google Cloud has been accepted."
-			case constants.INTEG_SLUG_BITBUCKET:
-				notificationContent.Message = requesterInfo.FirstName + " " + requesterInfo.LastName + "'s request to be invited in Bitbucket has been accepted."
-			case constants.INTEG_SLUG_JIRA:
-				notificationContent.Message = requesterInfo.FirstName + " " + requesterInfo.LastName + "'s request to create an account on Jira has been accepted."
-			default:
-				notificationContent.Message = requesterInfo.FirstName + " " + requesterInfo.LastName + "'s request to create an account has been accepted."
-			}
-		} else {
-			c.Response.Status = 400
+	} else if err := call.Release(); err != nil {
+		revel.AppLog.Error("RejectRequest: unable to release idempotency key", err)
+	}
+
+	c.Response.Status = result.StatusCode
+	return c.RenderJSON(result.Body)
+}
+
+/*
+****************
+WithdrawRequest()
+- Lets the requester cancel a pending request. The notifications sent to
+the approvers are updated to show it was withdrawn.
+Params:
+request_id - required, unless notification_id is given
+notification_id - optional, any notification sent about the request
+****************
+*/
+func (c RequestController) WithdrawRequest() revel.Result {
+	companyID := c.ViewArgs["companyID"].(string)
+	userID := c.ViewArgs["userID"].(string)
+	requestID := c.Params.Get("request_id")
+	data := make(map[string]interface{})
+
+	// requests filed before they were stored are only known by their
+	// notifications
+	if notificationID := c.Params.Get("notification_id"); requestID == "" && notificationID != "" {
+		request, err := GetRequestByNotificationID(notificationID, companyID)
+		if err != nil {
+			c.Response.Status = 404
 			return c.RenderJSON(models.ErrorResponse{
-				Code:    "400",
-				Message: "No data received",
+				Code:    "404",
+				Message: "Unable to retrieve request",
 			})
 		}
-		// if len(companyAdmins) != 0 {
-		// 	for _, compAdmin := range companyAdmins {
-		// 		data["compAdmin"] = compAdmin.UserID
-		for _, userID := range userIDs {
-			sendNotificationToUser(c, userID, requesterInfo, requestType, true, notificationID, notificationContent)
-		}
-		// 	}
-		// }
+		requestID = request.RequestID
 	}
 
-	notification, opsErr := ops.GetNotificationByID(notificationID)
-	if opsErr == nil {
-		input := &dynamodb.UpdateItemInput{
-			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-				":s": {
-					BOOL: aws.Bool(true),
-				},
-				":ua": {
-					S: aws.String(utils.GetCurrentTimestamp()),
-				},
-			},
-			TableName: aws.String(app.TABLE_NAME),
-			Key: map[string]*dynamodb.AttributeValue{
-				"PK": {
-					S: aws.String(notification.PK),
-				},
-				"SK": {
-					S: aws.String(notification.SK),
-				},
-			},
-			UpdateExpression: aws.String("SET Seen = :s, UpdatedAt = :ua"),
-		}
+	request, result := c.loadOwnPendingRequest(companyID, userID, requestID)
+	if result != nil {
+		return result
+	}
 
-		res, err := app.SVC.UpdateItem(input)
-		if err != nil {
-		}
-		_ = res
+	requester, err := GetCompanyUser(companyID, request.RequesterUserID)
+	if err != nil {
+		c.Response.Status = 400
+		return c.RenderJSON(models.ErrorResponse{
+			Code:    "400",
+			Message: "Unable to retrieve Company user",
+		})
 	}
 
-	data["action"] = "Accept"
-	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+	if err := TransitionRequest(&request, REQUEST_STATUS_WITHDRAWN, userID, ""); err != nil {
+		return renderRequestNotPending(c.Controller, request)
+	}
 
+	template := NewNotificationTemplate(MESSAGE_REQUEST_WITHDRAW, requesterName(requester))
+	err = RewriteRequestNotifications(request, template, func(content *models.NotificationContentType) {
+		content.IsAccepted = requestNotificationStatus[REQUEST_STATUS_WITHDRAWN]
+	})
+	if err != nil {
+		data["notifications"] = "error while updating request notifications"
+	}
+
+	data["request"] = request
+	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
 	return c.RenderJSON(data)
 }
 
+// AmendRequestParams is the body of AmendRequest.
+type AmendRequestParams struct {
+	RequestID string   `json:"request_id,omitempty"`
+	Roles     []string `json:"roles,omitempty"`
+}
+
 /*
 ****************
-RejectRequest()
-- Reject request depending on type (group, role, integration).
+AmendRequest()
+- Lets the requester change the roles of a pending role request. Approvals
+given so far are dropped since they were for different roles, and the
+approvers' notifications are rewritten.
+Body:
+request_id - required
+roles[] - required
 ****************
 */
-
-func (c RequestController) RejectRequest() revel.Result {
-	var userIDs []string
-	var requestType string
-	var notificationID string
-	c.Params.Bind(&requestType, "requestType")
+func (c RequestController) AmendRequest() revel.Result {
 	companyID := c.ViewArgs["companyID"].(string)
-	c.Params.Bind(&userIDs, "user_id")
-	c.Params.Bind(&requestType, "requestType")
-	c.Params.Bind(&notificationID, "notification_id")
+	userID := c.ViewArgs["userID"].(string)
 	data := make(map[string]interface{})
-	company, opsError := ops.GetCompanyByID(companyID)
-	_, _ = company, opsError
-	if opsError != nil {
-		return c.RenderJSON(opsError)
+
+	var input AmendRequestParams
+	c.Params.BindJSON(&input)
+	input.Roles = uniqueStrings(input.Roles)
+
+	request, result := c.loadOwnPendingRequest(companyID, userID, input.RequestID)
+	if result != nil {
+		return result
 	}
-	for _, userID := range userIDs {
-		user, opsErr := ops.GetUserByIDNew(userID)
-		_, _ = user, opsErr
-		if opsErr != nil {
-			return c.RenderJSON(opsErr)
-		}
 
-		// companyAdmins, err := ops.GetCompanyAdminsByRoleID(companyID, constants.ROLE_ID_COMPANY_ADMIN)
-		// _, _ = companyAdmins, err
-		// if err != nil {
-		// 	c.Response.Status = 400
-		// 	return c.RenderJSON(models.ErrorResponse{
-		// 		Code:    "400",
-		// 		Message: "Unable to retrieve Company Admins",
-		// 	})
-		// }
-		requesterInfo, err := ops.GetCompanyMember(ops.GetCompanyMemberParams{
-			UserID:    userID,
-			CompanyID: companyID,
-		}, c.Controller)
-		if err != nil {
+	if request.RequestType != constants.REQUEST_COMPANY_ROLE_UPDATE {
+		c.Response.Status = 422
+		return c.RenderJSON(models.ErrorResponse{
+			Code:           "422",
+			HTTPStatusCode: 422,
+			Message:        "Only role requests can be amended",
+		})
+	}
+	if len(input.Roles) == 0 {
+		c.Response.Status = 400
+		return c.RenderJSON(models.ErrorResponse{
+			Code:           "400",
+			HTTPStatusCode: 400,
+			Message:        "Missing required parameter - roles",
+		})
+	}
+
+	var rolesRequested []models.Role
+	for _, roleID := range input.Roles {
+		roleInfo, opsErr := ops.GetRoleByID(roleID, companyID)
+		if opsErr != nil {
 			c.Response.Status = 400
 			return c.RenderJSON(models.ErrorResponse{
 				Code:    "400",
-				Message: "Unable to retrieve Company user",
+				Message: "Unable to retrieve Roles",
 			})
 		}
-		_, _ = requesterInfo, err
-		notificationContent := models.NotificationContentType{
-			RequesterUserID: requesterInfo.UserID,
-			ActiveCompany:   companyID,
-			IsAccepted:      "REJECTED",
-		}
-		if groupID := c.Params.Get("group_id"); groupID != "" {
-			groupID := c.Params.Form.Get("group_id")
-			group, err := GetGroupByID(groupID)
-			if err != nil {
-				data["error"] = "Group not exists."
-				data["status"] = utils.GetHTTPStatus(err.Error())
-				return c.RenderJSON(data)
-			}
-			notificationContent.Message = requesterInfo.FirstName + " " + requesterInfo.LastName + "'s request to join " + group.GroupName + " has been rejected."
-			notificationContent.GroupID = groupID
-		} else if roleIDs := c.Params.Values["role_id[]"]; len(roleIDs) > 0 {
-			c.Params.Bind(&roleIDs, "role_id")
-			var rolesRequested []string
-			for _, roleID := range roleIDs {
-				role, opsErr := ops.GetRoleByID(roleID, companyID)
-				_, _ = role, opsErr
-				if opsErr != nil {
-					return c.RenderJSON(opsErr)
-				}
-				rolesRequested = append(rolesRequested, role.RoleName)
-				if len(rolesRequested) == 1 {
-					notificationContent.Message = requesterInfo.FirstName + " " + requesterInfo.LastName + "'s request to take on the role of " + rolesRequested[0] + " has been rejected."
-				} else {
-					notificationContent.Message = requesterInfo.FirstName + " " + requesterInfo.LastName + "'s request to take on the following roles: " + strings.Join(rolesRequested, ", ") + " has been rejected."
-				}
-				notificationContent.RolesRequested = roleIDs
-			}
-		} else if integrationIDs := c.Params.Values["integration_id[]"]; len(integrationIDs) > 0 {
-			c.Params.Bind(&integrationIDs, "integration_id")
-			var requestAction string
-			if requestType == constants.REQUEST_CONNECT_INTEGRATION {
-				requestAction = "connect"
-			} else {
-				requestAction = "disconnect"
-			}
-			var integrationsRequested []string
-			for _, integ := range integrationIDs {
-				integInfo, err := ops.GetIntegrationByID(integ)
-				if err != nil {
-					c.Response.Status = 400
-					return c.RenderJSON(models.ErrorResponse{
-						Code:    "400",
-						Message: "Unable to retrieve Integrations",
-					})
-				}
-				integrationsRequested = append(integrationsRequested, integInfo.IntegrationName)
-				if len(integrationsRequested) == 1 {
-					notificationContent.Message = requesterInfo.FirstName + " " + requesterInfo.LastName + "'s request to " + requestAction + " to " + integrationsRequested[0] + " has been rejected."
-				} else {
-					notificationContent.Message = requesterInfo.FirstName + " " + requesterInfo.LastName + "'s request to " + requestAction + " to the following integrations: " + strings.Join(integrationsRequested, ", ") + " has been rejected."
-				}
-				notificationContent.RequestedIntegrations = integrationIDs
-			}
-		} else if requestType == "REQUEST_TO_CREATE_ACCOUNT" {
-			originalNotification, opsErr := ops.GetNotificationByID(notificationID)
-			if opsErr != nil {
-				c.Response.Status = 400
-				return c.RenderJSON(models.ErrorResponse{
-					Code:    "400",
-					Message: "Unable to retrieve original notification",
-				})
-			}
-
-			notificationContent.Integration = originalNotification.NotificationContent.Integration
-			integration := notificationContent.Integration
-
-			switch integration.IntegrationSlug {
-			case constants.INTEG_SLUG_GOOGLE_CLOUD:
-				notificationContent.Message = requesterInfo.FirstName + " " + requesterInfo.LastName + "'s request to create an account on Google Cloud has been rejected."
-			case constants.INTEG_SLUG_BITBUCKET:
-				notificationContent.Message = requesterInfo.FirstName + " " + requesterInfo.LastName + "'s request to be invited in Bitbucket has been rejected."
-			case constants.INTEG_SLUG_JIRA:
-				notificationContent.Message = requesterInfo.FirstName + " " + requesterInfo.LastName + "'s request to create an account on Jira has been rejected."
-			default:
-				notificationContent.Message = requesterInfo.FirstName + " " + requesterInfo.LastName + "'s request to create an account has been rejected."
-			}
-		} else {
-			c.Response.Status = 400
+		rolesRequested = append(rolesRequested, roleInfo)
+	}
+
+	pendingRequests, err := GetPendingRequestsOfUser(companyID, request.RequesterUserID, constants.REQUEST_COMPANY_ROLE_UPDATE)
+	if err != nil {
+		c.Response.Status = 500
+		return c.RenderJSON(models.ErrorResponse{
+			Code:    "500",
+			Message: "Error retrieving pending requests",
+			Status:  utils.GetHTTPStatus(constants.HTTP_STATUS_500),
+		})
+	}
+	for _, pending := range pendingRequests {
+		if pending.RequestID != request.RequestID && utils.ComparingSlices(pending.RolesRequested, input.Roles) {
+			c.Response.Status = 497
 			return c.RenderJSON(models.ErrorResponse{
-				Code:    "400",
-				Message: "No data received",
+				Code:    "497",
+				Message: "Request already submitted.",
+				Status:  utils.GetHTTPStatus(constants.HTTP_STATUS_497),
 			})
 		}
+	}
 
-		// if len(companyAdmins) != 0 {
-		// 	for _, compAdmin := range companyAdmins {
-		sendNotificationToUser(c, user.UserID, requesterInfo, requestType, false, notificationID, notificationContent)
-		// 	}
-		// }
+	requester, err := GetCompanyUser(companyID, request.RequesterUserID)
+	if err != nil {
+		c.Response.Status = 400
+		return c.RenderJSON(models.ErrorResponse{
+			Code:    "400",
+			Message: "Unable to retrieve Company user",
+		})
 	}
 
-	notification, opsErr := ops.GetNotificationByID(notificationID)
-	if opsErr == nil {
-		input := &dynamodb.UpdateItemInput{
-			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
-				":s": {
-					BOOL: aws.Bool(true),
-				},
-				":ua": {
-					S: aws.String(utils.GetCurrentTimestamp()),
-				},
-			},
-			TableName: aws.String(app.TABLE_NAME),
-			Key: map[string]*dynamodb.AttributeValue{
-				"PK": {
-					S: aws.String(notification.PK),
-				},
-				"SK": {
-					S: aws.String(notification.SK),
-				},
-			},
-			UpdateExpression: aws.String("SET Seen = :s, UpdatedAt = :ua"),
-		}
+	// approvals and links given before the change would approve roles their
+	// approver has not seen
+	if err := ClearRequestApprovals(request.RequestID, ""); err != nil {
+		c.Response.Status = 500
+		return c.RenderJSON(models.ErrorResponse{
+			Code:    "500",
+			Message: "Unable to clear the approvals of the request",
+			Status:  utils.GetHTTPStatus(constants.HTTP_STATUS_500),
+		})
+	}
+	if err := InvalidateRequestActionTokens(request.RequestID); err != nil {
+		c.Response.Status = 500
+		return c.RenderJSON(models.ErrorResponse{
+			Code:    "500",
+			Message: "Unable to invalidate the links of the request",
+			Status:  utils.GetHTTPStatus(constants.HTTP_STATUS_500),
+		})
+	}
 
-		res, err := app.SVC.UpdateItem(input)
-		if err != nil {
+	if err := AmendRequestRoles(&request, input.Roles); err != nil {
+		if err == ErrRequestNotPending {
+			return renderRequestNotPending(c.Controller, request)
 		}
-		_ = res
+		data["status"] = utils.GetHTTPStatus(err.Error())
+		return c.RenderJSON(data)
+	}
+	// an approval recorded while the roles were being changed was still
+	// for the old ones
+	if err := ClearRequestApprovals(request.RequestID, request.UpdatedAt); err != nil {
+		c.Response.Status = 500
+		return c.RenderJSON(models.ErrorResponse{
+			Code:    "500",
+			Message: "Unable to clear the approvals of the request",
+			Status:  utils.GetHTTPStatus(constants.HTTP_STATUS_500),
+		})
+	}
+
+	template := roleRequestTemplate(requester, rolesRequested, request)
+	err = RewriteRequestNotifications(request, template, func(content *models.NotificationContentType) {
+		content.RolesRequested = input.Roles
+	})
+	if err != nil {
+		data["notifications"] = "error while updating request notifications"
+	}
+
+	// the new roles may bring approvers who were not asked before
+	if err := notifyNewRequestApprovers(c.Controller, request, template); err != nil {
+		data["notifications"] = "error while notifying new approvers"
 	}
 
+	data["request"] = request
 	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
 	return c.RenderJSON(data)
 }
 
-func sendNotificationToUser(c RequestController, companyAdminUserID string, requesterUserInfo models.CompanyUser, typeOfRequest string, methodOfRequest bool, notificationID string, notificationContentFromRequest models.NotificationContentType) revel.Result {
-	companyID := c.ViewArgs["companyID"].(string)
-	data := make(map[string]interface{})
-	var method string
-	if methodOfRequest {
-		method += "ACCEPTED"
-	} else {
-		method += "REJECTED"
+// loadOwnPendingRequest returns the request if it is still pending and was
+// filed by or for the user, or the response to render otherwise.
+func (c RequestController) loadOwnPendingRequest(companyID, userID, requestID string) (Request, revel.Result) {
+	if requestID == "" {
+		c.Response.Status = 400
+		return Request{}, c.RenderJSON(models.ErrorResponse{
+			Code:           "400",
+			HTTPStatusCode: 400,
+			Message:        "Missing required parameter - request_id",
+		})
 	}
 
-	if err := UpdateNotification(notificationID, method, notificationContentFromRequest); err != nil {
-		c.Response.Status = 400
-		return c.RenderJSON(models.ErrorResponse{
-			Code:    "400",
-			Message: "Unable to update notification: " + err.Error(),
+	request, err := GetRequestByID(companyID, requestID)
+	if err != nil {
+		c.Response.Status = 404
+		return request, c.RenderJSON(models.ErrorResponse{
+			Code:    "404",
+			Message: "Unable to retrieve request",
 		})
 	}
-	notificationContent := models.NotificationContentType{
-		RequesterUserID: requesterUserInfo.UserID,
-		ActiveCompany:   companyID,
-	}
-	switch typeOfRequest {
-	case constants.REQUEST_COMPANY_ROLE_UPDATE:
-		var rolesRequested []string
-		message := "Your request to take on the "
-		for _, roleID := range notificationContentFromRequest.RolesRequested {
-			role, opsErr := ops.GetRoleByID(roleID, companyID)
-			_, _ = role, opsErr
-			if opsErr != nil {
-				return c.RenderJSON(opsErr)
-			}
-			rolesRequested = append(rolesRequested, role.RoleName)
-			if len(rolesRequested) == 1 {
-				message += "role of " + rolesRequested[0] + " has been "
-			} else {
-				message += "following roles: " + strings.Join(rolesRequested, ", ") + " has been "
-			}
-			if methodOfRequest {
-				message += "accepted."
-			} else {
-				message += "rejected."
-			}
-		}
-		notificationContent.Message = message
-	case constants.REQUEST_TO_JOIN_GROUP:
-		group, err := GetGroupByID(notificationContentFromRequest.GroupID)
-		if err != nil {
-			data["error"] = "Group not exists."
-			data["status"] = utils.GetHTTPStatus(err.Error())
-			return c.RenderJSON(data)
-		}
-		message := "Your request to join " + group.GroupName + " has been "
-		if methodOfRequest {
-			message += "accepted."
-		} else {
-			message += "rejected."
+	if request.RequesterUserID != userID && request.RequestedBy != userID {
+		c.Response.Status = 403
+		return request, c.RenderJSON(models.ErrorResponse{
+			Code:           "403",
+			HTTPStatusCode: 403,
+			Message:        "Only the requester can change this request",
+		})
+	}
+	if !IsRequestOpen(request.Status) {
+		return request, renderRequestNotPending(c.Controller, request)
+	}
+
+	return request, nil
+}
+
+// FiledRequest is the outcome of FileRequest. AutoApproval is the
+// acceptance of the request when an auto-approval rule matched it.
+type FiledRequest struct {
+	Request      Request
+	AutoApproval *requestDecisionResult
+}
+
+/*
+****************
+FileRequest()
+- Stores a new request and sends it to its approvers. Role and group-join
+requests are filed through here, once per filing: the notification of each
+approver is linked to the one request, so a decision taken from any of them
+settles it for all. Integration and account requests still arrive as
+notifications and only become requests once they are decided. A routine
+request matching an auto-approval rule is accepted right away instead, and
+goes to the approvers only if that fails. Only a request that could not be
+stored fails the filing; approvers missed are reminded by RequestExpiryJob.
+****************
+*/
+func FileRequest(c *revel.Controller, request Request, requester models.CompanyUser, template NotificationTemplate) (FiledRequest, error) {
+	rule, autoApproved, err := MatchAutoApprovalRule(request, requester, time.Now())
+	if err != nil {
+		revel.AppLog.Error("FileRequest: unable to evaluate auto-approval rules", err)
+		autoApproved = false
+	}
+	if autoApproved {
+		request.AutoApprovalRuleID = rule.RuleID
+	}
+
+	if err := CreateRequest(request); err != nil {
+		return FiledRequest{Request: request}, err
+	}
+
+	if autoApproved {
+		result := AutoApproveRequest(&request, rule)
+		if result.StatusCode == 200 || result.StatusCode == 207 {
+			return FiledRequest{Request: request, AutoApproval: &result}, nil
 		}
-		notificationContent.Message = message
-	case constants.REQUEST_CONNECT_INTEGRATION, constants.REQUEST_DISCONNECT_INTEGRATION:
-		var requestAction string
-		if typeOfRequest == constants.REQUEST_CONNECT_INTEGRATION {
-			requestAction = "connect"
-		} else {
-			requestAction = "disconnect"
+		revel.AppLog.Error("FileRequest: auto-approval failed", request.RequestID, result.Body)
+	}
+
+	if err := notifyNewRequestApprovers(c, request, template); err != nil {
+		revel.AppLog.Error("FileRequest: unable to notify the approvers of "+request.RequestID, err)
+	}
+	return FiledRequest{Request: request}, nil
+}
+
+/*
+****************
+notifyNewRequestApprovers()
+- Sends the request to the approvers of its current policy who have no
+notification about it yet
+****************
+*/
+func notifyNewRequestApprovers(c *revel.Controller, request Request, template NotificationTemplate) error {
+	policy, err := GetRequestApprovalPolicy(request)
+	if err != nil {
+		return err
+	}
+	approvers, err := GetPolicyApprovers(request.CompanyID, policy)
+	if err != nil {
+		return err
+	}
+	notifications, err := GetRequestNotifications(request.RequestID)
+	if err != nil {
+		return err
+	}
+	notified := map[string]bool{}
+	for _, notification := range notifications {
+		notified[notification.UserID] = true
+	}
+
+	for _, approver := range approvers {
+		if notified[approver.UserID] {
+			continue
 		}
-		var integrationsRequested []string
-		message := "Your request to " + requestAction + " to  "
-		for _, integ := range notificationContentFromRequest.RequestedIntegrations {
-			integInfo, err := ops.GetIntegrationByID(integ)
-			if err != nil {
-				c.Response.Status = 400
-				return c.RenderJSON(models.ErrorResponse{
-					Code:    "400",
-					Message: "Unable to retrieve Integrations",
-				})
-			}
-			integrationsRequested = append(integrationsRequested, integInfo.IntegrationName)
-			if len(integrationsRequested) == 1 {
-				message += integrationsRequested[0] + " has been "
-			} else {
-				message += " the following integrations: " + strings.Join(integrationsRequested, ", ") + " has been "
-			}
+		createdNotification, err := ops.CreateNotification(ops.CreateNotificationInput{
+			UserID:           approver.UserID,
+			NotificationType: request.RequestType,
+			NotificationContent: models.NotificationContentType{
+				RequesterUserID:       request.RequesterUserID,
+				ActiveCompany:         request.CompanyID,
+				GroupID:               request.GroupID,
+				RolesRequested:        request.RolesRequested,
+				RequestedIntegrations: request.RequestedIntegrations,
+				Integration:           request.Integration,
+				IsAccepted:            NOTIFICATION_REQUEST_UNDER_REVIEW,
+				Message:               template.Render(userMessageLocale(approver.UserID)),
+			},
+			Global: false,
+		}, c)
+		if err != nil {
+			return errors.New("Unable to create notification for " + approver.UserID)
 		}
-		if methodOfRequest {
-			message += "checked and is in progress for connection."
-		} else {
-			message += "rejected."
+		if err := SetNotificationTemplate(createdNotification, &template); err != nil {
+			return err
 		}
-		notificationContent.Message = message
-	case constants.REQUEST_TO_CREATE_ACCOUNT:
-		notificationContent.Integration = models.NotificationIntegration{
-			IntegrationID:   notificationContentFromRequest.Integration.IntegrationID,
-			IntegrationSlug: notificationContentFromRequest.Integration.IntegrationSlug,
-			IntegrationName: notificationContentFromRequest.Integration.IntegrationName,
+		if err := LinkRequestNotification(request, createdNotification.NotificationID); err != nil {
+			return err
 		}
-		integration := notificationContent.Integration
-
-		var message string
-		switch integration.IntegrationSlug {
-		case constants.INTEG_SLUG_GOOGLE_CLOUD:
-			if methodOfRequest {
-				message = "Your request to create an account on Google Cloud has been accepted. Please wait for your account to be created."
-			} else {
-				message = "Your request to create an account on Google Cloud has been rejected."
-			}
-		case constants.INTEG_SLUG_BITBUCKET:
-			if methodOfRequest {
-				message = "Your request to be invited in Bitbucket has been accepted. Please wait for the invitation email."
-			} else {
-				message = "Your request to be invited in Bitbucket has been rejected."
-			}
-		case constants.INTEG_SLUG_JIRA:
-			if methodOfRequest {
-				message = "Your request to create an account on Jira has been accepted. Please wait for your account to be created."
-			} else {
-				message = "Your request to create an account on Jira has been rejected."
-			}
-		default:
-			if methodOfRequest {
-				message = "Your request to create an account has been accepted. Please wait for your account to be created."
-			} else {
-				message = "Your request to create an account has been rejected."
-			}
+		notifyApproverChannels(request, approver.UserID, createdNotification.NotificationID, createdNotification.NotificationContent.Message)
+	}
+
+	return nil
+}
+
+// requestReply is a status update to send to a requester after the decision
+// has been committed.
+type requestReply struct {
+	RequesterInfo       models.CompanyUser
+	NotificationContent models.NotificationContentType
+	Template            *NotificationTemplate
+}
+
+func renderRequestNotPending(c *revel.Controller, request Request) revel.Result {
+	c.Response.Status = 409
+	return c.RenderJSON(models.ErrorResponse{
+		Code:           "409",
+		HTTPStatusCode: 409,
+		Message:        "Request is already " + strings.ToLower(request.Status),
+	})
+}
+
+/*
+****************
+sendNotificationToUser()
+- Updates the admin notification with the decision and notifies the
+requester, with the message described by the request handler
+****************
+*/
+func sendNotificationToUser(ctx *RequestContext, handler RequestHandler, reply requestReply, methodOfRequest bool) (models.Notification, error) {
+	requesterUserInfo := reply.RequesterInfo
+	var method string
+	if methodOfRequest {
+		method += NOTIFICATION_REQUEST_ACCEPTED
+	} else {
+		method += NOTIFICATION_REQUEST_REJECTED
+	}
+
+	// auto-approved requests never had an admin notification
+	if ctx.NotificationID != "" {
+		if err := UpdateNotification(ctx.NotificationID, method, reply.NotificationContent, reply.Template); err != nil {
+			return models.Notification{}, errors.New("Unable to update notification: " + err.Error())
 		}
-		notificationContent.Message = message
-	default:
-		notificationContent.Message = "Error reply failed."
 	}
-	// utils.PrintJSON(companyAdminUserID, requesterUserInfo.UserID, notificationID, typeOfRequest, notificationContent.Message)
+	notificationContent := models.NotificationContentType{
+		RequesterUserID: requesterUserInfo.UserID,
+		ActiveCompany:   ctx.CompanyID,
+	}
+	ctx.takeMessage()
+	if err := handler.Describe(ctx, &notificationContent, methodOfRequest); err != nil {
+		ctx.RequesterMessage(&notificationContent, NewNotificationTemplate(MESSAGE_REQUEST_FAILED))
+	}
+	template := ctx.takeMessage()
+	if template != nil && !methodOfRequest && ctx.Reason != "" {
+		template.Reason = ctx.Reason
+		notificationContent.Message = template.Render(userMessageLocale(requesterUserInfo.UserID))
+	}
+
 	createdNotification, err := ops.CreateNotification(ops.CreateNotificationInput{
 		UserID:              requesterUserInfo.UserID,
 		NotificationType:    constants.REQUEST_STATUS_UPDATE,
 		NotificationContent: notificationContent,
 		Global:              false,
-	}, c.Controller)
+	}, ctx.Controller)
 
 	if err != nil {
-		c.Response.Status = 400
-		return c.RenderJSON(models.ErrorResponse{
-			Code:    "400",
-			Message: "Unable to create notification for " + companyAdminUserID,
-		})
+		return createdNotification, errors.New("Unable to create notification for " + requesterUserInfo.UserID)
+	}
+	if err := SetNotificationTemplate(createdNotification, template); err != nil {
+		return createdNotification, err
 	}
-	// utils.PrintJSON(createdNotification)
-	return c.RenderJSON(createdNotification)
+	return createdNotification, nil
 }
 
-func UpdateNotification(notificationID string, requestMethod string, notificationContentFromRequest models.NotificationContentType) error {
+/*
+****************
+markNotificationSeen()
+- Marks the notification the decision was made from as seen
+****************
+*/
+func markNotificationSeen(notificationID string) {
+	notification, opsErr := ops.GetNotificationByID(notificationID)
+	if opsErr != nil {
+		return
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":s": {
+				BOOL: aws.Bool(true),
+			},
+			":ua": {
+				S: aws.String(utils.GetCurrentTimestamp()),
+			},
+		},
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(notification.PK),
+			},
+			"SK": {
+				S: aws.String(notification.SK),
+			},
+		},
+		UpdateExpression: aws.String("SET Seen = :s, UpdatedAt = :ua"),
+	}
+
+	_, err := app.SVC.UpdateItem(input)
+	if err != nil {
+		revel.AppLog.Error("Unable to mark notification as seen", notificationID, err)
+	}
+}
+
+func UpdateNotification(notificationID string, requestMethod string, notificationContentFromRequest models.NotificationContentType, template *NotificationTemplate) error {
 	notification, err := GetNotificationByID(notificationID)
 	if err != nil || notification.NotificationID == "" {
 		return errors.New("notification not found")
@@ -883,5 +593,184 @@ func UpdateNotification(notificationID string, requestMethod string, notificatio
 		return err
 	}
 
-	return nil
+	return SetNotificationTemplate(notification, template)
+}
+
+// ApprovalPolicyParams is the body of SaveApprovalPolicy.
+type ApprovalPolicyParams struct {
+	Scope  string               `json:"scope,omitempty"`
+	Target string               `json:"target,omitempty"`
+	Rules  []ApprovalRuleParams `json:"rules,omitempty"`
+	// EscalationRoleID is the role stale requests are escalated to
+	EscalationRoleID string `json:"escalation_role_id,omitempty"`
+}
+
+type ApprovalRuleParams struct {
+	RoleID string `json:"role_id,omitempty"`
+	Count  int    `json:"count,omitempty"`
+}
+
+/*
+****************
+SaveApprovalPolicy()
+- Creates or replaces the approval policy of a request type or a role
+Body:
+scope - required (REQUEST_TYPE, ROLE or ELEVATION)
+target - required (request type or role id)
+rules[] - required ({role_id, count})
+escalation_role_id - optional
+****************
+*/
+func (c RequestController) SaveApprovalPolicy() revel.Result {
+	companyID := c.ViewArgs["companyID"].(string)
+	userID := c.ViewArgs["userID"].(string)
+	data := make(map[string]interface{})
+
+	isAdmin, err := isCompanyAdmin(companyID, userID)
+	if err != nil || !isAdmin {
+		c.Response.Status = 401
+		data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_401)
+		return c.RenderJSON(data)
+	}
+
+	var input ApprovalPolicyParams
+	c.Params.BindJSON(&input)
+
+	if input.Scope != APPROVAL_POLICY_SCOPE_TYPE && input.Scope != APPROVAL_POLICY_SCOPE_ROLE && input.Scope != APPROVAL_POLICY_SCOPE_ELEVATION {
+		c.Response.Status = 422
+		data["errors"] = "scope must be " + APPROVAL_POLICY_SCOPE_TYPE + ", " + APPROVAL_POLICY_SCOPE_ROLE + " or " + APPROVAL_POLICY_SCOPE_ELEVATION
+		data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_422)
+		return c.RenderJSON(data)
+	}
+	if input.Scope == APPROVAL_POLICY_SCOPE_TYPE {
+		if _, ok := GetRequestHandler(input.Target); !ok {
+			c.Response.Status = 422
+			data["errors"] = "Unsupported request type: " + input.Target
+			data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_422)
+			return c.RenderJSON(data)
+		}
+	} else if _, opsErr := ops.GetRoleByID(input.Target, companyID); opsErr != nil {
+		c.Response.Status = 422
+		data["errors"] = "Role not found: " + input.Target
+		data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_422)
+		return c.RenderJSON(data)
+	}
+
+	currentTime := utils.GetCurrentTimestamp()
+	policy := ApprovalPolicy{
+		CompanyID:   companyID,
+		PolicyScope: input.Scope,
+		Target:      input.Target,
+		CreatedBy:   userID,
+		CreatedAt:   currentTime,
+		UpdatedAt:   currentTime,
+	}
+	// replacing a policy keeps who created it and when
+	existing, found, err := GetApprovalPolicy(companyID, input.Scope, input.Target)
+	if err != nil {
+		data["status"] = utils.GetHTTPStatus(err.Error())
+		return c.RenderJSON(data)
+	}
+	if found {
+		policy.CreatedBy = existing.CreatedBy
+		policy.CreatedAt = existing.CreatedAt
+	}
+	if input.EscalationRoleID != "" {
+		if _, opsErr := ops.GetRoleByID(input.EscalationRoleID, companyID); opsErr != nil {
+			c.Response.Status = 422
+			data["errors"] = "Role not found: " + input.EscalationRoleID
+			data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_422)
+			return c.RenderJSON(data)
+		}
+		policy.EscalationRoleID = input.EscalationRoleID
+	}
+	for _, rule := range input.Rules {
+		if rule.RoleID == "" || rule.Count < 1 {
+			c.Response.Status = 422
+			data["errors"] = "Every rule needs a role_id and a count of at least 1"
+			data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_422)
+			return c.RenderJSON(data)
+		}
+		holders, err := ops.GetCompanyAdminsByRoleID(companyID, rule.RoleID)
+		if err != nil {
+			data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_500)
+			return c.RenderJSON(data)
+		}
+		// a rule nobody can satisfy would leave requests pending forever
+		if len(holders) < rule.Count {
+			c.Response.Status = 422
+			data["errors"] = "Not enough users hold role " + rule.RoleID + " to satisfy the rule"
+			data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_422)
+			return c.RenderJSON(data)
+		}
+		policy.Rules = mergeApprovalRules(policy.Rules, []ApprovalRule{
+			{
+				RoleID: rule.RoleID,
+				Count:  rule.Count,
+			},
+		})
+	}
+
+	if err := SaveApprovalPolicy(policy); err != nil {
+		data["status"] = utils.GetHTTPStatus(err.Error())
+		return c.RenderJSON(data)
+	}
+
+	data["policy"] = policy
+	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+	return c.RenderJSON(data)
+}
+
+/*
+****************
+GetApprovalPolicies()
+- Returns every approval policy of the company
+****************
+*/
+func (c RequestController) GetApprovalPolicies() revel.Result {
+	companyID := c.ViewArgs["companyID"].(string)
+	data := make(map[string]interface{})
+
+	policies, err := GetCompanyApprovalPolicies(companyID)
+	if err != nil {
+		data["status"] = utils.GetHTTPStatus(err.Error())
+		return c.RenderJSON(data)
+	}
+
+	data["policies"] = policies
+	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+	return c.RenderJSON(data)
+}
+
+/*
+****************
+DeleteApprovalPolicy()
+- Removes the approval policy of a request type or a role. Requests then go
+back to needing a single approval.
+Params:
+scope - required
+target - required
+****************
+*/
+func (c RequestController) DeleteApprovalPolicy() revel.Result {
+	companyID := c.ViewArgs["companyID"].(string)
+	userID := c.ViewArgs["userID"].(string)
+	scope := c.Params.Get("scope")
+	target := c.Params.Get("target")
+	data := make(map[string]interface{})
+
+	isAdmin, err := isCompanyAdmin(companyID, userID)
+	if err != nil || !isAdmin {
+		c.Response.Status = 401
+		data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_401)
+		return c.RenderJSON(data)
+	}
+
+	if err := DeleteApprovalPolicy(companyID, scope, target); err != nil {
+		data["status"] = utils.GetHTTPStatus(err.Error())
+		return c.RenderJSON(data)
+	}
+
+	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+	return c.RenderJSON(data)
 }
@@ -0,0 +1,530 @@
+package controllers
+
+import (
+	"grooper/app/constants"
+	"grooper/app/models"
+	ops "grooper/app/operations"
+	"grooper/app/utils"
+	"strconv"
+	"strings"
+
+	"github.com/revel/revel"
+)
+
+const (
+	REQUEST_DECISION_ACCEPT  = "ACCEPT"
+	REQUEST_DECISION_REJECT  = "REJECT"
+	REQUEST_BATCH_LIMIT      = 50
+	IDEMPOTENCY_ACTION_BATCH = "DECIDE_REQUESTS"
+)
+
+// RequestDecision is one accept or reject of a request, as sent to
+// AcceptRequest and RejectRequest or as an entry of DecideRequests.
+type RequestDecision struct {
+	NotificationID string   `json:"notification_id,omitempty"`
+	RequestType    string   `json:"requestType,omitempty"`
+	Action         string   `json:"action,omitempty"`
+	UserIDs        []string `json:"user_id,omitempty"`
+	GroupID        string   `json:"group_id,omitempty"`
+	MemberType     string   `json:"member_type,omitempty"`
+	RoleIDs        []string `json:"role_id,omitempty"`
+	IntegrationIDs []string `json:"integration_id,omitempty"`
+	Reason         string   `json:"reason,omitempty"`
+}
+
+// RequestUserResult is the outcome of a decision for one requester.
+type RequestUserResult struct {
+	UserID  string `json:"user_id"`
+	Success bool   `json:"success"`
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+// requestDecisionResult is the status code and body to answer a decision
+// with.
+type requestDecisionResult struct {
+	StatusCode int
+	Body       interface{}
+}
+
+// bindRequestDecision reads a decision from the query or form parameters.
+func bindRequestDecision(c *revel.Controller) RequestDecision {
+	var decision RequestDecision
+	c.Params.Bind(&decision.UserIDs, "user_id")
+	c.Params.Bind(&decision.NotificationID, "notification_id")
+	c.Params.Bind(&decision.RequestType, "requestType")
+	c.Params.Bind(&decision.RoleIDs, "role_id")
+	c.Params.Bind(&decision.IntegrationIDs, "integration_id")
+	c.Params.Bind(&decision.Reason, "reason")
+	decision.GroupID = c.Params.Get("group_id")
+	decision.MemberType = c.Params.Get("member_type")
+	decision.Reason = strings.TrimSpace(decision.Reason)
+	return decision
+}
+
+func requestErrorResult(err error) requestDecisionResult {
+	requestErr, ok := err.(*RequestError)
+	if !ok {
+		requestErr = NewRequestError(500, err.Error())
+	}
+	return requestDecisionResult{
+		StatusCode: requestErr.HTTPStatusCode,
+		Body: models.ErrorResponse{
+			Code:           strconv.Itoa(requestErr.HTTPStatusCode),
+			HTTPStatusCode: requestErr.HTTPStatusCode,
+			Message:        requestErr.Message,
+		},
+	}
+}
+
+func requestNotPendingResult(request Request) requestDecisionResult {
+	return requestDecisionResult{
+		StatusCode: 409,
+		Body: models.ErrorResponse{
+			Code:           "409",
+			HTTPStatusCode: 409,
+			Message:        "Request is already " + strings.ToLower(request.Status),
+		},
+	}
+}
+
+func requestUserFailure(userID string, err error) RequestUserResult {
+	requestErr, ok := err.(*RequestError)
+	if !ok {
+		requestErr = NewRequestError(500, err.Error())
+	}
+	return RequestUserResult{
+		UserID:  userID,
+		Success: false,
+		Code:    requestErr.HTTPStatusCode,
+		Message: requestErr.Message,
+	}
+}
+
+// partialResult answers a decision once the users that could be processed
+// have been committed: 200 when all of them were, 207 otherwise.
+func partialResult(data map[string]interface{}, results []RequestUserResult) requestDecisionResult {
+	failed := 0
+	for _, result := range results {
+		if !result.Success {
+			failed++
+		}
+	}
+	data["results"] = results
+	data["succeeded"] = len(results) - failed
+	data["failed"] = failed
+	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+
+	statusCode := 200
+	if failed != 0 {
+		statusCode = 207
+	}
+	return requestDecisionResult{
+		StatusCode: statusCode,
+		Body:       data,
+	}
+}
+
+// loadDecidableRequest resolves the request a decision is about.
+func loadDecidableRequest(companyID string, decision RequestDecision) (Request, *requestDecisionResult) {
+	request, err := GetRequestByNotificationID(decision.NotificationID, companyID)
+	if err != nil {
+		return request, &requestDecisionResult{
+			StatusCode: 404,
+			Body: models.ErrorResponse{
+				Code:    "404",
+				Message: "Unable to retrieve request",
+			},
+		}
+	}
+	if !IsRequestOpen(request.Status) {
+		result := requestNotPendingResult(request)
+		return request, &result
+	}
+	return request, nil
+}
+
+/*
+****************
+acceptRequestDecision()
+- Records the approver's approval and, once the request's approval policy
+is satisfied, accepts it for every user of the decision
+****************
+*/
+func acceptRequestDecision(c *revel.Controller, decision RequestDecision) requestDecisionResult {
+	companyID := c.ViewArgs["companyID"].(string)
+	data := make(map[string]interface{})
+
+	request, failed := loadDecidableRequest(companyID, decision)
+	if failed != nil {
+		return *failed
+	}
+
+	ctx, err := NewRequestContext(c, &request, decision)
+	if err != nil {
+		return requestErrorResult(err)
+	}
+	handler, err := prepareRequestDecision(ctx, true)
+	if err != nil {
+		return requestErrorResult(err)
+	}
+
+	// requests under a quorum policy stay pending until enough approvers
+	// have accepted them
+	quorum, err := RecordRequestApproval(ctx)
+	if err != nil {
+		return requestErrorResult(err)
+	}
+	if !quorum.Satisfied {
+		audit := newRequestAudit(ctx)
+		for _, userID := range ctx.UserIDs {
+			audit.record(LOG_ACTION_APPROVE_REQUEST, userID, models.CompanyUser{})
+		}
+		if err := audit.write(); err != nil {
+			data["logs"] = "error while creating logs"
+		}
+		markNotificationSeen(decision.NotificationID)
+		data["action"] = "Approve"
+		data["quorum"] = quorum
+		data["request"] = request
+		data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+		return requestDecisionResult{
+			StatusCode: 200,
+			Body:       data,
+		}
+	}
+
+	// an acceptance that was not applied must not leave the approval behind,
+	// the approver would be refused with a 409 when trying again
+	result := commitRequestAcceptance(ctx, handler, decision)
+	if result.StatusCode >= 300 {
+		if err := RemoveRequestApproval(request.RequestID, ctx.ApproverID); err != nil {
+			revel.AppLog.Error("acceptRequestDecision: unable to remove the approval of "+ctx.ApproverID+" on request "+request.RequestID, err)
+		}
+	}
+	return result
+}
+
+/*
+****************
+commitRequestAcceptance()
+- Grants the request to the users of the context. Users that fail are
+reported and skipped, the others are granted in one transaction together
+with the request status change. Shared by approvers and auto-approval rules.
+****************
+*/
+func commitRequestAcceptance(ctx *RequestContext, handler RequestHandler, decision RequestDecision) requestDecisionResult {
+	data := make(map[string]interface{})
+	acceptAction := LOG_ACTION_ACCEPT_REQUEST
+	if ctx.AutoApprovalRuleID != "" {
+		acceptAction = LOG_ACTION_AUTO_APPROVE_REQUEST
+	}
+
+	// every grant is collected into one transaction together with the request
+	// status change; side effects only run once it has committed
+	audit := newRequestAudit(ctx)
+	var replies []requestReply
+	var results []RequestUserResult
+	var firstErr error
+	for _, userID := range ctx.UserIDs {
+		savepoint := ctx.Savepoint()
+		ctx.takeMessage()
+		subject, err := loadRequestSubject(ctx, userID)
+		if err == nil {
+			notificationContent := models.NotificationContentType{
+				RequesterUserID: subject.RequesterInfo.UserID,
+				ActiveCompany:   ctx.CompanyID,
+				IsAccepted:      NOTIFICATION_REQUEST_ACCEPTED,
+			}
+			err = handler.Accept(ctx, subject, &notificationContent)
+			if err == nil {
+				replies = append(replies, requestReply{
+					RequesterInfo:       subject.RequesterInfo,
+					NotificationContent: notificationContent,
+					Template:            ctx.takeMessage(),
+				})
+				results = append(results, RequestUserResult{
+					UserID:  userID,
+					Success: true,
+					Code:    200,
+				})
+				continue
+			}
+		}
+
+		ctx.Rollback(savepoint)
+		audit.record(LOG_ACTION_REQUEST_FAILED, userID, subject.RequesterInfo)
+		results = append(results, requestUserFailure(userID, err))
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if len(replies) == 0 {
+		if err := audit.write(); err != nil {
+			revel.AppLog.Error("commitRequestAcceptance: unable to log the failed decision on request "+ctx.Request.RequestID, err)
+		}
+		if firstErr == nil {
+			firstErr = NewRequestError(400, "Missing required parameter - user_id")
+		}
+		result := requestErrorResult(firstErr)
+		if len(results) != 0 {
+			result.Body = map[string]interface{}{
+				"error":   result.Body,
+				"results": results,
+				"status":  utils.GetHTTPStatus(constants.HTTP_STATUS_400),
+			}
+		}
+		return result
+	}
+
+	ctx.Transaction.Transition(ctx.Request, REQUEST_STATUS_APPROVED, ctx.ApproverID)
+	if err := ctx.Transaction.Commit(); err != nil {
+		for _, reply := range replies {
+			audit.record(LOG_ACTION_REQUEST_FAILED, reply.RequesterInfo.UserID, reply.RequesterInfo)
+		}
+		if err := audit.write(); err != nil {
+			revel.AppLog.Error("commitRequestAcceptance: unable to log the failed decision on request "+ctx.Request.RequestID, err)
+		}
+		if err == ErrRequestNotPending {
+			return requestNotPendingResult(*ctx.Request)
+		}
+		data["message"] = "Unable to accept request"
+		data["error"] = err.Error()
+		data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_500)
+		return requestDecisionResult{
+			StatusCode: 500,
+			Body:       data,
+		}
+	}
+
+	for key, value := range ctx.output {
+		data[key] = value
+	}
+
+	for _, reply := range replies {
+		audit.record(acceptAction, reply.RequesterInfo.UserID, reply.RequesterInfo)
+	}
+	if err := audit.write(); err != nil {
+		data["logs"] = "error while creating logs"
+	}
+
+	if errs := ctx.RunAfterCommit(); len(errs) != 0 {
+		data["cleanup"] = "error while completing the accepted request"
+		data["error"] = errs[0].Error()
+	}
+
+	for _, reply := range replies {
+		sendNotificationToUser(ctx, handler, reply, true)
+	}
+
+	if err := SyncRequestNotifications(*ctx.Request); err != nil {
+		data["notifications"] = "error while updating request notifications"
+	}
+	markNotificationSeen(decision.NotificationID)
+
+	data["action"] = "Accept"
+	return partialResult(data, results)
+}
+
+/*
+****************
+rejectRequestDecision()
+- Rejects a request for the users of the context, reporting the users
+that could not be processed
+****************
+*/
+func rejectRequestDecision(c *revel.Controller, decision RequestDecision) requestDecisionResult {
+	companyID := c.ViewArgs["companyID"].(string)
+	data := make(map[string]interface{})
+
+	if len(decision.Reason) > REQUEST_MAX_COMMENT_LENGTH {
+		return requestErrorResult(NewRequestError(422, "Reason must be at most "+strconv.Itoa(REQUEST_MAX_COMMENT_LENGTH)+" characters"))
+	}
+
+	request, failed := loadDecidableRequest(companyID, decision)
+	if failed != nil {
+		return *failed
+	}
+
+	ctx, err := NewRequestContext(c, &request, decision)
+	if err != nil {
+		return requestErrorResult(err)
+	}
+	handler, err := prepareRequestDecision(ctx, false)
+	if err != nil {
+		return requestErrorResult(err)
+	}
+
+	audit := newRequestAudit(ctx)
+	var replies []requestReply
+	var results []RequestUserResult
+	var firstErr error
+	for _, userID := range ctx.UserIDs {
+		ctx.takeMessage()
+		subject, err := loadRequestSubject(ctx, userID)
+		if err == nil {
+			notificationContent := models.NotificationContentType{
+				RequesterUserID: subject.RequesterInfo.UserID,
+				ActiveCompany:   companyID,
+				IsAccepted:      NOTIFICATION_REQUEST_REJECTED,
+			}
+			err = handler.Reject(ctx, subject, &notificationContent)
+			if err == nil {
+				replies = append(replies, requestReply{
+					RequesterInfo:       subject.RequesterInfo,
+					NotificationContent: notificationContent,
+					Template:            ctx.takeMessage(),
+				})
+				results = append(results, RequestUserResult{
+					UserID:  userID,
+					Success: true,
+					Code:    200,
+				})
+				continue
+			}
+		}
+
+		audit.record(LOG_ACTION_REQUEST_FAILED, userID, subject.RequesterInfo)
+		results = append(results, requestUserFailure(userID, err))
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	if len(replies) == 0 {
+		if err := audit.write(); err != nil {
+			revel.AppLog.Error("rejectRequestDecision: unable to log the failed decision on request "+request.RequestID, err)
+		}
+		if firstErr == nil {
+			firstErr = NewRequestError(400, "Missing required parameter - user_id")
+		}
+		result := requestErrorResult(firstErr)
+		if len(results) != 0 {
+			result.Body = map[string]interface{}{
+				"error":   result.Body,
+				"results": results,
+				"status":  utils.GetHTTPStatus(constants.HTTP_STATUS_400),
+			}
+		}
+		return result
+	}
+
+	if err := TransitionRequest(&request, REQUEST_STATUS_REJECTED, ctx.ApproverID, ctx.Reason); err != nil {
+		for _, reply := range replies {
+			audit.record(LOG_ACTION_REQUEST_FAILED, reply.RequesterInfo.UserID, reply.RequesterInfo)
+		}
+		if err := audit.write(); err != nil {
+			revel.AppLog.Error("rejectRequestDecision: unable to log the failed decision on request "+request.RequestID, err)
+		}
+		return requestNotPendingResult(request)
+	}
+
+	for _, reply := range replies {
+		audit.record(LOG_ACTION_REJECT_REQUEST, reply.RequesterInfo.UserID, reply.RequesterInfo)
+	}
+	if err := audit.write(); err != nil {
+		data["logs"] = "error while creating logs"
+	}
+
+	for _, reply := range replies {
+		sendNotificationToUser(ctx, handler, reply, false)
+	}
+
+	if err := SyncRequestNotifications(request); err != nil {
+		data["notifications"] = "error while updating request notifications"
+	}
+	markNotificationSeen(decision.NotificationID)
+
+	return partialResult(data, results)
+}
+
+// RequestDecisionsParams is the body of DecideRequests.
+type RequestDecisionsParams struct {
+	Decisions []RequestDecision `json:"decisions,omitempty"`
+}
+
+// RequestDecisionResult is the outcome of one entry of DecideRequests.
+type RequestDecisionResult struct {
+	NotificationID string      `json:"notification_id"`
+	Action         string      `json:"action"`
+	Code           int         `json:"code"`
+	Result         interface{} `json:"result"`
+}
+
+/*
+****************
+DecideRequests()
+- Accepts or rejects several requests in one call. Every decision is
+applied on its own; the response lists the outcome of each.
+Body:
+decisions[] - required ({notification_id, action (ACCEPT or REJECT), user_id[], ...})
+****************
+*/
+func (c RequestController) DecideRequests() revel.Result {
+	companyID := c.ViewArgs["companyID"].(string)
+	data := make(map[string]interface{})
+
+	var input RequestDecisionsParams
+	c.Params.BindJSON(&input)
+
+	if len(input.Decisions) == 0 || len(input.Decisions) > REQUEST_BATCH_LIMIT {
+		c.Response.Status = 422
+		return c.RenderJSON(models.ErrorResponse{
+			Code:           "422",
+			HTTPStatusCode: 422,
+			Message:        "decisions must hold between 1 and " + strconv.Itoa(REQUEST_BATCH_LIMIT) + " entries",
+		})
+	}
+
+	call, replayed := beginIdempotentCall(c.Controller, companyID, IDEMPOTENCY_ACTION_BATCH, input)
+	if replayed != nil {
+		return replayed
+	}
+
+	_, opsError := ops.GetCompanyByID(companyID)
+	if opsError != nil {
+		if err := call.Release(); err != nil {
+			revel.AppLog.Error("DecideRequests: unable to release idempotency key", err)
+		}
+		return c.RenderJSON(opsError)
+	}
+
+	var results []RequestDecisionResult
+	succeeded := 0
+	for _, decision := range input.Decisions {
+		decision.Reason = strings.TrimSpace(decision.Reason)
+
+		var result requestDecisionResult
+		switch decision.Action {
+		case REQUEST_DECISION_ACCEPT:
+			result = acceptRequestDecision(c.Controller, decision)
+		case REQUEST_DECISION_REJECT:
+			result = rejectRequestDecision(c.Controller, decision)
+		default:
+			result = requestErrorResult(NewRequestError(422, "action must be "+REQUEST_DECISION_ACCEPT+" or "+REQUEST_DECISION_REJECT))
+		}
+		if result.StatusCode == 200 {
+			succeeded++
+		}
+		results = append(results, RequestDecisionResult{
+			NotificationID: decision.NotificationID,
+			Action:         decision.Action,
+			Code:           result.StatusCode,
+			Result:         result.Body,
+		})
+	}
+
+	c.Response.Status = 200
+	if succeeded != len(results) {
+		c.Response.Status = 207
+	}
+	data["results"] = results
+	data["succeeded"] = succeeded
+	data["failed"] = len(results) - succeeded
+	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+
+	if err := call.Complete(c.Response.Status, data); err != nil {
+		revel.AppLog.Error("DecideRequests: unable to store idempotent result", err)
+	}
+
+	return c.RenderJSON(data)
+}
@@ -0,0 +1,515 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"grooper/app"
+	"grooper/app/constants"
+	"grooper/app/models"
+	ops "grooper/app/operations"
+	"grooper/app/utils"
+	"html/template"
+	"mime"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/revel/modules/jobs/app/jobs"
+	"github.com/revel/revel"
+)
+
+const (
+	PREFIX_REQUEST_ACTION_TOKEN      = "ACTION_TOKEN#"
+	ENTITY_TYPE_REQUEST_ACTION_TOKEN = "REQUEST_ACTION_TOKEN"
+	REQUEST_EMAIL_LINK_SECRET_KEY    = "request.email_link.secret"
+	REQUEST_EMAIL_LINK_DEFAULT_TTL   = "72h"
+	REQUEST_EMAIL_LINK_NONCE_SIZE    = 24
+)
+
+var (
+	ErrRequestActionTokenInvalid = errors.New("invalid request action token")
+	ErrRequestActionTokenUsed    = errors.New("request action token already used or expired")
+)
+
+// requestActionClaims is what an approve or reject link is signed over. The
+// two links of an email share the nonce, so using one spends both.
+type requestActionClaims struct {
+	CompanyID      string `json:"c"`
+	RequestID      string `json:"r"`
+	ApproverID     string `json:"u"`
+	NotificationID string `json:"n"`
+	Action         string `json:"a"`
+	Nonce          string `json:"k"`
+	ExpiresAt      int64  `json:"e"`
+}
+
+// RequestActionToken records the nonce of the links sent to an approver.
+// ExpiresAt is the table's TTL attribute.
+type RequestActionToken struct {
+	PK         string `json:"PK,omitempty"`
+	SK         string `json:"SK,omitempty"`
+	RequestID  string `json:"RequestID,omitempty"`
+	CompanyID  string `json:"CompanyID,omitempty"`
+	ApproverID string `json:"ApproverID,omitempty"`
+	ExpiresAt  int64  `json:"ExpiresAt,omitempty"`
+	UsedAt     string `json:"UsedAt,omitempty"`
+	UsedAction string `json:"UsedAction,omitempty"`
+	CreatedAt  string `json:"CreatedAt,omitempty"`
+	Type       string `json:"Type,omitempty"`
+}
+
+func requestEmailLinkTTL() time.Duration {
+	ttl, err := time.ParseDuration(revel.Config.StringDefault("request.email_link.ttl", REQUEST_EMAIL_LINK_DEFAULT_TTL))
+	if err != nil || ttl <= 0 {
+		ttl, _ = time.ParseDuration(REQUEST_EMAIL_LINK_DEFAULT_TTL)
+	}
+	return ttl
+}
+
+func signRequestAction(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// encodeRequestActionToken returns "<payload>.<signature>", both base64url.
+func encodeRequestActionToken(secret string, claims requestActionClaims) (string, error) {
+	raw, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(raw)
+	return payload + "." + signRequestAction(secret, payload), nil
+}
+
+/*
+****************
+ParseRequestActionToken()
+- Checks the signature and expiry of a link token and returns its claims
+****************
+*/
+func ParseRequestActionToken(secret, token string, now time.Time) (requestActionClaims, error) {
+	var claims requestActionClaims
+
+	parts := strings.Split(token, ".")
+	if secret == "" || len(parts) != 2 {
+		return claims, ErrRequestActionTokenInvalid
+	}
+	if !hmac.Equal([]byte(signRequestAction(secret, parts[0])), []byte(parts[1])) {
+		return claims, ErrRequestActionTokenInvalid
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return claims, ErrRequestActionTokenInvalid
+	}
+	if err := json.Unmarshal(raw, &claims); err != nil {
+		return claims, ErrRequestActionTokenInvalid
+	}
+	if claims.Action != REQUEST_DECISION_ACCEPT && claims.Action != REQUEST_DECISION_REJECT {
+		return claims, ErrRequestActionTokenInvalid
+	}
+	if now.Unix() >= claims.ExpiresAt {
+		return claims, ErrRequestActionTokenUsed
+	}
+	return claims, nil
+}
+
+// randomToken returns size bytes from crypto/rand, encoded for URLs. It is
+// used wherever a value has to be unguessable.
+func randomToken(size int) (string, error) {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+/*
+****************
+createRequestActionLinks()
+- Stores a nonce for the approver and returns the signed approve and reject
+links pointing to the request.email_link.url page
+****************
+*/
+func createRequestActionLinks(request Request, approverID, notificationID string) (string, string, error) {
+	secret := revel.Config.StringDefault(REQUEST_EMAIL_LINK_SECRET_KEY, "")
+	if secret == "" {
+		return "", "", errors.New(REQUEST_EMAIL_LINK_SECRET_KEY + " is not configured")
+	}
+
+	nonce, err := randomToken(REQUEST_EMAIL_LINK_NONCE_SIZE)
+	if err != nil {
+		return "", "", err
+	}
+	claims := requestActionClaims{
+		CompanyID:      request.CompanyID,
+		RequestID:      request.RequestID,
+		ApproverID:     approverID,
+		NotificationID: notificationID,
+		Nonce:          nonce,
+		ExpiresAt:      time.Now().Add(requestEmailLinkTTL()).Unix(),
+	}
+
+	record := RequestActionToken{
+		PK:         utils.AppendPrefix(PREFIX_REQUEST, request.RequestID),
+		SK:         utils.AppendPrefix(PREFIX_REQUEST_ACTION_TOKEN, claims.Nonce),
+		RequestID:  request.RequestID,
+		CompanyID:  request.CompanyID,
+		ApproverID: approverID,
+		ExpiresAt:  claims.ExpiresAt,
+		CreatedAt:  utils.GetCurrentTimestamp(),
+		Type:       ENTITY_TYPE_REQUEST_ACTION_TOKEN,
+	}
+	av, err := dynamodbattribute.MarshalMap(record)
+	if err != nil {
+		return "", "", errors.New(constants.HTTP_STATUS_500)
+	}
+	_, err = app.SVC.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(app.TABLE_NAME),
+	})
+	if err != nil {
+		return "", "", errors.New(constants.HTTP_STATUS_500)
+	}
+
+	page := revel.Config.StringDefault("request.email_link.url", "/requests/email-action")
+	var links []string
+	for _, action := range []string{REQUEST_DECISION_ACCEPT, REQUEST_DECISION_REJECT} {
+		claims.Action = action
+		token, err := encodeRequestActionToken(secret, claims)
+		if err != nil {
+			return "", "", err
+		}
+		links = append(links, page+"?token="+url.QueryEscape(token))
+	}
+	return links[0], links[1], nil
+}
+
+// spendRequestActionToken marks the nonce used and returns when, which
+// releaseRequestActionToken needs. It fails if the nonce already was used,
+// has expired, was invalidated or was issued to someone else. Marking it
+// before the decision runs keeps a second click from running it again.
+func spendRequestActionToken(claims requestActionClaims) (string, error) {
+	now := time.Now()
+	usedAt := utils.GetCurrentTimestamp()
+	_, err := app.SVC.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(utils.AppendPrefix(PREFIX_REQUEST, claims.RequestID)),
+			},
+			"SK": {
+				S: aws.String(utils.AppendPrefix(PREFIX_REQUEST_ACTION_TOKEN, claims.Nonce)),
+			},
+		},
+		ConditionExpression: aws.String("attribute_exists(PK) AND attribute_not_exists(UsedAt) AND ApproverID = :approver AND ExpiresAt > :now"),
+		UpdateExpression:    aws.String("SET UsedAt = :ua, UsedAction = :action"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":approver": {
+				S: aws.String(claims.ApproverID),
+			},
+			":now": {
+				N: aws.String(strconv.FormatInt(now.Unix(), 10)),
+			},
+			":ua": {
+				S: aws.String(usedAt),
+			},
+			":action": {
+				S: aws.String(claims.Action),
+			},
+		},
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return "", ErrRequestActionTokenUsed
+		}
+		return "", errors.New(constants.HTTP_STATUS_500)
+	}
+	return usedAt, nil
+}
+
+// releaseRequestActionToken makes the links usable again after the decision
+// they started failed. Only the spend made at usedAt is undone, and not if
+// the token was invalidated in the meantime.
+func releaseRequestActionToken(claims requestActionClaims, usedAt string) error {
+	_, err := app.SVC.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(utils.AppendPrefix(PREFIX_REQUEST, claims.RequestID)),
+			},
+			"SK": {
+				S: aws.String(utils.AppendPrefix(PREFIX_REQUEST_ACTION_TOKEN, claims.Nonce)),
+			},
+		},
+		ConditionExpression: aws.String("UsedAt = :ua"),
+		UpdateExpression:    aws.String("REMOVE UsedAt, UsedAction"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":ua": {
+				S: aws.String(usedAt),
+			},
+		},
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return nil
+		}
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+	return nil
+}
+
+/*
+****************
+InvalidateRequestActionTokens()
+- Deletes the nonces of every link sent for the request, used when the
+request changes under its approvers. Links already in inboxes stop working.
+****************
+*/
+func InvalidateRequestActionTokens(requestID string) error {
+	params := &dynamodb.QueryInput{
+		TableName: aws.String(app.TABLE_NAME),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"PK": {
+				ComparisonOperator: aws.String(constants.CONDITION_EQUAL),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(utils.AppendPrefix(PREFIX_REQUEST, requestID)),
+					},
+				},
+			},
+			"SK": {
+				ComparisonOperator: aws.String(constants.CONDITION_BEGINS_WITH),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(PREFIX_REQUEST_ACTION_TOKEN),
+					},
+				},
+			},
+		},
+		ProjectionExpression: aws.String("PK, SK"),
+	}
+
+	writer := NewBatchWriter()
+	var items []map[string]*dynamodb.AttributeValue
+	err := app.SVC.QueryPages(params, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		items = append(items, page.Items...)
+		return true
+	})
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+	for _, item := range items {
+		writer.Delete(aws.StringValue(item["PK"].S), aws.StringValue(item["SK"].S))
+	}
+	if _, err := writer.Flush(); err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	return nil
+}
+
+// isCurrentRequestApprover reports whether the user may still decide the
+// request under its approval policy.
+func isCurrentRequestApprover(request Request, userID string) (bool, error) {
+	policy, err := GetRequestApprovalPolicy(request)
+	if err != nil {
+		return false, err
+	}
+	approvers, err := GetPolicyApprovers(request.CompanyID, policy)
+	if err != nil {
+		return false, err
+	}
+	for _, approver := range approvers {
+		if approver.UserID == userID {
+			return true, nil
+		}
+	}
+	return isEscalationApprover(request, policy, userID)
+}
+
+// RequestApprovalEmailJob emails one approver a new request with its
+// approve and reject links.
+type RequestApprovalEmailJob struct {
+	Request        Request
+	ApproverID     string
+	NotificationID string
+	Message        string
+}
+
+func (j RequestApprovalEmailJob) Run() {
+	approver, opsErr := ops.GetUserByIDNew(j.ApproverID)
+	if opsErr != nil || approver.Email == "" {
+		revel.AppLog.Error("RequestApprovalEmailJob: unable to retrieve approver", j.ApproverID)
+		return
+	}
+	approveURL, rejectURL, err := createRequestActionLinks(j.Request, j.ApproverID, j.NotificationID)
+	if err != nil {
+		revel.AppLog.Error("RequestApprovalEmailJob: unable to create links", j.Request.RequestID, err)
+		return
+	}
+
+	err = sendTemplateEmail(approver.Email, j.Message, requestApprovalEmailTemplate, requestApprovalEmail{
+		Name:       approver.FirstName + " " + approver.LastName,
+		Message:    j.Message,
+		ApproveURL: approveURL,
+		RejectURL:  rejectURL,
+	})
+	if err != nil {
+		revel.AppLog.Error("RequestApprovalEmailJob: unable to email approver "+j.ApproverID, err)
+	}
+}
+
+// requestApprovalEmail is what requestApprovalEmailTemplate renders. The
+// templates of mail.SendEmail have nowhere to put the links, so this email
+// is rendered and sent here.
+type requestApprovalEmail struct {
+	Name       string
+	Message    string
+	ApproveURL string
+	RejectURL  string
+}
+
+var requestApprovalEmailTemplate = template.Must(template.New("request_approval").Parse(`<p>Hi {{.Name}},</p>
+<p>{{.Message}}</p>
+<p>
+  <a href="{{.ApproveURL}}">Approve</a>
+  &nbsp;&middot;&nbsp;
+  <a href="{{.RejectURL}}">Reject</a>
+</p>
+<p>These links work once and only while you are signed in.</p>
+`))
+
+// sendTemplateEmail renders an email the templates of mail.SendEmail cannot
+// carry and sends it through the mail.smtp.* server.
+func sendTemplateEmail(to, subject string, body *template.Template, data interface{}) error {
+	host := revel.Config.StringDefault("mail.smtp.host", "")
+	from := revel.Config.StringDefault("mail.from", "")
+	if host == "" || from == "" {
+		return errors.New("mail.smtp.host and mail.from must be configured")
+	}
+
+	var message bytes.Buffer
+	message.WriteString("From: " + from + "\r\n")
+	message.WriteString("To: " + to + "\r\n")
+	message.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", subject) + "\r\n")
+	message.WriteString("MIME-Version: 1.0\r\n")
+	message.WriteString("Content-Type: text/html; charset=utf-8\r\n\r\n")
+	if err := body.Execute(&message, data); err != nil {
+		return err
+	}
+
+	addr := host + ":" + revel.Config.StringDefault("mail.smtp.port", "587")
+	var auth smtp.Auth
+	if username := revel.Config.StringDefault("mail.smtp.username", ""); username != "" {
+		auth = smtp.PlainAuth("", username, revel.Config.StringDefault("mail.smtp.password", ""), host)
+	}
+	return smtp.SendMail(addr, auth, from, []string{to}, message.Bytes())
+}
+
+/*
+****************
+notifyApproverChannels()
+- Sends a new request to an approver outside the app: an email with approve
+and reject links, and a Slack message when the company has Slack
+****************
+*/
+func notifyApproverChannels(request Request, approverID, notificationID, message string) {
+	jobs.Now(RequestApprovalEmailJob{
+		Request:        request,
+		ApproverID:     approverID,
+		NotificationID: notificationID,
+		Message:        message,
+	})
+	notifySlackApprover(request, approverID, notificationID, message)
+}
+
+/*
+****************
+EmailRequestAction()
+- Runs the accept or reject of an email link. The page the link opens posts
+the token here with the approver's session, so a forwarded email is of no
+use to anyone else. Each email's links work once.
+Params:
+token - required
+reason - optional, on reject
+****************
+*/
+func (c RequestController) EmailRequestAction() revel.Result {
+	companyID := c.ViewArgs["companyID"].(string)
+	userID := c.ViewArgs["userID"].(string)
+
+	secret := revel.Config.StringDefault(REQUEST_EMAIL_LINK_SECRET_KEY, "")
+	claims, err := ParseRequestActionToken(secret, c.Params.Get("token"), time.Now())
+	if err == ErrRequestActionTokenUsed {
+		return renderRequestError(c.Controller, NewRequestError(410, "This link has expired"))
+	}
+	if err != nil {
+		return renderRequestError(c.Controller, NewRequestError(400, "Invalid link"))
+	}
+	if claims.ApproverID != userID || claims.CompanyID != companyID {
+		return renderRequestError(c.Controller, NewRequestError(403, "This link was sent to another approver"))
+	}
+
+	request, err := GetRequestByID(companyID, claims.RequestID)
+	if err != nil {
+		c.Response.Status = 404
+		return c.RenderJSON(models.ErrorResponse{
+			Code:    "404",
+			Message: "Unable to retrieve request",
+		})
+	}
+	if !IsRequestOpen(request.Status) {
+		return renderRequestNotPending(c.Controller, request)
+	}
+
+	approver, err := isCurrentRequestApprover(request, userID)
+	if err != nil {
+		return renderRequestError(c.Controller, NewRequestError(500, "Unable to retrieve approvers"))
+	}
+	if !approver {
+		return renderRequestError(c.Controller, NewRequestError(403, "You are no longer an approver of this request"))
+	}
+
+	usedAt, err := spendRequestActionToken(claims)
+	if err != nil {
+		if err == ErrRequestActionTokenUsed {
+			return renderRequestError(c.Controller, NewRequestError(410, "This link has already been used"))
+		}
+		return renderRequestError(c.Controller, err)
+	}
+
+	decision := RequestDecision{
+		NotificationID: claims.NotificationID,
+		RequestType:    request.RequestType,
+		Action:         claims.Action,
+		UserIDs:        []string{request.RequesterUserID},
+		Reason:         strings.TrimSpace(c.Params.Get("reason")),
+	}
+	var result requestDecisionResult
+	if claims.Action == REQUEST_DECISION_ACCEPT {
+		result = acceptRequestDecision(c.Controller, decision)
+	} else {
+		result = rejectRequestDecision(c.Controller, decision)
+	}
+	// the links stay usable when the decision did not go through
+	if result.StatusCode >= 300 {
+		if err := releaseRequestActionToken(claims, usedAt); err != nil {
+			revel.AppLog.Error("EmailRequestAction: unable to release the link of request "+claims.RequestID, err)
+		}
+	}
+
+	c.Response.Status = result.StatusCode
+	return c.RenderJSON(result.Body)
+}
@@ -0,0 +1,95 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRequestActionToken(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	claims := requestActionClaims{
+		CompanyID:      "c1",
+		RequestID:      "r1",
+		ApproverID:     "u1",
+		NotificationID: "n1",
+		Action:         REQUEST_DECISION_ACCEPT,
+		Nonce:          "nonce",
+		ExpiresAt:      now.Add(time.Hour).Unix(),
+	}
+	token := func(secret string, claims requestActionClaims) string {
+		encoded, err := encodeRequestActionToken(secret, claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encoded
+	}
+
+	expired := claims
+	expired.ExpiresAt = now.Unix()
+	unknownAction := claims
+	unknownAction.Action = "DELETE"
+	valid := token("secret", claims)
+	payload := strings.Split(valid, ".")[0]
+	forged := token("secret", unknownAction)
+
+	tests := []struct {
+		name    string
+		secret  string
+		token   string
+		wantErr error
+	}{
+		{
+			name:   "valid token",
+			secret: "secret",
+			token:  valid,
+		},
+		{
+			name:    "signed with another secret",
+			secret:  "secret",
+			token:   token("other", claims),
+			wantErr: ErrRequestActionTokenInvalid,
+		},
+		{
+			name:    "payload swapped under a signature",
+			secret:  "secret",
+			token:   strings.Split(forged, ".")[0] + "." + strings.Split(valid, ".")[1],
+			wantErr: ErrRequestActionTokenInvalid,
+		},
+		{
+			name:    "no signature",
+			secret:  "secret",
+			token:   payload,
+			wantErr: ErrRequestActionTokenInvalid,
+		},
+		{
+			name:    "no secret configured",
+			token:   valid,
+			wantErr: ErrRequestActionTokenInvalid,
+		},
+		{
+			name:    "unknown action",
+			secret:  "secret",
+			token:   forged,
+			wantErr: ErrRequestActionTokenInvalid,
+		},
+		{
+			name:    "expired",
+			secret:  "secret",
+			token:   token("secret", expired),
+			wantErr: ErrRequestActionTokenUsed,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseRequestActionToken(test.secret, test.token, now)
+			if err != test.wantErr {
+				t.Fatalf("ParseRequestActionToken() error = %v; want %v", err, test.wantErr)
+			}
+			if err == nil && got != claims {
+				t.Errorf("ParseRequestActionToken() = %+v; want %+v", got, claims)
+			}
+		})
+	}
+}
@@ -0,0 +1,415 @@
+package controllers
+
+import (
+	"errors"
+	"grooper/app"
+	"grooper/app/constants"
+	"grooper/app/models"
+	ops "grooper/app/operations"
+	"grooper/app/utils"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/revel/modules/jobs/app/jobs"
+	"github.com/revel/revel"
+)
+
+const (
+	REQUEST_STAGE_REMINDED           = "REMINDED"
+	REQUEST_STAGE_ESCALATED          = "ESCALATED"
+	REQUEST_ACTOR_SYSTEM             = "SYSTEM"
+	NOTIFICATION_REQUEST_REMINDER    = "REQUEST_REMINDER"
+	REQUEST_DEFAULT_REMINDER_AFTER   = "48h"
+	REQUEST_DEFAULT_ESCALATION_AFTER = "96h"
+	REQUEST_DEFAULT_EXPIRY_AFTER     = "168h"
+	REQUEST_DEFAULT_EXPIRY_SCHEDULE  = "@every 15m"
+	// REQUEST_DEFAULT_NEEDS_INFO_EXPIRY_AFTER is how long a request waits on
+	// its requester, counted from the question
+	REQUEST_DEFAULT_NEEDS_INFO_EXPIRY_AFTER = "168h"
+	// INDEX_NAME_REQUEST_DUE is keyed on DuePartition and NextActionAt. Only
+	// open requests carry DuePartition, so the index holds nothing else.
+	INDEX_NAME_REQUEST_DUE = "RequestDueIndex"
+	REQUEST_DUE_PARTITION  = "REQUEST_DUE"
+)
+
+func init() {
+	revel.OnAppStart(func() {
+		jobs.Schedule(revel.Config.StringDefault("request.expiry.schedule", REQUEST_DEFAULT_EXPIRY_SCHEDULE), RequestExpiryJob{})
+	})
+}
+
+// requestDelay reads a duration from the config, falling back to the default
+// when it is missing or malformed.
+func requestDelay(key, fallback string) time.Duration {
+	delay, err := time.ParseDuration(revel.Config.StringDefault(key, fallback))
+	if err != nil {
+		delay, _ = time.ParseDuration(fallback)
+	}
+	return delay
+}
+
+// requestReminderDelay is how long a request waits before approvers are
+// reminded of it.
+func requestReminderDelay() time.Duration {
+	return requestDelay("request.reminder.after", REQUEST_DEFAULT_REMINDER_AFTER)
+}
+
+// requestEscalationDelay is how long a request waits, counted from its
+// creation, before it is escalated.
+func requestEscalationDelay() time.Duration {
+	return requestDelay("request.escalation.after", REQUEST_DEFAULT_ESCALATION_AFTER)
+}
+
+// requestExpiryDelay is how long a request waits, counted from its creation,
+// before it expires.
+func requestExpiryDelay() time.Duration {
+	return requestDelay("request.expiry.after", REQUEST_DEFAULT_EXPIRY_AFTER)
+}
+
+// requestNeedsInfoExpiryDelay is how long a request asked more information
+// about waits for its requester before it expires.
+func requestNeedsInfoExpiryDelay() time.Duration {
+	return requestDelay("request.needs_info.expiry_after", REQUEST_DEFAULT_NEEDS_INFO_EXPIRY_AFTER)
+}
+
+// escalationRoleID is the role a stale request governed by the policy is
+// escalated to.
+func escalationRoleID(policy ApprovalPolicy) string {
+	if policy.EscalationRoleID != "" {
+		return policy.EscalationRoleID
+	}
+	return revel.Config.StringDefault("request.escalation.role", constants.ROLE_ID_COMPANY_ADMIN)
+}
+
+// RequestExpiryJob reminds approvers of pending requests, escalates the ones
+// still waiting and finally expires them, so a stale request stops blocking
+// its requester from asking again.
+type RequestExpiryJob struct{}
+
+func (j RequestExpiryJob) Run() {
+	requests, err := GetDueRequests(time.Now().Unix())
+	if err != nil {
+		revel.AppLog.Error("RequestExpiryJob: unable to retrieve due requests", err)
+		return
+	}
+
+	for _, request := range requests {
+		if err := advanceStaleRequest(request); err != nil {
+			revel.AppLog.Error("RequestExpiryJob: unable to process request "+request.RequestID, err)
+		}
+	}
+}
+
+/*
+****************
+GetDueRequests()
+- Returns every open request whose next reminder, escalation or expiry is
+due at the given time, read from the request due index
+****************
+*/
+func GetDueRequests(now int64) ([]Request, error) {
+	requests := []Request{}
+
+	params := &dynamodb.QueryInput{
+		TableName: aws.String(app.TABLE_NAME),
+		IndexName: aws.String(INDEX_NAME_REQUEST_DUE),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"DuePartition": {
+				ComparisonOperator: aws.String(constants.CONDITION_EQUAL),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(REQUEST_DUE_PARTITION),
+					},
+				},
+			},
+			"NextActionAt": {
+				ComparisonOperator: aws.String(dynamodb.ComparisonOperatorLe),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						N: aws.String(strconv.FormatInt(now, 10)),
+					},
+				},
+			},
+		},
+		// the status is written before DuePartition is removed by the same
+		// update, the filter only guards against items written otherwise
+		FilterExpression: aws.String("#s IN (:pending, :needsInfo)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#s": aws.String("Status"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":pending": {
+				S: aws.String(REQUEST_STATUS_PENDING),
+			},
+			":needsInfo": {
+				S: aws.String(REQUEST_STATUS_NEEDS_INFO),
+			},
+		},
+	}
+
+	var items []map[string]*dynamodb.AttributeValue
+	err := app.SVC.QueryPages(params, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		items = append(items, page.Items...)
+		return true
+	})
+	if err != nil {
+		return requests, errors.New(constants.HTTP_STATUS_500)
+	}
+
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &requests)
+	if err != nil {
+		return requests, errors.New(constants.HTTP_STATUS_400)
+	}
+
+	return requests, nil
+}
+
+/*
+****************
+advanceRequestStage()
+- Moves a pending request to its next reminder stage. The write only
+succeeds if nobody advanced or decided the request since it was read, so
+two job runs never notify twice.
+****************
+*/
+func advanceRequestStage(request *Request, stage string, nextActionAt int64) error {
+	currentTime := utils.GetCurrentTimestamp()
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":pending": {
+				S: aws.String(REQUEST_STATUS_PENDING),
+			},
+			":due": {
+				N: aws.String(strconv.FormatInt(request.NextActionAt, 10)),
+			},
+			":stage": {
+				S: aws.String(stage),
+			},
+			":next": {
+				N: aws.String(strconv.FormatInt(nextActionAt, 10)),
+			},
+			":ua": {
+				S: aws.String(currentTime),
+			},
+		},
+		ExpressionAttributeNames: map[string]*string{
+			"#s": aws.String("Status"),
+		},
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(request.PK),
+			},
+			"SK": {
+				S: aws.String(request.SK),
+			},
+		},
+		ConditionExpression: aws.String("#s = :pending AND NextActionAt = :due"),
+		UpdateExpression:    aws.String("SET Stage = :stage, NextActionAt = :next, UpdatedAt = :ua"),
+	}
+
+	_, err := app.SVC.UpdateItem(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return ErrRequestNotPending
+		}
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	// an escalated request has new approvers
+	if stage == REQUEST_STAGE_ESCALATED {
+		invalidateRequestCounts(request.CompanyID)
+	}
+	request.Stage = stage
+	request.NextActionAt = nextActionAt
+	request.UpdatedAt = currentTime
+	return nil
+}
+
+// advanceStaleRequest takes a due request one step further: reminder, then
+// escalation, then expiry. A request still waiting on its requester when due
+// expires.
+func advanceStaleRequest(request Request) error {
+	if request.Status == REQUEST_STATUS_NEEDS_INFO {
+		err := expireRequest(request)
+		if err == ErrRequestNotPending {
+			return nil
+		}
+		return err
+	}
+
+	// delays are counted from the creation of the request, which is one
+	// stage delay before the action now due
+	due := time.Unix(request.NextActionAt, 0)
+
+	var err error
+	switch request.Stage {
+	case "":
+		created := due.Add(-requestReminderDelay())
+		err = advanceRequestStage(&request, REQUEST_STAGE_REMINDED, created.Add(requestEscalationDelay()).Unix())
+		if err == nil {
+			err = remindRequestApprovers(request)
+		}
+	case REQUEST_STAGE_REMINDED:
+		created := due.Add(-requestEscalationDelay())
+		err = advanceRequestStage(&request, REQUEST_STAGE_ESCALATED, created.Add(requestExpiryDelay()).Unix())
+		if err == nil {
+			err = escalateRequest(request)
+		}
+	default:
+		err = expireRequest(request)
+	}
+
+	// someone acted on the request since it was read, nothing left to do
+	if err == ErrRequestNotPending {
+		return nil
+	}
+	return err
+}
+
+// remindRequestApprovers notifies the approvers who have not approved the
+// request yet.
+func remindRequestApprovers(request Request) error {
+	policy, err := GetRequestApprovalPolicy(request)
+	if err != nil {
+		return err
+	}
+	approvers, err := GetPolicyApprovers(request.CompanyID, policy)
+	if err != nil {
+		return err
+	}
+	approvals, err := GetRequestApprovals(request.RequestID)
+	if err != nil {
+		return err
+	}
+	approved := map[string]bool{}
+	for _, approval := range approvals {
+		approved[approval.ApproverID] = true
+	}
+
+	requester, err := GetCompanyUser(request.CompanyID, request.RequesterUserID)
+	if err != nil {
+		return err
+	}
+
+	template := NewNotificationTemplate(MESSAGE_REQUEST_REMINDER, requesterName(requester))
+	for _, approver := range approvers {
+		if approved[approver.UserID] {
+			continue
+		}
+		createdNotification, err := ops.CreateNotification(ops.CreateNotificationInput{
+			UserID:           approver.UserID,
+			NotificationType: NOTIFICATION_REQUEST_REMINDER,
+			NotificationContent: models.NotificationContentType{
+				RequesterUserID: request.RequesterUserID,
+				ActiveCompany:   request.CompanyID,
+				IsAccepted:      NOTIFICATION_REQUEST_UNDER_REVIEW,
+				Message:         template.Render(userMessageLocale(approver.UserID)),
+			},
+			Global: false,
+		}, jobController(request.CompanyID))
+		if err != nil {
+			return errors.New("Unable to create notification for " + approver.UserID)
+		}
+		if err := SetNotificationTemplate(createdNotification, &template); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// escalateRequest hands the request to the escalation tier. The notifications
+// are linked to the request so it can be accepted or rejected from them.
+func escalateRequest(request Request) error {
+	policy, err := GetRequestApprovalPolicy(request)
+	if err != nil {
+		return err
+	}
+	approvers, err := ops.GetCompanyAdminsByRoleID(request.CompanyID, escalationRoleID(policy))
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	requester, err := GetCompanyUser(request.CompanyID, request.RequesterUserID)
+	if err != nil {
+		return err
+	}
+
+	template := NewNotificationTemplate(MESSAGE_REQUEST_ESCALATE, requesterName(requester))
+	for _, approver := range approvers {
+		createdNotification, err := ops.CreateNotification(ops.CreateNotificationInput{
+			UserID:           approver.UserID,
+			NotificationType: request.RequestType,
+			NotificationContent: models.NotificationContentType{
+				RequesterUserID:       request.RequesterUserID,
+				ActiveCompany:         request.CompanyID,
+				GroupID:               request.GroupID,
+				RolesRequested:        request.RolesRequested,
+				RequestedIntegrations: request.RequestedIntegrations,
+				Integration:           request.Integration,
+				IsAccepted:            NOTIFICATION_REQUEST_UNDER_REVIEW,
+				Message:               template.Render(userMessageLocale(approver.UserID)),
+			},
+			Global: false,
+		}, jobController(request.CompanyID))
+		if err != nil {
+			return errors.New("Unable to create notification for " + approver.UserID)
+		}
+		if err := SetNotificationTemplate(createdNotification, &template); err != nil {
+			return err
+		}
+		if err := LinkRequestNotification(request, createdNotification.NotificationID); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// expireRequest closes the request and tells the requester it can be filed
+// again.
+func expireRequest(request Request) error {
+	template := NewNotificationTemplate(MESSAGE_REQUEST_EXPIRED)
+	if request.Status == REQUEST_STATUS_NEEDS_INFO {
+		template = NewNotificationTemplate(MESSAGE_REQUEST_EXPIRED_NEEDS_INFO)
+	}
+	if err := TransitionRequest(&request, REQUEST_STATUS_EXPIRED, REQUEST_ACTOR_SYSTEM, ""); err != nil {
+		return err
+	}
+	if err := SyncRequestNotifications(request); err != nil {
+		revel.AppLog.Error("expireRequest: unable to update notifications of request "+request.RequestID, err)
+	}
+
+	createdNotification, err := ops.CreateNotification(ops.CreateNotificationInput{
+		UserID:           request.RequesterUserID,
+		NotificationType: constants.REQUEST_STATUS_UPDATE,
+		NotificationContent: models.NotificationContentType{
+			RequesterUserID: request.RequesterUserID,
+			ActiveCompany:   request.CompanyID,
+			IsAccepted:      REQUEST_STATUS_EXPIRED,
+			Message:         template.Render(userMessageLocale(request.RequesterUserID)),
+		},
+		Global: false,
+	}, jobController(request.CompanyID))
+	if err != nil {
+		return errors.New("Unable to create notification for " + request.RequesterUserID)
+	}
+
+	return SetNotificationTemplate(createdNotification, &template)
+}
+
+// jobController stands in for the request controller when notifications are
+// created outside of a request.
+func jobController(companyID string) *revel.Controller {
+	return &revel.Controller{
+		ViewArgs: map[string]interface{}{
+			"companyID": companyID,
+			"userID":    REQUEST_ACTOR_SYSTEM,
+		},
+	}
+}
@@ -0,0 +1,364 @@
+package controllers
+
+import (
+	"grooper/app/models"
+	ops "grooper/app/operations"
+	"strconv"
+
+	"github.com/revel/revel"
+)
+
+// RequestHandler implements one kind of request. The controller resolves the
+// handler from the request type and drives it; it never branches on the type
+// itself, so a new kind of request only needs a handler and a registration.
+type RequestHandler interface {
+	// Validate checks that the context carries what the request type needs.
+	Validate(ctx *RequestContext) error
+	// Authorize checks anything the approver needs beyond the permissions
+	// declared with RegisterRequestPermissions, which are checked first.
+	Authorize(ctx *RequestContext, accept bool) error
+	// Accept adds the grant for one requester to ctx.Transaction and any
+	// side effects to ctx.AfterCommit. It fills the admin facing message.
+	Accept(ctx *RequestContext, subject RequestSubject, content *models.NotificationContentType) error
+	// Reject fills the admin facing message for one requester.
+	Reject(ctx *RequestContext, subject RequestSubject, content *models.NotificationContentType) error
+	// Describe fills the notification sent to the requester once the request
+	// has been decided.
+	Describe(ctx *RequestContext, content *models.NotificationContentType, accepted bool) error
+}
+
+var requestHandlers = map[string]RequestHandler{}
+
+/*
+****************
+RegisterRequestHandler()
+- Registers the handler of a request type. Called from init() of the file
+implementing the handler.
+****************
+*/
+func RegisterRequestHandler(requestType string, handler RequestHandler) {
+	requestHandlers[requestType] = handler
+}
+
+/*
+****************
+GetRequestHandler()
+- Returns the handler registered for the request type
+****************
+*/
+func GetRequestHandler(requestType string) (RequestHandler, bool) {
+	handler, ok := requestHandlers[requestType]
+	return handler, ok
+}
+
+// RequestContext carries everything a handler needs about the decision being
+// made. Targets and users come from the stored request.
+type RequestContext struct {
+	Controller     *revel.Controller
+	CompanyID      string
+	ApproverID     string
+	RequestType    string
+	NotificationID string
+	Request        *Request
+	// UserIDs are the users the decision is made for: the requester
+	UserIDs        []string
+	GroupID        string
+	MemberType     string
+	RoleIDs        []string
+	IntegrationIDs []string
+	Integration    models.NotificationIntegration
+	Reason         string
+	// AutoApprovalRuleID is set when a rule accepts the request rather than
+	// an approver
+	AutoApprovalRuleID string
+	Transaction        *RequestTransaction
+	afterCommit        []func() error
+	applied            map[string]bool
+	output             map[string]interface{}
+	message            *NotificationTemplate
+}
+
+// RequestSubject is the user a decision is being made for.
+type RequestSubject struct {
+	User          models.User
+	RequesterInfo models.CompanyUser
+}
+
+// RequestError is returned by handlers to fail the call with a status code.
+type RequestError struct {
+	HTTPStatusCode int
+	Message        string
+}
+
+func (e *RequestError) Error() string {
+	return e.Message
+}
+
+func NewRequestError(httpStatusCode int, message string) *RequestError {
+	return &RequestError{
+		HTTPStatusCode: httpStatusCode,
+		Message:        message,
+	}
+}
+
+/*
+****************
+NewRequestContext()
+- Builds the context of a decision on the request. Its type, targets and
+requester only ever come from the stored request; a decision naming others
+is refused with a 422 rather than applied to what the approver did not see.
+Targets are de-duplicated, a transaction may only write each item once.
+****************
+*/
+func NewRequestContext(c *revel.Controller, request *Request, decision RequestDecision) (*RequestContext, error) {
+	if err := checkRequestDecision(*request, decision); err != nil {
+		return nil, err
+	}
+
+	return &RequestContext{
+		Controller:     c,
+		CompanyID:      c.ViewArgs["companyID"].(string),
+		ApproverID:     c.ViewArgs["userID"].(string),
+		RequestType:    request.RequestType,
+		NotificationID: decision.NotificationID,
+		Request:        request,
+		UserIDs:        []string{request.RequesterUserID},
+		GroupID:        request.GroupID,
+		MemberType:     decision.MemberType,
+		RoleIDs:        uniqueStrings(request.RolesRequested),
+		IntegrationIDs: uniqueStrings(request.RequestedIntegrations),
+		Integration:    request.Integration,
+		Reason:         decision.Reason,
+		Transaction:    &RequestTransaction{},
+	}, nil
+}
+
+// checkRequestDecision refuses a decision whose parameters name another
+// type, target or requester than the stored request. Parameters left out
+// are taken from the request.
+func checkRequestDecision(request Request, decision RequestDecision) error {
+	if decision.RequestType != "" && decision.RequestType != request.RequestType {
+		return NewRequestError(422, "requestType does not match the request")
+	}
+	if decision.GroupID != "" && decision.GroupID != request.GroupID {
+		return NewRequestError(422, "group_id does not match the request")
+	}
+	if len(decision.RoleIDs) != 0 && !sameStringSet(decision.RoleIDs, request.RolesRequested) {
+		return NewRequestError(422, "role_id does not match the roles of the request")
+	}
+	if len(decision.IntegrationIDs) != 0 && !sameStringSet(decision.IntegrationIDs, request.RequestedIntegrations) {
+		return NewRequestError(422, "integration_id does not match the integrations of the request")
+	}
+	for _, userID := range decision.UserIDs {
+		if userID != request.RequesterUserID {
+			return NewRequestError(422, "user_id does not match the requester of the request")
+		}
+	}
+	return nil
+}
+
+// uniqueStrings returns the values in their order, without repetitions.
+func uniqueStrings(values []string) []string {
+	if values == nil {
+		return nil
+	}
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, value := range values {
+		if seen[value] {
+			continue
+		}
+		seen[value] = true
+		unique = append(unique, value)
+	}
+	return unique
+}
+
+// sameStringSet reports whether both lists hold the same values, whatever
+// their order and repetitions.
+func sameStringSet(a, b []string) bool {
+	inA := map[string]bool{}
+	for _, value := range a {
+		inA[value] = true
+	}
+	inB := map[string]bool{}
+	for _, value := range b {
+		if !inA[value] {
+			return false
+		}
+		inB[value] = true
+	}
+	return len(inA) == len(inB)
+}
+
+/*
+****************
+AfterCommit()
+- Queues a side effect to run once the decision has been committed
+****************
+*/
+func (ctx *RequestContext) AfterCommit(fn func() error) {
+	ctx.afterCommit = append(ctx.afterCommit, fn)
+}
+
+/*
+****************
+Once()
+- Returns true the first time it is called with the key. Used by handlers
+for effects that apply to the whole request rather than to each requester.
+****************
+*/
+func (ctx *RequestContext) Once(key string) bool {
+	if ctx.applied == nil {
+		ctx.applied = map[string]bool{}
+	}
+	if ctx.applied[key] {
+		return false
+	}
+	ctx.applied[key] = true
+	return true
+}
+
+/*
+****************
+Respond()
+- Adds a value to the response sent to the approver once the decision has
+been committed
+****************
+*/
+func (ctx *RequestContext) Respond(key string, value interface{}) {
+	if ctx.output == nil {
+		ctx.output = map[string]interface{}{}
+	}
+	ctx.output[key] = value
+}
+
+// requestSavepoint marks how far a decision had got, so the work done for
+// one requester can be dropped without losing the others.
+type requestSavepoint struct {
+	items       int
+	afterCommit int
+	applied     map[string]bool
+	output      map[string]interface{}
+}
+
+/*
+****************
+Savepoint()
+- Marks the current state of the decision
+****************
+*/
+func (ctx *RequestContext) Savepoint() requestSavepoint {
+	applied := map[string]bool{}
+	for key, done := range ctx.applied {
+		applied[key] = done
+	}
+	output := map[string]interface{}{}
+	for key, value := range ctx.output {
+		output[key] = value
+	}
+	return requestSavepoint{
+		items:       ctx.Transaction.Len(),
+		afterCommit: len(ctx.afterCommit),
+		applied:     applied,
+		output:      output,
+	}
+}
+
+/*
+****************
+Rollback()
+- Drops the writes and side effects queued since the savepoint
+****************
+*/
+func (ctx *RequestContext) Rollback(savepoint requestSavepoint) {
+	ctx.Transaction.truncate(savepoint.items)
+	if savepoint.afterCommit < len(ctx.afterCommit) {
+		ctx.afterCommit = ctx.afterCommit[:savepoint.afterCommit]
+	}
+	ctx.applied = savepoint.applied
+	ctx.output = savepoint.output
+}
+
+/*
+****************
+RunAfterCommit()
+- Runs every queued side effect and returns the errors of those that failed
+****************
+*/
+func (ctx *RequestContext) RunAfterCommit() []error {
+	var errs []error
+	for _, fn := range ctx.afterCommit {
+		if err := fn(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errs
+}
+
+/*
+****************
+prepareRequestDecision()
+- Resolves, validates and authorizes the handler of a decision
+****************
+*/
+func prepareRequestDecision(ctx *RequestContext, accept bool) (RequestHandler, error) {
+	handler, ok := GetRequestHandler(ctx.RequestType)
+	if !ok {
+		return nil, NewRequestError(400, "Unsupported request type: "+ctx.RequestType)
+	}
+	if err := handler.Validate(ctx); err != nil {
+		return nil, err
+	}
+	action := REQUEST_ACTION_REJECT
+	if accept {
+		action = REQUEST_ACTION_ACCEPT
+	}
+	if err := AuthorizeRequestAction(ctx.CompanyID, ctx.ApproverID, ctx.RequestType, action); err != nil {
+		return nil, err
+	}
+	if err := handler.Authorize(ctx, accept); err != nil {
+		return nil, err
+	}
+	return handler, nil
+}
+
+/*
+****************
+loadRequestSubject()
+- Returns the user and company member the decision is made for
+****************
+*/
+func loadRequestSubject(ctx *RequestContext, userID string) (RequestSubject, error) {
+	var subject RequestSubject
+
+	user, opsErr := ops.GetUserByIDNew(userID)
+	if opsErr != nil {
+		return subject, NewRequestError(400, "Unable to retrieve user")
+	}
+
+	requesterInfo, err := ops.GetCompanyMember(ops.GetCompanyMemberParams{
+		UserID:    userID,
+		CompanyID: ctx.CompanyID,
+	}, ctx.Controller)
+	if err != nil {
+		return subject, NewRequestError(400, "Unable to retrieve Company user")
+	}
+
+	subject.User = user
+	subject.RequesterInfo = requesterInfo
+	return subject, nil
+}
+
+func renderRequestError(c *revel.Controller, err error) revel.Result {
+	requestErr, ok := err.(*RequestError)
+	if !ok {
+		requestErr = NewRequestError(500, err.Error())
+	}
+	c.Response.Status = requestErr.HTTPStatusCode
+	return c.RenderJSON(models.ErrorResponse{
+		Code:           strconv.Itoa(requestErr.HTTPStatusCode),
+		HTTPStatusCode: requestErr.HTTPStatusCode,
+		Message:        requestErr.Message,
+	})
+}
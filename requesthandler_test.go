@@ -0,0 +1,36 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUniqueStrings(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []string
+		want   []string
+	}{
+		{
+			name: "nothing",
+		},
+		{
+			name:   "no repetition",
+			values: []string{"admin", "dev"},
+			want:   []string{"admin", "dev"},
+		},
+		{
+			name:   "repetitions dropped, first order kept",
+			values: []string{"dev", "admin", "dev", "dev", "admin"},
+			want:   []string{"dev", "admin"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := uniqueStrings(tt.values); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("uniqueStrings() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,532 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"grooper/app"
+	"grooper/app/constants"
+	"grooper/app/models"
+	"grooper/app/utils"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/revel/revel"
+	"github.com/revel/revel/cache"
+)
+
+const (
+	REQUEST_INBOX_MAX_LIMIT = 100
+	// REQUEST_COUNTS_CACHE_DURATION bounds how long counts of an approver's
+	// requests lag behind role and policy changes; request changes refresh
+	// them right away
+	REQUEST_COUNTS_CACHE_DURATION = 5 * time.Minute
+)
+
+// RequestInboxFilter narrows the company's requests. Empty fields match
+// everything.
+type RequestInboxFilter struct {
+	RequestTypes []string
+	Statuses     []string
+	RequesterID  string
+	// TargetID matches the group, a requested role or a requested
+	// integration.
+	TargetID string
+	// ApproverID matches the requests the user decided and the open
+	// requests they may decide.
+	ApproverID string
+	// From and To bound CreatedAt, inclusive, in the format of CreatedAt.
+	From string
+	To   string
+}
+
+// RequestInboxPage is one page of the inbox. Cursor is empty on the last
+// page.
+type RequestInboxPage struct {
+	Requests []Request      `json:"requests"`
+	Counts   map[string]int `json:"counts"`
+	Cursor   string         `json:"cursor,omitempty"`
+}
+
+// requestInboxCursor is the position after the last request of a page.
+type requestInboxCursor struct {
+	PK string `json:"PK"`
+	SK string `json:"SK"`
+}
+
+// filterExpression builds the filter of the query. Statuses are left out
+// when withStatus is false, which is how the counts are taken.
+func (f RequestInboxFilter) filterExpression(withStatus bool) (string, map[string]*string, map[string]*dynamodb.AttributeValue) {
+	var conditions []string
+	names := map[string]*string{
+		"#type": aws.String("Type"),
+	}
+	values := map[string]*dynamodb.AttributeValue{
+		":type": {
+			S: aws.String(ENTITY_TYPE_REQUEST),
+		},
+	}
+	conditions = append(conditions, "#type = :type")
+
+	in := func(attribute, name, prefix string, list []string) {
+		var placeholders []string
+		for i, value := range list {
+			placeholder := ":" + prefix + strconv.Itoa(i)
+			placeholders = append(placeholders, placeholder)
+			values[placeholder] = &dynamodb.AttributeValue{
+				S: aws.String(value),
+			}
+		}
+		names[name] = aws.String(attribute)
+		conditions = append(conditions, name+" IN ("+strings.Join(placeholders, ", ")+")")
+	}
+	if len(f.RequestTypes) != 0 {
+		in("RequestType", "#rt", "rt", f.RequestTypes)
+	}
+	if withStatus && len(f.Statuses) != 0 {
+		in("Status", "#st", "st", f.Statuses)
+	}
+
+	if f.RequesterID != "" {
+		conditions = append(conditions, "RequesterUserID = :requester")
+		values[":requester"] = &dynamodb.AttributeValue{
+			S: aws.String(f.RequesterID),
+		}
+	}
+	if f.TargetID != "" {
+		conditions = append(conditions, "(GroupID = :target OR contains(RolesRequested, :target) OR contains(RequestedIntegrations, :target) OR Integration.IntegrationID = :target)")
+		values[":target"] = &dynamodb.AttributeValue{
+			S: aws.String(f.TargetID),
+		}
+	}
+	// open requests are narrowed to the ones the approver may decide by
+	// requestApproverMatcher
+	if f.ApproverID != "" {
+		conditions = append(conditions, "(DecidedBy = :approver OR #open IN (:pending, :info))")
+		names["#open"] = aws.String("Status")
+		values[":approver"] = &dynamodb.AttributeValue{
+			S: aws.String(f.ApproverID),
+		}
+		values[":pending"] = &dynamodb.AttributeValue{
+			S: aws.String(REQUEST_STATUS_PENDING),
+		}
+		values[":info"] = &dynamodb.AttributeValue{
+			S: aws.String(REQUEST_STATUS_NEEDS_INFO),
+		}
+	}
+	if f.From != "" {
+		conditions = append(conditions, "CreatedAt >= :from")
+		values[":from"] = &dynamodb.AttributeValue{
+			S: aws.String(f.From),
+		}
+	}
+	if f.To != "" {
+		conditions = append(conditions, "CreatedAt <= :to")
+		values[":to"] = &dynamodb.AttributeValue{
+			S: aws.String(f.To),
+		}
+	}
+
+	return strings.Join(conditions, " AND "), names, values
+}
+
+func requestInboxQuery(companyID string, filter RequestInboxFilter, withStatus bool) *dynamodb.QueryInput {
+	expression, names, values := filter.filterExpression(withStatus)
+	values[":pk"] = &dynamodb.AttributeValue{
+		S: aws.String(utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
+	}
+	values[":sk"] = &dynamodb.AttributeValue{
+		S: aws.String(PREFIX_REQUEST),
+	}
+
+	return &dynamodb.QueryInput{
+		TableName:                 aws.String(app.TABLE_NAME),
+		KeyConditionExpression:    aws.String("PK = :pk AND begins_with(SK, :sk)"),
+		FilterExpression:          aws.String(expression),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	}
+}
+
+func encodeRequestInboxCursor(key map[string]*dynamodb.AttributeValue) string {
+	cursor := requestInboxCursor{
+		PK: aws.StringValue(key["PK"].S),
+		SK: aws.StringValue(key["SK"].S),
+	}
+	raw, err := json.Marshal(cursor)
+	if err != nil {
+		return ""
+	}
+	return base64.RawURLEncoding.EncodeToString(raw)
+}
+
+func decodeRequestInboxCursor(companyID, value string) (map[string]*dynamodb.AttributeValue, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return nil, errors.New(constants.HTTP_STATUS_400)
+	}
+	var cursor requestInboxCursor
+	if err := json.Unmarshal(raw, &cursor); err != nil {
+		return nil, errors.New(constants.HTTP_STATUS_400)
+	}
+	// a cursor only continues a listing of the caller's own company
+	if cursor.PK != utils.AppendPrefix(constants.PREFIX_COMPANY, companyID) || !strings.HasPrefix(cursor.SK, PREFIX_REQUEST) {
+		return nil, errors.New(constants.HTTP_STATUS_400)
+	}
+	return map[string]*dynamodb.AttributeValue{
+		"PK": {
+			S: aws.String(cursor.PK),
+		},
+		"SK": {
+			S: aws.String(cursor.SK),
+		},
+	}, nil
+}
+
+/*
+****************
+GetRequestInbox()
+- Returns one page of the company's requests matching the filter, oldest
+first when ascending. Request IDs start with their creation time, so the
+sort key order is the creation order. The query is read until the page is
+full because the filter applies after DynamoDB's limit.
+****************
+*/
+func GetRequestInbox(companyID string, filter RequestInboxFilter, cursor string, limit int, ascending bool) (RequestInboxPage, error) {
+	page := RequestInboxPage{
+		Requests: []Request{},
+		Counts:   map[string]int{},
+	}
+
+	params := requestInboxQuery(companyID, filter, true)
+	params.ScanIndexForward = aws.Bool(ascending)
+	params.Limit = aws.Int64(int64(limit))
+	if cursor != "" {
+		startKey, err := decodeRequestInboxCursor(companyID, cursor)
+		if err != nil {
+			return page, err
+		}
+		params.ExclusiveStartKey = startKey
+	}
+
+	var approvers *requestApproverMatcher
+	if filter.ApproverID != "" {
+		approvers = newRequestApproverMatcher(companyID, filter.ApproverID)
+	}
+
+	var items []map[string]*dynamodb.AttributeValue
+	for {
+		res, err := app.SVC.Query(params)
+		if err != nil {
+			return page, errors.New(constants.HTTP_STATUS_500)
+		}
+		for i, item := range res.Items {
+			if approvers != nil {
+				matches, err := approvers.matchesItem(item)
+				if err != nil {
+					return page, err
+				}
+				if !matches {
+					continue
+				}
+			}
+			items = append(items, item)
+			if len(items) == limit {
+				// more may follow the last request of the page
+				if i < len(res.Items)-1 || len(res.LastEvaluatedKey) != 0 {
+					page.Cursor = encodeRequestInboxCursor(item)
+				}
+				break
+			}
+		}
+		if len(items) == limit {
+			break
+		}
+		if len(res.LastEvaluatedKey) == 0 {
+			break
+		}
+		params.ExclusiveStartKey = res.LastEvaluatedKey
+	}
+
+	if err := dynamodbattribute.UnmarshalListOfMaps(items, &page.Requests); err != nil {
+		return page, errors.New(constants.HTTP_STATUS_400)
+	}
+
+	counts, err := getRequestCounts(companyID, filter)
+	if err != nil {
+		return page, err
+	}
+	page.Counts = counts
+
+	return page, nil
+}
+
+// requestApproverMatcher tells whether a request is one the approver
+// decided or may decide. Requests asking for the same thing share their
+// policy, so each is only looked up once.
+type requestApproverMatcher struct {
+	companyID  string
+	approverID string
+	assigned   map[string]bool
+}
+
+func newRequestApproverMatcher(companyID, approverID string) *requestApproverMatcher {
+	return &requestApproverMatcher{
+		companyID:  companyID,
+		approverID: approverID,
+		assigned:   map[string]bool{},
+	}
+}
+
+func (m *requestApproverMatcher) matchesItem(item map[string]*dynamodb.AttributeValue) (bool, error) {
+	var request Request
+	if err := dynamodbattribute.UnmarshalMap(item, &request); err != nil {
+		return false, errors.New(constants.HTTP_STATUS_400)
+	}
+	return m.matches(request)
+}
+
+func (m *requestApproverMatcher) matches(request Request) (bool, error) {
+	if request.DecidedBy == m.approverID {
+		return true, nil
+	}
+	if !IsRequestOpen(request.Status) {
+		return false, nil
+	}
+
+	key := requestApproverKey(request)
+	if assigned, ok := m.assigned[key]; ok {
+		return assigned, nil
+	}
+
+	policy, err := GetRequestApprovalPolicy(request)
+	if err != nil {
+		return false, errors.New(constants.HTTP_STATUS_500)
+	}
+	assigned, err := isEscalationApprover(request, policy, m.approverID)
+	if err != nil {
+		return false, errors.New(constants.HTTP_STATUS_500)
+	}
+	if !assigned {
+		approvers, err := GetPolicyApprovers(m.companyID, policy)
+		if err != nil {
+			return false, err
+		}
+		for _, approver := range approvers {
+			if approver.UserID == m.approverID {
+				assigned = true
+				break
+			}
+		}
+	}
+
+	m.assigned[key] = assigned
+	return assigned, nil
+}
+
+// requestApproverKey is what the approvers of a request depend on: its
+// type, the roles it asks for, whether they are elevations and whether it
+// was escalated.
+func requestApproverKey(request Request) string {
+	roles := append([]string{}, request.RolesRequested...)
+	sort.Strings(roles)
+	return request.RequestType + "|" + strings.Join(roles, ",") + "|" +
+		strconv.FormatBool(request.ElevationSeconds != 0) + "|" + request.Stage
+}
+
+/*
+****************
+getRequestCounts()
+- Returns the counts of the inbox tabs from the cache, counting them again
+once a request of the company changed since they were cached
+****************
+*/
+func getRequestCounts(companyID string, filter RequestInboxFilter) (map[string]int, error) {
+	var generation int64
+	cache.Get(requestCountsGenerationKey(companyID), &generation)
+	key := requestCountsCacheKey(companyID, generation, filter)
+
+	var counts map[string]int
+	if err := cache.Get(key, &counts); err == nil && counts != nil {
+		return counts, nil
+	}
+
+	counts, err := countRequestsByStatus(companyID, filter)
+	if err != nil {
+		return counts, err
+	}
+	go cache.Set(key, counts, REQUEST_COUNTS_CACHE_DURATION)
+
+	return counts, nil
+}
+
+func requestCountsGenerationKey(companyID string) string {
+	return "request_counts_generation_" + companyID
+}
+
+// requestCountsCacheKey names the counts of the filter under a generation
+// of the company. The status filter is left out as the counts ignore it.
+func requestCountsCacheKey(companyID string, generation int64, filter RequestInboxFilter) string {
+	filter.Statuses = nil
+	raw, _ := json.Marshal(filter)
+	sum := sha256.Sum256(raw)
+
+	return "request_counts_" + companyID + "_" + strconv.FormatInt(generation, 10) + "_" + hex.EncodeToString(sum[:])
+}
+
+// invalidateRequestCounts starts a new generation of the company's cached
+// counts, called whenever a request is filed or changes.
+func invalidateRequestCounts(companyID string) {
+	cache.Set(requestCountsGenerationKey(companyID), time.Now().UnixNano(), cache.FOREVER)
+}
+
+// countRequestsByStatus counts the requests matching every filter but the
+// status, so the inbox can show its tabs.
+func countRequestsByStatus(companyID string, filter RequestInboxFilter) (map[string]int, error) {
+	counts := map[string]int{}
+	for status := range requestNotificationStatus {
+		counts[status] = 0
+	}
+
+	params := requestInboxQuery(companyID, filter, false)
+	// the approver needs whole requests to tell which open ones are theirs
+	var approvers *requestApproverMatcher
+	if filter.ApproverID != "" {
+		approvers = newRequestApproverMatcher(companyID, filter.ApproverID)
+	} else {
+		params.ExpressionAttributeNames["#status"] = aws.String("Status")
+		params.ProjectionExpression = aws.String("#status")
+	}
+
+	var matchErr error
+	err := app.SVC.QueryPages(params, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			if approvers != nil {
+				matches, err := approvers.matchesItem(item)
+				if err != nil {
+					matchErr = err
+					return false
+				}
+				if !matches {
+					continue
+				}
+			}
+			if item["Status"] != nil {
+				counts[aws.StringValue(item["Status"].S)]++
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return counts, errors.New(constants.HTTP_STATUS_500)
+	}
+	if matchErr != nil {
+		return counts, matchErr
+	}
+
+	return counts, nil
+}
+
+/*
+****************
+GetRequests()
+- Lists the company's requests of every type the user may view
+Params:
+request_type[] - optional
+status[] - optional
+requester_id - optional
+target_id - optional (group, role or integration id)
+approver_id - optional (who decided the request, or may decide it while open)
+from, to - optional (CreatedAt bounds, inclusive)
+cursor - optional (from the previous page)
+limit - optional (default 10, at most 100)
+sort_order - optional (ascending/descending, newest first by default)
+****************
+*/
+func (c RequestController) GetRequests() revel.Result {
+	companyID := c.ViewArgs["companyID"].(string)
+	userID := c.ViewArgs["userID"].(string)
+	data := make(map[string]interface{})
+
+	var filter RequestInboxFilter
+	c.Params.Bind(&filter.RequestTypes, "request_type")
+	c.Params.Bind(&filter.Statuses, "status")
+	filter.RequesterID = c.Params.Get("requester_id")
+	filter.TargetID = c.Params.Get("target_id")
+	filter.ApproverID = c.Params.Get("approver_id")
+	filter.From = c.Params.Get("from")
+	filter.To = c.Params.Get("to")
+
+	for _, requestType := range filter.RequestTypes {
+		if _, ok := GetRequestHandler(requestType); !ok {
+			return c.renderInboxError(422, "Unsupported request type: "+requestType)
+		}
+	}
+	// the requested types were authorized by the interceptor; without any
+	// the inbox lists the types the user may view
+	if len(filter.RequestTypes) == 0 {
+		filter.RequestTypes = viewableRequestTypes(companyID, userID)
+		if len(filter.RequestTypes) == 0 {
+			return c.renderInboxError(403, "Missing permission to view requests")
+		}
+	}
+	for _, status := range filter.Statuses {
+		if _, ok := requestNotificationStatus[status]; !ok {
+			return c.renderInboxError(422, "Unknown request status: "+status)
+		}
+	}
+	if filter.From != "" && filter.To != "" && filter.From > filter.To {
+		return c.renderInboxError(422, "from must not be after to")
+	}
+
+	limit := constants.DEFAULT_PAGE_LIMIT
+	if value := c.Params.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil || limit < 1 || limit > REQUEST_INBOX_MAX_LIMIT {
+			return c.renderInboxError(422, "limit must be between 1 and "+strconv.Itoa(REQUEST_INBOX_MAX_LIMIT))
+		}
+	}
+
+	ascending := false
+	switch c.Params.Get("sort_order") {
+	case "", "descending":
+	case "ascending":
+		ascending = true
+	default:
+		c.Response.Status = 400
+		data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_400)
+		return c.RenderJSON(data)
+	}
+
+	page, err := GetRequestInbox(companyID, filter, c.Params.Get("cursor"), limit, ascending)
+	if err != nil {
+		if err.Error() == constants.HTTP_STATUS_400 {
+			c.Response.Status = 400
+		}
+		data["status"] = utils.GetHTTPStatus(err.Error())
+		return c.RenderJSON(data)
+	}
+
+	data["requests"] = page.Requests
+	data["counts"] = page.Counts
+	data["cursor"] = page.Cursor
+	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+	return c.RenderJSON(data)
+}
+
+func (c RequestController) renderInboxError(statusCode int, message string) revel.Result {
+	c.Response.Status = statusCode
+	return c.RenderJSON(models.ErrorResponse{
+		Code:           strconv.Itoa(statusCode),
+		HTTPStatusCode: statusCode,
+		Message:        message,
+	})
+}
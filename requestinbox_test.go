@@ -0,0 +1,74 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRequestInboxApproverFilter(t *testing.T) {
+	expression, names, values := RequestInboxFilter{ApproverID: "u1"}.filterExpression(true)
+
+	if !strings.Contains(expression, "(DecidedBy = :approver OR #open IN (:pending, :info))") {
+		t.Errorf("expression = %q; want decided or open requests", expression)
+	}
+	if *names["#open"] != "Status" {
+		t.Errorf("#open = %q", *names["#open"])
+	}
+	if *values[":pending"].S != REQUEST_STATUS_PENDING || *values[":info"].S != REQUEST_STATUS_NEEDS_INFO {
+		t.Errorf("open statuses = %q, %q", *values[":pending"].S, *values[":info"].S)
+	}
+}
+
+func TestRequestApproverKey(t *testing.T) {
+	base := Request{RequestType: "ROLE", RolesRequested: []string{"r1", "r2"}}
+
+	tests := []struct {
+		name    string
+		request Request
+		same    bool
+	}{
+		{
+			name:    "roles in another order",
+			request: Request{RequestType: "ROLE", RolesRequested: []string{"r2", "r1"}},
+			same:    true,
+		},
+		{
+			name:    "other roles",
+			request: Request{RequestType: "ROLE", RolesRequested: []string{"r1"}},
+		},
+		{
+			name:    "elevation",
+			request: Request{RequestType: "ROLE", RolesRequested: []string{"r1", "r2"}, ElevationSeconds: 3600},
+		},
+		{
+			name:    "escalated",
+			request: Request{RequestType: "ROLE", RolesRequested: []string{"r1", "r2"}, Stage: REQUEST_STAGE_ESCALATED},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if same := requestApproverKey(test.request) == requestApproverKey(base); same != test.same {
+				t.Errorf("same key = %v; want %v", same, test.same)
+			}
+		})
+	}
+}
+
+func TestRequestCountsCacheKeyIgnoresStatus(t *testing.T) {
+	filter := RequestInboxFilter{RequestTypes: []string{"ROLE"}, ApproverID: "u1"}
+	withStatus := filter
+	withStatus.Statuses = []string{REQUEST_STATUS_PENDING}
+
+	if requestCountsCacheKey("c1", 1, filter) != requestCountsCacheKey("c1", 1, withStatus) {
+		t.Errorf("the status filter changed the counts key")
+	}
+	other := filter
+	other.ApproverID = "u2"
+	if requestCountsCacheKey("c1", 1, filter) == requestCountsCacheKey("c1", 1, other) {
+		t.Errorf("two approvers share the counts key")
+	}
+	if requestCountsCacheKey("c1", 1, filter) == requestCountsCacheKey("c1", 2, filter) {
+		t.Errorf("a new generation kept the counts key")
+	}
+}
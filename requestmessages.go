@@ -0,0 +1,326 @@
+package controllers
+
+import (
+	"errors"
+	"grooper/app"
+	"grooper/app/constants"
+	"grooper/app/models"
+	"grooper/app/utils"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/revel/revel"
+	"github.com/revel/revel/cache"
+)
+
+const (
+	MESSAGE_OUTCOME_ACCEPTED = "accepted"
+	MESSAGE_OUTCOME_REJECTED = "rejected"
+	MESSAGE_LIST_SUFFIX      = ".many"
+	MESSAGE_REQUEST_REASON   = "request.reason"
+	MESSAGE_REQUEST_WITHDRAW = "request.withdrawn"
+	MESSAGE_REQUEST_FAILED   = "request.reply.failed"
+	MESSAGE_ROLE_REQUESTED   = "request.role.admin.requested"
+	MESSAGE_GROUP_REQUESTED  = "request.group.admin.requested"
+	MESSAGE_ROLE_EXPIRING    = "role.expiring"
+
+	MESSAGE_REQUEST_REMINDER = "request.reminder"
+	MESSAGE_REQUEST_ESCALATE = "request.escalated"
+	MESSAGE_REQUEST_EXPIRED  = "request.expired"
+	MESSAGE_REQUEST_INFO     = "request.info.requested"
+	MESSAGE_REQUEST_COMMENT  = "request.comment"
+
+	MESSAGE_REQUEST_EXPIRED_NEEDS_INFO = "request.expired.needs_info"
+	MESSAGE_ROLE_ELEVATION_REQUESTED   = "request.role.admin.elevation"
+	MESSAGE_ROLE_ELEVATION_TICKET      = "request.role.admin.elevation.ticket"
+
+	MESSAGE_CONNECTION_CONNECTED = "request.connect.connected"
+	MESSAGE_CONNECTION_FAILED    = "request.connect.failed"
+	MESSAGE_ACCOUNT_PROVISIONED  = "request.account.provisioned"
+	MESSAGE_ACCOUNT_INVITED      = "request.account.invited"
+	MESSAGE_ACCOUNT_FAILED       = "request.account.failed"
+	MESSAGE_ACCOUNT_CREDENTIALS  = "request.account.credentials"
+
+	MESSAGE_ACCOUNT_CREDENTIALS_GREETING = "request.account.credentials.greeting"
+	MESSAGE_ACCOUNT_CREDENTIALS_CREATED  = "request.account.credentials.created"
+	MESSAGE_ACCOUNT_CREDENTIALS_SIGN_IN  = "request.account.credentials.sign_in"
+
+	SK_MESSAGE_LOCALE               = "MESSAGE_LOCALE"
+	MESSAGE_LOCALE_CACHE_DURATION   = 24 * time.Hour
+	MESSAGE_LOCALE_CACHE_KEY_PREFIX = "message_locale_"
+)
+
+// messageLocale is the locale a user last called with. Their notifications
+// are rendered in it.
+type messageLocale struct {
+	PK        string `json:"PK,omitempty"`
+	SK        string `json:"SK,omitempty"`
+	UserID    string `json:"UserID,omitempty"`
+	Locale    string `json:"Locale,omitempty"`
+	UpdatedAt string `json:"UpdatedAt,omitempty"`
+}
+
+func init() {
+	revel.InterceptMethod(RequestController.rememberMessageLocale, revel.BEFORE)
+	revel.InterceptMethod(RoleController.rememberMessageLocale, revel.BEFORE)
+}
+
+// NotificationTemplate is the message key and parameters a notification was
+// rendered from. It is stored on the notification so the frontend can render
+// it again in the viewer's language.
+type NotificationTemplate struct {
+	Key    string   `json:"Key,omitempty"`
+	Params []string `json:"Params,omitempty"`
+	Reason string   `json:"Reason,omitempty"`
+}
+
+// NewNotificationTemplate returns the template of a message.
+func NewNotificationTemplate(key string, params ...string) NotificationTemplate {
+	return NotificationTemplate{Key: key, Params: params}
+}
+
+// newListTemplate picks the one item or the many items variant of the key.
+// The names are the last parameter, joined.
+func newListTemplate(key string, names []string, params ...string) NotificationTemplate {
+	if len(names) != 1 {
+		key += MESSAGE_LIST_SUFFIX
+	}
+	return NewNotificationTemplate(key, append(params, strings.Join(names, ", "))...)
+}
+
+/*
+****************
+Render()
+- Returns the message in the locale, from the messages files. Keys the
+locale has no message for are rendered in the default locale
+****************
+*/
+func (t NotificationTemplate) Render(locale string) string {
+	message := renderRequestMessage(locale, t.Key, t.Params)
+	if t.Reason != "" {
+		message += " " + renderRequestMessage(locale, MESSAGE_REQUEST_REASON, []string{t.Reason})
+	}
+	return message
+}
+
+func renderRequestMessage(locale, key string, params []string) string {
+	args := make([]interface{}, len(params))
+	for i, param := range params {
+		args[i] = param
+	}
+
+	for _, candidate := range []string{locale, defaultMessageLocale()} {
+		// revel marks the keys it has no message for with ???
+		message := revel.Message(candidate, key, args...)
+		if message != "" && !strings.HasPrefix(message, "???") {
+			return message
+		}
+	}
+	return key
+}
+
+// defaultMessageLocale is the locale of users who never called with one.
+func defaultMessageLocale() string {
+	return revel.Config.StringDefault("i18n.default_language", "en")
+}
+
+// callerMessageLocale is the locale the caller asked for.
+func callerMessageLocale(c *revel.Controller) string {
+	if c != nil && c.Request != nil && c.Request.Locale != "" {
+		return c.Request.Locale
+	}
+	return defaultMessageLocale()
+}
+
+/*
+****************
+userMessageLocale()
+- Returns the locale the notifications of the user are rendered in: the one
+they last called with, or the default locale
+****************
+*/
+func userMessageLocale(userID string) string {
+	var locale string
+	if err := cache.Get(MESSAGE_LOCALE_CACHE_KEY_PREFIX+userID, &locale); err == nil && locale != "" {
+		return locale
+	}
+
+	res, err := app.SVC.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(utils.AppendPrefix(constants.PREFIX_USER, userID)),
+			},
+			"SK": {
+				S: aws.String(SK_MESSAGE_LOCALE),
+			},
+		},
+	})
+	if err != nil || len(res.Item) == 0 {
+		return defaultMessageLocale()
+	}
+	var stored messageLocale
+	if err := dynamodbattribute.UnmarshalMap(res.Item, &stored); err != nil || stored.Locale == "" {
+		return defaultMessageLocale()
+	}
+
+	go cache.Set(MESSAGE_LOCALE_CACHE_KEY_PREFIX+userID, stored.Locale, MESSAGE_LOCALE_CACHE_DURATION)
+	return stored.Locale
+}
+
+// saveMessageLocale stores the locale of the user when it changed.
+func saveMessageLocale(userID, locale string) error {
+	if userID == "" || locale == "" {
+		return nil
+	}
+	var current string
+	if err := cache.Get(MESSAGE_LOCALE_CACHE_KEY_PREFIX+userID, &current); err == nil && current == locale {
+		return nil
+	}
+
+	av, err := dynamodbattribute.MarshalMap(messageLocale{
+		PK:        utils.AppendPrefix(constants.PREFIX_USER, userID),
+		SK:        SK_MESSAGE_LOCALE,
+		UserID:    userID,
+		Locale:    locale,
+		UpdatedAt: utils.GetCurrentTimestamp(),
+	})
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+	_, err = app.SVC.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(app.TABLE_NAME),
+	})
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	go cache.Set(MESSAGE_LOCALE_CACHE_KEY_PREFIX+userID, locale, MESSAGE_LOCALE_CACHE_DURATION)
+	return nil
+}
+
+// rememberMessageLocale is an interceptor keeping the locale of the caller,
+// so the notifications they get later are in their language.
+func (c RequestController) rememberMessageLocale() revel.Result {
+	rememberCallerLocale(c.Controller)
+	return nil
+}
+
+func (c RoleController) rememberMessageLocale() revel.Result {
+	rememberCallerLocale(c.Controller)
+	return nil
+}
+
+func rememberCallerLocale(c *revel.Controller) {
+	userID, _ := c.ViewArgs["userID"].(string)
+	if userID == "" || c.Request == nil || c.Request.Locale == "" {
+		return
+	}
+	if err := saveMessageLocale(userID, c.Request.Locale); err != nil {
+		revel.AppLog.Error("rememberMessageLocale: unable to save the locale of "+userID, err)
+	}
+}
+
+// requesterName is how the requester is named in messages.
+func requesterName(requester models.CompanyUser) string {
+	return requester.FirstName + " " + requester.LastName
+}
+
+// requestMessageKey returns "request.<kind>.<audience>.<outcome>".
+func requestMessageKey(kind, audience string, accepted bool) string {
+	outcome := MESSAGE_OUTCOME_REJECTED
+	if accepted {
+		outcome = MESSAGE_OUTCOME_ACCEPTED
+	}
+	return "request." + kind + "." + audience + "." + outcome
+}
+
+/*
+****************
+AdminMessage()
+- Sets the message of the approver's notification, in the approver's
+locale, and keeps its template for the notification
+****************
+*/
+func (ctx *RequestContext) AdminMessage(content *models.NotificationContentType, template NotificationTemplate) {
+	content.Message = template.Render(callerMessageLocale(ctx.Controller))
+	ctx.message = &template
+}
+
+/*
+****************
+RequesterMessage()
+- Sets the message of the requester's notification, in the requester's
+locale, and keeps its template for the notification
+****************
+*/
+func (ctx *RequestContext) RequesterMessage(content *models.NotificationContentType, template NotificationTemplate) {
+	content.Message = template.Render(userMessageLocale(content.RequesterUserID))
+	ctx.message = &template
+}
+
+// takeMessage returns the template set since the last call.
+func (ctx *RequestContext) takeMessage() *NotificationTemplate {
+	template := ctx.message
+	ctx.message = nil
+	return template
+}
+
+/*
+****************
+SetNotificationTemplate()
+- Stores the template a notification was rendered from on the notification
+****************
+*/
+func SetNotificationTemplate(notification models.Notification, template *NotificationTemplate) error {
+	if template == nil || notification.PK == "" {
+		return nil
+	}
+	av, err := dynamodbattribute.MarshalMap(template)
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	_, err = app.SVC.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(notification.PK),
+			},
+			"SK": {
+				S: aws.String(notification.SK),
+			},
+		},
+		UpdateExpression: aws.String("SET MessageTemplate = :mt"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":mt": {
+				M: av,
+			},
+		},
+	})
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+	return nil
+}
+
+// notificationTemplates reads the templates stored on notification items,
+// keyed by notification ID.
+func notificationTemplates(items []map[string]*dynamodb.AttributeValue) map[string]NotificationTemplate {
+	templates := map[string]NotificationTemplate{}
+	for _, item := range items {
+		if item["MessageTemplate"] == nil || item["NotificationID"] == nil {
+			continue
+		}
+		var template NotificationTemplate
+		if err := dynamodbattribute.UnmarshalMap(item["MessageTemplate"].M, &template); err != nil {
+			continue
+		}
+		templates[aws.StringValue(item["NotificationID"].S)] = template
+	}
+	return templates
+}
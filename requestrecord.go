@@ -0,0 +1,888 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"grooper/app"
+	"grooper/app/constants"
+	"grooper/app/models"
+	ops "grooper/app/operations"
+	"grooper/app/utils"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const (
+	PREFIX_REQUEST                    = "REQUEST#"
+	ENTITY_TYPE_REQUEST               = "REQUEST"
+	ENTITY_TYPE_REQUEST_NOTIFICATION  = "REQUEST_NOTIFICATION"
+	REQUEST_STATUS_PENDING            = "PENDING"
+	REQUEST_STATUS_NEEDS_INFO         = "NEEDS_INFO"
+	REQUEST_STATUS_APPROVED           = "APPROVED"
+	REQUEST_STATUS_REJECTED           = "REJECTED"
+	REQUEST_STATUS_WITHDRAWN          = "WITHDRAWN"
+	REQUEST_STATUS_EXPIRED            = "EXPIRED"
+	NOTIFICATION_REQUEST_UNDER_REVIEW = "UNDER_REVIEW"
+	NOTIFICATION_REQUEST_ACCEPTED     = "ACCEPTED"
+	NOTIFICATION_REQUEST_REJECTED     = "REJECTED"
+	// PREFIX_LEGACY_REQUEST starts the IDs of the requests migrated from
+	// notifications sent before requests were stored
+	PREFIX_LEGACY_REQUEST             = "LEGACY-"
+	LEGACY_REQUEST_MIGRATION_ATTEMPTS = 3
+)
+
+var (
+	ErrRequestNotPending = errors.New("request is no longer pending")
+	ErrRequestExists     = errors.New("request already exists")
+)
+
+// requestTransitions lists the states a request may move to from each state.
+// Terminal states have no entry.
+var requestTransitions = map[string][]string{
+	REQUEST_STATUS_PENDING: {
+		REQUEST_STATUS_APPROVED,
+		REQUEST_STATUS_REJECTED,
+		REQUEST_STATUS_WITHDRAWN,
+		REQUEST_STATUS_EXPIRED,
+		REQUEST_STATUS_NEEDS_INFO,
+	},
+	// waiting on the requester; it goes back to pending once they reply,
+	// and expires if they never do
+	REQUEST_STATUS_NEEDS_INFO: {
+		REQUEST_STATUS_PENDING,
+		REQUEST_STATUS_APPROVED,
+		REQUEST_STATUS_REJECTED,
+		REQUEST_STATUS_WITHDRAWN,
+		REQUEST_STATUS_EXPIRED,
+	},
+}
+
+// IsRequestOpen returns true while a request can still be decided, amended
+// or withdrawn.
+func IsRequestOpen(status string) bool {
+	return status == REQUEST_STATUS_PENDING || status == REQUEST_STATUS_NEEDS_INFO
+}
+
+// requestNotificationStatus maps a request state to the IsAccepted value
+// shown on the notifications that point to it.
+var requestNotificationStatus = map[string]string{
+	REQUEST_STATUS_PENDING:    NOTIFICATION_REQUEST_UNDER_REVIEW,
+	REQUEST_STATUS_NEEDS_INFO: REQUEST_STATUS_NEEDS_INFO,
+	REQUEST_STATUS_APPROVED:   NOTIFICATION_REQUEST_ACCEPTED,
+	REQUEST_STATUS_REJECTED:   NOTIFICATION_REQUEST_REJECTED,
+	REQUEST_STATUS_WITHDRAWN:  REQUEST_STATUS_WITHDRAWN,
+	REQUEST_STATUS_EXPIRED:    REQUEST_STATUS_EXPIRED,
+}
+
+// Request is the single source of truth for a user's request, whatever its
+// type. Notifications sent to admins only point to it.
+type Request struct {
+	PK                    string                         `json:"PK,omitempty"`
+	SK                    string                         `json:"SK,omitempty"`
+	RequestID             string                         `json:"RequestID,omitempty"`
+	CompanyID             string                         `json:"CompanyID,omitempty"`
+	RequestType           string                         `json:"RequestType,omitempty"`
+	RequesterUserID       string                         `json:"RequesterUserID,omitempty"`
+	RequestedBy           string                         `json:"RequestedBy,omitempty"`
+	Status                string                         `json:"Status,omitempty"`
+	GroupID               string                         `json:"GroupID,omitempty"`
+	RolesRequested        []string                       `json:"RolesRequested,omitempty"`
+	RequestedIntegrations []string                       `json:"RequestedIntegrations,omitempty"`
+	Integration           models.NotificationIntegration `json:"Integration,omitempty"`
+	DecidedBy             string                         `json:"DecidedBy,omitempty"`
+	DecidedAt             string                         `json:"DecidedAt,omitempty"`
+	Reason                string                         `json:"Reason,omitempty"`
+	Stage                 string                         `json:"Stage,omitempty"`
+	NextActionAt          int64                          `json:"NextActionAt,omitempty"`
+	DuePartition          string                         `json:"DuePartition,omitempty"`
+	Provisioning          map[string]AccountProvisioning `json:"Provisioning,omitempty"`
+	AutoApprovalRuleID    string                         `json:"AutoApprovalRuleID,omitempty"`
+	// GrantExpiresAt ends the roles granted by the request, a unix time;
+	// zero grants them for good
+	GrantExpiresAt int64 `json:"GrantExpiresAt,omitempty"`
+	// ElevationSeconds marks a just-in-time elevation: the roles are granted
+	// for that long from the acceptance, for the reason in Justification
+	ElevationSeconds int64  `json:"ElevationSeconds,omitempty"`
+	Justification    string `json:"Justification,omitempty"`
+	TicketReference  string `json:"TicketReference,omitempty"`
+	CreatedAt        string `json:"CreatedAt,omitempty"`
+	UpdatedAt        string `json:"UpdatedAt,omitempty"`
+	Type             string `json:"Type,omitempty"`
+}
+
+// RequestNotification links an admin notification to the request it is about.
+type RequestNotification struct {
+	PK             string `json:"PK,omitempty"`
+	SK             string `json:"SK,omitempty"`
+	RequestID      string `json:"RequestID,omitempty"`
+	CompanyID      string `json:"CompanyID,omitempty"`
+	NotificationID string `json:"NotificationID,omitempty"`
+	Type           string `json:"Type,omitempty"`
+}
+
+/*
+****************
+CanTransitionRequest()
+- Returns true if a request in state "from" may move to state "to"
+****************
+*/
+func CanTransitionRequest(from, to string) bool {
+	for _, next := range requestTransitions[from] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+/*
+****************
+NewRequest()
+- Builds a pending request for the given company, type and requester
+****************
+*/
+func NewRequest(companyID, requestType, requesterUserID, requestedBy string) Request {
+	requestID := utils.GenerateTimestampWithUID()
+	currentTime := utils.GetCurrentTimestamp()
+	return Request{
+		PK:              utils.AppendPrefix(constants.PREFIX_COMPANY, companyID),
+		SK:              utils.AppendPrefix(PREFIX_REQUEST, requestID),
+		RequestID:       requestID,
+		CompanyID:       companyID,
+		RequestType:     requestType,
+		RequesterUserID: requesterUserID,
+		RequestedBy:     requestedBy,
+		Status:          REQUEST_STATUS_PENDING,
+		NextActionAt:    time.Now().Add(requestReminderDelay()).Unix(),
+		DuePartition:    REQUEST_DUE_PARTITION,
+		CreatedAt:       currentTime,
+		UpdatedAt:       currentTime,
+		Type:            ENTITY_TYPE_REQUEST,
+	}
+}
+
+/*
+****************
+CreateRequest()
+- Stores a new request, failing if one with the same ID already exists
+****************
+*/
+func CreateRequest(request Request) error {
+	av, err := dynamodbattribute.MarshalMap(request)
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	_, err = app.SVC.PutItem(&dynamodb.PutItemInput{
+		Item:                av,
+		TableName:           aws.String(app.TABLE_NAME),
+		ConditionExpression: aws.String("attribute_not_exists(PK)"),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return ErrRequestExists
+		}
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	invalidateRequestCounts(request.CompanyID)
+	return nil
+}
+
+/*
+****************
+GetRequestByID()
+- Returns the request with the given ID under the company
+****************
+*/
+func GetRequestByID(companyID, requestID string) (Request, error) {
+	var request Request
+
+	res, err := app.SVC.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
+			},
+			"SK": {
+				S: aws.String(utils.AppendPrefix(PREFIX_REQUEST, requestID)),
+			},
+		},
+	})
+	if err != nil {
+		return request, errors.New(constants.HTTP_STATUS_500)
+	}
+
+	if res.Item == nil {
+		return request, errors.New(constants.HTTP_STATUS_404)
+	}
+
+	err = dynamodbattribute.UnmarshalMap(res.Item, &request)
+	if err != nil {
+		return request, errors.New(constants.HTTP_STATUS_400)
+	}
+
+	return request, nil
+}
+
+/*
+****************
+GetCompanyRequests()
+- Returns every request of the company matching the given query filter
+****************
+*/
+func GetCompanyRequests(companyID string, filter map[string]*dynamodb.Condition) ([]Request, error) {
+	return getCompanyRequestsByPrefix(companyID, PREFIX_REQUEST, filter)
+}
+
+// getCompanyRequestsByPrefix returns the requests of the company whose key
+// starts with the prefix, in key order.
+func getCompanyRequestsByPrefix(companyID, prefix string, filter map[string]*dynamodb.Condition) ([]Request, error) {
+	requests := []Request{}
+
+	params := &dynamodb.QueryInput{
+		TableName: aws.String(app.TABLE_NAME),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"PK": {
+				ComparisonOperator: aws.String(constants.CONDITION_EQUAL),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
+					},
+				},
+			},
+			"SK": {
+				ComparisonOperator: aws.String(constants.CONDITION_BEGINS_WITH),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(prefix),
+					},
+				},
+			},
+		},
+	}
+	if len(filter) != 0 {
+		params.QueryFilter = filter
+	}
+
+	var items []map[string]*dynamodb.AttributeValue
+	err := app.SVC.QueryPages(params, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		items = append(items, page.Items...)
+		return true
+	})
+	if err != nil {
+		return requests, errors.New(constants.HTTP_STATUS_500)
+	}
+
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &requests)
+	if err != nil {
+		return requests, errors.New(constants.HTTP_STATUS_400)
+	}
+
+	return requests, nil
+}
+
+/*
+****************
+GetPendingRequestsOfUser()
+- Returns the open requests of a given type filed for a user
+****************
+*/
+func GetPendingRequestsOfUser(companyID, userID, requestType string) ([]Request, error) {
+	return GetCompanyRequests(companyID, map[string]*dynamodb.Condition{
+		"RequesterUserID": {
+			ComparisonOperator: aws.String(constants.CONDITION_EQUAL),
+			AttributeValueList: []*dynamodb.AttributeValue{
+				{
+					S: aws.String(userID),
+				},
+			},
+		},
+		"RequestType": {
+			ComparisonOperator: aws.String(constants.CONDITION_EQUAL),
+			AttributeValueList: []*dynamodb.AttributeValue{
+				{
+					S: aws.String(requestType),
+				},
+			},
+		},
+		"Status": {
+			ComparisonOperator: aws.String(dynamodb.ComparisonOperatorIn),
+			AttributeValueList: []*dynamodb.AttributeValue{
+				{
+					S: aws.String(REQUEST_STATUS_PENDING),
+				},
+				{
+					S: aws.String(REQUEST_STATUS_NEEDS_INFO),
+				},
+			},
+		},
+	})
+}
+
+/*
+****************
+TransitionRequest()
+- Moves the request to a new state. The write only succeeds if the stored
+request is still in the state it was read in, so two admins acting on the
+same request cannot both win. The reason, when given, is stored with the
+request. A request waiting on its requester is due to expire, and starts
+over from the first reminder once they reply; a decided request leaves the
+request due index.
+****************
+*/
+func TransitionRequest(request *Request, status, actorID, reason string) error {
+	if !CanTransitionRequest(request.Status, status) {
+		return ErrRequestNotPending
+	}
+
+	currentTime := utils.GetCurrentTimestamp()
+	values := map[string]*dynamodb.AttributeValue{
+		":from": {
+			S: aws.String(request.Status),
+		},
+		":to": {
+			S: aws.String(status),
+		},
+		":ua": {
+			S: aws.String(currentTime),
+		},
+	}
+	update := "SET #s = :to, UpdatedAt = :ua"
+	var remove []string
+	var nextActionAt int64
+	switch status {
+	case REQUEST_STATUS_NEEDS_INFO:
+		nextActionAt = time.Now().Add(requestNeedsInfoExpiryDelay()).Unix()
+	case REQUEST_STATUS_PENDING:
+		nextActionAt = time.Now().Add(requestReminderDelay()).Unix()
+		remove = append(remove, "Stage")
+	}
+	if nextActionAt != 0 {
+		values[":next"] = &dynamodb.AttributeValue{
+			N: aws.String(strconv.FormatInt(nextActionAt, 10)),
+		}
+		update += ", NextActionAt = :next"
+	}
+	// only a final state records who decided the request
+	decided := len(requestTransitions[status]) == 0
+	if decided {
+		values[":db"] = &dynamodb.AttributeValue{
+			S: aws.String(actorID),
+		}
+		update += ", DecidedBy = :db, DecidedAt = :ua"
+		remove = append(remove, "DuePartition")
+	}
+	if reason != "" {
+		values[":r"] = &dynamodb.AttributeValue{
+			S: aws.String(reason),
+		}
+		update += ", Reason = :r"
+	}
+	if len(remove) != 0 {
+		update += " REMOVE " + strings.Join(remove, ", ")
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: values,
+		ExpressionAttributeNames: map[string]*string{
+			"#s": aws.String("Status"),
+		},
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(request.PK),
+			},
+			"SK": {
+				S: aws.String(request.SK),
+			},
+		},
+		ConditionExpression: aws.String("#s = :from"),
+		UpdateExpression:    aws.String(update),
+	}
+
+	_, err := app.SVC.UpdateItem(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return ErrRequestNotPending
+		}
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	invalidateRequestCounts(request.CompanyID)
+	request.Status = status
+	request.UpdatedAt = currentTime
+	if nextActionAt != 0 {
+		request.NextActionAt = nextActionAt
+	}
+	if status == REQUEST_STATUS_PENDING {
+		request.Stage = ""
+	}
+	if decided {
+		request.DecidedBy = actorID
+		request.DecidedAt = currentTime
+		request.DuePartition = ""
+	}
+	if reason != "" {
+		request.Reason = reason
+	}
+	return nil
+}
+
+/*
+****************
+AmendRequestRoles()
+- Replaces the roles asked for by an open request
+****************
+*/
+func AmendRequestRoles(request *Request, roleIDs []string) error {
+	currentTime := utils.GetCurrentTimestamp()
+	roles := []*dynamodb.AttributeValue{}
+	for _, roleID := range roleIDs {
+		roles = append(roles, &dynamodb.AttributeValue{
+			S: aws.String(roleID),
+		})
+	}
+
+	input := &dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":pending": {
+				S: aws.String(REQUEST_STATUS_PENDING),
+			},
+			":info": {
+				S: aws.String(REQUEST_STATUS_NEEDS_INFO),
+			},
+			":r": {
+				L: roles,
+			},
+			":ua": {
+				S: aws.String(currentTime),
+			},
+		},
+		ExpressionAttributeNames: map[string]*string{
+			"#s": aws.String("Status"),
+		},
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(request.PK),
+			},
+			"SK": {
+				S: aws.String(request.SK),
+			},
+		},
+		ConditionExpression: aws.String("#s IN (:pending, :info)"),
+		UpdateExpression:    aws.String("SET RolesRequested = :r, UpdatedAt = :ua"),
+	}
+
+	_, err := app.SVC.UpdateItem(input)
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return ErrRequestNotPending
+		}
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	invalidateRequestCounts(request.CompanyID)
+	request.RolesRequested = roleIDs
+	request.UpdatedAt = currentTime
+	return nil
+}
+
+/*
+****************
+LinkRequestNotification()
+- Records that a notification was sent about a request
+****************
+*/
+func LinkRequestNotification(request Request, notificationID string) error {
+	link := RequestNotification{
+		PK:             utils.AppendPrefix(PREFIX_REQUEST, request.RequestID),
+		SK:             utils.AppendPrefix(constants.PREFIX_NOTIFICATION, notificationID),
+		RequestID:      request.RequestID,
+		CompanyID:      request.CompanyID,
+		NotificationID: notificationID,
+		Type:           ENTITY_TYPE_REQUEST_NOTIFICATION,
+	}
+
+	av, err := dynamodbattribute.MarshalMap(link)
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	_, err = app.SVC.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(app.TABLE_NAME),
+	})
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	return nil
+}
+
+/*
+****************
+GetRequestNotificationIDs()
+- Returns the IDs of every notification pointing to the request
+****************
+*/
+func GetRequestNotificationIDs(requestID string) ([]string, error) {
+	var links []RequestNotification
+	var notificationIDs []string
+
+	params := &dynamodb.QueryInput{
+		TableName: aws.String(app.TABLE_NAME),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"PK": {
+				ComparisonOperator: aws.String(constants.CONDITION_EQUAL),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(utils.AppendPrefix(PREFIX_REQUEST, requestID)),
+					},
+				},
+			},
+			"SK": {
+				ComparisonOperator: aws.String(constants.CONDITION_BEGINS_WITH),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(constants.PREFIX_NOTIFICATION),
+					},
+				},
+			},
+		},
+	}
+
+	res, err := app.SVC.Query(params)
+	if err != nil {
+		return notificationIDs, errors.New(constants.HTTP_STATUS_500)
+	}
+
+	err = dynamodbattribute.UnmarshalListOfMaps(res.Items, &links)
+	if err != nil {
+		return notificationIDs, errors.New(constants.HTTP_STATUS_400)
+	}
+
+	for _, link := range links {
+		notificationIDs = append(notificationIDs, link.NotificationID)
+	}
+
+	return notificationIDs, nil
+}
+
+/*
+****************
+GetRequestByNotificationID()
+- Resolves the request a notification points to, within the company of the
+caller. Notifications sent before requests were stored are migrated first:
+the copies of one filing sent to different admins resolve to the same
+request, so it can only be decided once.
+****************
+*/
+func GetRequestByNotificationID(notificationID, companyID string) (Request, error) {
+	request, legacy, err := findRequestByNotificationID(notificationID, companyID)
+	if err != nil || legacy == nil {
+		return request, err
+	}
+	return migrateLegacyRequest(*legacy)
+}
+
+/*
+****************
+PeekRequestByNotificationID()
+- Resolves the request a notification points to like
+GetRequestByNotificationID, without writing anything. A notification sent
+before requests were stored resolves to a request built from its content,
+which is not stored.
+****************
+*/
+func PeekRequestByNotificationID(notificationID, companyID string) (Request, error) {
+	request, _, err := findRequestByNotificationID(notificationID, companyID)
+	return request, err
+}
+
+// findRequestByNotificationID returns the request a notification is linked
+// to. A notification sent before requests were stored is returned too, with
+// the request built from it.
+func findRequestByNotificationID(notificationID, companyID string) (Request, *models.Notification, error) {
+	link, linked, err := getRequestNotificationLink(notificationID)
+	if err != nil {
+		return Request{}, nil, err
+	}
+	if linked {
+		// a notification of another company is answered as if it did not exist
+		if link.CompanyID != companyID {
+			return Request{}, nil, errors.New(constants.HTTP_STATUS_404)
+		}
+		request, err := GetRequestByID(link.CompanyID, link.RequestID)
+		return request, nil, err
+	}
+
+	notification, err := getLegacyRequestNotification(notificationID, companyID)
+	if err != nil {
+		return Request{}, nil, err
+	}
+	return buildLegacyRequest(notification, legacyRequestFilingID(notification)), &notification, nil
+}
+
+// getRequestNotificationLink returns the link of a notification to its
+// request. The bool is false for notifications sent before requests were
+// stored.
+func getRequestNotificationLink(notificationID string) (RequestNotification, bool, error) {
+	var links []RequestNotification
+
+	params := &dynamodb.QueryInput{
+		TableName: aws.String(app.TABLE_NAME),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"SK": {
+				ComparisonOperator: aws.String(constants.CONDITION_EQUAL),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(utils.AppendPrefix(constants.PREFIX_NOTIFICATION, notificationID)),
+					},
+				},
+			},
+			"PK": {
+				ComparisonOperator: aws.String(constants.CONDITION_BEGINS_WITH),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(PREFIX_REQUEST),
+					},
+				},
+			},
+		},
+		IndexName: aws.String(constants.INDEX_NAME_INVERTED_INDEX),
+	}
+
+	res, err := app.SVC.Query(params)
+	if err != nil {
+		return RequestNotification{}, false, errors.New(constants.HTTP_STATUS_500)
+	}
+
+	err = dynamodbattribute.UnmarshalListOfMaps(res.Items, &links)
+	if err != nil {
+		return RequestNotification{}, false, errors.New(constants.HTTP_STATUS_400)
+	}
+
+	if len(links) == 0 {
+		return RequestNotification{}, false, nil
+	}
+	return links[0], true, nil
+}
+
+// getLegacyRequestNotification reads a notification sent before requests
+// were stored, if it was sent about a request of the company.
+func getLegacyRequestNotification(notificationID, companyID string) (models.Notification, error) {
+	notification, opsErr := ops.GetNotificationByID(notificationID)
+	if opsErr != nil || notification.NotificationID == "" {
+		return notification, errors.New(constants.HTTP_STATUS_404)
+	}
+	if notification.NotificationContent.ActiveCompany != companyID {
+		return notification, errors.New(constants.HTTP_STATUS_404)
+	}
+	if _, ok := GetRequestHandler(notification.NotificationType); !ok {
+		return notification, errors.New(constants.HTTP_STATUS_404)
+	}
+	return notification, nil
+}
+
+/*
+****************
+legacyRequestFilingID()
+- Identifies the filing a notification sent before requests were stored
+belongs to. The copies sent to each admin share the company, type,
+requester and targets, which nothing else does.
+****************
+*/
+func legacyRequestFilingID(notification models.Notification) string {
+	content := notification.NotificationContent
+	roles := append([]string{}, content.RolesRequested...)
+	sort.Strings(roles)
+	integrations := append([]string{}, content.RequestedIntegrations...)
+	sort.Strings(integrations)
+
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		content.ActiveCompany,
+		notification.NotificationType,
+		content.RequesterUserID,
+		content.GroupID,
+		strings.Join(roles, ","),
+		strings.Join(integrations, ","),
+		content.Integration.IntegrationID,
+	}, "|")))
+	return PREFIX_LEGACY_REQUEST + hex.EncodeToString(sum[:16])
+}
+
+// buildLegacyRequest builds the request of a notification sent before
+// requests were stored. The type is the one of the notification, never one
+// supplied by the caller.
+func buildLegacyRequest(notification models.Notification, requestID string) Request {
+	content := notification.NotificationContent
+
+	request := NewRequest(content.ActiveCompany, notification.NotificationType, content.RequesterUserID, content.RequesterUserID)
+	request.RequestID = requestID
+	request.SK = utils.AppendPrefix(PREFIX_REQUEST, requestID)
+	request.GroupID = content.GroupID
+	request.RolesRequested = content.RolesRequested
+	request.RequestedIntegrations = content.RequestedIntegrations
+	request.Integration = content.Integration
+	request.CreatedAt = notification.CreatedAt
+	switch content.IsAccepted {
+	case NOTIFICATION_REQUEST_ACCEPTED:
+		request.Status = REQUEST_STATUS_APPROVED
+	case NOTIFICATION_REQUEST_REJECTED:
+		request.Status = REQUEST_STATUS_REJECTED
+	}
+	if !IsRequestOpen(request.Status) {
+		request.NextActionAt = 0
+		request.DuePartition = ""
+	}
+	return request
+}
+
+/*
+****************
+migrateLegacyRequest()
+- Links a notification sent before requests were stored to the request of
+its filing, storing the request if it is the first copy resolved. The
+requests of successive filings with the same targets are numbered: a copy
+belongs to the first one still open or decided after the copy was sent,
+since a filing cannot be decided before its notifications exist.
+****************
+*/
+func migrateLegacyRequest(notification models.Notification) (Request, error) {
+	filingID := legacyRequestFilingID(notification)
+	companyID := notification.NotificationContent.ActiveCompany
+
+	for attempt := 0; attempt < LEGACY_REQUEST_MIGRATION_ATTEMPTS; attempt++ {
+		filings, err := getCompanyRequestsByPrefix(companyID, utils.AppendPrefix(PREFIX_REQUEST, filingID), nil)
+		if err != nil {
+			return Request{}, err
+		}
+		for _, filing := range filings {
+			if IsRequestOpen(filing.Status) || filing.DecidedAt >= notification.CreatedAt {
+				return filing, LinkRequestNotification(filing, notification.NotificationID)
+			}
+		}
+
+		request := buildLegacyRequest(notification, filingID+"-"+fmt.Sprintf("%04d", len(filings)))
+		err = CreateRequest(request)
+		if err == ErrRequestExists {
+			// another copy of the filing was migrated at the same time
+			continue
+		}
+		if err != nil {
+			return request, err
+		}
+		return request, LinkRequestNotification(request, notification.NotificationID)
+	}
+
+	return Request{}, errors.New(constants.HTTP_STATUS_500)
+}
+
+/*
+****************
+SyncRequestNotifications()
+- Updates the status shown on every notification pointing to the request
+****************
+*/
+func SyncRequestNotifications(request Request) error {
+	notificationIDs, err := GetRequestNotificationIDs(request.RequestID)
+	if err != nil {
+		return err
+	}
+
+	for _, notificationID := range notificationIDs {
+		notification, err := GetNotificationByID(notificationID)
+		if err != nil || notification.NotificationID == "" {
+			continue
+		}
+
+		input := &dynamodb.UpdateItemInput{
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":ia": {
+					S: aws.String(requestNotificationStatus[request.Status]),
+				},
+				":ua": {
+					S: aws.String(utils.GetCurrentTimestamp()),
+				},
+			},
+			TableName: aws.String(app.TABLE_NAME),
+			Key: map[string]*dynamodb.AttributeValue{
+				"PK": {
+					S: aws.String(notification.PK),
+				},
+				"SK": {
+					S: aws.String(notification.SK),
+				},
+			},
+			UpdateExpression: aws.String("SET NotificationContent.IsAccepted = :ia, UpdatedAt = :ua"),
+		}
+
+		_, err = app.SVC.UpdateItem(input)
+		if err != nil {
+			return errors.New(constants.HTTP_STATUS_500)
+		}
+	}
+
+	return nil
+}
+
+/*
+****************
+GetRequestNotifications()
+- Returns every notification pointing to the request
+****************
+*/
+func GetRequestNotifications(requestID string) ([]models.Notification, error) {
+	var notifications []models.Notification
+
+	notificationIDs, err := GetRequestNotificationIDs(requestID)
+	if err != nil {
+		return notifications, err
+	}
+
+	for _, notificationID := range notificationIDs {
+		notification, err := GetNotificationByID(notificationID)
+		if err != nil || notification.NotificationID == "" {
+			continue
+		}
+		notifications = append(notifications, notification)
+	}
+
+	return notifications, nil
+}
+
+/*
+****************
+RewriteRequestNotifications()
+- Applies the change to the content of every notification pointing to the
+request
+****************
+*/
+func RewriteRequestNotifications(request Request, template NotificationTemplate, rewrite func(content *models.NotificationContentType)) error {
+	notifications, err := GetRequestNotifications(request.RequestID)
+	if err != nil {
+		return err
+	}
+
+	for _, notification := range notifications {
+		content := notification.NotificationContent
+		content.Message = template.Render(userMessageLocale(notification.UserID))
+		rewrite(&content)
+		if err := UpdateNotification(notification.NotificationID, content.IsAccepted, content, &template); err != nil {
+			return errors.New(constants.HTTP_STATUS_500)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,233 @@
+package controllers
+
+import (
+	"errors"
+	"grooper/app"
+	"grooper/app/constants"
+	"grooper/app/utils"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const TRANSACTION_ITEM_LIMIT = 100
+
+var ErrRequestConflict = errors.New("request could not be applied, the affected items have changed")
+
+// RequestTransaction collects the writes of a request decision so they are
+// committed together with the request status change, or not at all.
+type RequestTransaction struct {
+	items           []*dynamodb.TransactWriteItem
+	request         *Request
+	status          string
+	actorID         string
+	transitionIndex int
+}
+
+/*
+****************
+Put()
+- Adds an item to be written by the transaction
+****************
+*/
+func (t *RequestTransaction) Put(item map[string]*dynamodb.AttributeValue) {
+	t.items = append(t.items, &dynamodb.TransactWriteItem{
+		Put: &dynamodb.Put{
+			Item:      item,
+			TableName: aws.String(app.TABLE_NAME),
+		},
+	})
+}
+
+/*
+****************
+PutModel()
+- Marshals a model and adds it to be written by the transaction
+****************
+*/
+func (t *RequestTransaction) PutModel(model interface{}) error {
+	av, err := dynamodbattribute.MarshalMap(model)
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+	t.Put(av)
+	return nil
+}
+
+/*
+****************
+PutModelIf()
+- Marshals a model and adds it to be written by the transaction if the
+condition holds on the item it replaces. values are the condition's
+placeholders, nil when it has none. A failed condition cancels the whole
+transaction with ErrRequestConflict.
+****************
+*/
+func (t *RequestTransaction) PutModelIf(model interface{}, condition string, values map[string]*dynamodb.AttributeValue) error {
+	av, err := dynamodbattribute.MarshalMap(model)
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+	put := &dynamodb.Put{
+		Item:                av,
+		TableName:           aws.String(app.TABLE_NAME),
+		ConditionExpression: aws.String(condition),
+	}
+	if len(values) != 0 {
+		put.ExpressionAttributeValues = values
+	}
+	t.items = append(t.items, &dynamodb.TransactWriteItem{Put: put})
+	return nil
+}
+
+/*
+****************
+RequireAbsent()
+- Adds a check that the item does not exist when the transaction commits.
+An item written meanwhile cancels the whole transaction with
+ErrRequestConflict.
+****************
+*/
+func (t *RequestTransaction) RequireAbsent(pk, sk string) {
+	t.items = append(t.items, &dynamodb.TransactWriteItem{
+		ConditionCheck: &dynamodb.ConditionCheck{
+			Key: map[string]*dynamodb.AttributeValue{
+				"PK": {
+					S: aws.String(pk),
+				},
+				"SK": {
+					S: aws.String(sk),
+				},
+			},
+			TableName:           aws.String(app.TABLE_NAME),
+			ConditionExpression: aws.String("attribute_not_exists(PK)"),
+		},
+	})
+}
+
+/*
+****************
+Delete()
+- Adds a delete that only succeeds if the item still exists
+****************
+*/
+func (t *RequestTransaction) Delete(pk, sk string) {
+	t.items = append(t.items, &dynamodb.TransactWriteItem{
+		Delete: &dynamodb.Delete{
+			Key: map[string]*dynamodb.AttributeValue{
+				"PK": {
+					S: aws.String(pk),
+				},
+				"SK": {
+					S: aws.String(sk),
+				},
+			},
+			TableName:           aws.String(app.TABLE_NAME),
+			ConditionExpression: aws.String("attribute_exists(PK)"),
+		},
+	})
+}
+
+// Len returns the number of items collected so far.
+func (t *RequestTransaction) Len() int {
+	return len(t.items)
+}
+
+// truncate drops the items collected after the first n.
+func (t *RequestTransaction) truncate(n int) {
+	if n < len(t.items) {
+		t.items = t.items[:n]
+	}
+}
+
+/*
+****************
+Transition()
+- Adds the request status change, conditioned on the request still being
+in the state it was read in
+****************
+*/
+func (t *RequestTransaction) Transition(request *Request, status, actorID string) {
+	update := "SET #s = :to, DecidedBy = :db, DecidedAt = :ua, UpdatedAt = :ua"
+	if len(requestTransitions[status]) == 0 {
+		update += " REMOVE DuePartition"
+	}
+	t.request = request
+	t.status = status
+	t.actorID = actorID
+	t.transitionIndex = len(t.items)
+	t.items = append(t.items, &dynamodb.TransactWriteItem{
+		Update: &dynamodb.Update{
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":from": {
+					S: aws.String(request.Status),
+				},
+				":to": {
+					S: aws.String(status),
+				},
+				":db": {
+					S: aws.String(actorID),
+				},
+				":ua": {
+					S: aws.String(utils.GetCurrentTimestamp()),
+				},
+			},
+			ExpressionAttributeNames: map[string]*string{
+				"#s": aws.String("Status"),
+			},
+			TableName: aws.String(app.TABLE_NAME),
+			Key: map[string]*dynamodb.AttributeValue{
+				"PK": {
+					S: aws.String(request.PK),
+				},
+				"SK": {
+					S: aws.String(request.SK),
+				},
+			},
+			ConditionExpression: aws.String("#s = :from"),
+			UpdateExpression:    aws.String(update),
+		},
+	})
+}
+
+/*
+****************
+Commit()
+- Writes every collected item in a single TransactWriteItems call.
+Returns ErrRequestNotPending if another decision got there first.
+****************
+*/
+func (t *RequestTransaction) Commit() error {
+	if t.request == nil || !CanTransitionRequest(t.request.Status, t.status) {
+		return ErrRequestNotPending
+	}
+	if len(t.items) > TRANSACTION_ITEM_LIMIT {
+		return errors.New(constants.HTTP_STATUS_422)
+	}
+
+	_, err := app.SVC.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: t.items,
+	})
+	if err != nil {
+		if canceled, ok := err.(*dynamodb.TransactionCanceledException); ok {
+			reasons := canceled.CancellationReasons
+			if t.transitionIndex < len(reasons) && aws.StringValue(reasons[t.transitionIndex].Code) == "ConditionalCheckFailed" {
+				return ErrRequestNotPending
+			}
+			return ErrRequestConflict
+		}
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	invalidateRequestCounts(t.request.CompanyID)
+	currentTime := utils.GetCurrentTimestamp()
+	t.request.Status = t.status
+	t.request.DecidedBy = t.actorID
+	t.request.DecidedAt = currentTime
+	t.request.UpdatedAt = currentTime
+	if len(requestTransitions[t.status]) == 0 {
+		t.request.DuePartition = ""
+	}
+	return nil
+}
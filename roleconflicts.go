@@ -0,0 +1,621 @@
+package controllers
+
+import (
+	"errors"
+	"grooper/app"
+	"grooper/app/constants"
+	"grooper/app/models"
+	ops "grooper/app/operations"
+	"grooper/app/utils"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/revel/revel"
+)
+
+const (
+	PREFIX_ROLE_CONFLICT_SET      = "ROLE_CONFLICT_SET#"
+	ENTITY_TYPE_ROLE_CONFLICT_SET = "ROLE_CONFLICT_SET"
+)
+
+// RoleConflictSet is a set of mutually exclusive roles: a user may hold at
+// most one of them in the company, e.g. an approver of payments and a
+// requester of payments.
+type RoleConflictSet struct {
+	PK        string   `json:"PK,omitempty"`
+	SK        string   `json:"SK,omitempty"`
+	SetID     string   `json:"SetID,omitempty"`
+	CompanyID string   `json:"CompanyID,omitempty"`
+	Name      string   `json:"Name,omitempty"`
+	RoleIDs   []string `json:"RoleIDs,omitempty"`
+	// Reason is shown when a grant is rejected by the set.
+	Reason    string `json:"Reason,omitempty"`
+	CreatedBy string `json:"CreatedBy,omitempty"`
+	CreatedAt string `json:"CreatedAt,omitempty"`
+	UpdatedAt string `json:"UpdatedAt,omitempty"`
+	Type      string `json:"Type,omitempty"`
+}
+
+// ErrRoleConflict fails a grant when the user was granted a conflicting role
+// after the grant was checked.
+var ErrRoleConflict = errors.New("a conflicting role was granted meanwhile")
+
+// RoleConflictSetParams is the body of SaveRoleConflictSet.
+type RoleConflictSetParams struct {
+	SetID   string   `json:"set_id,omitempty"`
+	Name    string   `json:"name,omitempty"`
+	RoleIDs []string `json:"role_id,omitempty"`
+	Reason  string   `json:"reason,omitempty"`
+}
+
+// RoleConflict is a user holding, or about to hold, more than one role of a
+// set.
+type RoleConflict struct {
+	SetID     string   `json:"set_id"`
+	SetName   string   `json:"set_name"`
+	Reason    string   `json:"reason,omitempty"`
+	UserID    string   `json:"user_id"`
+	RoleIDs   []string `json:"role_id"`
+	RoleNames []string `json:"role_names"`
+}
+
+// Message explains the conflict to the admin making the grant.
+func (conflict RoleConflict) Message() string {
+	message := "Roles " + strings.Join(conflict.RoleNames, ", ") + " cannot be held together (" + conflict.SetName + ")"
+	if conflict.Reason != "" {
+		message += ": " + conflict.Reason
+	}
+	return message
+}
+
+/*
+****************
+GetCompanyRoleConflictSets()
+- Returns every mutually exclusive role set of the company
+****************
+*/
+func GetCompanyRoleConflictSets(companyID string) ([]RoleConflictSet, error) {
+	sets := []RoleConflictSet{}
+
+	params := &dynamodb.QueryInput{
+		TableName: aws.String(app.TABLE_NAME),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"PK": {
+				ComparisonOperator: aws.String(constants.CONDITION_EQUAL),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
+					},
+				},
+			},
+			"SK": {
+				ComparisonOperator: aws.String(constants.CONDITION_BEGINS_WITH),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(PREFIX_ROLE_CONFLICT_SET),
+					},
+				},
+			},
+		},
+	}
+
+	res, err := app.SVC.Query(params)
+	if err != nil {
+		return sets, errors.New(constants.HTTP_STATUS_500)
+	}
+
+	err = dynamodbattribute.UnmarshalListOfMaps(res.Items, &sets)
+	if err != nil {
+		return sets, errors.New(constants.HTTP_STATUS_400)
+	}
+
+	return sets, nil
+}
+
+/*
+****************
+GetRoleConflictSet()
+- Returns a mutually exclusive role set of the company. The returned bool
+is false if there is none with the ID.
+****************
+*/
+func GetRoleConflictSet(companyID, setID string) (RoleConflictSet, bool, error) {
+	var set RoleConflictSet
+
+	res, err := app.SVC.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
+			},
+			"SK": {
+				S: aws.String(utils.AppendPrefix(PREFIX_ROLE_CONFLICT_SET, setID)),
+			},
+		},
+	})
+	if err != nil {
+		return set, false, errors.New(constants.HTTP_STATUS_500)
+	}
+	if res.Item == nil {
+		return set, false, nil
+	}
+
+	if err := dynamodbattribute.UnmarshalMap(res.Item, &set); err != nil {
+		return set, false, errors.New(constants.HTTP_STATUS_400)
+	}
+
+	return set, true, nil
+}
+
+/*
+****************
+SaveRoleConflictSet()
+- Creates or replaces a mutually exclusive role set
+****************
+*/
+func SaveRoleConflictSet(set RoleConflictSet) error {
+	set.PK = utils.AppendPrefix(constants.PREFIX_COMPANY, set.CompanyID)
+	set.SK = utils.AppendPrefix(PREFIX_ROLE_CONFLICT_SET, set.SetID)
+	set.Type = ENTITY_TYPE_ROLE_CONFLICT_SET
+
+	av, err := dynamodbattribute.MarshalMap(set)
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	_, err = app.SVC.PutItem(&dynamodb.PutItemInput{
+		Item:      av,
+		TableName: aws.String(app.TABLE_NAME),
+	})
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	return nil
+}
+
+/*
+****************
+DeleteRoleConflictSet()
+- Removes a mutually exclusive role set
+****************
+*/
+func DeleteRoleConflictSet(companyID, setID string) error {
+	_, err := app.SVC.DeleteItem(&dynamodb.DeleteItemInput{
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
+			},
+			"SK": {
+				S: aws.String(utils.AppendPrefix(PREFIX_ROLE_CONFLICT_SET, setID)),
+			},
+		},
+		TableName: aws.String(app.TABLE_NAME),
+	})
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+
+	return nil
+}
+
+// getUserCompanyRoleIDs returns the roles the user holds in the company,
+// read from the UserRole items under the user.
+func getUserCompanyRoleIDs(userID, companyID string) ([]string, error) {
+	var roleIDs []string
+
+	params := &dynamodb.QueryInput{
+		TableName:              aws.String(app.TABLE_NAME),
+		KeyConditionExpression: aws.String("PK = :pk AND begins_with(SK, :sk)"),
+		FilterExpression:       aws.String("CompanyID = :company"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":pk": {
+				S: aws.String(utils.AppendPrefix(constants.PREFIX_USER, userID)),
+			},
+			":sk": {
+				S: aws.String(constants.PREFIX_ROLE),
+			},
+			":company": {
+				S: aws.String(companyID),
+			},
+		},
+	}
+
+	var pageErr error
+	err := app.SVC.QueryPages(params, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		var userRoles []models.UserRole
+		if pageErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &userRoles); pageErr != nil {
+			return false
+		}
+		for _, userRole := range userRoles {
+			roleIDs = append(roleIDs, userRole.RoleID)
+		}
+		return true
+	})
+	if err != nil {
+		return roleIDs, errors.New(constants.HTTP_STATUS_500)
+	}
+	if pageErr != nil {
+		return roleIDs, errors.New(constants.HTTP_STATUS_400)
+	}
+
+	return roleIDs, nil
+}
+
+// findRoleConflicts returns the sets broken by granting roles on top of the
+// held ones. A set already broken by the held roles alone is not reported;
+// it is listed by GetRoleConflictViolations.
+func findRoleConflicts(sets []RoleConflictSet, heldRoleIDs, grantedRoleIDs []string) []RoleConflict {
+	var conflicts []RoleConflict
+	for _, set := range sets {
+		var roleIDs []string
+		granted := false
+		for _, roleID := range set.RoleIDs {
+			if utils.StringInSlice(roleID, grantedRoleIDs) {
+				granted = true
+				roleIDs = append(roleIDs, roleID)
+			} else if utils.StringInSlice(roleID, heldRoleIDs) {
+				roleIDs = append(roleIDs, roleID)
+			}
+		}
+		if granted && len(roleIDs) > 1 {
+			conflicts = append(conflicts, RoleConflict{
+				SetID:   set.SetID,
+				SetName: set.Name,
+				Reason:  set.Reason,
+				RoleIDs: roleIDs,
+			})
+		}
+	}
+	return conflicts
+}
+
+// fillRoleConflictNames looks up the names of the conflicting roles.
+func fillRoleConflictNames(companyID string, conflicts []RoleConflict) {
+	names := map[string]string{}
+	for i := range conflicts {
+		conflicts[i].RoleNames = nil
+		for _, roleID := range conflicts[i].RoleIDs {
+			if _, ok := names[roleID]; !ok {
+				names[roleID] = roleID
+				if role, opsErr := ops.GetRoleByID(roleID, companyID); opsErr == nil {
+					names[roleID] = role.RoleName
+				}
+			}
+			conflicts[i].RoleNames = append(conflicts[i].RoleNames, names[roleID])
+		}
+	}
+}
+
+// conflictGuardRoleIDs returns the roles the user must not hold for a grant
+// to keep clear of the sets: the other roles of every set a granted role
+// belongs to.
+func conflictGuardRoleIDs(sets []RoleConflictSet, grantedRoleIDs []string) []string {
+	var guards []string
+	for _, set := range sets {
+		granted := false
+		for _, roleID := range set.RoleIDs {
+			if utils.StringInSlice(roleID, grantedRoleIDs) {
+				granted = true
+				break
+			}
+		}
+		if !granted {
+			continue
+		}
+		for _, roleID := range set.RoleIDs {
+			if !utils.StringInSlice(roleID, grantedRoleIDs) && !utils.StringInSlice(roleID, guards) {
+				guards = append(guards, roleID)
+			}
+		}
+	}
+	return guards
+}
+
+// RoleGrantCheck is the outcome of CheckRoleGrant. Guards are the roles the
+// user must still not hold when the grant is written; the write checks them
+// in the same transaction, so two grants racing each other cannot both get
+// through.
+type RoleGrantCheck struct {
+	Conflicts []RoleConflict
+	Guards    []string
+}
+
+/*
+****************
+CheckRoleGrant()
+- Returns the mutually exclusive role sets the user would break by being
+granted the roles, and the roles the write of the grant must guard against.
+Every write of a UserRole item checks it first.
+****************
+*/
+func CheckRoleGrant(companyID, userID string, roleIDs []string) (RoleGrantCheck, error) {
+	var check RoleGrantCheck
+
+	sets, err := GetCompanyRoleConflictSets(companyID)
+	if err != nil || len(sets) == 0 {
+		return check, err
+	}
+
+	heldRoleIDs, err := getUserCompanyRoleIDs(userID, companyID)
+	if err != nil {
+		return check, err
+	}
+
+	check.Conflicts = findRoleConflicts(sets, heldRoleIDs, roleIDs)
+	for i := range check.Conflicts {
+		check.Conflicts[i].UserID = userID
+	}
+	fillRoleConflictNames(companyID, check.Conflicts)
+	check.Guards = conflictGuardRoleIDs(sets, roleIDs)
+	return check, nil
+}
+
+// checkRoleGrants runs CheckRoleGrant for every user of a grant and returns
+// the conflicts of all of them, and the guards of each.
+func checkRoleGrants(companyID string, userIDs, roleIDs []string) ([]RoleConflict, map[string][]string, error) {
+	var conflicts []RoleConflict
+	guards := map[string][]string{}
+	for _, userID := range userIDs {
+		check, err := CheckRoleGrant(companyID, userID, roleIDs)
+		if err != nil {
+			return conflicts, guards, err
+		}
+		conflicts = append(conflicts, check.Conflicts...)
+		guards[userID] = check.Guards
+	}
+	return conflicts, guards, nil
+}
+
+// roleConflictError fails a request decision with the explanation of the
+// conflicts.
+func roleConflictError(conflicts []RoleConflict) error {
+	var messages []string
+	for _, conflict := range conflicts {
+		messages = append(messages, conflict.Message())
+	}
+	return NewRequestError(422, strings.Join(messages, "; "))
+}
+
+/*
+****************
+GetRoleConflictViolations()
+- Returns every user of the company holding more than one role of a
+mutually exclusive set, e.g. grants made before the set was defined
+****************
+*/
+func GetRoleConflictViolations(companyID string) ([]RoleConflict, error) {
+	violations := []RoleConflict{}
+
+	sets, err := GetCompanyRoleConflictSets(companyID)
+	if err != nil {
+		return violations, err
+	}
+
+	for _, set := range sets {
+		holders := map[string][]string{}
+		var userIDs []string
+		for _, roleID := range set.RoleIDs {
+			for _, userRole := range GetAllUserID(roleID, companyID) {
+				if _, ok := holders[userRole.UserID]; !ok {
+					userIDs = append(userIDs, userRole.UserID)
+				}
+				holders[userRole.UserID] = append(holders[userRole.UserID], roleID)
+			}
+		}
+		for _, userID := range userIDs {
+			if len(holders[userID]) < 2 {
+				continue
+			}
+			violations = append(violations, RoleConflict{
+				SetID:   set.SetID,
+				SetName: set.Name,
+				Reason:  set.Reason,
+				UserID:  userID,
+				RoleIDs: holders[userID],
+			})
+		}
+	}
+	fillRoleConflictNames(companyID, violations)
+
+	return violations, nil
+}
+
+/*
+****************
+SaveRoleConflictSet()
+- Creates or replaces a set of roles no user may hold together
+Body:
+set_id - optional, replaces the set when set
+name - required
+role_id[] - required (at least two)
+reason - optional, shown when a grant is rejected
+****************
+*/
+func (c RoleController) SaveRoleConflictSet() revel.Result {
+	companyID := c.ViewArgs["companyID"].(string)
+	userID := c.ViewArgs["userID"].(string)
+	data := make(map[string]interface{})
+
+	isAdmin, err := isCompanyAdmin(companyID, userID)
+	if err != nil || !isAdmin {
+		c.Response.Status = 401
+		data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_401)
+		return c.RenderJSON(data)
+	}
+
+	var input RoleConflictSetParams
+	c.Params.BindJSON(&input)
+	input.Name = utils.TrimSpaces(input.Name)
+
+	var errs []string
+	if input.Name == "" {
+		errs = append(errs, "Missing required parameter - name")
+	}
+	var roleIDs []string
+	for _, roleID := range input.RoleIDs {
+		if utils.StringInSlice(roleID, roleIDs) {
+			continue
+		}
+		if _, opsErr := ops.GetRoleByID(roleID, companyID); opsErr != nil {
+			errs = append(errs, "Role not found: "+roleID)
+		}
+		roleIDs = append(roleIDs, roleID)
+	}
+	if len(roleIDs) < 2 {
+		errs = append(errs, "A set needs at least two roles")
+	}
+	if len(errs) != 0 {
+		c.Response.Status = 422
+		data["errors"] = errs
+		data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_422)
+		return c.RenderJSON(data)
+	}
+
+	currentTime := utils.GetCurrentTimestamp()
+	set := RoleConflictSet{
+		SetID:     input.SetID,
+		CompanyID: companyID,
+		Name:      input.Name,
+		RoleIDs:   roleIDs,
+		Reason:    input.Reason,
+		CreatedBy: userID,
+		CreatedAt: currentTime,
+		UpdatedAt: currentTime,
+	}
+	if set.SetID == "" {
+		set.SetID = utils.GenerateTimestampWithUID()
+	} else {
+		// a replaced set keeps who created it and when
+		existing, found, err := GetRoleConflictSet(companyID, set.SetID)
+		if err != nil {
+			data["status"] = utils.GetHTTPStatus(err.Error())
+			return c.RenderJSON(data)
+		}
+		if !found {
+			c.Response.Status = 404
+			return c.RenderJSON(models.ErrorResponse{
+				Code:           "404",
+				HTTPStatusCode: 404,
+				Message:        "Role conflict set not found: " + set.SetID,
+			})
+		}
+		set.CreatedBy = existing.CreatedBy
+		set.CreatedAt = existing.CreatedAt
+	}
+
+	if err := SaveRoleConflictSet(set); err != nil {
+		data["status"] = utils.GetHTTPStatus(err.Error())
+		return c.RenderJSON(data)
+	}
+
+	data["set"] = set
+	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+	return c.RenderJSON(data)
+}
+
+/*
+****************
+GetRoleConflictSets()
+- Returns every mutually exclusive role set of the company
+****************
+*/
+func (c RoleController) GetRoleConflictSets() revel.Result {
+	companyID := c.ViewArgs["companyID"].(string)
+	data := make(map[string]interface{})
+
+	sets, err := GetCompanyRoleConflictSets(companyID)
+	if err != nil {
+		data["status"] = utils.GetHTTPStatus(err.Error())
+		return c.RenderJSON(data)
+	}
+
+	data["sets"] = sets
+	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+	return c.RenderJSON(data)
+}
+
+/*
+****************
+DeleteRoleConflictSet()
+- Removes a mutually exclusive role set
+Params:
+set_id - required
+****************
+*/
+func (c RoleController) DeleteRoleConflictSet() revel.Result {
+	companyID := c.ViewArgs["companyID"].(string)
+	userID := c.ViewArgs["userID"].(string)
+	setID := c.Params.Get("set_id")
+	data := make(map[string]interface{})
+
+	isAdmin, err := isCompanyAdmin(companyID, userID)
+	if err != nil || !isAdmin {
+		c.Response.Status = 401
+		data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_401)
+		return c.RenderJSON(data)
+	}
+
+	if setID == "" {
+		c.Response.Status = 400
+		return c.RenderJSON(models.ErrorResponse{
+			HTTPStatusCode: 400,
+			Message:        "Missing required parameter - set_id",
+			Status:         utils.GetHTTPStatus(constants.HTTP_STATUS_400),
+		})
+	}
+
+	if err := DeleteRoleConflictSet(companyID, setID); err != nil {
+		data["status"] = utils.GetHTTPStatus(err.Error())
+		return c.RenderJSON(data)
+	}
+
+	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+	return c.RenderJSON(data)
+}
+
+/*
+****************
+GetRoleConflictViolations()
+- Lists the users holding more than one role of a mutually exclusive set
+****************
+*/
+func (c RoleController) GetRoleConflictViolations() revel.Result {
+	companyID := c.ViewArgs["companyID"].(string)
+	userID := c.ViewArgs["userID"].(string)
+	data := make(map[string]interface{})
+
+	isAdmin, err := isCompanyAdmin(companyID, userID)
+	if err != nil || !isAdmin {
+		c.Response.Status = 401
+		data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_401)
+		return c.RenderJSON(data)
+	}
+
+	violations, err := GetRoleConflictViolations(companyID)
+	if err != nil {
+		data["status"] = utils.GetHTTPStatus(err.Error())
+		return c.RenderJSON(data)
+	}
+
+	data["violations"] = violations
+	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+	return c.RenderJSON(data)
+}
+
+// renderRoleConflicts rejects a grant that would break a mutually exclusive
+// role set.
+func (c RoleController) renderRoleConflicts(conflicts []RoleConflict) revel.Result {
+	var messages []string
+	for _, conflict := range conflicts {
+		messages = append(messages, conflict.Message())
+	}
+	c.Response.Status = 422
+	return c.RenderJSON(map[string]interface{}{
+		"errors":    messages,
+		"conflicts": conflicts,
+		"status":    utils.GetHTTPStatus(constants.HTTP_STATUS_422),
+	})
+}
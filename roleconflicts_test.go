@@ -0,0 +1,111 @@
+package controllers
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFindRoleConflicts(t *testing.T) {
+	sets := []RoleConflictSet{
+		{SetID: "s1", Name: "Payments", RoleIDs: []string{"pay", "approve"}, Reason: "four eyes"},
+		{SetID: "s2", Name: "Audit", RoleIDs: []string{"audit", "admin", "dev"}},
+	}
+
+	tests := []struct {
+		name    string
+		held    []string
+		granted []string
+		want    []RoleConflict
+	}{
+		{
+			name:    "no set touched",
+			held:    []string{"viewer"},
+			granted: []string{"editor"},
+		},
+		{
+			name:    "granted role joins a held one",
+			held:    []string{"approve"},
+			granted: []string{"pay"},
+			want: []RoleConflict{
+				{SetID: "s1", SetName: "Payments", Reason: "four eyes", RoleIDs: []string{"pay", "approve"}},
+			},
+		},
+		{
+			name:    "two granted roles of one set",
+			granted: []string{"admin", "dev"},
+			want: []RoleConflict{
+				{SetID: "s2", SetName: "Audit", RoleIDs: []string{"admin", "dev"}},
+			},
+		},
+		{
+			name:    "set broken by the held roles only",
+			held:    []string{"pay", "approve"},
+			granted: []string{"viewer"},
+		},
+		{
+			name:    "single role of a set",
+			granted: []string{"audit"},
+		},
+		{
+			name:    "several sets",
+			held:    []string{"pay", "dev"},
+			granted: []string{"approve", "audit"},
+			want: []RoleConflict{
+				{SetID: "s1", SetName: "Payments", Reason: "four eyes", RoleIDs: []string{"pay", "approve"}},
+				{SetID: "s2", SetName: "Audit", RoleIDs: []string{"audit", "dev"}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := findRoleConflicts(sets, test.held, test.granted)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("findRoleConflicts() = %+v; want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestConflictGuardRoleIDs(t *testing.T) {
+	sets := []RoleConflictSet{
+		{SetID: "s1", RoleIDs: []string{"payer", "approver"}},
+		{SetID: "s2", RoleIDs: []string{"approver", "auditor", "requester"}},
+		{SetID: "s3", RoleIDs: []string{"dev", "ops"}},
+	}
+
+	tests := []struct {
+		name    string
+		granted []string
+		want    []string
+	}{
+		{
+			name:    "role in one set",
+			granted: []string{"payer"},
+			want:    []string{"approver"},
+		},
+		{
+			name:    "role in two sets",
+			granted: []string{"approver"},
+			want:    []string{"payer", "auditor", "requester"},
+		},
+		{
+			name:    "granted roles are not guards",
+			granted: []string{"auditor", "dev"},
+			want:    []string{"approver", "requester", "ops"},
+		},
+		{
+			name:    "role in no set",
+			granted: []string{"viewer"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := conflictGuardRoleIDs(sets, test.granted)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("conflictGuardRoleIDs() = %v; want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"grooper/app/utils"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
@@ -47,15 +48,13 @@ func (c RoleController) CreateRole() revel.Result {
 
 	roleName := utils.TrimSpaces(c.Params.Form.Get("role_name"))
 
-	var inputRequest []*dynamodb.WriteRequest
-	var input *dynamodb.BatchWriteItemInput
-	tableName := app.TABLE_NAME
+	writer := NewBatchWriter()
 	regExp := regexp.MustCompile("^[a-zA-Z0-9 ]*$")
 
 	//Get current timestamp
 	currentTime := utils.GetCurrentTimestamp()
 
-	var recipients []mail.Recipient
+	var pending []pendingRecipient
 
 	//Make a data interface to return as JSON
 	data := make(map[string]interface{})
@@ -106,51 +105,43 @@ func (c RoleController) CreateRole() revel.Result {
 		data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_500)
 		return c.RenderJSON(data)
 	}
-	inputRequest = append(inputRequest, &dynamodb.WriteRequest{PutRequest: &dynamodb.PutRequest{
-		Item: map[string]*dynamodb.AttributeValue{
-			"PK": &dynamodb.AttributeValue{
-				S: aws.String(role.PK),
-			},
-			"SK": &dynamodb.AttributeValue{
-				S: aws.String(role.SK),
-			},
-			"RoleID": &dynamodb.AttributeValue{
-				S: aws.String(role.RoleID),
-			},
-			"CompanyID": &dynamodb.AttributeValue{
-				S: aws.String(role.CompanyID),
-			},
-			"RolePermissions": &dynamodb.AttributeValue{
-				L: rolePermissions,
-			},
-			"RoleName": &dynamodb.AttributeValue{
-				S: aws.String(role.RoleName),
-			},
-			"SearchKey": &dynamodb.AttributeValue{
-				S: aws.String(strings.ToLower(role.RoleName)),
-			},
-			"Type": &dynamodb.AttributeValue{
-				S: aws.String(role.Type),
-			},
-			"CreatedBy": &dynamodb.AttributeValue{
-				S: aws.String(role.CreatedBy),
-			},
-			"CreatedAt": &dynamodb.AttributeValue{
-				S: aws.String(role.CreatedAt),
-			},
+	writer.Put(map[string]*dynamodb.AttributeValue{
+		"PK": &dynamodb.AttributeValue{
+			S: aws.String(role.PK),
 		},
-	}})
-
-	input = &dynamodb.BatchWriteItemInput{
-		RequestItems: map[string][]*dynamodb.WriteRequest{
-			tableName: inputRequest,
+		"SK": &dynamodb.AttributeValue{
+			S: aws.String(role.SK),
 		},
-	}
+		"RoleID": &dynamodb.AttributeValue{
+			S: aws.String(role.RoleID),
+		},
+		"CompanyID": &dynamodb.AttributeValue{
+			S: aws.String(role.CompanyID),
+		},
+		"RolePermissions": &dynamodb.AttributeValue{
+			L: rolePermissions,
+		},
+		"RoleName": &dynamodb.AttributeValue{
+			S: aws.String(role.RoleName),
+		},
+		"SearchKey": &dynamodb.AttributeValue{
+			S: aws.String(strings.ToLower(role.RoleName)),
+		},
+		"Type": &dynamodb.AttributeValue{
+			S: aws.String(role.Type),
+		},
+		"CreatedBy": &dynamodb.AttributeValue{
+			S: aws.String(role.CreatedBy),
+		},
+		"CreatedAt": &dynamodb.AttributeValue{
+			S: aws.String(role.CreatedAt),
+		},
+	})
 
-	_, roleErr := app.SVC.BatchWriteItem(input)
+	roleResult, roleErr := writer.Flush()
 	if roleErr != nil {
 		data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_500)
-		data["error"] = roleErr.Error()
+		data["error"] = roleResult.Failures[0].Reason
 		return c.RenderJSON(data)
 	}
 
@@ -173,39 +164,35 @@ func (c RoleController) CreateRole() revel.Result {
 					Type:      constants.ENTITY_TYPE_USER_ROLE,
 				}
 
-				av, err := dynamodbattribute.MarshalMap(item)
+				err := writer.PutModel(item)
 				if err != nil {
 					data["error"] = "Error at marshalmap"
 					data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_500)
 					return c.RenderJSON(data)
 				}
 
-				input := &dynamodb.PutItemInput{
-					Item:      av,
-					TableName: aws.String(app.TABLE_NAME),
-				}
-
-				_, err = app.SVC.PutItem(input)
-				if err != nil {
-					data["error"] = "Cannot assign role due to server error"
-					data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_500)
-					return c.RenderJSON(data)
-				}
 				user, opsErr := ops.GetUserByIDNew(userID)
 				if opsErr != nil {
 					return c.RenderJSON(opsErr)
 				}
-				recipients = append(recipients, mail.Recipient{
+				pending = append(pending, pendingRecipient{PK: item.PK, SK: item.SK, Recipient: mail.Recipient{
 					Name:           user.FirstName + " " + user.LastName,
 					Email:          user.Email,
 					ActionType:     "assigned",
 					RoleName:       role.RoleName,
 					RolePermission: role.RolePermissions,
-				})
+				}})
 
 			}
 		}
 	}
+	userRoleResult, err := writer.Flush()
+	if err != nil {
+		// the role exists, only some of its users are missing
+		c.Response.Status = 207
+		data["failures"] = userRoleResult.Failures
+	}
+	recipients := writtenRecipients(userRoleResult, pending)
 	jobs.Now(mail.SendEmail{
 		Subject:    "You have been assigned to a role",
 		Recipients: recipients,
@@ -244,6 +231,8 @@ func (c RoleController) CreateRole() revel.Result {
 ****************
 AssignRole()
 Assign multiple roles to multple users
+Params:
+expires_at - optional (RFC 3339), the roles are revoked at that time
 ****************
 */
 func (c RoleController) AssignRole() revel.Result {
@@ -255,12 +244,35 @@ func (c RoleController) AssignRole() revel.Result {
 
 	data := make(map[string]interface{})
 
+	expiresAt, err := parseRoleGrantExpiry(c.Params.Get("expires_at"), time.Now())
+	if err != nil {
+		c.Response.Status = 422
+		data["errors"] = err.Error()
+		data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_422)
+		return c.RenderJSON(data)
+	}
+
 	company, opsError := ops.GetCompanyByID(companyID)
 	if opsError != nil {
 		return c.RenderJSON(opsError)
 	}
+	conflicts, guards, err := checkRoleGrants(companyID, userIDs, roleIDs)
+	if err != nil {
+		data["status"] = utils.GetHTTPStatus(err.Error())
+		return c.RenderJSON(data)
+	}
+	if len(conflicts) != 0 {
+		return c.renderRoleConflicts(conflicts)
+	}
+
 	// var usersToInvite []models.User
-	var recipients []mail.Recipient
+	var pending []pendingRecipient
+	// time-bound grants and grants of roles in a conflict set are written
+	// one by one, on condition that they do not replace a grant without an
+	// end and that no conflicting role was granted since the check
+	var conditionalWritten, keptPermanent, conflicted int
+	var conditionalFailures []BatchWriteFailure
+	writer := NewBatchWriter()
 
 	for _, userID := range userIDs {
 		user, opsErr := ops.GetUserByIDNew(userID)
@@ -285,40 +297,36 @@ func (c RoleController) AssignRole() revel.Result {
 			//
 
 			// if !result {
-			item := models.UserRole{
-				PK:        utils.AppendPrefix(constants.PREFIX_USER, userID),
-				SK:        utils.AppendPrefix(utils.AppendPrefix(constants.PREFIX_ROLE, roleID), utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
-				UserID:    userID,
-				RoleID:    roleID,
-				CompanyID: companyID,
-				Type:      constants.ENTITY_TYPE_USER_ROLE,
-			}
-
-			av, err := dynamodbattribute.MarshalMap(item)
-			if err != nil {
+			item := newUserRoleGrant(userID, roleID, companyID, expiresAt)
+
+			if expiresAt != 0 || len(guards[userID]) != 0 {
+				var err error
+				if len(guards[userID]) != 0 {
+					condition := ""
+					if expiresAt != 0 {
+						condition = timeBoundGrantCondition
+					}
+					err = putGuardedUserRoleGrant(item, condition, guards[userID])
+				} else {
+					err = putTimeBoundUserRoleGrant(item)
+				}
+				if err == ErrRoleGrantChanged {
+					keptPermanent++
+					conditionalFailures = append(conditionalFailures, BatchWriteFailure{PK: item.PK, SK: item.SK, Action: BATCH_WRITE_ACTION_PUT, Reason: "the user holds the role without an end"})
+				} else if err == ErrRoleConflict {
+					conflicted++
+					conditionalFailures = append(conditionalFailures, BatchWriteFailure{PK: item.PK, SK: item.SK, Action: BATCH_WRITE_ACTION_PUT, Reason: err.Error()})
+				} else if err != nil {
+					conditionalFailures = append(conditionalFailures, BatchWriteFailure{PK: item.PK, SK: item.SK, Action: BATCH_WRITE_ACTION_PUT, Reason: err.Error()})
+				} else {
+					conditionalWritten++
+				}
+			} else if err := writer.PutModel(item); err != nil {
 				data["error"] = "Error at marshalmap"
 				data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_500)
 				return c.RenderJSON(data)
 			}
 
-			input := &dynamodb.PutItemInput{
-				Item:      av,
-				TableName: aws.String(app.TABLE_NAME),
-			}
-
-			//
-			//
-			//
-			//
-			//
-
-			_, err = app.SVC.PutItem(input)
-			if err != nil {
-				data["error"] = "Cannot assign role due to server error"
-				data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_500)
-				return c.RenderJSON(data)
-			}
-
 			// // create account if the user doesn't have
 			// user, err := ops.GetUserByID(userID)
 			// if err == nil {
@@ -368,16 +376,36 @@ func (c RoleController) AssignRole() revel.Result {
 			// 	}
 			// }
 
-			recipients = append(recipients, mail.Recipient{
+			pending = append(pending, pendingRecipient{PK: item.PK, SK: item.SK, Recipient: mail.Recipient{
 				Name:           user.FirstName + " " + user.LastName,
 				Email:          user.Email,
 				ActionType:     "assigned",
 				RoleName:       role.RoleName,
 				RolePermission: role.RolePermissions,
 				CompanyName:    company.CompanyName,
-			})
+			}})
+		}
+	}
+
+	result, err := writer.Flush()
+	result.Written += conditionalWritten
+	result.Failures = append(result.Failures, conditionalFailures...)
+	if len(result.Failures) != 0 {
+		if result.Written == 0 {
+			data["error"] = "Cannot assign role due to server error"
+			data["failures"] = result.Failures
+			data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_500)
+			if keptPermanent+conflicted == len(result.Failures) {
+				c.Response.Status = 422
+				data["error"] = "Cannot assign role"
+				data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_422)
+			}
+			return c.RenderJSON(data)
 		}
+		c.Response.Status = 207
+		data["failures"] = result.Failures
 	}
+	recipients := writtenRecipients(result, pending)
 	jobs.Now(mail.SendEmail{
 		Subject:    "[SaaSConsole] Your access to " + company.CompanyName + " has changed",
 		Recipients: recipients,
@@ -406,7 +434,7 @@ func (c RoleController) UnassignRole() revel.Result {
 	companyID := c.ViewArgs["companyID"].(string)
 
 	data := make(map[string]interface{})
-	var recipients []mail.Recipient
+	var unassignments []roleUnassignment
 
 	company, opsError := ops.GetCompanyByID(companyID)
 	if opsError != nil {
@@ -431,44 +459,135 @@ func (c RoleController) UnassignRole() revel.Result {
 			// }
 
 			// if result {
+			unassignments = append(unassignments, newRoleUnassignment(user, role, company))
+			// }
+		}
+	}
 
-			userrole := &dynamodb.DeleteItemInput{
-				Key: map[string]*dynamodb.AttributeValue{
-					"PK": {
-						S: aws.String(utils.AppendPrefix(constants.PREFIX_USER, userID)),
-					},
-					"SK": {
-						S: aws.String(utils.AppendPrefix(utils.AppendPrefix(constants.PREFIX_ROLE, roleID), utils.AppendPrefix(constants.PREFIX_COMPANY, companyID))),
-					},
-				},
-				TableName: aws.String(app.TABLE_NAME),
-			}
+	result, err := UnassignUserRoles(c.Controller, company, unassignments, LOG_ACTION_UNASSIGN_ROLE)
+	if err != nil {
+		if result.Written == 0 {
+			data["message"] = "Got error calling DeleteItem at userrole"
+			data["failures"] = result.Failures
+			data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_500)
+			return c.RenderJSON(data)
+		}
+		c.Response.Status = 207
+		data["failures"] = result.Failures
+	}
 
-			_, err := app.SVC.DeleteItem(userrole)
-			if err != nil {
-				data["message"] = "Got error calling DeleteItem at userrole"
-				data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_500)
-				return c.RenderJSON(data)
-			}
-			recipients = append(recipients, mail.Recipient{
-				Name:           user.FirstName + " " + user.LastName,
-				Email:          user.Email,
-				ActionType:     "unassigned",
-				RoleName:       role.RoleName,
-				RolePermission: role.RolePermissions,
-				CompanyName:    company.CompanyName,
-			})
-			// }
+	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
+	return c.RenderJSON(data)
+}
+
+// roleUnassignment is a user role to delete and the email telling its user.
+type roleUnassignment struct {
+	pendingRecipient
+	UserID string
+	RoleID string
+}
+
+func newRoleUnassignment(user models.User, role models.Role, company models.Company) roleUnassignment {
+	userRolePK := utils.AppendPrefix(constants.PREFIX_USER, user.UserID)
+	userRoleSK := utils.AppendPrefix(utils.AppendPrefix(constants.PREFIX_ROLE, role.RoleID), utils.AppendPrefix(constants.PREFIX_COMPANY, company.CompanyID))
+	return roleUnassignment{
+		pendingRecipient: pendingRecipient{PK: userRolePK, SK: userRoleSK, Recipient: mail.Recipient{
+			Name:           user.FirstName + " " + user.LastName,
+			Email:          user.Email,
+			ActionType:     "unassigned",
+			RoleName:       role.RoleName,
+			RolePermission: role.RolePermissions,
+			CompanyName:    company.CompanyName,
+		}},
+		UserID: user.UserID,
+		RoleID: role.RoleID,
+	}
+}
+
+/*
+****************
+UnassignUserRoles()
+- Deletes the user roles, then emails and logs every removal that was
+written. Shared by UnassignRole and the revocation of expired grants. The
+error is set when some deletes failed; result tells which.
+****************
+*/
+func UnassignUserRoles(c *revel.Controller, company models.Company, unassignments []roleUnassignment, logAction string) (BatchWriteResult, error) {
+	// the end of an elevation is logged as such, whoever removes the role
+	elevated := map[string]bool{}
+	for _, unassignment := range unassignments {
+		if grant, err := getUserRoleGrant(unassignment.PK, unassignment.SK); err == nil && grant.ElevationRequestID != "" {
+			elevated[unassignment.PK+unassignment.SK] = true
 		}
 	}
 
+	writer := NewBatchWriter()
+	var pending []pendingRecipient
+	for _, unassignment := range unassignments {
+		writer.Delete(unassignment.PK, unassignment.SK)
+		pending = append(pending, unassignment.pendingRecipient)
+	}
+
+	result, err := writer.Flush()
+	if err != nil && result.Written == 0 {
+		return result, err
+	}
+	recipients := writtenRecipients(result, pending)
+
 	jobs.Now(mail.SendEmail{
 		Subject:    "[SaaSConsole] Your access to " + company.CompanyName + " has changed",
 		Recipients: recipients,
 		Template:   "change_permissions.html",
 	})
-	data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_200)
-	return c.RenderJSON(data)
+
+	authorID := c.ViewArgs["userID"].(string)
+	var logs = []*models.Logs{}
+	for _, unassignment := range unassignments {
+		if result.Failed(unassignment.PK, unassignment.SK) {
+			continue
+		}
+		logs = append(logs, &models.Logs{
+			CompanyID: company.CompanyID,
+			UserID:    authorID,
+			LogAction: logAction,
+			LogType:   constants.ENTITY_TYPE_ROLE,
+			LogInfo: &models.LogInformation{
+				Role: &models.LogModuleParams{
+					ID:   unassignment.RoleID,
+					Name: unassignment.Recipient.RoleName,
+				},
+				User: &models.LogModuleParams{
+					ID: unassignment.UserID,
+				},
+				PerformedBy: authorID,
+			},
+		})
+		if elevated[unassignment.PK+unassignment.SK] {
+			logs = append(logs, &models.Logs{
+				CompanyID: company.CompanyID,
+				UserID:    authorID,
+				LogAction: LOG_ACTION_ELEVATION_END,
+				LogType:   constants.ENTITY_TYPE_ROLE,
+				LogInfo: &models.LogInformation{
+					Role: &models.LogModuleParams{
+						ID:   unassignment.RoleID,
+						Name: unassignment.Recipient.RoleName,
+					},
+					User: &models.LogModuleParams{
+						ID: unassignment.UserID,
+					},
+					PerformedBy: authorID,
+				},
+			})
+		}
+	}
+	if len(logs) != 0 {
+		if _, logErr := CreateBatchLog(logs); logErr != nil {
+			revel.AppLog.Error("UnassignUserRoles: unable to create logs", logErr)
+		}
+	}
+
+	return result, err
 }
 
 /*
@@ -729,25 +848,21 @@ func (c RoleController) DeleteRole() revel.Result {
 		}
 
 		if len(result) != 0 {
+			writer := NewBatchWriter()
 			for _, items := range result {
-				userrole := &dynamodb.DeleteItemInput{
-					Key: map[string]*dynamodb.AttributeValue{
-						"PK": {
-							S: aws.String(utils.AppendPrefix(constants.PREFIX_USER, items.UserID)),
-						},
-						"SK": {
-							S: aws.String(utils.AppendPrefix(utils.AppendPrefix(constants.PREFIX_ROLE, roleID), utils.AppendPrefix(constants.PREFIX_COMPANY, companyID))),
-						},
-					},
-					TableName: aws.String(app.TABLE_NAME),
-				}
+				writer.Delete(
+					utils.AppendPrefix(constants.PREFIX_USER, items.UserID),
+					utils.AppendPrefix(utils.AppendPrefix(constants.PREFIX_ROLE, roleID), utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
+				)
+			}
 
-				_, err := app.SVC.DeleteItem(userrole)
-				if err != nil {
-					data["message"] = "Got error calling DeleteItem at userrole"
-					data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_500)
-					return c.RenderJSON(data)
-				}
+			// the role is kept while any of its users could not be removed
+			userRoleResult, err := writer.Flush()
+			if err != nil {
+				data["message"] = "Got error calling DeleteItem at userrole"
+				data["failures"] = userRoleResult.Failures
+				data["status"] = utils.GetHTTPStatus(constants.HTTP_STATUS_500)
+				return c.RenderJSON(data)
 			}
 		}
 
@@ -916,48 +1031,31 @@ func (c RoleController) CreateGroupLog(companyID string, details *models.LogModu
 type RequestRolesParams struct {
 	Roles  []string `json:"roles,omitempty"`
 	UserID string   `json:"user_id,omitempty"`
+	// ExpiresAt (RFC 3339) asks for the roles until that time only
+	ExpiresAt string `json:"expires_at,omitempty"`
+	// ElevateFor (e.g. 1h) asks for a just-in-time elevation, granted for
+	// that long once accepted
+	ElevateFor      string `json:"elevate_for,omitempty"`
+	Justification   string `json:"justification,omitempty"`
+	TicketReference string `json:"ticket_reference,omitempty"`
 }
 
-func sendNotificationToCompanyAdmin(c RoleController, companyAdminUserID string, requesterUserInfo models.CompanyUser, requestedRoles []models.Role, input RequestRolesParams) revel.Result {
-
-	companyID := c.ViewArgs["companyID"].(string)
-
+// roleRequestTemplate is the message shown to approvers of a role request.
+// Elevations show how long they are for and why, with the ticket when there
+// is one.
+func roleRequestTemplate(requesterUserInfo models.CompanyUser, requestedRoles []models.Role, request Request) NotificationTemplate {
 	var roleNames []string
 	for _, role := range requestedRoles {
 		roleNames = append(roleNames, role.RoleName)
 	}
-
-	notificationContent := models.NotificationContentType{
-		RequesterUserID: requesterUserInfo.UserID,
-		ActiveCompany:   companyID,
-		RolesRequested:  input.Roles,
-		IsAccepted:      "UNDER_REVIEW",
-	}
-
-	if len(roleNames) == 1 {
-		notificationContent.Message = requesterUserInfo.FirstName + " " + requesterUserInfo.LastName + " has requested to take on the role of " + roleNames[0] + "."
-	} else {
-		notificationContent.Message = requesterUserInfo.FirstName + " " + requesterUserInfo.LastName + " has requested to take on the following roles: " + strings.Join(roleNames, ", ") + "."
-	}
-
-	createdNotification, err := ops.CreateNotification(ops.CreateNotificationInput{
-		UserID:              companyAdminUserID,
-		NotificationType:    constants.REQUEST_COMPANY_ROLE_UPDATE,
-		NotificationContent: notificationContent,
-		Global:              false,
-	}, c.Controller)
-
-	if err != nil {
-		c.Response.Status = 400
-		return c.RenderJSON(models.ErrorResponse{
-			Code:    "400",
-			Message: "Unable to create notification for " + requesterUserInfo.UserID,
-		})
+	if request.ElevationSeconds != 0 {
+		duration := time.Duration(request.ElevationSeconds) * time.Second
+		if request.TicketReference != "" {
+			return newListTemplate(MESSAGE_ROLE_ELEVATION_TICKET, roleNames, requesterName(requesterUserInfo), duration.String(), request.Justification, request.TicketReference)
+		}
+		return newListTemplate(MESSAGE_ROLE_ELEVATION_REQUESTED, roleNames, requesterName(requesterUserInfo), duration.String(), request.Justification)
 	}
-
-	utils.PrintJSON(createdNotification)
-
-	return c.RenderJSON(createdNotification)
+	return newListTemplate(MESSAGE_ROLE_REQUESTED, roleNames, requesterName(requesterUserInfo))
 }
 
 func (c RoleController) RequestRoles() revel.Result {
@@ -965,6 +1063,7 @@ func (c RoleController) RequestRoles() revel.Result {
 
 	var input RequestRolesParams
 	c.Params.BindJSON(&input)
+	input.Roles = uniqueStrings(input.Roles)
 
 	if utils.FindEmptyStringElement([]string{input.UserID}) {
 		c.Response.Status = 401
@@ -975,15 +1074,29 @@ func (c RoleController) RequestRoles() revel.Result {
 		})
 	}
 
-	//get company admins
-	companyAdmins, err := ops.GetCompanyAdminsByRoleID(companyID, constants.ROLE_ID_COMPANY_ADMIN)
+	input.Justification = strings.TrimSpace(input.Justification)
+	input.TicketReference = strings.TrimSpace(input.TicketReference)
+	elevationSeconds, err := parseRoleElevation(input, roleElevationMaxDuration())
 	if err != nil {
-		c.Response.Status = 400
+		c.Response.Status = 422
 		return c.RenderJSON(models.ErrorResponse{
-			Code:    "400",
-			Message: "Unable to retrieve Company Admins",
+			Code:           "422",
+			HTTPStatusCode: 422,
+			Message:        err.Error(),
+			Status:         utils.GetHTTPStatus(constants.HTTP_STATUS_422),
 		})
 	}
+	expiresAt, err := parseRoleGrantExpiry(input.ExpiresAt, time.Now())
+	if err != nil {
+		c.Response.Status = 422
+		return c.RenderJSON(models.ErrorResponse{
+			Code:           "422",
+			HTTPStatusCode: 422,
+			Message:        err.Error(),
+			Status:         utils.GetHTTPStatus(constants.HTTP_STATUS_422),
+		})
+	}
+
 	//get requester info
 	requesterInfo, err := ops.GetCompanyMember(ops.GetCompanyMemberParams{
 		UserID:    input.UserID,
@@ -1012,71 +1125,63 @@ func (c RoleController) RequestRoles() revel.Result {
 		rolesRequested = append(rolesRequested, roleInfo)
 	}
 
-	// Check for existing pending requests
-	if len(companyAdmins) != 0 {
-		for _, compAdmin := range companyAdmins {
-			userNotifications, _ := ops.GetUserNotifications(compAdmin.UserID, companyID)
-
-			//handle duplicate notifs
-			duplicateFound := false
-			for _, notif := range userNotifications {
-				if notif.NotificationType == constants.REQUEST_COMPANY_ROLE_UPDATE &&
-					notif.UserID == compAdmin.UserID &&
-					notif.NotificationContent.RequesterUserID == input.UserID &&
-					notif.NotificationContent.ActiveCompany == companyID {
-
-					if len(input.Roles) > 0 &&
-						len(notif.NotificationContent.RolesRequested) > 0 &&
-						utils.ComparingSlices(notif.NotificationContent.RolesRequested, input.Roles) &&
-						notif.NotificationContent.IsAccepted == "UNDER_REVIEW" {
-						duplicateFound = true
-						break
-					}
-				}
-			}
-
-			if duplicateFound {
-				c.Response.Status = 497
+	// an elevation is on top of the roles held, it would otherwise cut a
+	// permanent grant short
+	if elevationSeconds != 0 {
+		heldRoleIDs, err := getUserCompanyRoleIDs(input.UserID, companyID)
+		if err != nil {
+			c.Response.Status = 500
+			return c.RenderJSON(models.ErrorResponse{
+				Code:    "500",
+				Message: "Unable to retrieve the roles of the user",
+				Status:  utils.GetHTTPStatus(constants.HTTP_STATUS_500),
+			})
+		}
+		for _, role := range rolesRequested {
+			if utils.StringInSlice(role.RoleID, heldRoleIDs) {
+				c.Response.Status = 422
 				return c.RenderJSON(models.ErrorResponse{
-					Code:    "497",
-					Message: "Request already submitted.",
-					Status:  utils.GetHTTPStatus(constants.HTTP_STATUS_497),
+					Code:           "422",
+					HTTPStatusCode: 422,
+					Message:        "The user already holds the role " + role.RoleName,
+					Status:         utils.GetHTTPStatus(constants.HTTP_STATUS_422),
 				})
 			}
 		}
 	}
 
-	currentTime := utils.GetCurrentTimestamp()
-	pendingRequest := models.PendingRoleRequest{
-		PK:             utils.AppendPrefix(constants.PREFIX_USER, input.UserID),
-		SK:             utils.AppendPrefix(constants.PREFIX_ROLE_REQUEST, utils.GenerateTimestampWithUID()),
-		UserID:         input.UserID,
-		CompanyID:      companyID,
-		RequestedRoles: input.Roles,
-		Status:         "PENDING",
-		CreatedAt:      currentTime,
-		UpdatedAt:      currentTime,
-		Type:           constants.ENTITY_TYPE_ROLE_REQUEST,
-		RequestedBy:    c.ViewArgs["userID"].(string),
-	}
-
-	av, marshalErr := dynamodbattribute.MarshalMap(pendingRequest)
-	if marshalErr != nil {
+	// Check for existing pending requests
+	pendingRequests, err := GetPendingRequestsOfUser(companyID, input.UserID, constants.REQUEST_COMPANY_ROLE_UPDATE)
+	if err != nil {
 		c.Response.Status = 500
 		return c.RenderJSON(models.ErrorResponse{
 			Code:    "500",
-			Message: "Error marshalling pending request",
+			Message: "Error retrieving pending requests",
 			Status:  utils.GetHTTPStatus(constants.HTTP_STATUS_500),
 		})
 	}
-
-	putInput := &dynamodb.PutItemInput{
-		Item:      av,
-		TableName: aws.String(app.TABLE_NAME),
+	for _, pending := range pendingRequests {
+		if len(input.Roles) > 0 && utils.ComparingSlices(pending.RolesRequested, input.Roles) {
+			c.Response.Status = 497
+			return c.RenderJSON(models.ErrorResponse{
+				Code:    "497",
+				Message: "Request already submitted.",
+				Status:  utils.GetHTTPStatus(constants.HTTP_STATUS_497),
+			})
+		}
 	}
 
-	_, putErr := app.SVC.PutItem(putInput)
-	if putErr != nil {
+	request := NewRequest(companyID, constants.REQUEST_COMPANY_ROLE_UPDATE, input.UserID, c.ViewArgs["userID"].(string))
+	request.RolesRequested = input.Roles
+	request.GrantExpiresAt = expiresAt
+	request.ElevationSeconds = elevationSeconds
+	request.Justification = input.Justification
+	request.TicketReference = input.TicketReference
+
+	template := roleRequestTemplate(requesterInfo, rolesRequested, request)
+	filed, err := FileRequest(c.Controller, request, requesterInfo, template)
+	if err != nil {
+		revel.AppLog.Error("RequestRoles:", err)
 		c.Response.Status = 500
 		return c.RenderJSON(models.ErrorResponse{
 			Code:    "500",
@@ -1085,14 +1190,19 @@ func (c RoleController) RequestRoles() revel.Result {
 		})
 	}
 
-	for _, compAdmin := range companyAdmins {
-		sendNotificationToCompanyAdmin(c, compAdmin.UserID, requesterInfo, rolesRequested, input)
+	if filed.AutoApproval != nil {
+		return c.RenderJSON(map[string]interface{}{
+			"status":        utils.GetHTTPStatus(constants.HTTP_STATUS_200),
+			"message":       "Role request approved automatically",
+			"request":       filed.Request,
+			"auto_approval": filed.AutoApproval.Body,
+		})
 	}
 
 	return c.RenderJSON(map[string]interface{}{
 		"status":  utils.GetHTTPStatus(constants.HTTP_STATUS_200),
 		"message": "Role request submitted successfully",
-		"request": pendingRequest,
+		"request": filed.Request,
 	})
 }
 
@@ -1102,28 +1212,85 @@ func (c RoleController) GetPendingRoleRequests() revel.Result {
 
 	revel.AppLog.Info("GetPendingRoleRequests called for userID:", userID, "companyID:", companyID)
 
-	notifications, _ := ops.GetUserNotifications(userID, companyID)
-	revel.AppLog.Info("Found notifications:", len(notifications))
+	requests, err := GetPendingRequestsOfUser(companyID, userID, constants.REQUEST_COMPANY_ROLE_UPDATE)
+	if err != nil {
+		revel.AppLog.Error("Error retrieving pending requests:", err)
+		return c.RenderJSON(models.ErrorResponse{
+			Code:    "500",
+			Message: "Error retrieving pending requests",
+			Status:  utils.GetHTTPStatus(constants.HTTP_STATUS_500),
+		})
+	}
 
 	var pendingRequests []models.PendingRoleRequest
+	for _, request := range requests {
+		pendingRequests = append(pendingRequests, models.PendingRoleRequest{
+			PK:             request.PK,
+			SK:             request.SK,
+			UserID:         request.RequesterUserID,
+			CompanyID:      request.CompanyID,
+			RequestedRoles: request.RolesRequested,
+			Status:         request.Status,
+			CreatedAt:      request.CreatedAt,
+			UpdatedAt:      request.UpdatedAt,
+			Type:           request.Type,
+			RequestedBy:    request.RequestedBy,
+		})
+	}
 
+	legacyRequests, err := getLegacyPendingRoleRequests(companyID, userID)
+	if err != nil {
+		revel.AppLog.Error("Error retrieving legacy pending requests:", err)
+		return c.RenderJSON(models.ErrorResponse{
+			Code:    "500",
+			Message: "Error retrieving pending requests",
+			Status:  utils.GetHTTPStatus(constants.HTTP_STATUS_500),
+		})
+	}
+	pendingRequests = append(pendingRequests, legacyRequests...)
+	revel.AppLog.Info("Found pending requests:", len(pendingRequests))
+
+	return c.RenderJSON(map[string]interface{}{
+		"status":           utils.GetHTTPStatus(constants.HTTP_STATUS_200),
+		"pending_requests": pendingRequests,
+	})
+}
+
+// getLegacyPendingRoleRequests returns the role requests filed before
+// requests were stored and not decided since: the UNDER_REVIEW notifications
+// no request was linked to yet, and the PendingRoleRequest items. They are
+// only turned into requests once decided, so they are read as they are.
+func getLegacyPendingRoleRequests(companyID, userID string) ([]models.PendingRoleRequest, error) {
+	var pendingRequests []models.PendingRoleRequest
+
+	notifications, _ := ops.GetUserNotifications(userID, companyID)
+	filings := map[string]bool{}
 	for _, notif := range notifications {
-		if notif.NotificationType == constants.REQUEST_COMPANY_ROLE_UPDATE &&
-			notif.NotificationContent.RequesterUserID == userID &&
-			notif.NotificationContent.IsAccepted == "UNDER_REVIEW" {
-
-			pendingRequests = append(pendingRequests, models.PendingRoleRequest{
-				UserID:         userID,
-				RequestedRoles: notif.NotificationContent.RolesRequested,
-				Status:         "PENDING",
-				CreatedAt:      notif.CreatedAt,
-				CompanyID:      companyID,
-			})
+		if notif.NotificationType != constants.REQUEST_COMPANY_ROLE_UPDATE ||
+			notif.NotificationContent.RequesterUserID != userID ||
+			notif.NotificationContent.IsAccepted != NOTIFICATION_REQUEST_UNDER_REVIEW {
+			continue
+		}
+		// linked notifications are listed with their request
+		_, linked, err := getRequestNotificationLink(notif.NotificationID)
+		if err != nil {
+			return nil, err
 		}
+		filingID := legacyRequestFilingID(notif)
+		if linked || filings[filingID] {
+			continue
+		}
+		filings[filingID] = true
+
+		pendingRequests = append(pendingRequests, models.PendingRoleRequest{
+			UserID:         userID,
+			RequestedRoles: notif.NotificationContent.RolesRequested,
+			Status:         REQUEST_STATUS_PENDING,
+			CreatedAt:      notif.CreatedAt,
+			CompanyID:      companyID,
+		})
 	}
 
-	revel.AppLog.Info("Found pending requests from notifications:", len(pendingRequests))
-
 	params := &dynamodb.QueryInput{
 		KeyConditions: map[string]*dynamodb.Condition{
 			"PK": {
@@ -1148,7 +1315,7 @@ func (c RoleController) GetPendingRoleRequests() revel.Result {
 				ComparisonOperator: aws.String(constants.CONDITION_EQUAL),
 				AttributeValueList: []*dynamodb.AttributeValue{
 					{
-						S: aws.String("PENDING"),
+						S: aws.String(REQUEST_STATUS_PENDING),
 					},
 				},
 			},
@@ -1166,30 +1333,33 @@ func (c RoleController) GetPendingRoleRequests() revel.Result {
 
 	result, err := app.SVC.Query(params)
 	if err != nil {
-		revel.AppLog.Error("Error querying DynamoDB:", err)
-		return c.RenderJSON(models.ErrorResponse{
-			Code:    "500",
-			Message: "Error retrieving pending requests",
-			Status:  utils.GetHTTPStatus(constants.HTTP_STATUS_500),
-		})
+		return nil, errors.New(constants.HTTP_STATUS_500)
 	}
 
 	var dbRequests []models.PendingRoleRequest
 	err = dynamodbattribute.UnmarshalListOfMaps(result.Items, &dbRequests)
 	if err != nil {
-		revel.AppLog.Error("Error unmarshalling DynamoDB results:", err)
-		return c.RenderJSON(models.ErrorResponse{
-			Code:    "500",
-			Message: "Error unmarshalling pending requests",
-			Status:  utils.GetHTTPStatus(constants.HTTP_STATUS_500),
-		})
+		return nil, errors.New(constants.HTTP_STATUS_400)
 	}
 
-	pendingRequests = append(pendingRequests, dbRequests...)
-	revel.AppLog.Info("Total pending requests after merge:", len(pendingRequests))
+	return append(pendingRequests, dbRequests...), nil
+}
 
-	return c.RenderJSON(map[string]interface{}{
-		"status":           utils.GetHTTPStatus(constants.HTTP_STATUS_200),
-		"pending_requests": pendingRequests,
-	})
+// pendingRecipient is an email to send once the user role it is about has
+// been written.
+type pendingRecipient struct {
+	PK        string
+	SK        string
+	Recipient mail.Recipient
+}
+
+// writtenRecipients returns the recipients whose user role was written.
+func writtenRecipients(result BatchWriteResult, pending []pendingRecipient) []mail.Recipient {
+	var recipients []mail.Recipient
+	for _, p := range pending {
+		if !result.Failed(p.PK, p.SK) {
+			recipients = append(recipients, p.Recipient)
+		}
+	}
+	return recipients
 }
@@ -0,0 +1,120 @@
+package controllers
+
+import (
+	"errors"
+	"grooper/app/constants"
+	"grooper/app/models"
+	"grooper/app/utils"
+	"strconv"
+	"time"
+
+	"github.com/revel/modules/jobs/app/jobs"
+	"github.com/revel/revel"
+)
+
+const (
+	LOG_ACTION_ELEVATION_START          = "LOG_ACTION_ELEVATION_START"
+	LOG_ACTION_ELEVATION_END            = "LOG_ACTION_ELEVATION_END"
+	ROLE_ELEVATION_DEFAULT_MAX_DURATION = "8h"
+	ROLE_ELEVATION_MAX_TICKET_REFERENCE = 100
+)
+
+// roleElevationMaxDuration is the longest elevation a user may ask for.
+func roleElevationMaxDuration() time.Duration {
+	return requestDelay("role.elevation.max_duration", ROLE_ELEVATION_DEFAULT_MAX_DURATION)
+}
+
+/*
+****************
+parseRoleElevation()
+- Validates the elevation asked for by a role request and returns its
+length in seconds, zero for a regular role request. An elevation needs a
+justification, cannot be longer than maxDuration and cannot also set
+expires_at; it ends relative to its acceptance instead.
+****************
+*/
+func parseRoleElevation(input RequestRolesParams, maxDuration time.Duration) (int64, error) {
+	if input.ElevateFor == "" {
+		return 0, nil
+	}
+	duration, err := time.ParseDuration(input.ElevateFor)
+	if err != nil || duration <= 0 {
+		return 0, errors.New("elevate_for must be a duration such as 1h or 30m")
+	}
+	if duration > maxDuration {
+		return 0, errors.New("elevate_for must be at most " + maxDuration.String())
+	}
+	if input.ExpiresAt != "" {
+		return 0, errors.New("expires_at cannot be set on an elevation")
+	}
+	if input.Justification == "" {
+		return 0, errors.New("Missing required parameter - justification")
+	}
+	if len(input.Justification) > REQUEST_MAX_COMMENT_LENGTH {
+		return 0, errors.New("justification must be at most " + strconv.Itoa(REQUEST_MAX_COMMENT_LENGTH) + " characters")
+	}
+	if len(input.TicketReference) > ROLE_ELEVATION_MAX_TICKET_REFERENCE {
+		return 0, errors.New("ticket_reference must be at most " + strconv.Itoa(ROLE_ELEVATION_MAX_TICKET_REFERENCE) + " characters")
+	}
+	return int64(duration / time.Second), nil
+}
+
+/*
+****************
+startRoleElevation()
+- Queues what follows the grant of an elevated role once the decision is
+committed: the start event and the job ending the elevation on time, so
+the role only shows in the permission checks while it is active. The
+expiry job ends it too if the app restarts in between.
+****************
+*/
+func startRoleElevation(ctx *RequestContext, grant UserRoleGrant, roleName string) {
+	authorID := ctx.ApproverID
+	if ctx.AutoApprovalRuleID != "" {
+		authorID = utils.AppendPrefix(PREFIX_AUTO_APPROVAL_RULE, ctx.AutoApprovalRuleID)
+	}
+
+	ctx.AfterCommit(func() error {
+		until := time.Unix(grant.ExpiresAt, 0)
+		jobs.In(time.Until(until)+time.Second, RoleElevationEndJob{PK: grant.PK, SK: grant.SK})
+		return logRoleElevation(grant, roleName, authorID, LOG_ACTION_ELEVATION_START)
+	})
+}
+
+// logRoleElevation writes the start or end event of an elevation.
+func logRoleElevation(grant UserRoleGrant, roleName, authorID, logAction string) error {
+	_, err := CreateBatchLog([]*models.Logs{{
+		CompanyID: grant.CompanyID,
+		UserID:    authorID,
+		LogAction: logAction,
+		LogType:   constants.ENTITY_TYPE_ROLE,
+		LogInfo: &models.LogInformation{
+			Role: &models.LogModuleParams{
+				ID:   grant.RoleID,
+				Name: roleName,
+			},
+			User: &models.LogModuleParams{
+				ID: grant.UserID,
+			},
+			PerformedBy: authorID,
+		},
+	}})
+	return err
+}
+
+// RoleElevationEndJob revokes an elevated role when it ends.
+type RoleElevationEndJob struct {
+	PK string
+	SK string
+}
+
+func (j RoleElevationEndJob) Run() {
+	grant, err := getUserRoleGrant(j.PK, j.SK)
+	if err == nil {
+		err = revokeExpiredRoleGrant(grant)
+	}
+	// the role was unassigned or granted again in the meantime
+	if err != nil && err != ErrRoleGrantChanged {
+		revel.AppLog.Error("RoleElevationEndJob: unable to end elevation "+j.PK+" "+j.SK, err)
+	}
+}
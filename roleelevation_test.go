@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRoleElevation(t *testing.T) {
+	tests := []struct {
+		name    string
+		input   RequestRolesParams
+		want    int64
+		wantErr string
+	}{
+		{
+			name:  "regular role request",
+			input: RequestRolesParams{Roles: []string{"r1"}},
+		},
+		{
+			name:  "elevation",
+			input: RequestRolesParams{ElevateFor: "90m", Justification: "incident"},
+			want:  5400,
+		},
+		{
+			name:  "elevation with a ticket",
+			input: RequestRolesParams{ElevateFor: "1h", Justification: "incident", TicketReference: "OPS-1"},
+			want:  3600,
+		},
+		{
+			name:    "not a duration",
+			input:   RequestRolesParams{ElevateFor: "an hour", Justification: "incident"},
+			wantErr: "elevate_for must be a duration",
+		},
+		{
+			name:    "negative duration",
+			input:   RequestRolesParams{ElevateFor: "-1h", Justification: "incident"},
+			wantErr: "elevate_for must be a duration",
+		},
+		{
+			name:    "longer than the maximum",
+			input:   RequestRolesParams{ElevateFor: "9h", Justification: "incident"},
+			wantErr: "elevate_for must be at most",
+		},
+		{
+			name:    "with expires_at",
+			input:   RequestRolesParams{ElevateFor: "1h", Justification: "incident", ExpiresAt: "2030-01-01T00:00:00Z"},
+			wantErr: "expires_at cannot be set",
+		},
+		{
+			name:    "without justification",
+			input:   RequestRolesParams{ElevateFor: "1h"},
+			wantErr: "justification",
+		},
+		{
+			name:    "justification too long",
+			input:   RequestRolesParams{ElevateFor: "1h", Justification: strings.Repeat("x", REQUEST_MAX_COMMENT_LENGTH+1)},
+			wantErr: "justification must be at most",
+		},
+		{
+			name:    "ticket reference too long",
+			input:   RequestRolesParams{ElevateFor: "1h", Justification: "incident", TicketReference: strings.Repeat("x", ROLE_ELEVATION_MAX_TICKET_REFERENCE+1)},
+			wantErr: "ticket_reference must be at most",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseRoleElevation(test.input, 8*time.Hour)
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("parseRoleElevation() error = %v; want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseRoleElevation() error = %v", err)
+			}
+			if got != test.want {
+				t.Errorf("parseRoleElevation() = %d; want %d", got, test.want)
+			}
+		})
+	}
+}
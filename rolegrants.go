@@ -0,0 +1,502 @@
+package controllers
+
+import (
+	"errors"
+	"grooper/app"
+	"grooper/app/constants"
+	"grooper/app/mail"
+	"grooper/app/models"
+	ops "grooper/app/operations"
+	"grooper/app/utils"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/revel/modules/jobs/app/jobs"
+	"github.com/revel/revel"
+)
+
+const (
+	LOG_ACTION_UNASSIGN_ROLE           = "LOG_ACTION_UNASSIGN_ROLE"
+	LOG_ACTION_EXPIRE_ROLE             = "LOG_ACTION_EXPIRE_ROLE"
+	NOTIFICATION_ROLE_EXPIRY_WARNING   = "ROLE_EXPIRY_WARNING"
+	ROLE_GRANT_DEFAULT_WARNING_BEFORE  = "72h"
+	ROLE_GRANT_DEFAULT_EXPIRY_SCHEDULE = "@every 15m"
+	// INDEX_NAME_ROLE_EXPIRY is keyed on ExpiryPartition and ExpiresAt.
+	// Only time-bound grants carry ExpiryPartition, so the index holds
+	// nothing else.
+	INDEX_NAME_ROLE_EXPIRY = "RoleExpiryIndex"
+	ROLE_EXPIRY_PARTITION  = "ROLE_EXPIRY"
+)
+
+var ErrRoleGrantChanged = errors.New("role grant changed")
+
+func init() {
+	revel.OnAppStart(func() {
+		jobs.Schedule(revel.Config.StringDefault("role.expiry.schedule", ROLE_GRANT_DEFAULT_EXPIRY_SCHEDULE), RoleGrantExpiryJob{})
+	})
+}
+
+// UserRoleGrant is a UserRole item with the optional end of the grant.
+// ExpiresAt is a unix time, zero for a permanent grant. Writing the grant
+// again replaces the item, which clears ExpiryWarned.
+type UserRoleGrant struct {
+	models.UserRole
+	ExpiresAt       int64  `json:"ExpiresAt,omitempty"`
+	ExpiryPartition string `json:"ExpiryPartition,omitempty"`
+	ExpiryWarned    bool   `json:"ExpiryWarned,omitempty"`
+	// ElevationRequestID is the request of a just-in-time elevation
+	ElevationRequestID string `json:"ElevationRequestID,omitempty"`
+}
+
+// Active is false once the grant has ended, even before the expiry job has
+// revoked it.
+func (grant UserRoleGrant) Active(now time.Time) bool {
+	return grant.ExpiresAt == 0 || grant.ExpiresAt > now.Unix()
+}
+
+func newUserRoleGrant(userID, roleID, companyID string, expiresAt int64) UserRoleGrant {
+	var expiryPartition string
+	if expiresAt != 0 {
+		expiryPartition = ROLE_EXPIRY_PARTITION
+	}
+	return UserRoleGrant{
+		UserRole: models.UserRole{
+			PK:        utils.AppendPrefix(constants.PREFIX_USER, userID),
+			SK:        utils.AppendPrefix(utils.AppendPrefix(constants.PREFIX_ROLE, roleID), utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
+			UserID:    userID,
+			RoleID:    roleID,
+			CompanyID: companyID,
+			Type:      constants.ENTITY_TYPE_USER_ROLE,
+		},
+		ExpiresAt:       expiresAt,
+		ExpiryPartition: expiryPartition,
+	}
+}
+
+// timeBoundGrantCondition keeps a time-bound grant from replacing a
+// permanent one, which has no ExpiresAt.
+const timeBoundGrantCondition = "attribute_not_exists(PK) OR attribute_exists(ExpiresAt)"
+
+// elevationGrantCondition keeps an elevation from replacing a grant that
+// ends after it, which the end of the elevation would otherwise revoke.
+const elevationGrantCondition = "attribute_not_exists(PK) OR (attribute_exists(ExpiresAt) AND ExpiresAt <= :expiresAt)"
+
+// putTimeBoundUserRoleGrant writes a grant with an end. It fails with
+// ErrRoleGrantChanged if the user holds the role without an end.
+func putTimeBoundUserRoleGrant(grant UserRoleGrant) error {
+	av, err := dynamodbattribute.MarshalMap(grant)
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+	_, err = app.SVC.PutItem(&dynamodb.PutItemInput{
+		Item:                av,
+		TableName:           aws.String(app.TABLE_NAME),
+		ConditionExpression: aws.String(timeBoundGrantCondition),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return ErrRoleGrantChanged
+		}
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+	return nil
+}
+
+// putGuardedUserRoleGrant writes a grant on condition that the user holds
+// none of the guard roles, in one transaction so a conflicting role cannot
+// be granted between the check and the write. The grant itself is written
+// on the condition when one is given. It fails with ErrRoleConflict when a
+// guard role is held and with ErrRoleGrantChanged when the condition fails.
+func putGuardedUserRoleGrant(grant UserRoleGrant, condition string, guardRoleIDs []string) error {
+	av, err := dynamodbattribute.MarshalMap(grant)
+	if err != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+	put := &dynamodb.Put{
+		Item:      av,
+		TableName: aws.String(app.TABLE_NAME),
+	}
+	if condition != "" {
+		put.ConditionExpression = aws.String(condition)
+	}
+
+	items := []*dynamodb.TransactWriteItem{{Put: put}}
+	for _, roleID := range guardRoleIDs {
+		guard := newUserRoleGrant(grant.UserID, roleID, grant.CompanyID, 0)
+		items = append(items, &dynamodb.TransactWriteItem{
+			ConditionCheck: &dynamodb.ConditionCheck{
+				Key: map[string]*dynamodb.AttributeValue{
+					"PK": {
+						S: aws.String(guard.PK),
+					},
+					"SK": {
+						S: aws.String(guard.SK),
+					},
+				},
+				TableName:           aws.String(app.TABLE_NAME),
+				ConditionExpression: aws.String("attribute_not_exists(PK)"),
+			},
+		})
+	}
+
+	_, err = app.SVC.TransactWriteItems(&dynamodb.TransactWriteItemsInput{
+		TransactItems: items,
+	})
+	if err != nil {
+		if canceled, ok := err.(*dynamodb.TransactionCanceledException); ok {
+			for i, reason := range canceled.CancellationReasons {
+				if aws.StringValue(reason.Code) != "ConditionalCheckFailed" {
+					continue
+				}
+				if i == 0 {
+					return ErrRoleGrantChanged
+				}
+				return ErrRoleConflict
+			}
+		}
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+	return nil
+}
+
+// parseRoleGrantExpiry reads the expires_at parameter of a grant (RFC 3339).
+// An empty value is a permanent grant.
+func parseRoleGrantExpiry(value string, now time.Time) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	expiresAt, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, errors.New("expires_at must be an RFC 3339 time")
+	}
+	if !expiresAt.After(now) {
+		return 0, errors.New("expires_at must be in the future")
+	}
+	return expiresAt.Unix(), nil
+}
+
+// roleExpiryWarningDelay is how long before the end of a grant its user is
+// warned.
+func roleExpiryWarningDelay() time.Duration {
+	return requestDelay("role.expiry.warning_before", ROLE_GRANT_DEFAULT_WARNING_BEFORE)
+}
+
+// RoleGrantExpiryJob warns users of role grants about to end and revokes
+// the grants that have ended.
+type RoleGrantExpiryJob struct{}
+
+func (j RoleGrantExpiryJob) Run() {
+	now := time.Now()
+	grants, err := GetExpiringUserRoles(now.Add(roleExpiryWarningDelay()).Unix())
+	if err != nil {
+		revel.AppLog.Error("RoleGrantExpiryJob: unable to retrieve expiring user roles", err)
+		return
+	}
+
+	for _, grant := range grants {
+		if grant.ExpiresAt <= now.Unix() {
+			err = revokeExpiredRoleGrant(grant)
+		} else if !grant.ExpiryWarned && grant.ElevationRequestID == "" {
+			// elevations are too short to be warned of
+			err = warnRoleGrantExpiry(grant)
+		} else {
+			continue
+		}
+		// the grant was renewed or removed since it was read
+		if err != nil && err != ErrRoleGrantChanged {
+			revel.AppLog.Error("RoleGrantExpiryJob: unable to process role "+grant.RoleID+" of user "+grant.UserID, err)
+		}
+	}
+}
+
+/*
+****************
+GetExpiringUserRoles()
+- Returns every time-bound user role ending at or before the given time,
+read from the role expiry index
+****************
+*/
+func GetExpiringUserRoles(before int64) ([]UserRoleGrant, error) {
+	grants := []UserRoleGrant{}
+
+	params := &dynamodb.QueryInput{
+		TableName: aws.String(app.TABLE_NAME),
+		IndexName: aws.String(INDEX_NAME_ROLE_EXPIRY),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"ExpiryPartition": {
+				ComparisonOperator: aws.String(constants.CONDITION_EQUAL),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(ROLE_EXPIRY_PARTITION),
+					},
+				},
+			},
+			"ExpiresAt": {
+				ComparisonOperator: aws.String(dynamodb.ComparisonOperatorLe),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						N: aws.String(strconv.FormatInt(before, 10)),
+					},
+				},
+			},
+		},
+	}
+
+	var items []map[string]*dynamodb.AttributeValue
+	err := app.SVC.QueryPages(params, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		items = append(items, page.Items...)
+		return true
+	})
+	if err != nil {
+		return grants, errors.New(constants.HTTP_STATUS_500)
+	}
+
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &grants)
+	if err != nil {
+		return grants, errors.New(constants.HTTP_STATUS_400)
+	}
+
+	return grants, nil
+}
+
+// getUserRoleGrant reads the current state of a user role.
+func getUserRoleGrant(pk, sk string) (UserRoleGrant, error) {
+	var grant UserRoleGrant
+
+	res, err := app.SVC.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(pk),
+			},
+			"SK": {
+				S: aws.String(sk),
+			},
+		},
+	})
+	if err != nil {
+		return grant, errors.New(constants.HTTP_STATUS_500)
+	}
+	if len(res.Item) == 0 {
+		return grant, ErrRoleGrantChanged
+	}
+
+	err = dynamodbattribute.UnmarshalMap(res.Item, &grant)
+	if err != nil {
+		return grant, errors.New(constants.HTTP_STATUS_400)
+	}
+
+	return grant, nil
+}
+
+// getUserCompanyRoleGrants returns the user's roles in the company.
+func getUserCompanyRoleGrants(userID, companyID string) ([]UserRoleGrant, error) {
+	grants := []UserRoleGrant{}
+
+	params := &dynamodb.QueryInput{
+		TableName: aws.String(app.TABLE_NAME),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"PK": {
+				ComparisonOperator: aws.String(constants.CONDITION_EQUAL),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(utils.AppendPrefix(constants.PREFIX_USER, userID)),
+					},
+				},
+			},
+			"SK": {
+				ComparisonOperator: aws.String(constants.CONDITION_BEGINS_WITH),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(constants.PREFIX_ROLE),
+					},
+				},
+			},
+		},
+		FilterExpression: aws.String("CompanyID = :c"),
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":c": {
+				S: aws.String(companyID),
+			},
+		},
+	}
+
+	var items []map[string]*dynamodb.AttributeValue
+	err := app.SVC.QueryPages(params, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		items = append(items, page.Items...)
+		return true
+	})
+	if err != nil {
+		return grants, errors.New(constants.HTTP_STATUS_500)
+	}
+
+	err = dynamodbattribute.UnmarshalListOfMaps(items, &grants)
+	if err != nil {
+		return grants, errors.New(constants.HTTP_STATUS_400)
+	}
+
+	return grants, nil
+}
+
+/*
+****************
+hasActivePermission()
+- ops.CheckPermissions without the roles whose grant has ended. The expiry
+job revokes ended grants on a schedule, so until it runs the user still
+holds them; when the user has one, the permission is looked up again in the
+roles that are still active.
+****************
+*/
+func hasActivePermission(permission, userID, companyID string) bool {
+	if !ops.CheckPermissions(permission, userID, companyID) {
+		return false
+	}
+
+	grants, err := getUserCompanyRoleGrants(userID, companyID)
+	if err != nil {
+		return false
+	}
+	now := time.Now()
+	var active []UserRoleGrant
+	for _, grant := range grants {
+		if grant.Active(now) {
+			active = append(active, grant)
+		}
+	}
+	if len(active) == len(grants) {
+		return true
+	}
+
+	for _, grant := range active {
+		role, opsErr := ops.GetRoleByID(grant.RoleID, companyID)
+		if opsErr != nil {
+			continue
+		}
+		if utils.StringInSlice(permission, role.RolePermissions) {
+			return true
+		}
+	}
+	return false
+}
+
+// revokeExpiredRoleGrant removes an ended grant through the same path as
+// UnassignRole, so the user is emailed and the removal logged. The grant is
+// read again first in case it was renewed since the scan.
+func revokeExpiredRoleGrant(grant UserRoleGrant) error {
+	current, err := getUserRoleGrant(grant.PK, grant.SK)
+	if err != nil {
+		return err
+	}
+	if current.Active(time.Now()) {
+		return ErrRoleGrantChanged
+	}
+
+	company, opsErr := ops.GetCompanyByID(grant.CompanyID)
+	if opsErr != nil {
+		return errors.New("Unable to retrieve company " + grant.CompanyID)
+	}
+	user, opsErr := ops.GetUserByIDNew(grant.UserID)
+	if opsErr != nil {
+		return errors.New("Unable to retrieve user " + grant.UserID)
+	}
+	role, opsErr := ops.GetRoleByID(grant.RoleID, grant.CompanyID)
+	if opsErr != nil {
+		return errors.New("Unable to retrieve role " + grant.RoleID)
+	}
+
+	unassignments := []roleUnassignment{newRoleUnassignment(user, role, company)}
+	_, err = UnassignUserRoles(jobController(grant.CompanyID), company, unassignments, LOG_ACTION_EXPIRE_ROLE)
+	return err
+}
+
+// markRoleGrantWarned records that the user was warned of the end of the
+// grant. It fails with ErrRoleGrantChanged if the grant was warned of,
+// renewed or removed since it was read, so a warning is never sent twice.
+func markRoleGrantWarned(grant UserRoleGrant) error {
+	_, err := app.SVC.UpdateItem(&dynamodb.UpdateItemInput{
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":e": {
+				N: aws.String(strconv.FormatInt(grant.ExpiresAt, 10)),
+			},
+			":w": {
+				BOOL: aws.Bool(true),
+			},
+		},
+		TableName: aws.String(app.TABLE_NAME),
+		Key: map[string]*dynamodb.AttributeValue{
+			"PK": {
+				S: aws.String(grant.PK),
+			},
+			"SK": {
+				S: aws.String(grant.SK),
+			},
+		},
+		ConditionExpression: aws.String("ExpiresAt = :e AND attribute_not_exists(ExpiryWarned)"),
+		UpdateExpression:    aws.String("SET ExpiryWarned = :w"),
+	})
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return ErrRoleGrantChanged
+		}
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+	return nil
+}
+
+// warnRoleGrantExpiry tells the user, in the app and by email, when their
+// role ends.
+func warnRoleGrantExpiry(grant UserRoleGrant) error {
+	company, opsErr := ops.GetCompanyByID(grant.CompanyID)
+	if opsErr != nil {
+		return errors.New("Unable to retrieve company " + grant.CompanyID)
+	}
+	user, opsErr := ops.GetUserByIDNew(grant.UserID)
+	if opsErr != nil {
+		return errors.New("Unable to retrieve user " + grant.UserID)
+	}
+	role, opsErr := ops.GetRoleByID(grant.RoleID, grant.CompanyID)
+	if opsErr != nil {
+		return errors.New("Unable to retrieve role " + grant.RoleID)
+	}
+
+	if err := markRoleGrantWarned(grant); err != nil {
+		return err
+	}
+
+	expiresAt := time.Unix(grant.ExpiresAt, 0).UTC().Format(time.RFC1123)
+	message := NewNotificationTemplate(MESSAGE_ROLE_EXPIRING, role.RoleName, company.CompanyName, expiresAt).Render(userMessageLocale(grant.UserID))
+
+	_, err := ops.CreateNotification(ops.CreateNotificationInput{
+		UserID:           grant.UserID,
+		NotificationType: NOTIFICATION_ROLE_EXPIRY_WARNING,
+		NotificationContent: models.NotificationContentType{
+			RequesterUserID: grant.UserID,
+			ActiveCompany:   grant.CompanyID,
+			RolesRequested:  []string{grant.RoleID},
+			Message:         message,
+		},
+		Global: false,
+	}, jobController(grant.CompanyID))
+	if err != nil {
+		revel.AppLog.Error("warnRoleGrantExpiry: unable to create notification for "+grant.UserID, err)
+	}
+
+	jobs.Now(mail.SendEmail{
+		Subject: message,
+		Recipients: []mail.Recipient{{
+			Name:           user.FirstName + " " + user.LastName,
+			Email:          user.Email,
+			ActionType:     "expiring",
+			RoleName:       role.RoleName,
+			RolePermission: role.RolePermissions,
+			CompanyName:    company.CompanyName,
+		}},
+		Template: "change_permissions.html",
+	})
+
+	return nil
+}
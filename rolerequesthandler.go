@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"grooper/app/constants"
+	"grooper/app/models"
+	ops "grooper/app/operations"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func init() {
+	RegisterRequestHandler(constants.REQUEST_COMPANY_ROLE_UPDATE, RoleRequestHandler{})
+	RegisterRequestPermissions(constants.REQUEST_COMPANY_ROLE_UPDATE, RequestPermissions{
+		Accept: PERMISSION_ASSIGN_ROLE,
+		Reject: PERMISSION_ASSIGN_ROLE,
+		View:   PERMISSION_ASSIGN_ROLE,
+	})
+}
+
+// RoleRequestHandler assigns the requested company roles to the requester.
+type RoleRequestHandler struct{}
+
+func (h RoleRequestHandler) Validate(ctx *RequestContext) error {
+	if len(ctx.RoleIDs) == 0 {
+		return NewRequestError(400, "Missing required parameter - role_id")
+	}
+	return nil
+}
+
+func (h RoleRequestHandler) Authorize(ctx *RequestContext, accept bool) error {
+	return nil
+}
+
+func (h RoleRequestHandler) Accept(ctx *RequestContext, subject RequestSubject, content *models.NotificationContentType) error {
+	roleNames, err := h.roleNames(ctx)
+	if err != nil {
+		return err
+	}
+
+	check, err := CheckRoleGrant(ctx.CompanyID, subject.User.UserID, ctx.RoleIDs)
+	if err != nil {
+		return NewRequestError(500, "Unable to check role conflicts")
+	}
+	if len(check.Conflicts) != 0 {
+		return roleConflictError(check.Conflicts)
+	}
+	// a conflicting role granted after the check cancels the decision
+	for _, roleID := range check.Guards {
+		guard := newUserRoleGrant(subject.User.UserID, roleID, ctx.CompanyID, 0)
+		ctx.Transaction.RequireAbsent(guard.PK, guard.SK)
+	}
+
+	var expiresAt int64
+	var elevationRequestID string
+	if ctx.Request != nil {
+		expiresAt = ctx.Request.GrantExpiresAt
+		// an elevation runs from its acceptance
+		if ctx.Request.ElevationSeconds != 0 {
+			expiresAt = time.Now().Unix() + ctx.Request.ElevationSeconds
+			elevationRequestID = ctx.Request.RequestID
+		}
+	}
+	if expiresAt != 0 && expiresAt <= time.Now().Unix() {
+		return NewRequestError(422, "The requested roles were only asked for until "+time.Unix(expiresAt, 0).UTC().Format(time.RFC3339))
+	}
+
+	for i, roleID := range ctx.RoleIDs {
+		item := newUserRoleGrant(subject.User.UserID, roleID, ctx.CompanyID, expiresAt)
+		if expiresAt == 0 {
+			if err := ctx.Transaction.PutModel(item); err != nil {
+				return NewRequestError(500, "Error at marshalmap")
+			}
+		} else {
+			// granted without an end since the request was filed, a
+			// time-bound grant would cut it short
+			current, err := getUserRoleGrant(item.PK, item.SK)
+			if err == nil && current.ExpiresAt == 0 {
+				return NewRequestError(422, "The user already holds the role "+roleNames[i])
+			}
+			// the end of the elevation revokes the role, so it cannot
+			// replace a grant that lasts longer
+			if elevationRequestID != "" && err == nil && current.ExpiresAt > expiresAt {
+				return NewRequestError(422, "The user already holds the role "+roleNames[i]+" until "+time.Unix(current.ExpiresAt, 0).UTC().Format(time.RFC3339))
+			}
+			item.ElevationRequestID = elevationRequestID
+			// the condition covers a grant written after the read
+			condition := timeBoundGrantCondition
+			var values map[string]*dynamodb.AttributeValue
+			if elevationRequestID != "" {
+				condition = elevationGrantCondition
+				values = map[string]*dynamodb.AttributeValue{
+					":expiresAt": {
+						N: aws.String(strconv.FormatInt(expiresAt, 10)),
+					},
+				}
+			}
+			if err := ctx.Transaction.PutModelIf(item, condition, values); err != nil {
+				return NewRequestError(500, "Error at marshalmap")
+			}
+		}
+		if elevationRequestID != "" {
+			startRoleElevation(ctx, item, roleNames[i])
+		}
+	}
+
+	ctx.AdminMessage(content, newListTemplate(requestMessageKey("role", "admin", true), roleNames, requesterName(subject.RequesterInfo)))
+	content.RolesRequested = ctx.RoleIDs
+	return nil
+}
+
+func (h RoleRequestHandler) Reject(ctx *RequestContext, subject RequestSubject, content *models.NotificationContentType) error {
+	roleNames, err := h.roleNames(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctx.AdminMessage(content, newListTemplate(requestMessageKey("role", "admin", false), roleNames, requesterName(subject.RequesterInfo)))
+	content.RolesRequested = ctx.RoleIDs
+	return nil
+}
+
+func (h RoleRequestHandler) Describe(ctx *RequestContext, content *models.NotificationContentType, accepted bool) error {
+	roleNames, err := h.roleNames(ctx)
+	if err != nil {
+		return err
+	}
+
+	ctx.RequesterMessage(content, newListTemplate(requestMessageKey("role", "requester", accepted), roleNames))
+	return nil
+}
+
+func (h RoleRequestHandler) roleNames(ctx *RequestContext) ([]string, error) {
+	var roleNames []string
+	for _, roleID := range ctx.RoleIDs {
+		role, opsErr := ops.GetRoleByID(roleID, ctx.CompanyID)
+		if opsErr != nil {
+			return roleNames, NewRequestError(400, "Unable to retrieve Roles")
+		}
+		roleNames = append(roleNames, role.RoleName)
+	}
+	return roleNames, nil
+}
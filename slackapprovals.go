@@ -0,0 +1,486 @@
+package controllers
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"grooper/app"
+	"grooper/app/constants"
+	"grooper/app/models"
+	ops "grooper/app/operations"
+	"grooper/app/utils"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/revel/modules/jobs/app/jobs"
+	"github.com/revel/revel"
+)
+
+const (
+	SLACK_API_URL                   = "https://slack.com/api"
+	SLACK_ACTION_APPROVE            = "request_approve"
+	SLACK_ACTION_REJECT             = "request_reject"
+	SLACK_SIGNATURE_VERSION         = "v0"
+	SLACK_SIGNATURE_MAX_AGE         = 5 * time.Minute
+	SLACK_MAX_BODY_SIZE             = 1 << 20
+	SLACK_RAW_BODY_ARG              = "slackRawBody"
+	SLACK_SIGNING_SECRET_KEY        = "integration.slack.signing_secret"
+	SLACK_HEADER_SIGNATURE          = "X-Slack-Signature"
+	SLACK_HEADER_TIMESTAMP          = "X-Slack-Request-Timestamp"
+	SLACK_INTERACTION_BLOCK_ACTIONS = "block_actions"
+	IDEMPOTENCY_ACTION_SLACK        = "SLACK_INTERACTION"
+)
+
+var ErrSlackNotConnected = errors.New("slack is not connected")
+
+func init() {
+	// the params filter consumes form bodies before the action runs, so the
+	// body Slack signed is kept by a filter running ahead of it
+	revel.OnAppStart(func() {
+		revel.Filters = append([]revel.Filter{slackRawBodyFilter}, revel.Filters...)
+	})
+}
+
+// SlackController receives the calls Slack makes to the app. Its actions
+// authenticate Slack by the request signature, not by a user session.
+type SlackController struct {
+	*revel.Controller
+}
+
+// slackApprovalValue is the value of the Approve and Reject buttons. The
+// notification is the approver's own, so a click acts as that approver.
+type slackApprovalValue struct {
+	CompanyID      string `json:"c"`
+	RequestID      string `json:"r"`
+	NotificationID string `json:"n"`
+}
+
+// slackInteraction is the part of Slack's interaction payload we use.
+type slackInteraction struct {
+	Type string `json:"type"`
+	User struct {
+		ID string `json:"id"`
+	} `json:"user"`
+	TriggerID   string `json:"trigger_id"`
+	ResponseURL string `json:"response_url"`
+	Actions     []struct {
+		ActionID string `json:"action_id"`
+		Value    string `json:"value"`
+		ActionTs string `json:"action_ts"`
+	} `json:"actions"`
+}
+
+// slackResponse is the envelope of every Slack Web API answer.
+type slackResponse struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// slackRawBodyFilter keeps the body of Slack's calls in c.Args and puts it
+// back for the filters that follow.
+func slackRawBodyFilter(c *revel.Controller, fc []revel.Filter) {
+	if c.Request.GetHttpHeader(SLACK_HEADER_SIGNATURE) != "" {
+		if raw, ok := c.Request.In.GetRaw().(*http.Request); ok && raw.Body != nil {
+			body, err := ioutil.ReadAll(io.LimitReader(raw.Body, SLACK_MAX_BODY_SIZE))
+			if err == nil {
+				c.Args[SLACK_RAW_BODY_ARG] = body
+				raw.Body = ioutil.NopCloser(bytes.NewReader(body))
+			}
+		}
+	}
+	fc[0](c, fc[1:])
+}
+
+/*
+****************
+VerifySlackSignature()
+- Checks that the body was signed by Slack with the app's signing secret,
+and recently enough that it cannot be a replay
+****************
+*/
+func VerifySlackSignature(secret, timestamp, signature string, body []byte, now time.Time) bool {
+	if secret == "" || timestamp == "" || signature == "" {
+		return false
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	age := now.Sub(time.Unix(seconds, 0))
+	if age > SLACK_SIGNATURE_MAX_AGE || age < -SLACK_SIGNATURE_MAX_AGE {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(SLACK_SIGNATURE_VERSION + ":" + timestamp + ":"))
+	mac.Write(body)
+	expected := SLACK_SIGNATURE_VERSION + "=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(signature))
+}
+
+// callSlackAPI calls a Slack Web API method. Slack answers 200 to failed
+// calls too, the outcome is in the ok field.
+func callSlackAPI(token, method string, query url.Values, body interface{}, out interface{}) error {
+	endpoint := strings.TrimRight(revel.Config.StringDefault("integration.slack.api_url", SLACK_API_URL), "/") + "/" + method
+	httpMethod := http.MethodPost
+	if body == nil {
+		httpMethod = http.MethodGet
+		endpoint += "?" + query.Encode()
+	}
+
+	var raw json.RawMessage
+	if err := sendProvisioningRequest(nil, httpMethod, endpoint, "Bearer "+token, body, &raw); err != nil {
+		return err
+	}
+	var envelope slackResponse
+	if err := json.Unmarshal(raw, &envelope); err != nil {
+		return err
+	}
+	if !envelope.OK {
+		return errors.New("slack " + method + " failed: " + envelope.Error)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(raw, out)
+}
+
+// companySlackToken returns the bot token of the company's Slack
+// integration, ErrSlackNotConnected when it has none.
+func companySlackToken(companyID string) (string, error) {
+	res, err := app.SVC.Query(&dynamodb.QueryInput{
+		TableName: aws.String(app.TABLE_NAME),
+		KeyConditions: map[string]*dynamodb.Condition{
+			"PK": {
+				ComparisonOperator: aws.String(constants.CONDITION_EQUAL),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(utils.AppendPrefix(constants.PREFIX_COMPANY, companyID)),
+					},
+				},
+			},
+			"SK": {
+				ComparisonOperator: aws.String(constants.CONDITION_BEGINS_WITH),
+				AttributeValueList: []*dynamodb.AttributeValue{
+					{
+						S: aws.String(constants.PREFIX_INTEGRATION),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return "", errors.New(constants.HTTP_STATUS_500)
+	}
+
+	var companyIntegrations []models.CompanyIntegration
+	if err := dynamodbattribute.UnmarshalListOfMaps(res.Items, &companyIntegrations); err != nil {
+		return "", errors.New(constants.HTTP_STATUS_400)
+	}
+	for _, companyIntegration := range companyIntegrations {
+		integration, err := ops.GetIntegrationByID(companyIntegration.IntegrationID)
+		if err != nil || integration.IntegrationSlug != constants.INTEG_SLUG_SLACK {
+			continue
+		}
+		if companyIntegration.IntegrationToken == nil || companyIntegration.IntegrationToken.AccessToken == "" {
+			return "", ErrSlackNotConnected
+		}
+		return companyIntegration.IntegrationToken.AccessToken, nil
+	}
+	return "", ErrSlackNotConnected
+}
+
+// SlackApprovalJob sends one approver the Slack message of a new request.
+type SlackApprovalJob struct {
+	Request        Request
+	ApproverID     string
+	NotificationID string
+	Message        string
+}
+
+func (j SlackApprovalJob) Run() {
+	err := sendSlackApprovalMessage(j.Request, j.ApproverID, j.NotificationID, j.Message)
+	if err != nil && err != ErrSlackNotConnected {
+		revel.AppLog.Error("SlackApprovalJob: unable to send approval message", j.Request.RequestID, j.ApproverID, err)
+	}
+}
+
+/*
+****************
+notifySlackApprover()
+- Queues the Slack message with Approve and Reject buttons for an approver
+of a new request. Companies without Slack are skipped.
+****************
+*/
+func notifySlackApprover(request Request, approverID, notificationID, message string) {
+	jobs.Now(SlackApprovalJob{
+		Request:        request,
+		ApproverID:     approverID,
+		NotificationID: notificationID,
+		Message:        message,
+	})
+}
+
+func sendSlackApprovalMessage(request Request, approverID, notificationID, message string) error {
+	token, err := companySlackToken(request.CompanyID)
+	if err != nil {
+		return err
+	}
+
+	approver, opsErr := ops.GetUserByIDNew(approverID)
+	if opsErr != nil || approver.Email == "" {
+		return errors.New("Unable to retrieve approver " + approverID)
+	}
+	var lookup struct {
+		User struct {
+			ID string `json:"id"`
+		} `json:"user"`
+	}
+	if err := callSlackAPI(token, "users.lookupByEmail", url.Values{"email": {approver.Email}}, nil, &lookup); err != nil {
+		return err
+	}
+
+	value, err := json.Marshal(slackApprovalValue{
+		CompanyID:      request.CompanyID,
+		RequestID:      request.RequestID,
+		NotificationID: notificationID,
+	})
+	if err != nil {
+		return err
+	}
+
+	// posting to a user ID opens the direct message with the app
+	return callSlackAPI(token, "chat.postMessage", nil, map[string]interface{}{
+		"channel": lookup.User.ID,
+		"text":    message,
+		"blocks": []interface{}{
+			map[string]interface{}{
+				"type": "section",
+				"text": map[string]string{
+					"type": "mrkdwn",
+					"text": message,
+				},
+			},
+			map[string]interface{}{
+				"type": "actions",
+				"elements": []interface{}{
+					slackButton(SLACK_ACTION_APPROVE, "Approve", "primary", string(value)),
+					slackButton(SLACK_ACTION_REJECT, "Reject", "danger", string(value)),
+				},
+			},
+		},
+	}, nil)
+}
+
+func slackButton(actionID, label, style, value string) map[string]interface{} {
+	return map[string]interface{}{
+		"type":      "button",
+		"action_id": actionID,
+		"style":     style,
+		"value":     value,
+		"text": map[string]string{
+			"type": "plain_text",
+			"text": label,
+		},
+	}
+}
+
+/*
+****************
+Interactions()
+- Receives the clicks on the Approve and Reject buttons. Slack must get an
+answer within 3 seconds, so the decision is made by a job that updates the
+message with the outcome afterwards.
+****************
+*/
+func (c SlackController) Interactions() revel.Result {
+	body, _ := c.Args[SLACK_RAW_BODY_ARG].([]byte)
+	secret := revel.Config.StringDefault(SLACK_SIGNING_SECRET_KEY, "")
+	if !VerifySlackSignature(secret, c.Request.GetHttpHeader(SLACK_HEADER_TIMESTAMP), c.Request.GetHttpHeader(SLACK_HEADER_SIGNATURE), body, time.Now()) {
+		c.Response.Status = 401
+		return c.RenderJSON(models.ErrorResponse{
+			Code:    "401",
+			Message: "Invalid Slack signature",
+			Status:  utils.GetHTTPStatus(constants.HTTP_STATUS_401),
+		})
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		c.Response.Status = 400
+		return c.RenderText("")
+	}
+	var interaction slackInteraction
+	if err := json.Unmarshal([]byte(form.Get("payload")), &interaction); err != nil {
+		c.Response.Status = 400
+		return c.RenderText("")
+	}
+	if interaction.Type != SLACK_INTERACTION_BLOCK_ACTIONS || len(interaction.Actions) == 0 {
+		return c.RenderText("")
+	}
+
+	action := interaction.Actions[0]
+	if action.ActionID != SLACK_ACTION_APPROVE && action.ActionID != SLACK_ACTION_REJECT {
+		return c.RenderText("")
+	}
+	var value slackApprovalValue
+	if err := json.Unmarshal([]byte(action.Value), &value); err != nil {
+		c.Response.Status = 400
+		return c.RenderText("")
+	}
+
+	// Slack retries a delivery it got no answer for; a retry runs again
+	// unless an earlier delivery of the click was taken
+	call := slackInteractionCall(interaction, value)
+	if call.Key != "" {
+		err := claimIdempotencyKey(call)
+		if err == ErrIdempotencyKeyTaken {
+			return c.RenderText("")
+		}
+		if err != nil {
+			c.Response.Status = 500
+			return c.RenderText("")
+		}
+	}
+
+	jobs.Now(SlackInteractionJob{
+		Accept:      action.ActionID == SLACK_ACTION_APPROVE,
+		Value:       value,
+		SlackUserID: interaction.User.ID,
+		ResponseURL: interaction.ResponseURL,
+		Call:        call,
+	})
+	return c.RenderText("")
+}
+
+// slackInteractionCall keys a click by its trigger, which every delivery of
+// the click shares, and by the time of the action when Slack sent none.
+func slackInteractionCall(interaction slackInteraction, value slackApprovalValue) idempotentCall {
+	action := interaction.Actions[0]
+	key := interaction.TriggerID
+	if key == "" {
+		key = action.ActionTs
+	}
+	if key == "" {
+		return idempotentCall{}
+	}
+
+	payloadHash, _ := idempotencyPayloadHash(action)
+	return idempotentCall{
+		CompanyID:   value.CompanyID,
+		Action:      IDEMPOTENCY_ACTION_SLACK,
+		UserID:      interaction.User.ID,
+		Key:         key,
+		PayloadHash: payloadHash,
+		CreatedAt:   utils.GetCurrentTimestamp(),
+	}
+}
+
+// SlackInteractionJob makes the decision of a button click and reports the
+// outcome in the message.
+type SlackInteractionJob struct {
+	Accept      bool
+	Value       slackApprovalValue
+	SlackUserID string
+	ResponseURL string
+	Call        idempotentCall
+}
+
+func (j SlackInteractionJob) Run() {
+	outcome := j.decide()
+	if err := j.Call.Complete(200, outcome); err != nil {
+		revel.AppLog.Error("SlackInteractionJob: unable to store the outcome", j.Value.RequestID, err)
+	}
+	err := sendProvisioningRequest(nil, http.MethodPost, j.ResponseURL, "", map[string]interface{}{
+		"replace_original": true,
+		"text":             outcome,
+	}, nil)
+	if err != nil {
+		revel.AppLog.Error("SlackInteractionJob: unable to update message", j.Value.RequestID, err)
+	}
+}
+
+// decide maps the Slack user to the approver the message was sent to and
+// runs the same accept or reject as RequestController, as that approver.
+func (j SlackInteractionJob) decide() string {
+	notification, opsErr := ops.GetNotificationByID(j.Value.NotificationID)
+	if opsErr != nil || notification.UserID == "" {
+		return "This request can no longer be found."
+	}
+	token, err := companySlackToken(j.Value.CompanyID)
+	if err != nil {
+		return "Slack is no longer connected to your company."
+	}
+
+	var info struct {
+		User struct {
+			Profile struct {
+				Email string `json:"email"`
+			} `json:"profile"`
+		} `json:"user"`
+	}
+	if err := callSlackAPI(token, "users.info", url.Values{"user": {j.SlackUserID}}, nil, &info); err != nil {
+		return "Unable to identify your Slack user."
+	}
+	approver, opsErr := ops.GetUserByIDNew(notification.UserID)
+	if opsErr != nil || approver.Email == "" || !strings.EqualFold(approver.Email, info.User.Profile.Email) {
+		return "Only the approver this message was sent to can decide the request."
+	}
+	if _, err := ops.GetCompanyMember(ops.GetCompanyMemberParams{
+		UserID:    approver.UserID,
+		CompanyID: j.Value.CompanyID,
+	}, jobController(j.Value.CompanyID)); err != nil {
+		return "You are no longer a member of this company."
+	}
+
+	request, err := GetRequestByID(j.Value.CompanyID, j.Value.RequestID)
+	if err != nil {
+		return "This request can no longer be found."
+	}
+
+	c := &revel.Controller{
+		ViewArgs: map[string]interface{}{
+			"companyID": j.Value.CompanyID,
+			"userID":    approver.UserID,
+		},
+	}
+	decision := RequestDecision{
+		NotificationID: j.Value.NotificationID,
+		RequestType:    request.RequestType,
+		UserIDs:        []string{request.RequesterUserID},
+	}
+	if j.Accept {
+		return slackOutcome(acceptRequestDecision(c, decision), j.SlackUserID, "approved")
+	}
+	return slackOutcome(rejectRequestDecision(c, decision), j.SlackUserID, "rejected")
+}
+
+// slackOutcome is the text the message is replaced with.
+func slackOutcome(result requestDecisionResult, slackUserID, outcome string) string {
+	switch body := result.Body.(type) {
+	case models.ErrorResponse:
+		return "Unable to decide the request: " + body.Message
+	case map[string]interface{}:
+		if quorum, ok := body["quorum"].(QuorumStatus); ok {
+			return "<@" + slackUserID + "> approved. " + strconv.Itoa(quorum.Approvals) + " of " + strconv.Itoa(quorum.Required) + " approvals so far."
+		}
+		if result.StatusCode == 200 {
+			return "Request " + outcome + " by <@" + slackUserID + ">."
+		}
+		if result.StatusCode == 207 {
+			return "Request " + outcome + " by <@" + slackUserID + ">, for some of the users only."
+		}
+	}
+	return "Unable to decide the request."
+}
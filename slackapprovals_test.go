@@ -0,0 +1,145 @@
+package controllers
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func slackSignature(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(SLACK_SIGNATURE_VERSION + ":" + timestamp + ":"))
+	mac.Write(body)
+	return SLACK_SIGNATURE_VERSION + "=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifySlackSignature(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	timestamp := strconv.FormatInt(now.Unix(), 10)
+	stale := strconv.FormatInt(now.Add(-SLACK_SIGNATURE_MAX_AGE-time.Second).Unix(), 10)
+	body := []byte("payload=%7B%22type%22%3A%22block_actions%22%7D")
+
+	tests := []struct {
+		name      string
+		secret    string
+		timestamp string
+		signature string
+		body      []byte
+		want      bool
+	}{
+		{
+			name:      "valid signature",
+			secret:    "secret",
+			timestamp: timestamp,
+			signature: slackSignature("secret", timestamp, body),
+			body:      body,
+			want:      true,
+		},
+		{
+			name:      "other secret",
+			secret:    "secret",
+			timestamp: timestamp,
+			signature: slackSignature("other", timestamp, body),
+			body:      body,
+		},
+		{
+			name:      "altered body",
+			secret:    "secret",
+			timestamp: timestamp,
+			signature: slackSignature("secret", timestamp, body),
+			body:      []byte("payload=%7B%7D"),
+		},
+		{
+			name:      "replayed timestamp",
+			secret:    "secret",
+			timestamp: stale,
+			signature: slackSignature("secret", stale, body),
+			body:      body,
+		},
+		{
+			name:      "timestamp not a number",
+			secret:    "secret",
+			timestamp: "now",
+			signature: slackSignature("secret", "now", body),
+			body:      body,
+		},
+		{
+			name:      "no secret configured",
+			timestamp: timestamp,
+			signature: slackSignature("", timestamp, body),
+			body:      body,
+		},
+		{
+			name:      "no signature",
+			secret:    "secret",
+			timestamp: timestamp,
+			body:      body,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := VerifySlackSignature(test.secret, test.timestamp, test.signature, test.body, now)
+			if got != test.want {
+				t.Errorf("VerifySlackSignature() = %t; want %t", got, test.want)
+			}
+		})
+	}
+}
+
+func TestSlackInteractionCall(t *testing.T) {
+	value := slackApprovalValue{CompanyID: "c1", RequestID: "r1", NotificationID: "n1"}
+	interaction := func(triggerID, actionTs, actionID string) slackInteraction {
+		var i slackInteraction
+		i.User.ID = "U1"
+		i.TriggerID = triggerID
+		i.Actions = append(i.Actions, struct {
+			ActionID string `json:"action_id"`
+			Value    string `json:"value"`
+			ActionTs string `json:"action_ts"`
+		}{ActionID: actionID, ActionTs: actionTs})
+		return i
+	}
+
+	tests := []struct {
+		name        string
+		interaction slackInteraction
+		wantKey     string
+	}{
+		{
+			name:        "keyed by trigger",
+			interaction: interaction("t1", "1700000000.1", SLACK_ACTION_APPROVE),
+			wantKey:     "t1",
+		},
+		{
+			name:        "keyed by action time without a trigger",
+			interaction: interaction("", "1700000000.1", SLACK_ACTION_APPROVE),
+			wantKey:     "1700000000.1",
+		},
+		{
+			name:        "no key",
+			interaction: interaction("", "", SLACK_ACTION_APPROVE),
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			call := slackInteractionCall(test.interaction, value)
+			if call.Key != test.wantKey {
+				t.Errorf("Key = %q; want %q", call.Key, test.wantKey)
+			}
+			if call.Key != "" && (call.CompanyID != "c1" || call.UserID != "U1" || call.Action != IDEMPOTENCY_ACTION_SLACK) {
+				t.Errorf("call = %+v", call)
+			}
+		})
+	}
+
+	approve := slackInteractionCall(interaction("t1", "1", SLACK_ACTION_APPROVE), value)
+	reject := slackInteractionCall(interaction("t1", "1", SLACK_ACTION_REJECT), value)
+	if approve.PayloadHash == reject.PayloadHash {
+		t.Errorf("approve and reject share a payload hash")
+	}
+}
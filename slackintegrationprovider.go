@@ -0,0 +1,45 @@
+package controllers
+
+import (
+	"errors"
+	"grooper/app/constants"
+	slackoperations "grooper/app/integrations/slack"
+	"grooper/app/models"
+)
+
+func init() {
+	RegisterIntegrationProvider(constants.INTEG_SLUG_SLACK, SlackIntegrationProvider{})
+}
+
+// SlackIntegrationProvider uninstalls the app from the Slack workspace.
+type SlackIntegrationProvider struct{}
+
+func (p SlackIntegrationProvider) Credentials(companyID string, integration models.Integration) (IntegrationCredentials, error) {
+	credentials, ok := companyIntegrationCredentials(companyID, integration)
+	if !ok {
+		return credentials, NewRequestError(401, "GetSlackToken Error: Slack token not found")
+	}
+	return credentials, nil
+}
+
+func (p SlackIntegrationProvider) Revoke(companyID string, integration models.Integration, credentials IntegrationCredentials) error {
+	_, slackErr := slackoperations.UninstallAppFromSlackWorkspace("Bearer " + credentials.AccessToken)
+	if slackErr != nil {
+		return errors.New(constants.HTTP_STATUS_500)
+	}
+	return nil
+}
+
+func (p SlackIntegrationProvider) LocalState(companyID string, integration models.Integration, connectedGroups []models.Integration) ([]DisconnectItem, error) {
+	return nil, nil
+}
+
+func (p SlackIntegrationProvider) CleanupLocalState(companyID string, integration models.Integration, connectedGroups []models.Integration) error {
+	return nil
+}
+
+// ReauthorizesOnRestore is true since uninstalling the app invalidates the
+// workspace token.
+func (p SlackIntegrationProvider) ReauthorizesOnRestore() bool {
+	return true
+}